@@ -6,10 +6,16 @@ import (
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/bsure-analytics/bsure-chatbot-grafana-panel/pkg/plugin"
 )
 
 func main() {
+	// Set up OpenTelemetry tracing from the environment Grafana passes to plugins
+	if err := backend.SetupTracer("bsure-chatbot-panel", tracing.Opts{}); err != nil {
+		log.DefaultLogger.Error("Failed to set up tracing", "error", err)
+	}
+
 	// Create a single instance of our plugin
 	ds, err := plugin.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{})
 	if err != nil {
@@ -17,9 +23,10 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create backend opts with just the CallResourceHandler
+	// Create backend opts with the resource and usage query handlers
 	opts := backend.ServeOpts{
 		CallResourceHandler: ds.(*plugin.Datasource),
+		QueryDataHandler:    ds.(*plugin.Datasource),
 	}
 
 	if err := backend.Serve(opts); err != nil {
@@ -0,0 +1,264 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// defaultAgentMaxIterations is how many rounds of tool calls the model
+	// may make before it has to answer.
+	defaultAgentMaxIterations = 5
+
+	// defaultAgentTimeoutSeconds is the time budget of the tool rounds.
+	defaultAgentTimeoutSeconds = 60
+
+	// maxAgentToolCallsPerStep bounds the tool calls of a single answer;
+	// further calls get an error result.
+	maxAgentToolCallsPerStep = 5
+
+	// maxToolResultTokens bounds a tool result in the conversation. The
+	// results of a step share what is left of the context window if that is
+	// less, and are replaced by an error below minToolResultTokens.
+	maxToolResultTokens = 2000
+	minToolResultTokens = 50
+)
+
+// droppedToolResult replaces tool results that don't fit into the context
+// window.
+var droppedToolResult = toolErrorResult("the result doesn't fit into the context window")
+
+// Reasons the agent loop stopped.
+const (
+	agentStopAnswered      = "answered"
+	agentStopMaxIterations = "max_iterations"
+	agentStopTimeBudget    = "time_budget"
+	agentStopContextWindow = "context_window"
+)
+
+const agentInstructions = `You can call tools to read from Grafana: search dashboards, get the data of a panel for a time range, list firing alerts and search annotations.
+Call them when the question needs data that isn't in the conversation, then answer from their results. Don't make up data the tools didn't return.
+The current time is %s.`
+
+// agentConfig bounds the agent loop. Zero values select the defaults.
+type agentConfig struct {
+	MaxIterations  int `json:"maxIterations"`
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// agentTrace reports what the agent loop did. It is added to the chat
+// response.
+type agentTrace struct {
+	Iterations int             `json:"iterations"`
+	ToolCalls  []agentToolCall `json:"toolCalls"`
+	StopReason string          `json:"stopReason"`
+
+	// Usage adds up the tokens of all model calls.
+	Usage chatUsage `json:"usage"`
+}
+
+type agentToolCall struct {
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// agentMessage is a message of the agent loop, which may carry the model's
+// tool calls or the result of a call.
+type agentMessage struct {
+	chatMessage
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// groqToolRequest is a chat completions request offering tools.
+type groqToolRequest struct {
+	Model      string           `json:"model"`
+	Messages   []agentMessage   `json:"messages"`
+	Tools      []toolDefinition `json:"tools"`
+	ToolChoice string           `json:"tool_choice"`
+}
+
+// groqResponse is the part of a chat completions response the agent loop
+// reads.
+type groqResponse struct {
+	Choices []struct {
+		Message agentMessage `json:"message"`
+	} `json:"choices"`
+	Usage chatUsage `json:"usage"`
+}
+
+// runAgent answers the conversation of req, letting the model call
+// grafanaTools as the caller of r until it answers. When the iterations or
+// the time budget run out, the model is asked to answer from what it has.
+// It returns the last response of the model and the conversation including
+// the tool calls and results, for the audit log.
+func (ds *Datasource) runAgent(ctx context.Context, r *http.Request, apiKey string, req *chatRequest) ([]byte, []chatMessage, *agentTrace, *requestError) {
+	ctx, span := startSpan(ctx, "agent.run")
+	defer span.End()
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Error("Cannot call Grafana API", "error", err)
+		return nil, req.Messages, nil, spanError(span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+	}
+	env := &toolEnv{ds: ds, r: r, client: client, now: time.Now().UTC()}
+
+	maxIterations := orDefault(ds.config.Agent.MaxIterations, defaultAgentMaxIterations)
+	timeout := time.Duration(orDefault(ds.config.Agent.TimeoutSeconds, defaultAgentTimeoutSeconds)) * time.Second
+	budgetCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	messages := []agentMessage{{chatMessage: chatMessage{Role: "system", Content: fmt.Sprintf(agentInstructions, env.now.Format(time.RFC3339))}}}
+	for _, msg := range req.Messages {
+		messages = append(messages, agentMessage{chatMessage: msg})
+	}
+	trace := &agentTrace{ToolCalls: []agentToolCall{}}
+	defer func() {
+		span.SetAttributes(attribute.Int(attrAgentIterations, trace.Iterations), attribute.String(attrAgentStop, trace.StopReason))
+	}()
+
+	// The conversation was fitted into the context window without the tools,
+	// so their definitions and results are budgeted here.
+	family := familyOf(req.Model)
+	definitions, _ := json.Marshal(toolDefinitions())
+	limit := promptTokenLimit(ds.contextWindow(req.Model)) - family.estimateTokens(string(definitions))
+
+	for {
+		// Results are dropped, oldest first, if the conversation has
+		// outgrown the context window.
+		tokens := family.estimateMessages(transcript(messages))
+		for tokens > limit && dropToolResult(messages) {
+			tokens = family.estimateMessages(transcript(messages))
+		}
+
+		// The final answer isn't bound by the budget, which only covers the
+		// tool rounds.
+		callCtx, toolChoice := budgetCtx, "auto"
+		switch {
+		case budgetCtx.Err() != nil:
+			callCtx, toolChoice, trace.StopReason = ctx, "none", agentStopTimeBudget
+		case trace.Iterations == maxIterations:
+			callCtx, toolChoice, trace.StopReason = ctx, "none", agentStopMaxIterations
+		case tokens > limit:
+			callCtx, toolChoice, trace.StopReason = ctx, "none", agentStopContextWindow
+		}
+
+		respBody, resp, reqErr := ds.agentStep(callCtx, apiKey, req.Model, messages, toolChoice)
+		if reqErr != nil {
+			if toolChoice != "none" && budgetCtx.Err() != nil && ctx.Err() == nil {
+				continue
+			}
+			return nil, transcript(messages), trace, spanError(span, reqErr)
+		}
+		trace.Iterations++
+		trace.Usage.PromptTokens += resp.Usage.PromptTokens
+		trace.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		trace.Usage.TotalTokens += resp.Usage.TotalTokens
+
+		msg := resp.Choices[0].Message
+		if toolChoice == "none" || len(msg.ToolCalls) == 0 {
+			if trace.StopReason == "" {
+				trace.StopReason = agentStopAnswered
+			}
+			return respBody, transcript(append(messages, msg)), trace, nil
+		}
+
+		messages = append(messages, msg)
+		share := (limit-family.estimateMessages(transcript(messages)))/len(msg.ToolCalls) - family.messageOverhead
+		for i, call := range msg.ToolCalls {
+			result := toolErrorResult(fmt.Sprintf("too many tool calls at once, at most %d are run", maxAgentToolCallsPerStep))
+			if i < maxAgentToolCallsPerStep {
+				result = ds.callTool(budgetCtx, env, call, trace)
+			}
+			result = fitToolResult(family, result, min(maxToolResultTokens, share))
+			messages = append(messages, agentMessage{chatMessage: chatMessage{Role: "tool", Content: result}, ToolCallID: call.ID})
+		}
+	}
+}
+
+// agentStep sends the conversation to the model with the tools offered.
+func (ds *Datasource) agentStep(ctx context.Context, apiKey, model string, messages []agentMessage, toolChoice string) ([]byte, *groqResponse, *requestError) {
+	payload, err := json.Marshal(groqToolRequest{Model: model, Messages: messages, Tools: toolDefinitions(), ToolChoice: toolChoice})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to marshal request", "error", err)
+		return nil, nil, &requestError{status: http.StatusInternalServerError, code: errCodeInternal, message: "Failed to prepare request"}
+	}
+
+	respBody, reqErr := ds.callGroq(ctx, apiKey, model, payload)
+	if reqErr != nil {
+		return nil, nil, reqErr
+	}
+	var resp groqResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil || len(resp.Choices) == 0 {
+		log.DefaultLogger.Warn("Invalid Groq response in agent loop", "error", err)
+		return nil, nil, &requestError{status: http.StatusBadGateway, code: errCodeUpstreamError, message: "Invalid response from model"}
+	}
+	return respBody, &resp, nil
+}
+
+// callTool runs a tool call and records it in trace.
+func (ds *Datasource) callTool(ctx context.Context, env *toolEnv, call toolCall, trace *agentTrace) string {
+	ctx, span := startSpan(ctx, "agent.tool")
+	defer span.End()
+	span.SetAttributes(attribute.String(attrToolName, call.Function.Name))
+
+	start := time.Now()
+	result, err := runTool(ctx, env, call)
+	record := agentToolCall{Name: call.Function.Name, Arguments: call.Function.Arguments, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		log.DefaultLogger.Warn("Tool call failed", "tool", call.Function.Name, "error", err)
+		record.Error = toolErrorMessage(err)
+		span.RecordError(err)
+	}
+	recordToolCall(call.Function.Name, err == nil)
+	trace.ToolCalls = append(trace.ToolCalls, record)
+	return result
+}
+
+// fitToolResult shortens a tool result to maxTokens, or replaces it if too
+// little of it would be left.
+func fitToolResult(family modelFamily, result string, maxTokens int) string {
+	const marker = "\n(truncated)"
+	truncated, shortened := family.truncateTokens(result, maxTokens-family.estimateTokens(marker))
+	switch {
+	case !shortened:
+		return result
+	case maxTokens < minToolResultTokens:
+		return droppedToolResult
+	}
+	return truncated + marker
+}
+
+// dropToolResult replaces the oldest tool result that is left, and reports
+// whether there was one.
+func dropToolResult(messages []agentMessage) bool {
+	for i := range messages {
+		if messages[i].Role == "tool" && messages[i].Content != droppedToolResult {
+			messages[i].Content = droppedToolResult
+			return true
+		}
+	}
+	return false
+}
+
+// transcript converts the messages of the agent loop to chat messages, with
+// the tool calls written out as content.
+func transcript(messages []agentMessage) []chatMessage {
+	result := make([]chatMessage, len(messages))
+	for i, msg := range messages {
+		result[i] = msg.chatMessage
+		for _, call := range msg.ToolCalls {
+			result[i].Content = strings.TrimSpace(result[i].Content + "\nTool call " + call.Function.Name + " " + call.Function.Arguments)
+		}
+	}
+	return result
+}
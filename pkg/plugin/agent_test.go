@@ -0,0 +1,283 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestParseToolTime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		value    string
+		expected time.Time
+		err      bool
+	}{
+		{value: "now", expected: now},
+		{value: "now-6h", expected: now.Add(-6 * time.Hour)},
+		{value: "now-2w", expected: now.Add(-14 * 24 * time.Hour)},
+		{value: "2024-05-31T08:00:00Z", expected: time.Date(2024, 5, 31, 8, 0, 0, 0, time.UTC)},
+		{value: "1717200000000", expected: time.UnixMilli(1717200000000).UTC()},
+		{value: "now-6x", err: true},
+		{value: "now-99999999999w", err: true},
+		{value: "yesterday", err: true},
+	}
+	for _, tc := range testCases {
+		got, err := parseToolTime(tc.value, now)
+		if (err != nil) != tc.err || !tc.err && !got.Equal(tc.expected) {
+			t.Errorf("parseToolTime(%q) = %s, %v, expected %s", tc.value, got, err, tc.expected)
+		}
+	}
+}
+
+// newTestToolGrafana serves the APIs of the tools on top of newTestGrafana.
+func newTestToolGrafana(t *testing.T) *httptest.Server {
+	t.Helper()
+	grafana := newTestGrafana(t, nil)
+	target, _ := url.Parse(grafana.URL)
+	mux := http.NewServeMux()
+	mux.Handle("/", httputil.NewSingleHostReverseProxy(target))
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"uid":"dash-1","title":"Checkout Service","folderTitle":"Shop","tags":["prod"]}]`))
+	})
+	mux.HandleFunc("/api/alertmanager/grafana/api/v2/alerts", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("active") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(`[{"labels":{"alertname":"HighErrorRate","severity":"critical"},"annotations":{"summary":"5% errors"},"startsAt":"2023-11-14T22:00:00Z"}]`))
+	})
+	mux.HandleFunc("/api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"dashboardUID":"dash-1","time":1700000000000,"text":"<b>Deploy</b> v42","tags":["deploy"]}]`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestAgentGroq answers with the tool calls of calls, one answer per
+// request, and then with a final answer. It returns the requests it got.
+func newTestAgentGroq(t *testing.T, calls [][]toolCall) (*httptest.Server, func() []groqToolRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []groqToolRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req groqToolRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		requests = append(requests, req)
+		step := len(requests) - 1
+		mu.Unlock()
+
+		msg := agentMessage{chatMessage: chatMessage{Role: "assistant", Content: "The error rate is high since the deploy."}}
+		if step < len(calls) && req.ToolChoice != "none" {
+			msg = agentMessage{chatMessage: chatMessage{Role: "assistant"}, ToolCalls: calls[step]}
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []any{map[string]any{"message": msg}},
+			"usage":   chatUsage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []groqToolRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func newTestToolCall(id, name, args string) toolCall {
+	return toolCall{ID: id, Type: "function", Function: toolCallFunction{Name: name, Arguments: args}}
+}
+
+func TestChatWithTools(t *testing.T) {
+	grafana := newTestToolGrafana(t)
+	round := []toolCall{
+		newTestToolCall("1", "get_panel_data", `{"dashboardUid":"dash-1","panelId":2,"from":"1700000000000","to":"1700003600000"}`),
+		newTestToolCall("2", "list_alerts", `{}`),
+		newTestToolCall("3", "search_annotations", `{"from":"now-7d"}`),
+		newTestToolCall("4", "get_panel_data", `{"dashboardUid":"secret","panelId":2}`),
+		newTestToolCall("5", "drop_tables", `{}`),
+	}
+
+	testCases := []struct {
+		name          string
+		calls         [][]toolCall
+		maxIterations int
+		expectedStop  string
+		expectedCalls int
+	}{
+		{name: "answered", calls: [][]toolCall{round, {newTestToolCall("6", "list_dashboards", `{"query":"checkout"}`)}}, expectedStop: agentStopAnswered, expectedCalls: 3},
+		{name: "max iterations", calls: [][]toolCall{round, round, round}, maxIterations: 2, expectedStop: agentStopMaxIterations, expectedCalls: 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			groq, requests := newTestAgentGroq(t, tc.calls)
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL, Agent: agentConfig{MaxIterations: tc.maxIterations}},
+				groqURL:  groq.URL,
+			}
+
+			body := `{"model":"llama-3.3-70b-versatile","tools":true,"messages":[{"role":"user","content":"Why are errors high?"}]}`
+			req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleGroqChat(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+			}
+			sent := requests()
+			if len(sent) != tc.expectedCalls || len(sent[0].Tools) != 4 || sent[0].ToolChoice != "auto" {
+				t.Fatalf("Expected %d requests offering the tools, got %+v", tc.expectedCalls, sent)
+			}
+			if last := sent[len(sent)-1]; tc.expectedStop == agentStopMaxIterations && last.ToolChoice != "none" {
+				t.Errorf("Expected the final request to ask for an answer, got %q", last.ToolChoice)
+			}
+			if !strings.Contains(sent[0].Messages[0].Content, "You can call tools") {
+				t.Errorf("Expected the tool instructions first, got %+v", sent[0].Messages[0])
+			}
+
+			// The second request carries the calls and one result per call
+			results := map[string]string{}
+			for _, msg := range sent[1].Messages {
+				if msg.Role == "tool" {
+					results[msg.ToolCallID] = msg.Content
+				}
+			}
+			for id, want := range map[string]string{
+				"1": "Panel 2 \"Request rate\"",
+				"2": `"alertname":"HighErrorRate"`,
+				"3": `"text":"Deploy v42"`,
+				"4": `{"error":"Access denied"}`,
+				"5": `{"error":"unknown tool \"drop_tables\""}`,
+			} {
+				if !strings.Contains(results[id], want) {
+					t.Errorf("Expected result of call %s to contain %q, got %q", id, want, results[id])
+				}
+			}
+
+			var resp struct {
+				Choices []struct {
+					Message chatMessage `json:"message"`
+				} `json:"choices"`
+				Agent agentTrace `json:"agent"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Choices[0].Message.Content != "The error rate is high since the deploy." {
+				t.Errorf("Expected the final answer, got %+v", resp.Choices)
+			}
+			if resp.Agent.StopReason != tc.expectedStop || resp.Agent.Iterations != tc.expectedCalls || resp.Agent.Usage.TotalTokens != 110*tc.expectedCalls {
+				t.Errorf("Unexpected agent trace: %+v", resp.Agent)
+			}
+			if resp.Agent.ToolCalls[3].Error != "Access denied" || resp.Agent.ToolCalls[0].Error != "" {
+				t.Errorf("Expected the failed tool call in the trace, got %+v", resp.Agent.ToolCalls)
+			}
+		})
+	}
+}
+
+func TestChatWithToolsTimeBudget(t *testing.T) {
+	globalRateLimiter.reset()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		w.Write([]byte(`[]`))
+	}))
+	defer slow.Close()
+
+	calls := [][]toolCall{{newTestToolCall("1", "list_dashboards", `{}`)}, {newTestToolCall("2", "list_dashboards", `{}`)}}
+	groq, requests := newTestAgentGroq(t, calls)
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		config:   pluginConfig{GrafanaURL: slow.URL, Agent: agentConfig{TimeoutSeconds: 1}},
+		groqURL:  groq.URL,
+	}
+
+	body := `{"model":"llama-3.3-70b-versatile","tools":true,"messages":[{"role":"user","content":"Which dashboards exist?"}]}`
+	req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	ds.handleGroqChat(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	sent := requests()
+	if len(sent) != 2 || sent[1].ToolChoice != "none" {
+		t.Fatalf("Expected an answer to be forced after the budget ran out, got %+v", sent)
+	}
+	if !strings.Contains(rr.Body.String(), `"stopReason":"time_budget"`) {
+		t.Errorf("Expected the time budget as stop reason, got %s", rr.Body.String())
+	}
+}
+
+func TestChatWithToolsContextWindow(t *testing.T) {
+	globalRateLimiter.reset()
+	var dashboards []map[string]any
+	for i := range 20 {
+		dashboards = append(dashboards, map[string]any{"uid": fmt.Sprintf("dash-%d", i), "title": strings.Repeat("Checkout service latency by region ", 10)})
+	}
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(dashboards)
+	}))
+	defer grafana.Close()
+
+	round := []toolCall{newTestToolCall("1", "list_dashboards", `{}`), newTestToolCall("2", "list_dashboards", `{"query":"checkout"}`)}
+	groq, requests := newTestAgentGroq(t, [][]toolCall{round, round, round})
+	model := "llama-3.3-70b-versatile"
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		config:   pluginConfig{GrafanaURL: grafana.URL, ContextWindows: map[string]int{model: 4096}},
+		groqURL:  groq.URL,
+	}
+
+	body := `{"model":"` + model + `","tools":true,"messages":[{"role":"user","content":"Which dashboards show checkout latency?"}]}`
+	req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	ds.handleGroqChat(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	family := familyOf(model)
+	definitions, _ := json.Marshal(toolDefinitions())
+	limit := promptTokenLimit(4096) - family.estimateTokens(string(definitions))
+	sent := requests()
+	if len(sent) != 4 {
+		t.Fatalf("Expected 3 rounds of tool calls and an answer, got %d requests", len(sent))
+	}
+	for i, r := range sent {
+		if tokens := family.estimateMessages(transcript(r.Messages)); tokens > limit {
+			t.Errorf("Expected request %d to fit into %d tokens, got %d", i+1, limit, tokens)
+		}
+	}
+
+	var truncated, dropped int
+	for _, msg := range sent[len(sent)-1].Messages {
+		switch {
+		case msg.Role != "tool":
+		case msg.Content == droppedToolResult:
+			dropped++
+		case strings.HasSuffix(msg.Content, "\n(truncated)"):
+			truncated++
+		}
+	}
+	if truncated == 0 || dropped == 0 {
+		t.Errorf("Expected truncated results and the oldest ones dropped, got %d truncated and %d dropped", truncated, dropped)
+	}
+}
@@ -0,0 +1,314 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// annotationConfirmationTTL is how long a proposed annotation waits for
+	// the user's confirmation.
+	annotationConfirmationTTL = 10 * time.Minute
+
+	// maxPendingAnnotations bounds the proposals kept for confirmation; the
+	// oldest are dropped first.
+	maxPendingAnnotations = 1000
+
+	// maxAnnotationText bounds the text of an annotation, and maxFinding the
+	// finding it is written from.
+	maxAnnotationText = 2000
+	maxFinding        = 8000
+
+	// maxAnnotationTags bounds the tags of an annotation, and
+	// maxAnnotationTag the length of a tag.
+	maxAnnotationTags = 10
+	maxAnnotationTag  = 50
+
+	// annotationTag marks the annotations created from the chatbot.
+	annotationTag = "chatbot"
+)
+
+const annotationInstructions = `You write the text of a Grafana annotation that marks an incident window on a dashboard, from a finding of the dashboard assistant.
+Answer with a JSON object with these keys:
+- "text": what happened in the window and its likely cause, in one or two plain sentences without markdown
+- "tags": up to three short lowercase tags that classify the incident, e.g. "latency" or "deployment"`
+
+// annotationRequest is the body accepted by /annotations. Without a
+// ConfirmationToken it proposes an annotation; the text is written by the
+// model from Finding unless Text is given. With a token, it creates the
+// proposed annotation.
+type annotationRequest struct {
+	Model             string   `json:"model"`
+	DashboardUID      string   `json:"dashboardUid"`
+	PanelID           int64    `json:"panelId"`
+	From              string   `json:"from"`
+	To                string   `json:"to"`
+	Tags              []string `json:"tags"`
+	Text              string   `json:"text"`
+	Finding           string   `json:"finding"`
+	ConfirmationToken string   `json:"confirmationToken"`
+}
+
+// annotation is an annotation as Grafana's API creates it. Times are Unix
+// milliseconds.
+type annotation struct {
+	DashboardUID string   `json:"dashboardUID"`
+	PanelID      int64    `json:"panelId,omitempty"`
+	Time         int64    `json:"time"`
+	TimeEnd      int64    `json:"timeEnd"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+type pendingAnnotation struct {
+	annotation annotation
+	user       string
+	orgID      int64
+	expires    time.Time
+}
+
+// pendingAnnotations keeps proposed annotations until they are confirmed.
+// A token can be used once, only by the user it was issued to.
+type pendingAnnotations struct {
+	mu      sync.Mutex
+	entries map[string]pendingAnnotation
+	order   []string
+}
+
+func newPendingAnnotations() *pendingAnnotations {
+	return &pendingAnnotations{entries: make(map[string]pendingAnnotation)}
+}
+
+// put stores a proposal and returns its confirmation token.
+func (p *pendingAnnotations) put(pending pendingAnnotation) (string, error) {
+	if p == nil {
+		return "", fmt.Errorf("no store for pending annotations")
+	}
+	var raw [24]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw[:])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for len(p.order) > 0 && (len(p.order) >= maxPendingAnnotations || p.entries[p.order[0]].expires.Before(now)) {
+		delete(p.entries, p.order[0])
+		p.order = p.order[1:]
+	}
+	p.entries[token] = pending
+	p.order = append(p.order, token)
+	return token, nil
+}
+
+// take removes and returns the proposal of a token, if it is unexpired and
+// was issued to the user.
+func (p *pendingAnnotations) take(token, user string, orgID int64) (annotation, bool) {
+	if p == nil {
+		return annotation{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.entries[token]
+	if !ok || pending.user != user || pending.orgID != orgID {
+		return annotation{}, false
+	}
+	delete(p.entries, token)
+	if i := slices.Index(p.order, token); i >= 0 {
+		p.order = slices.Delete(p.order, i, i+1)
+	}
+	return pending.annotation, time.Now().Before(pending.expires)
+}
+
+// annotationTags cleans up tags: trimmed, deduplicated, bounded, and with
+// annotationTag first.
+func annotationTags(tags ...[]string) []string {
+	result := []string{annotationTag}
+	for _, list := range tags {
+		for _, tag := range list {
+			tag = truncate(strings.TrimSpace(tag), maxAnnotationTag)
+			if tag != "" && !slices.Contains(result, tag) && len(result) < maxAnnotationTags {
+				result = append(result, tag)
+			}
+		}
+	}
+	return result
+}
+
+// callerIdentity returns the login and org of the calling user, which bind
+// a confirmation token.
+func callerIdentity(ctx context.Context) (string, int64) {
+	var login string
+	if user := backend.UserFromContext(ctx); user != nil {
+		login = user.Login
+	}
+	return login, backend.PluginConfigFromContext(ctx).OrgID
+}
+
+// handleAnnotations proposes and creates annotations of incident windows
+// the assistant found. A proposal only returns the annotation with a
+// confirmation token; it is created, with the caller's permissions, when
+// the token is sent back. The model never gets to create annotations
+// itself.
+func (ds *Datasource) handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "annotations.handle")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		writeRequestError(w, span, &requestError{status: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed, message: "Method not allowed"})
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidContentType, message: "Invalid Content-Type"})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Error("Cannot call Grafana API", "error", err)
+		writeRequestError(w, span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+		return
+	}
+	if req.ConfirmationToken != "" {
+		ds.createAnnotation(ctx, w, span, client, req.ConfirmationToken)
+		return
+	}
+	ds.proposeAnnotation(ctx, w, r, span, client, &req)
+}
+
+// proposeAnnotation validates a proposed annotation, has the model write its
+// text if needed, and stores it for confirmation.
+func (ds *Datasource) proposeAnnotation(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span, client *grafanaClient, req *annotationRequest) {
+	if !dashboardUIDRegex.MatchString(req.DashboardUID) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidDashboard, message: "Invalid dashboard UID"})
+		return
+	}
+	now := time.Now().UTC()
+	from, fromErr := parseToolTime(req.From, now)
+	to, toErr := parseToolTime(orDefaultString(req.To, req.From), now)
+	if fromErr != nil || toErr != nil || to.Before(from) || req.PanelID < 0 {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid time range"})
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" && strings.TrimSpace(req.Finding) == "" {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Either a text or a finding is required"})
+		return
+	}
+	if len(req.Text) > maxAnnotationText || len(req.Finding) > maxFinding {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeContentTooLong, message: "Text too long"})
+		return
+	}
+	span.SetAttributes(attribute.Int64(attrPanelID, req.PanelID))
+
+	// Reading the dashboard checks that it exists and that the caller may
+	// see it; whether they may annotate it is checked on creation.
+	var dash dashboardResponse
+	if err := client.get(ctx, "/api/dashboards/uid/"+url.PathEscape(req.DashboardUID), &dash); err != nil {
+		log.DefaultLogger.Warn("Failed to load dashboard", "uid", req.DashboardUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Dashboard"))
+		return
+	}
+
+	proposed := annotation{DashboardUID: req.DashboardUID, PanelID: req.PanelID, Time: from.UnixMilli(), TimeEnd: to.UnixMilli(), Text: req.Text}
+	var written struct {
+		Text string   `json:"text"`
+		Tags []string `json:"tags"`
+	}
+	if proposed.Text == "" {
+		apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+		if reqErr != nil {
+			writeRequestError(w, span, reqErr)
+			return
+		}
+		req.Model = orDefaultString(req.Model, defaultChatModel)
+		if !validModel(req.Model) {
+			writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+			return
+		}
+		span.SetAttributes(attribute.String(attrModel, req.Model))
+
+		var b strings.Builder
+		b.WriteString(annotationInstructions)
+		fmt.Fprintf(&b, "\n\nDashboard: %q\n", truncate(stripHTML(dash.Dashboard.Title), maxContextTitle))
+		fmt.Fprintf(&b, "Window: %s to %s\n", from.Format(time.RFC3339), to.Format(time.RFC3339))
+		chatReq := &chatRequest{Model: req.Model, Messages: []chatMessage{
+			{Role: "system", Content: b.String()},
+			{Role: "user", Content: req.Finding},
+		}, DashboardUID: req.DashboardUID}
+		if _, reqErr := ds.completeJSON(ctx, apiKey, "annotations", chatReq, &written); reqErr != nil {
+			writeRequestError(w, span, reqErr)
+			return
+		}
+		proposed.Text = truncate(strings.TrimSpace(written.Text), maxAnnotationText)
+		if proposed.Text == "" {
+			writeRequestError(w, span, &requestError{status: http.StatusBadGateway, code: errCodeUpstreamUnavailable, message: "No annotation text written"})
+			return
+		}
+		written.Tags = written.Tags[:min(len(written.Tags), 3)]
+	}
+	proposed.Tags = annotationTags(req.Tags, written.Tags)
+
+	user, orgID := callerIdentity(ctx)
+	expires := now.Add(annotationConfirmationTTL)
+	token, err := ds.annotations.put(pendingAnnotation{annotation: proposed, user: user, orgID: orgID, expires: expires})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to create confirmation token", "error", err)
+		writeRequestError(w, span, &requestError{status: http.StatusInternalServerError, code: errCodeInternal, message: "Failed to propose annotation"})
+		return
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Proposed annotation", "dashboard", req.DashboardUID, "panel", req.PanelID)
+
+	writeJSON(w, map[string]any{
+		"dashboardTitle":    dash.Dashboard.Title,
+		"annotation":        proposed,
+		"confirmationToken": token,
+		"expiresAt":         expires,
+	})
+}
+
+// createAnnotation creates the proposed annotation of a confirmation token.
+func (ds *Datasource) createAnnotation(ctx context.Context, w http.ResponseWriter, span trace.Span, client *grafanaClient, token string) {
+	user, orgID := callerIdentity(ctx)
+	confirmed, ok := ds.annotations.take(token, user, orgID)
+	if !ok {
+		writeRequestError(w, span, &requestError{status: http.StatusNotFound, code: errCodeNotFound, message: "Unknown or expired confirmation token"})
+		return
+	}
+	span.SetAttributes(attribute.Int64(attrPanelID, confirmed.PanelID))
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := client.post(ctx, "/api/annotations", confirmed, &created); err != nil {
+		log.DefaultLogger.Warn("Failed to create annotation", "dashboard", confirmed.DashboardUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Dashboard"))
+		return
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Created annotation", "dashboard", confirmed.DashboardUID, "panel", confirmed.PanelID, "id", created.ID)
+
+	writeJSON(w, map[string]any{"id": created.ID, "annotation": confirmed})
+}
@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// newTestAnnotationGrafana serves the dashboards "dash-1" and "readonly",
+// which the caller may see but not annotate, and records the annotations
+// created.
+func newTestAnnotationGrafana(t *testing.T, created *[]annotation) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/dashboards/uid/dash-1" || r.URL.Path == "/api/dashboards/uid/readonly":
+			w.Write([]byte(`{"dashboard":{"title":"Checkout"}}`))
+		case r.URL.Path == "/api/annotations" && r.Method == http.MethodPost:
+			var a annotation
+			json.NewDecoder(r.Body).Decode(&a)
+			if a.DashboardUID == "readonly" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			*created = append(*created, a)
+			w.Write([]byte(`{"id":7,"message":"Annotation added"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestAnnotationDatasource(t *testing.T, grafanaURL string) *Datasource {
+	t.Helper()
+	groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		answer := `{"text":"Checkout latency doubled after the 14:00 deployment.","tags":["latency","deployment","checkout","extra"]}`
+		json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: answer}}}})
+	}))
+	t.Cleanup(groq.Close)
+	return &Datasource{
+		settings:    backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		config:      pluginConfig{GrafanaURL: grafanaURL},
+		groqURL:     groq.URL,
+		annotations: newPendingAnnotations(),
+	}
+}
+
+func callAnnotations(ds *Datasource, login, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/annotations", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	ctx := backend.WithUser(context.Background(), &backend.User{Login: login})
+	ctx = backend.WithPluginContext(ctx, backend.PluginContext{OrgID: 1})
+	rr := httptest.NewRecorder()
+	ds.handleAnnotations(rr, req.WithContext(ctx))
+	return rr
+}
+
+func TestProposeAnnotation(t *testing.T) {
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedText   string
+		expectedTags   []string
+		expectedEnd    int64
+	}{
+		{name: "text", body: `{"dashboardUid":"dash-1","panelId":2,"from":"1700000000000","to":"1700000600000","text":"Checkout outage","tags":["incident"," incident "]}`,
+			expectedStatus: http.StatusOK, expectedText: "Checkout outage", expectedTags: []string{"chatbot", "incident"}, expectedEnd: 1700000600000},
+		{name: "written by the model", body: `{"dashboardUid":"dash-1","from":"2023-11-14T22:13:20Z","to":"2023-11-14T22:23:20Z","finding":"Latency rose at 14:00.","tags":["incident"]}`,
+			expectedStatus: http.StatusOK, expectedText: "Checkout latency doubled after the 14:00 deployment.",
+			expectedTags: []string{"chatbot", "incident", "latency", "deployment", "checkout"}, expectedEnd: 1700000600000},
+		{name: "point in time", body: `{"dashboardUid":"dash-1","from":"1700000000000","text":"Restart"}`,
+			expectedStatus: http.StatusOK, expectedText: "Restart", expectedTags: []string{"chatbot"}, expectedEnd: 1700000000000},
+		{name: "end before start", body: `{"dashboardUid":"dash-1","from":"1700000600000","to":"1700000000000","text":"x"}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid time", body: `{"dashboardUid":"dash-1","from":"yesterday","text":"x"}`, expectedStatus: http.StatusBadRequest},
+		{name: "no text", body: `{"dashboardUid":"dash-1","from":"now-1h","to":"now"}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid dashboard", body: `{"dashboardUid":"../x","from":"now-1h","text":"x"}`, expectedStatus: http.StatusBadRequest},
+		{name: "forbidden dashboard", body: `{"dashboardUid":"secret","from":"now-1h","text":"x"}`, expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var created []annotation
+			ds := newTestAnnotationDatasource(t, newTestAnnotationGrafana(t, &created).URL)
+			rr := callAnnotations(ds, "alice", tc.body)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if len(created) != 0 {
+				t.Errorf("Expected a proposal not to create an annotation, got %+v", created)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Annotation        annotation `json:"annotation"`
+				ConfirmationToken string     `json:"confirmationToken"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			a := resp.Annotation
+			if resp.ConfirmationToken == "" || a.Text != tc.expectedText || !slices.Equal(a.Tags, tc.expectedTags) || a.TimeEnd != tc.expectedEnd {
+				t.Errorf("Unexpected proposal %+v", resp)
+			}
+		})
+	}
+}
+
+func TestCreateAnnotation(t *testing.T) {
+	globalRateLimiter.reset()
+	var created []annotation
+	ds := newTestAnnotationDatasource(t, newTestAnnotationGrafana(t, &created).URL)
+
+	propose := func(dashboardUID string) string {
+		rr := callAnnotations(ds, "alice", `{"dashboardUid":"`+dashboardUID+`","panelId":2,"from":"1700000000000","to":"1700000600000","text":"Checkout outage"}`)
+		var resp struct {
+			ConfirmationToken string `json:"confirmationToken"`
+		}
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return resp.ConfirmationToken
+	}
+
+	token := propose("dash-1")
+	if rr := callAnnotations(ds, "bob", `{"confirmationToken":"`+token+`"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's confirmation to fail, got %d", rr.Code)
+	}
+	rr := callAnnotations(ds, "alice", `{"confirmationToken":"`+token+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	expected := annotation{DashboardUID: "dash-1", PanelID: 2, Time: 1700000000000, TimeEnd: 1700000600000, Tags: []string{"chatbot"}, Text: "Checkout outage"}
+	if resp.ID != 7 || len(created) != 1 || created[0].DashboardUID != expected.DashboardUID || created[0].PanelID != expected.PanelID ||
+		created[0].Time != expected.Time || created[0].TimeEnd != expected.TimeEnd || created[0].Text != expected.Text || !slices.Equal(created[0].Tags, expected.Tags) {
+		t.Errorf("Expected annotation %+v to be created, got %+v (id %d)", expected, created, resp.ID)
+	}
+
+	if rr := callAnnotations(ds, "alice", `{"confirmationToken":"`+token+`"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected a token to be usable once, got %d", rr.Code)
+	}
+	expired, _ := ds.annotations.put(pendingAnnotation{annotation: expected, user: "alice", orgID: 1, expires: time.Now().Add(-time.Minute)})
+	if rr := callAnnotations(ds, "alice", `{"confirmationToken":"`+expired+`"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected an expired token to fail, got %d", rr.Code)
+	}
+	if rr := callAnnotations(ds, "alice", `{"confirmationToken":"unknown"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown token to fail, got %d", rr.Code)
+	}
+	if rr := callAnnotations(ds, "alice", `{"confirmationToken":"`+propose("readonly")+`"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected Grafana's permission check to apply, got %d", rr.Code)
+	}
+	if len(created) != 1 {
+		t.Errorf("Expected one annotation, got %+v", created)
+	}
+}
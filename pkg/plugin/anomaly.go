@@ -0,0 +1,444 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Anomaly detectors run over the panel series before prompting. Their
+// findings are added to the context, so that the LLM doesn't have to spot
+// anomalies in the summaries itself.
+const (
+	// detectorZScore flags points far from the median, in robust standard
+	// deviations estimated from the median absolute deviation.
+	detectorZScore = "zscore"
+	// detectorSeasonal flags points far from the daily or weekly pattern of
+	// a seasonal series, using the residuals of a moving average
+	// decomposition.
+	detectorSeasonal = "seasonal_residual"
+	// detectorLevelShift flags sudden shifts of the mean.
+	detectorLevelShift = "level_shift"
+	// detectorFlatline flags a varying series that stops changing.
+	detectorFlatline = "flatline"
+)
+
+const (
+	// minAnomalyPoints is the fewest points a series needs for detection.
+	minAnomalyPoints = 12
+
+	// zScoreThreshold is the robust z-score of an outlier, as recommended by
+	// Iglewicz and Hoaglin.
+	zScoreThreshold = 3.5
+
+	// minSeasonalCorrelation is the autocorrelation at the period above
+	// which a series is treated as seasonal.
+	minSeasonalCorrelation = 0.5
+
+	// minFlatlinePoints is the fewest equal points of a flatline. It must
+	// also cover a fifth of the series.
+	minFlatlinePoints = 10
+
+	// minFindingConfidence is the confidence a finding needs to be reported.
+	minFindingConfidence = 0.5
+
+	// maxPanelFindings and maxContextFindings bound the findings per panel
+	// and in the prompt.
+	maxPanelFindings   = 5
+	maxContextFindings = 10
+)
+
+// finding is an anomaly flagged in a series. Start and End are equal for a
+// single point.
+type finding struct {
+	Detector    string    `json:"detector"`
+	Series      string    `json:"series"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Confidence  float64   `json:"confidence"`
+	Description string    `json:"description"`
+}
+
+// detectAnomalies runs the detectors over the time series of a panel and
+// keeps its most confident findings.
+func detectAnomalies(panel *panelContext) {
+	var findings []finding
+	for _, frame := range panel.Frames {
+		timeField := firstTimeField(frame)
+		if timeField == nil {
+			continue
+		}
+		for _, field := range frame.Fields {
+			if field == timeField || !field.Type().Numeric() {
+				continue
+			}
+			values, times, _ := fieldValues(field, timeField)
+			for _, f := range detectSeriesAnomalies(values, times) {
+				f.Series = seriesName(frame, field)
+				findings = append(findings, f)
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Confidence > findings[j].Confidence })
+	if len(findings) > maxPanelFindings {
+		findings = findings[:maxPanelFindings]
+	}
+	panel.Findings = findings
+}
+
+// detectSeriesAnomalies runs the detectors over a series. Seasonal series
+// are checked against their seasonal pattern instead of their median, so
+// that daily peaks aren't reported as outliers.
+func detectSeriesAnomalies(values []float64, times []time.Time) []finding {
+	if len(values) < minAnomalyPoints {
+		return nil
+	}
+
+	// Where findings overlap, the flatline explains the level shift into
+	// it, and the level shift the outliers after it.
+	findings := flatlines(values, times)
+	findings = appendDistinct(findings, levelShifts(values, times))
+	if period := seasonalPeriod(values, times); period > 0 {
+		findings = appendDistinct(findings, seasonalResiduals(values, times, period))
+	} else {
+		findings = appendDistinct(findings, zScoreOutliers(values, times))
+	}
+
+	confident := findings[:0]
+	for _, f := range findings {
+		if f.Confidence >= minFindingConfidence {
+			confident = append(confident, f)
+		}
+	}
+	return confident
+}
+
+// appendDistinct appends the candidates that don't overlap any of findings.
+func appendDistinct(findings, candidates []finding) []finding {
+	n := len(findings)
+	for _, c := range candidates {
+		overlaps := false
+		for _, f := range findings[:n] {
+			overlaps = overlaps || !c.End.Before(f.Start) && !c.Start.After(f.End)
+		}
+		if !overlaps {
+			findings = append(findings, c)
+		}
+	}
+	return findings
+}
+
+// zScoreOutliers flags runs of points whose robust z-score exceeds
+// zScoreThreshold.
+func zScoreOutliers(values []float64, times []time.Time) []finding {
+	center, scores := robustZScores(values)
+	if scores == nil {
+		return nil
+	}
+	return outlierIntervals(scores, times, detectorZScore, func(peak int) string {
+		return fmt.Sprintf("value %s vs. median %s (%.1f robust standard deviations)", formatNumber(values[peak]), formatNumber(center), scores[peak])
+	})
+}
+
+// seasonalPeriod returns the period of a daily or weekly pattern in points,
+// or 0 if the series isn't seasonal. The series must cover two periods.
+func seasonalPeriod(values []float64, times []time.Time) int {
+	step := medianStep(times)
+	if step <= 0 {
+		return 0
+	}
+
+	best, bestCorrelation := 0, minSeasonalCorrelation
+	for _, season := range []time.Duration{24 * time.Hour, 7 * 24 * time.Hour} {
+		period := int(season / step)
+		if period < 4 || 2*period > len(values) {
+			continue
+		}
+		if correlation := autocorrelation(values, period); correlation >= bestCorrelation {
+			best, bestCorrelation = period, correlation
+		}
+	}
+	return best
+}
+
+// seasonalResiduals decomposes a series into a moving average trend, the
+// pattern of each phase of the period and residuals, and flags runs of
+// outlying residuals.
+func seasonalResiduals(values []float64, times []time.Time, period int) []finding {
+	n := len(values)
+	prefix := make([]float64, n+1)
+	for i, v := range values {
+		prefix[i+1] = prefix[i] + v
+	}
+	// The trend is a centered moving average over one period, with half
+	// weights at both ends for even periods. Near the ends of the series,
+	// where the window doesn't fit, the nearest full average is used.
+	half := period / 2
+	trend := make([]float64, n)
+	for i := half; i < n-half; i++ {
+		lo, hi := i-half, i+half+1
+		sum := prefix[hi] - prefix[lo]
+		if period%2 == 0 {
+			sum -= (values[lo] + values[hi-1]) / 2
+		}
+		trend[i] = sum / float64(period)
+	}
+	for i := 0; i < half; i++ {
+		trend[i], trend[n-1-i] = trend[half], trend[n-1-half]
+	}
+
+	// The pattern of a phase is the median of the other cycles at that
+	// phase: the median keeps an anomaly from shifting the expectation of
+	// the same time on other days, and leaving the point itself out keeps
+	// the residuals from shrinking towards zero.
+	phases := make([][]float64, period)
+	for i, v := range values {
+		phases[i%period] = append(phases[i%period], v-trend[i])
+	}
+	var seasonalMean float64
+	for _, detrended := range phases {
+		sorted := append([]float64(nil), detrended...)
+		sort.Float64s(sorted)
+		seasonalMean += percentile(sorted, 0.5) / float64(period)
+	}
+
+	residuals := make([]float64, n)
+	expected := make([]float64, n)
+	others := make([]float64, 0, len(phases[0]))
+	for i, v := range values {
+		phase := phases[i%period]
+		others = others[:0]
+		for cycle, d := range phase {
+			if cycle != i/period {
+				others = append(others, d)
+			}
+		}
+		sort.Float64s(others)
+		expected[i] = trend[i] + percentile(others, 0.5) - seasonalMean
+		residuals[i] = v - expected[i]
+	}
+
+	_, scores := robustZScores(residuals)
+	if scores == nil {
+		return nil
+	}
+	return outlierIntervals(scores, times, detectorSeasonal, func(peak int) string {
+		return fmt.Sprintf("value %s vs. %s expected from the seasonal pattern (period %s)", formatNumber(values[peak]), formatNumber(expected[peak]), isoDuration(time.Duration(period)*medianStep(times)))
+	})
+}
+
+// levelShifts reports the change points of a series at which the mean
+// shifts within a few points rather than gradually.
+func levelShifts(values []float64, times []time.Time) []finding {
+	var findings []finding
+	for _, cp := range changePoints(values, times) {
+		i := cp.index
+		if i < minChangePointSegment || i+minChangePointSegment > len(values) {
+			continue
+		}
+		before := mean(values[i-minChangePointSegment : i])
+		after := mean(values[i : i+minChangePointSegment])
+		if math.Abs(after-before) < 0.5*math.Abs(cp.After-cp.Before) {
+			continue
+		}
+
+		description := fmt.Sprintf("mean shifted from %s to %s", formatNumber(cp.Before), formatNumber(cp.After))
+		if cp.Before != 0 {
+			description += fmt.Sprintf(" (%+.0f%%)", (cp.After-cp.Before)/math.Abs(cp.Before)*100)
+		}
+		start, end := times[i-1], times[i]
+		if end.Before(start) {
+			start, end = end, start
+		}
+		findings = append(findings, finding{
+			Detector:    detectorLevelShift,
+			Start:       start,
+			End:         end,
+			Confidence:  scoreConfidence(cp.score, changePointThreshold),
+			Description: description,
+		})
+	}
+	return findings
+}
+
+// flatlines reports the longest run of equal values of a series that
+// otherwise varies. A flatline that lasts until the end of the series is
+// more likely to be a stuck exporter than a quiet period.
+func flatlines(values []float64, times []time.Time) []finding {
+	n := len(values)
+	start, length := 0, 1
+	for i, runStart := 1, 0; i < n; i++ {
+		if !nearlyEqual(values[i], values[runStart]) {
+			runStart = i
+		}
+		if i-runStart+1 > length {
+			start, length = runStart, i-runStart+1
+		}
+	}
+	if length == n || length < max(minFlatlinePoints, n/5) {
+		return nil
+	}
+
+	end := start + length - 1
+	confidence := 0.4 + float64(length)/float64(n)
+	description := fmt.Sprintf("constant at %s for %s (%d points)", formatNumber(values[start]), isoDuration(times[end].Sub(times[start])), length)
+	if end == n-1 {
+		confidence += 0.2
+		description += " until the end of the range"
+	}
+	return []finding{{
+		Detector:    detectorFlatline,
+		Start:       times[start],
+		End:         times[end],
+		Confidence:  math.Round(math.Min(confidence, 1)*100) / 100,
+		Description: description,
+	}}
+}
+
+// robustZScores returns the median of values and the distance of each value
+// from it in robust standard deviations. Scores are nil if the values don't
+// vary.
+func robustZScores(values []float64) (float64, []float64) {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	median := percentile(sorted, 0.5)
+
+	deviations := make([]float64, len(values))
+	var meanDeviation float64
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+		meanDeviation += deviations[i] / float64(len(values))
+	}
+	sort.Float64s(deviations)
+
+	// The MAD is zero if more than half of the values are equal; the mean
+	// absolute deviation is the fallback.
+	scale := 1.4826 * percentile(deviations, 0.5)
+	if scale == 0 {
+		scale = 1.2533 * meanDeviation
+	}
+	if scale == 0 {
+		return median, nil
+	}
+
+	scores := make([]float64, len(values))
+	for i, v := range values {
+		scores[i] = (v - median) / scale
+	}
+	return median, scores
+}
+
+// outlierIntervals merges consecutive points whose score exceeds
+// zScoreThreshold into findings. The description is of the point with the
+// highest score.
+func outlierIntervals(scores []float64, times []time.Time, detector string, describe func(peak int) string) []finding {
+	var findings []finding
+	for i := 0; i < len(scores); i++ {
+		if math.Abs(scores[i]) <= zScoreThreshold {
+			continue
+		}
+		start, peak := i, i
+		for i+1 < len(scores) && math.Abs(scores[i+1]) > zScoreThreshold {
+			i++
+			if math.Abs(scores[i]) > math.Abs(scores[peak]) {
+				peak = i
+			}
+		}
+
+		description := describe(peak)
+		if i > start {
+			description = fmt.Sprintf("%d points, peak %s", i-start+1, description)
+		}
+		findings = append(findings, finding{
+			Detector:    detector,
+			Start:       times[start],
+			End:         times[i],
+			Confidence:  scoreConfidence(math.Abs(scores[peak]), zScoreThreshold),
+			Description: description,
+		})
+	}
+	return findings
+}
+
+// scoreConfidence maps a detector score to a confidence between 0.5 at the
+// threshold and 1 at twice the threshold.
+func scoreConfidence(score, threshold float64) float64 {
+	confidence := math.Min(1, 0.5+0.5*(score-threshold)/threshold)
+	return math.Round(confidence*100) / 100
+}
+
+// autocorrelation is the correlation of values with themselves lag points
+// later.
+func autocorrelation(values []float64, lag int) float64 {
+	m := mean(values)
+	var num, den float64
+	for i, v := range values {
+		den += (v - m) * (v - m)
+		if i+lag < len(values) {
+			num += (v - m) * (values[i+lag] - m)
+		}
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// medianStep returns the median interval between the points of a series.
+func medianStep(times []time.Time) time.Duration {
+	if len(times) < 2 {
+		return 0
+	}
+	steps := make([]time.Duration, len(times)-1)
+	for i := range steps {
+		steps[i] = times[i+1].Sub(times[i])
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i] < steps[j] })
+	return steps[len(steps)/2]
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func nearlyEqual(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// writeFindings renders the most confident findings of all panels.
+func writeFindings(b *strings.Builder, panels []panelContext) {
+	type panelFinding struct {
+		finding
+		panel *panelContext
+	}
+	var findings []panelFinding
+	for i := range panels {
+		for _, f := range panels[i].Findings {
+			findings = append(findings, panelFinding{finding: f, panel: &panels[i]})
+		}
+	}
+	if len(findings) == 0 {
+		return
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Confidence > findings[j].Confidence })
+	if len(findings) > maxContextFindings {
+		findings = findings[:maxContextFindings]
+	}
+
+	b.WriteString("\nFindings of the anomaly detectors, most confident first:\n")
+	for _, f := range findings {
+		when := "at " + f.Start.UTC().Format(time.RFC3339)
+		if !f.End.Equal(f.Start) {
+			when = "from " + f.Start.UTC().Format(time.RFC3339) + " to " + f.End.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(b, "- [%s, confidence %.2f] Panel %d %q, series %s, %s: %s\n",
+			f.Detector, f.Confidence, f.panel.ID, f.panel.Title, truncate(f.Series, maxContextTitle), when, f.Description)
+	}
+}
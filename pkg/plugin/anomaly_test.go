@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// noisySeries returns n points every step with value f(i) plus Gaussian noise
+// of the given standard deviation.
+func noisySeries(n int, step time.Duration, noise float64, f func(i int) float64) ([]float64, []time.Time) {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	values := make([]float64, n)
+	times := make([]time.Time, n)
+	for i := range values {
+		values[i] = f(i) + rng.NormFloat64()*noise
+		times[i] = start.Add(time.Duration(i) * step)
+	}
+	return values, times
+}
+
+func TestDetectSeriesAnomalies(t *testing.T) {
+	daily := func(i int) float64 { return 100 + 50*math.Sin(2*math.Pi*float64(i)/24) }
+
+	testCases := []struct {
+		name     string
+		step     time.Duration
+		n        int
+		noise    float64
+		f        func(i int) float64
+		flatFrom int
+		expected []string
+		at       int
+	}{
+		{name: "steady", step: time.Minute, n: 120, f: func(i int) float64 { return 10 }},
+		{name: "spike", step: time.Minute, n: 120, f: func(i int) float64 {
+			if i == 60 {
+				return 40
+			}
+			return 10
+		}, expected: []string{detectorZScore}, at: 60},
+		{name: "daily pattern", step: time.Hour, n: 24 * 7, noise: 3, f: daily},
+		{name: "seasonal anomaly", step: time.Hour, n: 24 * 7, noise: 3, f: func(i int) float64 {
+			if i == 100 {
+				// Trough hour at peak level
+				return daily(i) + 90
+			}
+			return daily(i)
+		}, expected: []string{detectorSeasonal}, at: 100},
+		{name: "level shift", step: time.Minute, n: 120, f: func(i int) float64 {
+			if i >= 80 {
+				return 30
+			}
+			return 10
+		}, expected: []string{detectorLevelShift}, at: 80},
+		{name: "gradual ramp", step: time.Minute, n: 120, f: func(i int) float64 { return float64(i) / 4 }},
+		{name: "flatline", step: time.Minute, n: 120, f: func(i int) float64 { return 10 }, flatFrom: 90, expected: []string{detectorFlatline}, at: 90},
+		{name: "too short", step: time.Minute, n: 8, f: func(i int) float64 {
+			if i == 4 {
+				return 100
+			}
+			return 10
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			values, times := noisySeries(tc.n, tc.step, max(tc.noise, 1), tc.f)
+			if tc.flatFrom > 0 {
+				for i := tc.flatFrom; i < tc.n; i++ {
+					values[i] = 12
+				}
+			}
+
+			findings := detectSeriesAnomalies(values, times)
+
+			var detectors []string
+			for _, f := range findings {
+				detectors = append(detectors, f.Detector)
+				if f.Confidence < minFindingConfidence || f.Confidence > 1 || f.Description == "" {
+					t.Errorf("Unexpected finding %+v", f)
+				}
+			}
+			if strings.Join(detectors, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("Expected findings of %v, got %+v", tc.expected, findings)
+			}
+			if len(findings) > 0 && (times[tc.at].Before(findings[0].Start.Add(-tc.step)) || times[tc.at].After(findings[0].End)) {
+				t.Errorf("Expected the finding to cover %s, got %s to %s", times[tc.at], findings[0].Start, findings[0].End)
+			}
+		})
+	}
+}
+
+// TestLevelShiftUnorderedTimes covers series whose times descend, as of SQL
+// queries ordered DESC, or repeat.
+func TestLevelShiftUnorderedTimes(t *testing.T) {
+	shift := func(i int) float64 {
+		if i >= 80 {
+			return 30
+		}
+		return 10
+	}
+	values, times := noisySeries(120, time.Minute, 1, shift)
+	descending := slices.Clone(times)
+	slices.Reverse(descending)
+	duplicates := slices.Clone(times)
+	for i := range duplicates {
+		duplicates[i] = times[i/10*10]
+	}
+
+	for name, times := range map[string][]time.Time{"descending": descending, "duplicates": duplicates} {
+		t.Run(name, func(t *testing.T) {
+			findings := detectSeriesAnomalies(values, times)
+			i := slices.IndexFunc(findings, func(f finding) bool { return f.Detector == detectorLevelShift })
+			if i < 0 || findings[i].End.Before(findings[i].Start) {
+				t.Errorf("Expected a level shift, got %+v", findings)
+			}
+		})
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	values, times := noisySeries(60, time.Minute, 1, func(i int) float64 {
+		if i == 30 {
+			return 80
+		}
+		return 20
+	})
+	panel := panelContext{ID: 7, Title: "Latency", Frames: data.Frames{data.NewFrame("A",
+		data.NewField("time", nil, times),
+		data.NewField("Value", data.Labels{"pod": "a"}, values),
+	)}}
+
+	detectAnomalies(&panel)
+	if len(panel.Findings) != 1 || panel.Findings[0].Series != "A{pod=a}" {
+		t.Fatalf("Expected a finding for the series, got %+v", panel.Findings)
+	}
+
+	dc := &dashboardContext{Title: "Checkout", Panels: []panelContext{panel}}
+	prompt := dc.prompt()
+	for _, want := range []string{"Findings of the anomaly detectors", "[zscore, confidence 1.00] Panel 7 \"Latency\", series A{pod=a}, at 2024-06-01T00:30:00Z: value 79.15 vs. median 20.27"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("Expected prompt to contain %q:\n%s", want, prompt)
+		}
+	}
+}
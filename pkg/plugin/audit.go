@@ -0,0 +1,417 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Redaction levels of the audit log.
+const (
+	// auditRedactionNone stores prompts and responses in full.
+	auditRedactionNone = "none"
+	// auditRedactionHash stores SHA-256 digests of prompts and responses.
+	auditRedactionHash = "hash"
+	// auditRedactionOmit stores metadata only.
+	auditRedactionOmit = "omit"
+)
+
+const (
+	defaultAuditRetentionDays = 90
+	defaultAuditMaxFileMB     = 100
+	defaultAuditRotateHours   = 24
+
+	// auditDir is the audit directory below the plugin data directory.
+	auditDir = "audit"
+
+	// maxAuditSearchResults bounds the entries returned by /audit.
+	maxAuditSearchResults = 1000
+)
+
+// auditEntry is one line of the audit log and describes a single exchange
+// with the LLM.
+type auditEntry struct {
+	Time             time.Time     `json:"time"`
+	User             string        `json:"user"`
+	OrgID            int64         `json:"orgId"`
+	DashboardUID     string        `json:"dashboardUid,omitempty"`
+	Endpoint         string        `json:"endpoint"`
+	Model            string        `json:"model"`
+	Status           int           `json:"status"`
+	ErrorCode        string        `json:"errorCode,omitempty"`
+	PromptTokens     int           `json:"promptTokens,omitempty"`
+	CompletionTokens int           `json:"completionTokens,omitempty"`
+	Redaction        string        `json:"redaction"`
+	Messages         []chatMessage `json:"messages,omitempty"`
+	PromptHash       string        `json:"promptHash,omitempty"`
+	Response         string        `json:"response,omitempty"`
+	ResponseHash     string        `json:"responseHash,omitempty"`
+}
+
+// auditLog appends audit entries as JSON lines to files in a directory. The
+// current file is rotated when it exceeds its size or age limit, and rotated
+// files are deleted after the retention period.
+type auditLog struct {
+	mu        sync.Mutex
+	dir       string
+	redaction string
+	retention time.Duration
+	maxSize   int64
+	maxAge    time.Duration
+
+	file    *os.File
+	size    int64
+	opened  time.Time
+	nowFunc func() time.Time
+}
+
+// newAuditLog creates an audit log in dir. The first file is opened lazily.
+func newAuditLog(dir string, cfg auditConfig) (*auditLog, error) {
+	redaction := cfg.Redaction
+	if redaction == "" {
+		redaction = auditRedactionHash
+	}
+	if !validAuditRedaction(redaction) {
+		return nil, fmt.Errorf("invalid audit redaction level %q", redaction)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create audit directory: %w", err)
+	}
+
+	return &auditLog{
+		dir:       dir,
+		redaction: redaction,
+		retention: time.Duration(orDefault(cfg.RetentionDays, defaultAuditRetentionDays)) * 24 * time.Hour,
+		maxSize:   int64(orDefault(cfg.MaxFileMB, defaultAuditMaxFileMB)) << 20,
+		maxAge:    time.Duration(orDefault(cfg.RotateHours, defaultAuditRotateHours)) * time.Hour,
+		nowFunc:   time.Now,
+	}, nil
+}
+
+func validAuditRedaction(redaction string) bool {
+	return redaction == "" || redaction == auditRedactionNone || redaction == auditRedactionHash || redaction == auditRedactionOmit
+}
+
+// newAuditEntry describes an exchange of the calling user with the LLM.
+func newAuditEntry(ctx context.Context, endpoint string, req *chatRequest) auditEntry {
+	entry := auditEntry{
+		Time:         time.Now(),
+		OrgID:        backend.PluginConfigFromContext(ctx).OrgID,
+		DashboardUID: req.DashboardUID,
+		Endpoint:     endpoint,
+		Model:        req.Model,
+		Messages:     req.Messages,
+	}
+	if user := backend.UserFromContext(ctx); user != nil {
+		entry.User = user.Login
+	}
+	return entry
+}
+
+func orDefault(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// orDefaultString returns the first non-empty value.
+func orDefaultString(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// write redacts and appends an entry. A nil audit log discards it. The file
+// is synced after every entry, so that entries survive a crash.
+func (a *auditLog) write(entry auditEntry, response string) {
+	if a == nil {
+		return
+	}
+	a.redact(&entry, response)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.DefaultLogger.Error("Failed to encode audit entry", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.rotateIfNeeded(int64(len(line))); err != nil {
+		log.DefaultLogger.Error("Failed to rotate audit log", "error", err)
+		return
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		log.DefaultLogger.Error("Failed to write audit entry", "error", err)
+	}
+}
+
+// redact fills in the prompt and response according to the redaction level.
+func (a *auditLog) redact(entry *auditEntry, response string) {
+	entry.Redaction = a.redaction
+	switch a.redaction {
+	case auditRedactionNone:
+		entry.Response = response
+	case auditRedactionHash:
+		prompt, _ := json.Marshal(entry.Messages)
+		entry.PromptHash = sha256Hex(prompt)
+		if response != "" {
+			entry.ResponseHash = sha256Hex([]byte(response))
+		}
+		entry.Messages = nil
+	default:
+		entry.Messages = nil
+	}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// rotateIfNeeded opens a new file if there is none, or if the current one
+// would exceed its limits. Must be called with a.mu held.
+func (a *auditLog) rotateIfNeeded(next int64) error {
+	now := a.nowFunc()
+	if a.file != nil && a.size+next <= a.maxSize && now.Sub(a.opened) < a.maxAge {
+		return nil
+	}
+	if a.file != nil {
+		if err := a.file.Close(); err != nil {
+			log.DefaultLogger.Warn("Failed to close audit file", "error", err)
+		}
+		a.file = nil
+	}
+
+	name := filepath.Join(a.dir, fmt.Sprintf("audit-%s.jsonl", now.UTC().Format("20060102T150405.000000000")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	a.file, a.size, a.opened = file, 0, now
+
+	a.deleteExpired(now)
+	return nil
+}
+
+// deleteExpired removes files that were last written before the retention
+// period. Must be called with a.mu held.
+func (a *auditLog) deleteExpired(now time.Time) {
+	files, err := a.files()
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to list audit files", "error", err)
+		return
+	}
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil || a.file != nil && name == a.file.Name() {
+			continue
+		}
+		if now.Sub(info.ModTime()) > a.retention {
+			if err := os.Remove(name); err != nil {
+				log.DefaultLogger.Warn("Failed to delete expired audit file", "file", name, "error", err)
+			}
+		}
+	}
+}
+
+// files returns the audit files, oldest first.
+func (a *auditLog) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(a.dir, "audit-*.jsonl"))
+	sort.Strings(files)
+	return files, err
+}
+
+// close closes the current file.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// auditFilter selects entries in search.
+type auditFilter struct {
+	orgID     int64
+	user      string
+	dashboard string
+	model     string
+	text      string
+	from, to  time.Time
+	limit     int
+}
+
+func (f auditFilter) matches(entry auditEntry) bool {
+	if entry.OrgID != f.orgID || entry.Time.Before(f.from) || !entry.Time.Before(f.to) {
+		return false
+	}
+	if f.user != "" && entry.User != f.user || f.dashboard != "" && entry.DashboardUID != f.dashboard || f.model != "" && entry.Model != f.model {
+		return false
+	}
+	if f.text == "" {
+		return true
+	}
+	text := strings.ToLower(f.text)
+	if strings.Contains(strings.ToLower(entry.Response), text) {
+		return true
+	}
+	for _, msg := range entry.Messages {
+		if strings.Contains(strings.ToLower(msg.Content), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// search returns the newest entries matching filter, newest first. Only
+// the file list is taken under a.mu, so that searches don't hold up
+// writes; a file deleted in the meantime is skipped, and a line still being
+// written is skipped by readAuditFile.
+func (a *auditLog) search(filter auditFilter) ([]auditEntry, error) {
+	a.mu.Lock()
+	files, err := a.files()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []auditEntry
+	for i := len(files) - 1; i >= 0 && len(result) < filter.limit; i-- {
+		entries, err := readAuditFile(files[i])
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for j := len(entries) - 1; j >= 0 && len(result) < filter.limit; j-- {
+			if filter.matches(entries[j]) {
+				result = append(result, entries[j])
+			}
+		}
+	}
+	return result, nil
+}
+
+// readAuditFile reads all entries of a file. Lines that can't be decoded, e.g.
+// one cut short by a crash, are skipped.
+func readAuditFile(name string) ([]auditEntry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// handleAudit searches the audit log of the caller's organization. Only
+// organization admins may use it.
+//
+// Query parameters: user, dashboard, model, q (text in prompts or
+// responses, only with redaction "none"), from and to (RFC 3339; default the
+// last 7 days) and limit (default 100).
+func (ds *Datasource) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isOrgAdmin(backend.UserFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if ds.audit == nil {
+		http.Error(w, "Audit log not configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditFilter{
+		orgID:     backend.PluginConfigFromContext(r.Context()).OrgID,
+		user:      query.Get("user"),
+		dashboard: query.Get("dashboard"),
+		model:     query.Get("model"),
+		text:      query.Get("q"),
+		to:        time.Now(),
+		limit:     100,
+	}
+	filter.from = filter.to.Add(-7 * 24 * time.Hour)
+
+	for name, target := range map[string]*time.Time{"from": &filter.from, "to": &filter.to} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditSearchResults {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.limit = limit
+	}
+
+	entries, err := ds.audit.search(filter)
+	if err != nil {
+		log.DefaultLogger.Error("Failed to search audit log", "error", err)
+		http.Error(w, "Failed to search audit log", http.StatusInternalServerError)
+		return
+	}
+
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"entries": entries}); err != nil {
+		log.DefaultLogger.Error("Failed to encode audit response", "error", err)
+	}
+}
@@ -0,0 +1,196 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func newTestAuditEntry(user, prompt string) auditEntry {
+	return auditEntry{
+		Time:     time.Now(),
+		User:     user,
+		OrgID:    1,
+		Endpoint: "groq-chat",
+		Model:    "llama-3.3-70b-versatile",
+		Status:   http.StatusOK,
+		Messages: []chatMessage{{Role: "user", Content: prompt}},
+	}
+}
+
+func TestAuditRedaction(t *testing.T) {
+	testCases := []struct {
+		redaction    string
+		wantMessages bool
+		wantHash     bool
+		wantResponse bool
+	}{
+		{redaction: auditRedactionNone, wantMessages: true, wantResponse: true},
+		{redaction: auditRedactionHash, wantHash: true},
+		{redaction: auditRedactionOmit},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.redaction, func(t *testing.T) {
+			audit, err := newAuditLog(t.TempDir(), auditConfig{Redaction: tc.redaction})
+			if err != nil {
+				t.Fatalf("Failed to create audit log: %v", err)
+			}
+			defer audit.close()
+
+			audit.write(newTestAuditEntry("alice", "secret question"), "secret answer")
+
+			files, _ := audit.files()
+			entries, err := readAuditFile(files[0])
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("Expected 1 entry, got %d (%v)", len(entries), err)
+			}
+			entry := entries[0]
+			if entry.Redaction != tc.redaction || entry.User != "alice" {
+				t.Errorf("Unexpected metadata: %+v", entry)
+			}
+			if (len(entry.Messages) > 0) != tc.wantMessages || (entry.Response != "") != tc.wantResponse {
+				t.Errorf("Unexpected content for redaction %s: %+v", tc.redaction, entry)
+			}
+			if (entry.PromptHash != "") != tc.wantHash || (entry.ResponseHash != "") != tc.wantHash {
+				t.Errorf("Unexpected hashes for redaction %s: %+v", tc.redaction, entry)
+			}
+		})
+	}
+
+	if _, err := newAuditLog(t.TempDir(), auditConfig{Redaction: "some"}); err == nil {
+		t.Error("Expected an error for an unknown redaction level")
+	}
+}
+
+func TestNewDatasourceAuditDirectory(t *testing.T) {
+	// A file where the data directory should be can't hold the audit log,
+	// which disables auditing instead of failing the plugin.
+	dataDir := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(dataDir, nil, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envDataDir, dataDir)
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{})
+	if err != nil {
+		t.Fatalf("Expected the plugin to start without the audit log, got %v", err)
+	}
+	if ds := instance.(*Datasource); ds.audit != nil {
+		t.Errorf("Expected the audit log to be disabled, got %+v", ds.audit)
+	}
+	if ds := instance.(*Datasource); ds.usage == nil || ds.usage.dir != "" {
+		t.Errorf("Expected usage to be kept in memory, got %+v", ds.usage)
+	}
+
+	t.Setenv(envAuditRedaction, "some")
+	if _, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{}); err == nil || !strings.Contains(err.Error(), "redaction") {
+		t.Errorf("Expected an error for an unknown redaction level, got %v", err)
+	}
+}
+
+func TestAuditRotationAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	expired := filepath.Join(dir, "audit-20000101T000000.000000000.jsonl")
+	if err := os.WriteFile(expired, []byte("{}\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(expired, old, old)
+
+	audit, err := newAuditLog(dir, auditConfig{RetentionDays: 1, MaxFileMB: 1, RotateHours: 1})
+	if err != nil {
+		t.Fatalf("Failed to create audit log: %v", err)
+	}
+	defer audit.close()
+	now := time.Now()
+	audit.nowFunc = func() time.Time { return now }
+
+	audit.write(newTestAuditEntry("alice", "first"), "")
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Error("Expected expired audit file to be deleted")
+	}
+
+	// Rotate by age
+	now = now.Add(2 * time.Hour)
+	audit.write(newTestAuditEntry("alice", "second"), "")
+
+	// Rotate by size
+	now = now.Add(time.Second)
+	audit.size = audit.maxSize
+	audit.write(newTestAuditEntry("alice", "third"), "")
+
+	files, _ := audit.files()
+	if len(files) != 3 {
+		t.Errorf("Expected 3 audit files after two rotations, got %d", len(files))
+	}
+}
+
+func TestHandleAudit(t *testing.T) {
+	audit, err := newAuditLog(t.TempDir(), auditConfig{Redaction: auditRedactionNone})
+	if err != nil {
+		t.Fatalf("Failed to create audit log: %v", err)
+	}
+	defer audit.close()
+	audit.write(newTestAuditEntry("alice", "what is the CPU usage?"), "It is high.")
+	audit.write(newTestAuditEntry("bob", "what about memory?"), "It is fine.")
+	other := newTestAuditEntry("carol", "cpu in another org")
+	other.OrgID = 2
+	audit.write(other, "")
+
+	ds := &Datasource{audit: audit}
+
+	testCases := []struct {
+		name           string
+		role           string
+		query          string
+		expectedStatus int
+		expectedUsers  []string
+	}{
+		{name: "viewer is forbidden", role: "Viewer", expectedStatus: http.StatusForbidden},
+		{name: "all entries of the org, newest first", role: "Admin", expectedStatus: http.StatusOK, expectedUsers: []string{"bob", "alice"}},
+		{name: "filter by user", role: "Admin", query: "?user=alice", expectedStatus: http.StatusOK, expectedUsers: []string{"alice"}},
+		{name: "search text", role: "Admin", query: "?q=cpu", expectedStatus: http.StatusOK, expectedUsers: []string{"alice"}},
+		{name: "limit", role: "Admin", query: "?limit=1", expectedStatus: http.StatusOK, expectedUsers: []string{"bob"}},
+		{name: "invalid limit", role: "Admin", query: "?limit=0", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/audit"+tc.query, nil)
+			ctx := backend.WithUser(req.Context(), &backend.User{Login: "admin", Role: tc.role})
+			ctx = backend.WithPluginContext(ctx, backend.PluginContext{OrgID: 1})
+			rr := httptest.NewRecorder()
+			ds.handleAudit(rr, req.WithContext(ctx))
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Entries []auditEntry `json:"entries"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(resp.Entries) != len(tc.expectedUsers) {
+				t.Fatalf("Expected %d entries, got %d", len(tc.expectedUsers), len(resp.Entries))
+			}
+			for i, user := range tc.expectedUsers {
+				if resp.Entries[i].User != user {
+					t.Errorf("Expected entry %d from %s, got %s", i, user, resp.Entries[i].User)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// keepRecentMessages is how many of the latest messages are kept before
+// panels of the dashboard context are dropped.
+const keepRecentMessages = 4
+
+// contextBudget reports how a chat request was fitted into the model's
+// context window. It is added to the chat response as "budget".
+type contextBudget struct {
+	ContextWindow int `json:"contextWindow"`
+	PromptTokens  int `json:"estimatedPromptTokens"`
+
+	// Trimmed lists the parts of the dashboard context that were left out,
+	// "points" and "breakdowns".
+	Trimmed         []string `json:"trimmed,omitempty"`
+	DroppedPanels   []int64  `json:"droppedPanels,omitempty"`
+	DroppedMessages int      `json:"droppedMessages,omitempty"`
+}
+
+// fitContextWindow trims a conversation and its dashboard context until the
+// estimated prompt leaves room for the answer in the model's context window.
+// In order, it drops downsampled points and label breakdowns, older turns
+// down to the last keepRecentMessages, the least useful panels and finally
+// all but the last message. The returned messages start with the system
+// message built from dc, if any; the client's must have been removed.
+func (ds *Datasource) fitContextWindow(ctx context.Context, model string, dc *dashboardContext, messages []chatMessage) ([]chatMessage, *contextBudget, *requestError) {
+	_, span := startSpan(ctx, "chat.budget")
+	defer span.End()
+
+	family := familyOf(model)
+	budget := &contextBudget{ContextWindow: ds.contextWindow(model)}
+	limit := promptTokenLimit(budget.ContextWindow)
+
+	tokens := make([]int, len(messages))
+	for i, msg := range messages {
+		tokens[i] = family.messageOverhead + family.estimateTokens(msg.Content)
+	}
+	systemTokens := 0
+	estimateSystem := func() {
+		if dc != nil {
+			systemTokens = family.messageOverhead + family.estimateTokens(dc.prompt())
+		}
+	}
+	estimateSystem()
+
+	fits := func() bool {
+		budget.PromptTokens = replyPrimingTokens + systemTokens
+		for _, t := range tokens {
+			budget.PromptTokens += t
+		}
+		return budget.PromptTokens <= limit
+	}
+
+	// dropOldest drops the oldest message that isn't a system message, as
+	// long as more than keep of them remain.
+	dropOldest := func(keep int) bool {
+		first, count := -1, 0
+		for i, msg := range messages {
+			if msg.Role != "system" {
+				if first < 0 {
+					first = i
+				}
+				count++
+			}
+		}
+		if count <= keep {
+			return false
+		}
+		messages = append(messages[:first:first], messages[first+1:]...)
+		tokens = append(tokens[:first:first], tokens[first+1:]...)
+		budget.DroppedMessages++
+		return true
+	}
+
+	trimContext := func(trim func() bool, name string) bool {
+		if dc == nil || !trim() {
+			return false
+		}
+		if name != "" {
+			budget.Trimmed = append(budget.Trimmed, name)
+		}
+		estimateSystem()
+		return true
+	}
+
+	steps := []func() bool{
+		func() bool { return trimContext(dc.dropPoints, "points") },
+		func() bool { return trimContext(dc.dropBreakdowns, "breakdowns") },
+		func() bool { return dropOldest(keepRecentMessages) },
+		func() bool {
+			return trimContext(func() bool {
+				id, ok := dc.dropLeastUsefulPanel()
+				if ok {
+					budget.DroppedPanels = append(budget.DroppedPanels, id)
+				}
+				return ok
+			}, "")
+		},
+		func() bool { return dropOldest(1) },
+	}
+
+	for !fits() {
+		trimmed := false
+		for _, step := range steps {
+			if step() {
+				trimmed = true
+				break
+			}
+		}
+		if !trimmed {
+			span.SetAttributes(attribute.Int(attrEstimatedTokens, budget.PromptTokens), attribute.Int(attrContextWindow, budget.ContextWindow))
+			log.DefaultLogger.Warn("Conversation exceeds the context window", "model", model, "estimated_tokens", budget.PromptTokens, "context_window", budget.ContextWindow)
+			return nil, nil, spanError(span, &requestError{status: http.StatusBadRequest, code: errCodeContextTooLong, message: "Conversation too long for the model's context window"})
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int(attrEstimatedTokens, budget.PromptTokens),
+		attribute.Int(attrContextWindow, budget.ContextWindow),
+		attribute.Int(attrDroppedMessages, budget.DroppedMessages),
+		attribute.Int(attrDroppedPanels, len(budget.DroppedPanels)),
+	)
+	if dc != nil {
+		messages = append([]chatMessage{{Role: "system", Content: dc.prompt()}}, messages...)
+	}
+	return messages, budget, nil
+}
+
+// dropPoints leaves the downsampled points out of the context and reports
+// whether there were any.
+func (dc *dashboardContext) dropPoints() bool {
+	dropped := false
+	for i := range dc.Panels {
+		for j := range dc.Panels[i].Summaries {
+			if len(dc.Panels[i].Summaries[j].Points) > 0 {
+				dc.Panels[i].Summaries[j].Points = nil
+				dropped = true
+			}
+		}
+	}
+	return dropped
+}
+
+// dropBreakdowns leaves the label breakdowns out of the context and reports
+// whether there were any.
+func (dc *dashboardContext) dropBreakdowns() bool {
+	dropped := false
+	for i := range dc.Panels {
+		if len(dc.Panels[i].Breakdowns) > 0 {
+			dc.Panels[i].Breakdowns = nil
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// dropLeastUsefulPanel removes the panel that contributes the least to the
+// context: panels without data first, panels with anomalies, change points,
+// new and rising log patterns or failed spans last. Among equals, the panel
+// furthest down the dashboard goes first.
+func (dc *dashboardContext) dropLeastUsefulPanel() (int64, bool) {
+	if len(dc.Panels) == 0 {
+		return 0, false
+	}
+	drop := 0
+	for i := range dc.Panels {
+		if panelPriority(&dc.Panels[i]) <= panelPriority(&dc.Panels[drop]) {
+			drop = i
+		}
+	}
+	id := dc.Panels[drop].ID
+	dc.Panels = append(dc.Panels[:drop:drop], dc.Panels[drop+1:]...)
+	return id, true
+}
+
+func panelPriority(panel *panelContext) int {
+	if panel.Error != "" || len(panel.Summaries) == 0 && len(panel.Breakdowns) == 0 && panel.Logs == nil && len(panel.Traces) == 0 {
+		return 0
+	}
+	if len(panel.Findings) > 0 {
+		return 2
+	}
+	for _, t := range panel.Traces {
+		if t.ErrorCount > 0 {
+			return 2
+		}
+	}
+	if panel.Logs != nil {
+		for _, p := range panel.Logs.Patterns {
+			if p.New || p.Rising {
+				return 2
+			}
+		}
+	}
+	for _, s := range panel.Summaries {
+		if len(s.ChangePoints) > 0 {
+			return 2
+		}
+	}
+	return 1
+}
+
+// withField adds a top-level field to a chat response, e.g. the budget.
+// Responses that aren't JSON objects are returned unchanged.
+func withField(respBody []byte, name string, value any) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(respBody, &fields); err != nil || fields == nil {
+		return respBody
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return respBody
+	}
+	fields[name] = encoded
+	result, err := json.Marshal(fields)
+	if err != nil {
+		return respBody
+	}
+	return result
+}
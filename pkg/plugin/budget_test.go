@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// newBudgetTestContext returns a dashboard context with a panel without data,
+// one with points and breakdowns, and one with a change point.
+func newBudgetTestContext() *dashboardContext {
+	points := make([]seriesPoint, 200)
+	for i := range points {
+		points[i] = seriesPoint{Time: testTimes(1)[0], Value: float64(i)}
+	}
+	return &dashboardContext{
+		UID: "dash-1", Title: "Checkout", Summary: summaryConfig{Detail: detailStandard},
+		Panels: []panelContext{
+			{ID: 1, Title: "Errors", Error: "query failed"},
+			{ID: 2, Title: "Latency", Summaries: []seriesSummary{{Name: "p99", Count: 200, Points: points}},
+				Breakdowns: []labelBreakdown{{Label: "pod", Values: []labelShare{{Value: "a", Mean: 1, Share: 1}}}}},
+			{ID: 3, Title: "Traffic", Summaries: []seriesSummary{{Name: "rps", Count: 200, ChangePoints: []changePoint{{Time: testTimes(1)[0], Before: 1, After: 5}}}}},
+		},
+	}
+}
+
+func TestFitContextWindow(t *testing.T) {
+	turns := func(n, size int) []chatMessage {
+		messages := make([]chatMessage, n)
+		for i := range messages {
+			role := "user"
+			if i%2 == 1 {
+				role = "assistant"
+			}
+			messages[i] = chatMessage{Role: role, Content: strings.Repeat("word ", size)}
+		}
+		return messages
+	}
+
+	testCases := []struct {
+		name            string
+		window          int
+		context         bool
+		messages        []chatMessage
+		expectedError   bool
+		expectedTrimmed []string
+		expectedPanels  []int64
+		expectedDropped int
+	}{
+		{name: "fits", window: 8192, context: true, messages: turns(3, 10)},
+		{name: "points first", window: 1200, context: true, messages: turns(3, 10), expectedTrimmed: []string{"points"}},
+		{name: "older turns before panels", window: 1200, context: true, messages: turns(8, 70), expectedTrimmed: []string{"points", "breakdowns"}, expectedDropped: 4},
+		{name: "panels without data first", window: 1000, context: true, messages: turns(4, 60), expectedTrimmed: []string{"points", "breakdowns"}, expectedPanels: []int64{1}},
+		{name: "last message kept", window: 800, messages: turns(6, 200), expectedDropped: 5},
+		{name: "too long", window: 400, messages: turns(1, 1000), expectedError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := &Datasource{config: pluginConfig{ContextWindows: map[string]int{"test-model": tc.window}}}
+			var dc *dashboardContext
+			if tc.context {
+				dc = newBudgetTestContext()
+			}
+
+			messages, budget, reqErr := ds.fitContextWindow(t.Context(), "test-model", dc, tc.messages)
+			if tc.expectedError {
+				if reqErr == nil || reqErr.status != http.StatusBadRequest || reqErr.code != errCodeContextTooLong {
+					t.Fatalf("Expected a context_too_long error, got %v", reqErr)
+				}
+				return
+			}
+			if reqErr != nil {
+				t.Fatalf("Unexpected error: %v", reqErr)
+			}
+
+			if budget.PromptTokens > tc.window || budget.PromptTokens != familyOf("test-model").estimateMessages(messages) {
+				t.Errorf("Expected the estimate of the sent messages within %d tokens, got %d", tc.window, budget.PromptTokens)
+			}
+			if strings.Join(budget.Trimmed, ",") != strings.Join(tc.expectedTrimmed, ",") {
+				t.Errorf("Expected trimmed %v, got %v", tc.expectedTrimmed, budget.Trimmed)
+			}
+			if len(budget.DroppedPanels) != len(tc.expectedPanels) || len(tc.expectedPanels) > 0 && budget.DroppedPanels[0] != tc.expectedPanels[0] {
+				t.Errorf("Expected dropped panels %v, got %v", tc.expectedPanels, budget.DroppedPanels)
+			}
+			if budget.DroppedMessages != tc.expectedDropped {
+				t.Errorf("Expected %d dropped messages, got %d", tc.expectedDropped, budget.DroppedMessages)
+			}
+			if last := messages[len(messages)-1]; last != tc.messages[len(tc.messages)-1] {
+				t.Errorf("Expected the last message to be kept, got %+v", last)
+			}
+			if tc.context && messages[0].Role != "system" {
+				t.Errorf("Expected the system context first, got %+v", messages[0])
+			}
+		})
+	}
+}
+
+func TestDropLeastUsefulPanel(t *testing.T) {
+	dc := newBudgetTestContext()
+	dc.Panels = append(dc.Panels, panelContext{ID: 4, Title: "Saturation", Summaries: []seriesSummary{{Name: "cpu"}}},
+		panelContext{ID: 5, Title: "Logs", Logs: &logSummary{Patterns: []logPattern{{Template: "request done"}}}},
+		panelContext{ID: 6, Title: "Errors", Logs: &logSummary{Patterns: []logPattern{{Template: "request done"}, {Template: "timeout after <*>", Rising: true}}}},
+		panelContext{ID: 7, Title: "Traces", Traces: []traceSummary{{TraceID: "a"}}},
+		panelContext{ID: 8, Title: "Failed traces", Traces: []traceSummary{{TraceID: "b", ErrorCount: 1}}})
+
+	var order []int64
+	for {
+		id, ok := dc.dropLeastUsefulPanel()
+		if !ok {
+			break
+		}
+		order = append(order, id)
+	}
+	if !slices.Equal(order, []int64{1, 7, 5, 4, 2, 8, 6, 3}) {
+		t.Errorf("Expected panels dropped in the order 1, 7, 5, 4, 2, 8, 6, 3, got %v", order)
+	}
+}
+
+func TestChatBudgetMetadata(t *testing.T) {
+	globalRateLimiter.reset()
+
+	groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer groq.Close()
+
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		groqURL:  groq.URL,
+	}
+
+	testCases := []struct {
+		name           string
+		content        string
+		expectedStatus int
+	}{
+		{name: "fits", content: "hello", expectedStatus: http.StatusOK},
+		{name: "too long", content: strings.Repeat("x ", 4999), expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ds.config.ContextWindows = map[string]int{"llama-3.3-70b-versatile": 4096}
+			content, _ := json.Marshal(tc.content)
+			body := `{"model":"llama-3.3-70b-versatile","messages":[{"role":"user","content":` + string(content) + `}]}`
+			req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleGroqChat(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Choices []json.RawMessage `json:"choices"`
+				Budget  contextBudget     `json:"budget"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(resp.Choices) != 1 || resp.Budget.ContextWindow != 4096 || resp.Budget.PromptTokens == 0 {
+				t.Errorf("Expected the Groq response with budget metadata, got %+v", resp)
+			}
+		})
+	}
+}
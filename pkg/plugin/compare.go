@@ -0,0 +1,317 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// minSignificantChange is the change of the mean or max of a series, in
+	// percent, that makes it significant.
+	minSignificantChange = 10
+
+	// maxContextDeltas bounds the series changes listed in the prompt.
+	maxContextDeltas = 20
+
+	// maxDefaultBaselineShift is how far back the baseline is by default:
+	// the same range a week earlier, which keeps daily and weekly patterns
+	// aligned. Longer ranges are compared with the preceding range.
+	maxDefaultBaselineShift = 7 * 24 * time.Hour
+)
+
+// Statuses of a series in a comparison.
+const (
+	deltaChanged   = "changed"
+	deltaUnchanged = "unchanged"
+	deltaNew       = "new"
+	deltaGone      = "gone"
+)
+
+const compareInstructions = `You compare a Grafana dashboard between two time ranges for an engineer.
+The changes of each series between the baseline and the current range were computed from the panel data of both ranges and are listed below.
+Explain the significant differences: what changed, by how much, and how the changes relate to each other. Point out plausible causes the panels suggest, and say so if nothing changed significantly.
+Answer in Markdown, in at most three short paragraphs or a list. Base the answer only on the data below. Don't invent values.`
+
+// comparison holds the changes of the panel data from a baseline range to
+// the range of the context.
+type comparison struct {
+	BaselineFrom time.Time     `json:"baselineFrom"`
+	BaselineTo   time.Time     `json:"baselineTo"`
+	Deltas       []seriesDelta `json:"deltas"`
+}
+
+// seriesDelta is the change of a series. Mean, Max and Last are only set for
+// series found in both ranges.
+type seriesDelta struct {
+	PanelID     int64        `json:"panelId"`
+	PanelTitle  string       `json:"panelTitle"`
+	Series      string       `json:"series"`
+	Status      string       `json:"status"`
+	Significant bool         `json:"significant"`
+	Mean        *metricDelta `json:"mean,omitempty"`
+	Max         *metricDelta `json:"max,omitempty"`
+	Last        *metricDelta `json:"last,omitempty"`
+}
+
+// metricDelta is the change of a statistic of a series. Percent is unset if
+// the baseline is zero.
+type metricDelta struct {
+	Current  float64  `json:"current"`
+	Baseline float64  `json:"baseline"`
+	Delta    float64  `json:"delta"`
+	Percent  *float64 `json:"percent,omitempty"`
+}
+
+func newMetricDelta(current, baseline float64) *metricDelta {
+	d := &metricDelta{Current: current, Baseline: baseline, Delta: current - baseline}
+	if baseline != 0 {
+		percent := d.Delta / math.Abs(baseline) * 100
+		d.Percent = &percent
+	}
+	return d
+}
+
+// significant reports whether the statistic changed by at least
+// minSignificantChange percent, or at all from a zero baseline.
+func (d *metricDelta) significant() bool {
+	if d.Percent == nil {
+		return !nearlyEqual(d.Current, 0)
+	}
+	return math.Abs(*d.Percent) >= minSignificantChange
+}
+
+// magnitude orders deltas; changes from a zero baseline come first.
+func (d *seriesDelta) magnitude() float64 {
+	if d.Mean == nil {
+		return math.Inf(1)
+	}
+	m := 0.0
+	for _, md := range []*metricDelta{d.Mean, d.Max} {
+		if md.Percent == nil {
+			if !nearlyEqual(md.Current, 0) {
+				return math.Inf(1)
+			}
+			continue
+		}
+		m = max(m, math.Abs(*md.Percent))
+	}
+	return m
+}
+
+// compareContexts matches the series of the panels of current and baseline by
+// name and computes their changes, significant ones first. Panels whose
+// queries failed in either range are left out. Series are only reported new
+// or gone if neither range left series out of its summaries.
+func compareContexts(current, baseline *dashboardContext) *comparison {
+	c := &comparison{BaselineFrom: baseline.From, BaselineTo: baseline.To, Deltas: []seriesDelta{}}
+	baselinePanels := make(map[int64]*panelContext, len(baseline.Panels))
+	for i := range baseline.Panels {
+		baselinePanels[baseline.Panels[i].ID] = &baseline.Panels[i]
+	}
+
+	for _, panel := range current.Panels {
+		base := baselinePanels[panel.ID]
+		if base == nil || panel.Error != "" || base.Error != "" {
+			continue
+		}
+		complete := panel.SeriesCount == len(panel.Summaries) && base.SeriesCount == len(base.Summaries)
+		baseSeries := make(map[string]seriesSummary, len(base.Summaries))
+		for _, s := range base.Summaries {
+			baseSeries[s.Name] = s
+		}
+
+		for _, s := range panel.Summaries {
+			delta := seriesDelta{PanelID: panel.ID, PanelTitle: panel.Title, Series: s.Name}
+			b, ok := baseSeries[s.Name]
+			delete(baseSeries, s.Name)
+			switch {
+			case ok:
+				delta.Mean = newMetricDelta(s.Mean, b.Mean)
+				delta.Max = newMetricDelta(s.Max, b.Max)
+				delta.Last = newMetricDelta(s.Last, b.Last)
+				delta.Significant = delta.Mean.significant() || delta.Max.significant()
+				delta.Status = deltaUnchanged
+				if delta.Significant {
+					delta.Status = deltaChanged
+				}
+			case complete:
+				delta.Status, delta.Significant = deltaNew, true
+			default:
+				continue
+			}
+			c.Deltas = append(c.Deltas, delta)
+		}
+
+		if complete {
+			gone := make([]string, 0, len(baseSeries))
+			for name := range baseSeries {
+				gone = append(gone, name)
+			}
+			sort.Strings(gone)
+			for _, name := range gone {
+				c.Deltas = append(c.Deltas, seriesDelta{PanelID: panel.ID, PanelTitle: panel.Title, Series: name, Status: deltaGone, Significant: true})
+			}
+		}
+	}
+
+	sort.SliceStable(c.Deltas, func(i, j int) bool {
+		a, b := &c.Deltas[i], &c.Deltas[j]
+		if a.Significant != b.Significant {
+			return a.Significant
+		}
+		return a.magnitude() > b.magnitude()
+	})
+	return c
+}
+
+// writeComparison writes the significant changes of a comparison to the
+// prompt, largest first.
+func writeComparison(b *strings.Builder, c *comparison) {
+	if c == nil {
+		return
+	}
+	fmt.Fprintf(b, "\nComparison with the baseline range %s to %s, series whose mean or max changed by at least %d%%, largest change first:\n",
+		c.BaselineFrom.Format(time.RFC3339), c.BaselineTo.Format(time.RFC3339), minSignificantChange)
+
+	listed, unchanged := 0, 0
+	for _, d := range c.Deltas {
+		if !d.Significant {
+			unchanged++
+			continue
+		}
+		if listed == maxContextDeltas {
+			continue
+		}
+		listed++
+		fmt.Fprintf(b, "- Panel %d %q, series %s: ", d.PanelID, d.PanelTitle, truncate(d.Series, maxContextTitle))
+		switch d.Status {
+		case deltaNew:
+			b.WriteString("new, not in the baseline\n")
+		case deltaGone:
+			b.WriteString("in the baseline, no longer reported\n")
+		default:
+			fmt.Fprintf(b, "mean %s, max %s, last %s\n", d.Mean, d.Max, d.Last)
+		}
+	}
+	if significant := len(c.Deltas) - unchanged; significant > listed {
+		fmt.Fprintf(b, "%d further series changed significantly.\n", significant-listed)
+	}
+	if listed == 0 {
+		b.WriteString("No series changed significantly.\n")
+	}
+	if unchanged > 0 {
+		fmt.Fprintf(b, "%d series changed by less than %d%%.\n", unchanged, minSignificantChange)
+	}
+}
+
+// String renders the change as "12.5 vs. 10 (+25.0%)".
+func (d *metricDelta) String() string {
+	s := formatNumber(d.Current) + " vs. " + formatNumber(d.Baseline)
+	if d.Percent != nil {
+		s += fmt.Sprintf(" (%+.1f%%)", *d.Percent)
+	}
+	return s
+}
+
+// defaultBaseline returns the range a comparison of from to to is made
+// against if the request doesn't name one. Times are Unix milliseconds.
+func defaultBaseline(from, to int64) (int64, int64) {
+	shift := max(time.Duration(to-from)*time.Millisecond, maxDefaultBaselineShift).Milliseconds()
+	return from - shift, to - shift
+}
+
+// compareRequest is the body accepted by /compare. Times are Unix
+// milliseconds. The baseline defaults to the same range a week earlier.
+type compareRequest struct {
+	Model        string  `json:"model"`
+	DashboardUID string  `json:"dashboardUid"`
+	From         int64   `json:"from"`
+	To           int64   `json:"to"`
+	BaselineFrom int64   `json:"baselineFrom"`
+	BaselineTo   int64   `json:"baselineTo"`
+	PanelIDs     []int64 `json:"panelIds,omitempty"`
+
+	// Question is asked about the comparison instead of a general one.
+	Question string `json:"question,omitempty"`
+}
+
+// handleCompare compares the panels of a dashboard between two time ranges
+// and has the model explain the significant changes.
+func (ds *Datasource) handleCompare(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "compare.handle")
+	defer span.End()
+
+	apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req compareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	req.Model = orDefaultString(req.Model, defaultChatModel)
+	if !validModel(req.Model) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+		return
+	}
+	if len(req.Question) > 10000 { // Same limit as chat messages
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeContentTooLong, message: "Question too long"})
+		return
+	}
+	if req.BaselineFrom == 0 && req.BaselineTo == 0 {
+		req.BaselineFrom, req.BaselineTo = defaultBaseline(req.From, req.To)
+	}
+	contextReq := contextRequest{DashboardUID: req.DashboardUID, From: req.From, To: req.To, PanelIDs: req.PanelIDs, CompareFrom: req.BaselineFrom, CompareTo: req.BaselineTo}
+	if reqErr := contextReq.validate(); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	span.SetAttributes(attribute.String(attrModel, req.Model))
+
+	dc, reqErr := ds.loadDashboardContext(ctx, r, contextReq)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	dc.Instructions = compareInstructions
+
+	question := orDefaultString(req.Question, "How does the current range compare to the baseline?")
+	messages, budget, reqErr := ds.fitContextWindow(ctx, req.Model, dc, []chatMessage{{Role: "user", Content: question}})
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	chatReq := &chatRequest{Model: req.Model, Messages: messages, DashboardUID: req.DashboardUID}
+	explanation, _, reqErr := ds.complete(ctx, apiKey, "compare", chatReq, nil)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Compared dashboard", "dashboard", req.DashboardUID, "series", len(dc.Comparison.Deltas))
+
+	writeJSON(w, map[string]any{
+		"dashboardUid": dc.UID,
+		"title":        dc.Title,
+		"from":         dc.From,
+		"to":           dc.To,
+		"baselineFrom": dc.Comparison.BaselineFrom,
+		"baselineTo":   dc.Comparison.BaselineTo,
+		"deltas":       dc.Comparison.Deltas,
+		"explanation":  explanation,
+		"budget":       budget,
+	})
+}
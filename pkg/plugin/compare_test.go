@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestCompareContexts(t *testing.T) {
+	series := func(name string, mean, max float64) seriesSummary {
+		return seriesSummary{Name: name, Mean: mean, Max: max, Last: mean}
+	}
+	panel := func(id int64, summaries ...seriesSummary) panelContext {
+		return panelContext{ID: id, Title: "Panel", Summaries: summaries, SeriesCount: len(summaries)}
+	}
+	current := &dashboardContext{Panels: []panelContext{
+		panel(1, series("A", 150, 200), series("B", 10, 20), series("C", 5, 5), series("E", 3, 3)),
+		{ID: 2, Title: "Failing", Error: "Query failed"},
+		{ID: 3, Title: "Truncated", Summaries: []seriesSummary{series("X", 1, 1)}, SeriesCount: 30},
+	}}
+	baseline := &dashboardContext{From: time.UnixMilli(1), To: time.UnixMilli(2), Panels: []panelContext{
+		panel(1, series("A", 100, 150), series("B", 10.5, 20), series("D", 1, 1), series("E", 0, 0)),
+		panel(2, series("A", 1, 1)),
+		panel(3, series("Y", 1, 1)),
+	}}
+
+	c := compareContexts(current, baseline)
+
+	var got []string
+	for _, d := range c.Deltas {
+		got = append(got, d.Series+":"+d.Status)
+	}
+	// New and gone series and E, which changed from zero, sort before A's +50%
+	expected := "C:new,E:changed,D:gone,A:changed,B:unchanged"
+	if strings.Join(got, ",") != expected {
+		t.Fatalf("Expected deltas %s, got %s", expected, strings.Join(got, ","))
+	}
+	if a := c.Deltas[3]; *a.Mean.Percent != 50 || a.Mean.Delta != 50 || a.Max.String() != "200 vs. 150 (+33.3%)" {
+		t.Errorf("Unexpected delta for A: %+v", a.Mean)
+	}
+	if c.Deltas[1].Mean.Percent != nil {
+		t.Errorf("Expected no percentage from a zero baseline, got %v", *c.Deltas[1].Mean.Percent)
+	}
+
+	var b strings.Builder
+	writeComparison(&b, c)
+	for _, want := range []string{
+		"Comparison with the baseline range 1970-01-01T00:00:00Z",
+		`- Panel 1 "Panel", series A: mean 150 vs. 100 (+50.0%), max 200 vs. 150 (+33.3%), last 150 vs. 100 (+50.0%)`,
+		`- Panel 1 "Panel", series C: new, not in the baseline`,
+		`- Panel 1 "Panel", series D: in the baseline, no longer reported`,
+		"1 series changed by less than 10%.",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected prompt to contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestDefaultBaseline(t *testing.T) {
+	hour, week := time.Hour.Milliseconds(), 7*24*time.Hour.Milliseconds()
+	testCases := []struct {
+		from, to       int64
+		expFrom, expTo int64
+	}{
+		{from: 100 * week, to: 100*week + hour, expFrom: 99 * week, expTo: 99*week + hour},
+		{from: 100 * week, to: 102 * week, expFrom: 98 * week, expTo: 100 * week},
+	}
+	for _, tc := range testCases {
+		if from, to := defaultBaseline(tc.from, tc.to); from != tc.expFrom || to != tc.expTo {
+			t.Errorf("defaultBaseline(%d, %d) = %d, %d, expected %d, %d", tc.from, tc.to, from, to, tc.expFrom, tc.expTo)
+		}
+	}
+}
+
+func TestHandleCompare(t *testing.T) {
+	grafana := newTestGrafana(t, nil)
+
+	testCases := []struct {
+		name             string
+		body             string
+		expectedStatus   int
+		expectedBaseline int64
+	}{
+		{name: "default baseline", body: `{"dashboardUid":"dash-1","from":1700000000000,"to":1700003600000}`, expectedStatus: http.StatusOK, expectedBaseline: 1699395200000},
+		{name: "explicit baseline", body: `{"dashboardUid":"dash-1","from":1700000000000,"to":1700003600000,"baselineFrom":1699990000000,"baselineTo":1699993600000}`, expectedStatus: http.StatusOK, expectedBaseline: 1699990000000},
+		{name: "invalid baseline", body: `{"dashboardUid":"dash-1","from":1700000000000,"to":1700003600000,"baselineFrom":1699990000000}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid time range", body: `{"dashboardUid":"dash-1","from":2,"to":1}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var sent groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: "Nothing changed."}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest("POST", "/compare", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleCompare(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			system := sent.Messages[0].Content
+			if !strings.Contains(system, "You compare a Grafana dashboard") || !strings.Contains(system, "No series changed significantly.") {
+				t.Errorf("Expected the comparison in the prompt, got %q", system)
+			}
+
+			var resp struct {
+				BaselineFrom time.Time     `json:"baselineFrom"`
+				Deltas       []seriesDelta `json:"deltas"`
+				Explanation  string        `json:"explanation"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.BaselineFrom.UnixMilli() != tc.expectedBaseline || resp.Explanation != "Nothing changed." {
+				t.Errorf("Unexpected response: %+v", resp)
+			}
+			// The failing Postgres panel is left out
+			if len(resp.Deltas) != 1 || resp.Deltas[0].PanelID != 2 || resp.Deltas[0].Status != deltaUnchanged || *resp.Deltas[0].Mean.Percent != 0 {
+				t.Errorf("Expected an unchanged series of panel 2, got %+v", resp.Deltas)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// defaultChatModel is used by endpoints whose request doesn't name a model.
+// It matches the panel's default.
+const defaultChatModel = "llama-3.3-70b-versatile"
+
+// responseFormat selects Groq's JSON mode, in which the answer is a single
+// JSON object. The prompt must ask for JSON.
+type responseFormat struct {
+	Type string `json:"type"`
+}
+
+var jsonResponseFormat = &responseFormat{Type: "json_object"}
+
+// validModel reports whether a model name is safe to forward: alphanumeric,
+// hyphens and dots only.
+func validModel(model string) bool {
+	return model != "" && len(model) <= 50 && modelNameRegex.MatchString(model)
+}
+
+// requestClientID identifies the client of r for rate limiting.
+func requestClientID(r *http.Request) string {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		return forwardedFor
+	}
+	return r.RemoteAddr
+}
+
+// checkLLMRequest makes the checks of every endpoint that calls the LLM
+// before its body is read: a JSON POST, the rate limit shared with the chat,
+// and a configured API key, which is returned.
+func (ds *Datasource) checkLLMRequest(ctx context.Context, r *http.Request) (string, *requestError) {
+	if r.Method != http.MethodPost {
+		return "", &requestError{status: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed, message: "Method not allowed"}
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		return "", &requestError{status: http.StatusBadRequest, code: errCodeInvalidContentType, message: "Invalid Content-Type"}
+	}
+	if clientID := requestClientID(r); !checkRateLimit(ctx, clientID) {
+		log.DefaultLogger.Warn("Rate limit exceeded", "client", clientID)
+		rateLimitRejectionsTotal.Inc()
+		return "", &requestError{status: http.StatusTooManyRequests, code: errCodeRateLimited, message: "Too many requests"}
+	}
+	apiKey := ds.groqAPIKey()
+	if apiKey == "" {
+		log.DefaultLogger.Error("GROQ API key not configured - please configure through Grafana plugin settings or GROQ_API_KEY")
+		return "", &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"}
+	}
+	return apiKey, nil
+}
+
+// complete sends the messages of req to Groq and returns the answer. The
+// call is accounted and audited under endpoint.
+func (ds *Datasource) complete(ctx context.Context, apiKey, endpoint string, req *chatRequest, format *responseFormat) (string, chatUsage, *requestError) {
+	payload, err := json.Marshal(groqChatRequest{Model: req.Model, Messages: req.Messages, ResponseFormat: format})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to marshal request", "error", err)
+		return "", chatUsage{}, &requestError{status: http.StatusInternalServerError, code: errCodeInternal, message: "Failed to prepare request"}
+	}
+
+	auditEntry := newAuditEntry(ctx, endpoint, req)
+	start := time.Now()
+	respBody, reqErr := ds.callGroq(ctx, apiKey, req.Model, payload)
+	if reqErr != nil {
+		auditEntry.Status, auditEntry.ErrorCode = reqErr.status, reqErr.code
+		ds.audit.write(auditEntry, "")
+		return "", chatUsage{}, reqErr
+	}
+
+	usage, content := processChatResponse(ctx, respBody)
+	recordTokenUsage(ds.metricModel(req.Model), usage)
+	ds.usage.record(newUsageRecord(ctx, req, usage, time.Since(start)))
+
+	auditEntry.Status = http.StatusOK
+	auditEntry.PromptTokens, auditEntry.CompletionTokens = usage.PromptTokens, usage.CompletionTokens
+	ds.audit.write(auditEntry, content)
+	return strings.TrimSpace(content), usage, nil
+}
+
+// completeJSON is complete in JSON mode; the answer is decoded into out.
+func (ds *Datasource) completeJSON(ctx context.Context, apiKey, endpoint string, req *chatRequest, out any) (chatUsage, *requestError) {
+	content, usage, reqErr := ds.complete(ctx, apiKey, endpoint, req, jsonResponseFormat)
+	if reqErr != nil {
+		return usage, reqErr
+	}
+	if err := json.Unmarshal([]byte(content), out); err != nil {
+		log.DefaultLogger.Warn("Model answered with invalid JSON", "endpoint", endpoint, "model", req.Model, "error", err)
+		return usage, &requestError{status: http.StatusBadGateway, code: errCodeUpstreamError, message: "Invalid response from model"}
+	}
+	return usage, nil
+}
+
+// writeJSON sends v as the JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.DefaultLogger.Error("Failed to encode response", "error", err)
+	}
+}
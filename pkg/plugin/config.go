@@ -0,0 +1,231 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Environment variables that override the plugin's JSON settings. Like
+// GROQ_API_KEY they are the usual way to configure a local or docker setup.
+const (
+	envPricing            = "BSURE_CHATBOT_PRICING"
+	envDataDir            = "BSURE_CHATBOT_DATA_DIR"
+	envAuditRedaction     = "BSURE_CHATBOT_AUDIT_REDACTION"
+	envAuditRetentionDays = "BSURE_CHATBOT_AUDIT_RETENTION_DAYS"
+	envAuditMaxFileMB     = "BSURE_CHATBOT_AUDIT_MAX_FILE_MB"
+	envAuditRotateHours   = "BSURE_CHATBOT_AUDIT_ROTATE_HOURS"
+	envGrafanaURL         = "BSURE_CHATBOT_GRAFANA_URL"
+	envSummaryDetail      = "BSURE_CHATBOT_SUMMARY_DETAIL"
+	envSummaryTopN        = "BSURE_CHATBOT_SUMMARY_TOP_N"
+	envDownsample         = "BSURE_CHATBOT_DOWNSAMPLE"
+	envDownsamplePoints   = "BSURE_CHATBOT_DOWNSAMPLE_POINTS"
+	envContextWindows     = "BSURE_CHATBOT_CONTEXT_WINDOWS"
+	envHistoryModel       = "BSURE_CHATBOT_HISTORY_MODEL"
+	envHistoryMaxTurns    = "BSURE_CHATBOT_HISTORY_MAX_TURNS"
+	envHistoryMaxTokens   = "BSURE_CHATBOT_HISTORY_MAX_TOKENS"
+	envHistoryKeepTurns   = "BSURE_CHATBOT_HISTORY_KEEP_TURNS"
+	envAgentMaxIterations = "BSURE_CHATBOT_AGENT_MAX_ITERATIONS"
+	envAgentTimeout       = "BSURE_CHATBOT_AGENT_TIMEOUT_SECONDS"
+	envWebhookURL         = "BSURE_CHATBOT_WEBHOOK_URL"
+	envWebhookFormat      = "BSURE_CHATBOT_WEBHOOK_FORMAT"
+	envWebhookModel       = "BSURE_CHATBOT_WEBHOOK_MODEL"
+	envWebhookTimeout     = "BSURE_CHATBOT_WEBHOOK_TIMEOUT_SECONDS"
+)
+
+// pluginConfig holds the backend configuration.
+type pluginConfig struct {
+	// Pricing maps model names to their prices per million tokens. It extends
+	// and overrides defaultPricing.
+	Pricing map[string]modelPrice `json:"pricing"`
+
+	// DataDir is where the plugin keeps its files. It defaults to a directory
+	// below Grafana's data path.
+	DataDir string `json:"dataDir"`
+
+	// Audit configures the audit log of LLM exchanges.
+	Audit auditConfig `json:"audit"`
+
+	// GrafanaURL is where the backend reaches Grafana's HTTP API. It defaults
+	// to Grafana's app URL.
+	GrafanaURL string `json:"grafanaUrl"`
+
+	// Summary configures how panel data is summarized in the prompt.
+	Summary summaryConfig `json:"summary"`
+
+	// ContextWindows maps model names to their context windows in tokens. It
+	// extends and overrides defaultContextWindows.
+	ContextWindows map[string]int `json:"contextWindows"`
+
+	// History configures the summarization of long conversations.
+	History historyConfig `json:"history"`
+
+	// Agent bounds the tool calling loop of chats with tools.
+	Agent agentConfig `json:"agent"`
+
+	// Webhook configures the forwarding of alert notifications.
+	Webhook webhookConfig `json:"webhook"`
+}
+
+// historyConfig configures when older turns of a conversation are replaced by
+// a summary. Zero values select the defaults.
+type historyConfig struct {
+	// Model is the model that writes the summaries, usually a cheaper one
+	// than the chat's.
+	Model string `json:"model"`
+
+	// MaxTurns and MaxTokens are the size of the history above which it is
+	// summarized. MaxTokens defaults to half the chat model's context window.
+	MaxTurns  int `json:"maxTurns"`
+	MaxTokens int `json:"maxTokens"`
+
+	// KeepTurns is how many of the latest turns are kept verbatim.
+	KeepTurns int `json:"keepTurns"`
+}
+
+// summaryConfig configures the summaries of panel data. Zero values select
+// the defaults.
+type summaryConfig struct {
+	// Detail is one of the detail* levels.
+	Detail string `json:"detail"`
+
+	// TopN is how many label values a breakdown lists.
+	TopN int `json:"topN"`
+
+	// Downsample is one of the downsample* methods. Series are included
+	// point by point, reduced to Points points, unless it is none.
+	Downsample string `json:"downsample"`
+	Points     int    `json:"points"`
+}
+
+// auditConfig configures the audit log. Zero values select the defaults.
+type auditConfig struct {
+	// Redaction is one of the auditRedaction* levels.
+	Redaction string `json:"redaction"`
+
+	// RetentionDays is how long rotated audit files are kept.
+	RetentionDays int `json:"retentionDays"`
+
+	// MaxFileMB and RotateHours trigger a rotation of the current file.
+	MaxFileMB   int `json:"maxFileMB"`
+	RotateHours int `json:"rotateHours"`
+}
+
+// loadPluginConfig reads the configuration from the plugin's JSON settings
+// and applies environment overrides on top.
+func loadPluginConfig(settings backend.DataSourceInstanceSettings) (pluginConfig, error) {
+	var cfg pluginConfig
+	if len(settings.JSONData) > 0 {
+		if err := json.Unmarshal(settings.JSONData, &cfg); err != nil {
+			return cfg, fmt.Errorf("invalid plugin settings: %w", err)
+		}
+	}
+
+	if pricing := os.Getenv(envPricing); pricing != "" {
+		if err := json.Unmarshal([]byte(pricing), &cfg.Pricing); err != nil {
+			return cfg, fmt.Errorf("invalid %s: %w", envPricing, err)
+		}
+	}
+
+	if windows := os.Getenv(envContextWindows); windows != "" {
+		if err := json.Unmarshal([]byte(windows), &cfg.ContextWindows); err != nil {
+			return cfg, fmt.Errorf("invalid %s: %w", envContextWindows, err)
+		}
+	}
+
+	if dataDir := os.Getenv(envDataDir); dataDir != "" {
+		cfg.DataDir = dataDir
+	}
+	if cfg.DataDir == "" {
+		if grafanaData := os.Getenv("GF_PATHS_DATA"); grafanaData != "" {
+			cfg.DataDir = filepath.Join(grafanaData, "bsure-chatbot-panel")
+		}
+	}
+
+	if grafanaURL := os.Getenv(envGrafanaURL); grafanaURL != "" {
+		cfg.GrafanaURL = grafanaURL
+	}
+
+	if detail := os.Getenv(envSummaryDetail); detail != "" {
+		cfg.Summary.Detail = detail
+	}
+	if cfg.Summary.Detail != "" && !validDetail(cfg.Summary.Detail) {
+		return cfg, fmt.Errorf("invalid summary detail level %q", cfg.Summary.Detail)
+	}
+	if downsample := os.Getenv(envDownsample); downsample != "" {
+		cfg.Summary.Downsample = downsample
+	}
+	if !validDownsample(cfg.Summary.Downsample) {
+		return cfg, fmt.Errorf("invalid downsampling method %q", cfg.Summary.Downsample)
+	}
+
+	if model := os.Getenv(envHistoryModel); model != "" {
+		cfg.History.Model = model
+	}
+	if cfg.History.Model != "" && !modelNameRegex.MatchString(cfg.History.Model) {
+		return cfg, fmt.Errorf("invalid history model %q", cfg.History.Model)
+	}
+
+	if webhookURL := os.Getenv(envWebhookURL); webhookURL != "" {
+		cfg.Webhook.URL = webhookURL
+	}
+	if format := os.Getenv(envWebhookFormat); format != "" {
+		cfg.Webhook.Format = format
+	}
+	if !validWebhookFormat(cfg.Webhook.Format) {
+		return cfg, fmt.Errorf("invalid webhook format %q", cfg.Webhook.Format)
+	}
+	if model := os.Getenv(envWebhookModel); model != "" {
+		cfg.Webhook.Model = model
+	}
+	if cfg.Webhook.Model != "" && !modelNameRegex.MatchString(cfg.Webhook.Model) {
+		return cfg, fmt.Errorf("invalid webhook model %q", cfg.Webhook.Model)
+	}
+
+	if redaction := os.Getenv(envAuditRedaction); redaction != "" {
+		cfg.Audit.Redaction = redaction
+	}
+	if !validAuditRedaction(cfg.Audit.Redaction) {
+		return cfg, fmt.Errorf("invalid audit redaction level %q", cfg.Audit.Redaction)
+	}
+	for name, target := range map[string]*int{
+		envAuditRetentionDays: &cfg.Audit.RetentionDays,
+		envAuditMaxFileMB:     &cfg.Audit.MaxFileMB,
+		envAuditRotateHours:   &cfg.Audit.RotateHours,
+		envSummaryTopN:        &cfg.Summary.TopN,
+		envDownsamplePoints:   &cfg.Summary.Points,
+		envHistoryMaxTurns:    &cfg.History.MaxTurns,
+		envHistoryMaxTokens:   &cfg.History.MaxTokens,
+		envHistoryKeepTurns:   &cfg.History.KeepTurns,
+		envAgentMaxIterations: &cfg.Agent.MaxIterations,
+		envAgentTimeout:       &cfg.Agent.TimeoutSeconds,
+		envWebhookTimeout:     &cfg.Webhook.TimeoutSeconds,
+	} {
+		if err := envInt(name, target); err != nil {
+			return cfg, err
+		}
+	}
+	if !validWebhookTimeout(cfg.Webhook.TimeoutSeconds) {
+		return cfg, fmt.Errorf("invalid webhook timeout %ds: with the %s to forward the notification, it must be less than Grafana's %s", cfg.Webhook.TimeoutSeconds, webhookForwardTimeout, grafanaWebhookTimeout)
+	}
+
+	return cfg, nil
+}
+
+// envInt sets target from an integer environment variable, if it is set.
+func envInt(name string, target *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid %s: %q", name, value)
+	}
+	*target = parsed
+	return nil
+}
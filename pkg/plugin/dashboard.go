@@ -0,0 +1,698 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Limits of what a dashboard context includes, so that a large dashboard
+// can't blow up the prompt.
+const (
+	maxContextPanels       = 50
+	maxContextQueries      = 10
+	maxContextVariables    = 20
+	maxContextTitle        = 100
+	maxContextDescription  = 500
+	maxContextQuery        = 1000
+	maxContextInstructions = 2000
+)
+
+// Limits of the variable values a context request may set.
+const (
+	maxRequestVariables   = 100
+	maxRequestVariableLen = 1000
+)
+
+// htmlTagRegex matches HTML tags in titles and descriptions.
+var htmlTagRegex = regexp.MustCompile(`<[^>]*>`)
+
+// queryTextKeys are the target fields that hold the query text of the common
+// data sources, in order of preference: Prometheus and Loki, SQL, InfluxDB and
+// others, Graphite.
+var queryTextKeys = []string{"expr", "rawSql", "query", "target"}
+
+// contextRequest selects the dashboard, time range and chatbot panel that a
+// context is built for. Times are Unix milliseconds, as used by Grafana.
+type contextRequest struct {
+	DashboardUID string `json:"dashboardUid,omitempty"`
+	From         int64  `json:"from"`
+	To           int64  `json:"to"`
+
+	// PanelID is the chatbot panel. It is left out of the context, and its
+	// initial chat message becomes the instructions.
+	PanelID int64 `json:"panelId"`
+
+	// Detail, Downsample and Points override the configured summary of the
+	// panel data.
+	Detail     string `json:"detail,omitempty"`
+	Downsample string `json:"downsample,omitempty"`
+	Points     int    `json:"points,omitempty"`
+
+	// PanelIDs restricts the context to these panels, if set.
+	PanelIDs []int64 `json:"panelIds,omitempty"`
+
+	// CompareFrom and CompareTo are a baseline range, e.g. the week before.
+	// If set, the panels are queried over it too and the changes of their
+	// series are added to the context.
+	CompareFrom int64 `json:"compareFrom,omitempty"`
+	CompareTo   int64 `json:"compareTo,omitempty"`
+
+	// Variables are the values of template variables as selected in the
+	// browser, which override those saved with the dashboard. Multi-value
+	// variables have several.
+	Variables map[string][]string `json:"variables,omitempty"`
+}
+
+func (c *contextRequest) validate() *requestError {
+	if !dashboardUIDRegex.MatchString(c.DashboardUID) {
+		return &requestError{status: http.StatusBadRequest, code: errCodeInvalidDashboard, message: "Invalid dashboard UID"}
+	}
+	if c.From <= 0 || c.To <= c.From {
+		return &requestError{status: http.StatusBadRequest, code: errCodeInvalidTimeRange, message: "Invalid time range"}
+	}
+	if c.Detail != "" && !validDetail(c.Detail) {
+		return &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid detail level"}
+	}
+	if !validDownsample(c.Downsample) || c.Points < 0 || c.Points > maxDownsamplePoints {
+		return &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid downsampling"}
+	}
+	if (c.CompareFrom != 0 || c.CompareTo != 0) && (c.CompareFrom <= 0 || c.CompareTo <= c.CompareFrom) {
+		return &requestError{status: http.StatusBadRequest, code: errCodeInvalidTimeRange, message: "Invalid comparison time range"}
+	}
+	if len(c.PanelIDs) > maxContextPanels {
+		return &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Too many panels"}
+	}
+	if len(c.Variables) > maxRequestVariables {
+		return &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Too many variables"}
+	}
+	for name, values := range c.Variables {
+		if len(name) > maxContextTitle || len(values) > maxRequestVariables || len(strings.Join(values, ",")) > maxRequestVariableLen {
+			return &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid variable " + truncate(name, maxContextTitle)}
+		}
+	}
+	return nil
+}
+
+// dataSourceRef identifies a data source. Older dashboards reference data
+// sources by name, newer ones by type and UID.
+type dataSourceRef struct {
+	Type string `json:"type,omitempty"`
+	UID  string `json:"uid,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+func (r *dataSourceRef) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		r.Name = name
+		return nil
+	}
+	type plain dataSourceRef
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// dashboardResponse is the subset of /api/dashboards/uid/:uid the context is
+// built from.
+type dashboardResponse struct {
+	Dashboard struct {
+		UID         string           `json:"uid"`
+		Title       string           `json:"title"`
+		Description string           `json:"description"`
+		Tags        []string         `json:"tags"`
+		Panels      []dashboardPanel `json:"panels"`
+		Templating  struct {
+			List []dashboardVariable `json:"list"`
+		} `json:"templating"`
+	} `json:"dashboard"`
+	Meta struct {
+		FolderTitle string `json:"folderTitle"`
+	} `json:"meta"`
+}
+
+type dashboardPanel struct {
+	ID          int64          `json:"id"`
+	Type        string         `json:"type"`
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Datasource  *dataSourceRef `json:"datasource"`
+	Targets     []panelTarget  `json:"targets"`
+	FieldConfig struct {
+		Defaults struct {
+			Unit       string `json:"unit"`
+			Thresholds struct {
+				Mode  string      `json:"mode"`
+				Steps []threshold `json:"steps"`
+			} `json:"thresholds"`
+		} `json:"defaults"`
+	} `json:"fieldConfig"`
+	Options json.RawMessage `json:"options"`
+
+	// Panels holds the panels of a collapsed row.
+	Panels []dashboardPanel `json:"panels"`
+}
+
+// panelTarget is a query of a panel. The model keeps all fields, since they
+// differ between data sources.
+type panelTarget struct {
+	RefID      string         `json:"refId"`
+	Hide       bool           `json:"hide"`
+	Datasource *dataSourceRef `json:"datasource"`
+
+	model map[string]any
+}
+
+func (t *panelTarget) UnmarshalJSON(b []byte) error {
+	type plain panelTarget
+	if err := json.Unmarshal(b, (*plain)(t)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &t.model)
+}
+
+// queryText returns the query of the target as written by the user.
+func (t *panelTarget) queryText() string {
+	for _, key := range queryTextKeys {
+		if text, ok := t.model[key].(string); ok && strings.TrimSpace(text) != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+// threshold is a step of a panel's thresholds. The base step has no value.
+type threshold struct {
+	Color string   `json:"color"`
+	Value *float64 `json:"value"`
+}
+
+type dashboardVariable struct {
+	Name    string `json:"name"`
+	Current struct {
+		Text  any `json:"text"`
+		Value any `json:"value"`
+	} `json:"current"`
+	Options []struct {
+		Value any `json:"value"`
+	} `json:"options"`
+	AllValue string `json:"allValue"`
+}
+
+// dashboardContext is what the LLM is told about a dashboard.
+type dashboardContext struct {
+	UID          string            `json:"uid"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description,omitempty"`
+	Folder       string            `json:"folder,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	From         time.Time         `json:"from"`
+	To           time.Time         `json:"to"`
+	Variables    []contextVariable `json:"variables,omitempty"`
+	Panels       []panelContext    `json:"panels"`
+	Instructions string            `json:"instructions,omitempty"`
+	Summary      summaryConfig     `json:"summary"`
+
+	// Comparison is set if the context was requested with a baseline range.
+	Comparison *comparison `json:"comparison,omitempty"`
+
+	// variables are used to interpolate the panel queries.
+	variables []dashboardVariable
+}
+
+type contextVariable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type panelContext struct {
+	ID          int64        `json:"id"`
+	Title       string       `json:"title"`
+	Description string       `json:"description,omitempty"`
+	Type        string       `json:"type"`
+	Unit        string       `json:"unit,omitempty"`
+	Queries     []panelQuery `json:"queries,omitempty"`
+
+	// Thresholds are the panel's default thresholds; percentage thresholds
+	// are relative to the min and max of the field.
+	Thresholds    []threshold `json:"thresholds,omitempty"`
+	ThresholdMode string      `json:"thresholdMode,omitempty"`
+
+	// Frames holds the data of the panel's visible queries. Error is set
+	// instead if they could not be run.
+	Frames data.Frames `json:"frames,omitempty"`
+	Error  string      `json:"error,omitempty"`
+
+	// Summaries and Breakdowns describe the frames in the prompt. SeriesCount
+	// includes series left out of the summaries.
+	Summaries   []seriesSummary  `json:"summaries,omitempty"`
+	Breakdowns  []labelBreakdown `json:"breakdowns,omitempty"`
+	SeriesCount int              `json:"seriesCount,omitempty"`
+
+	// Findings are the anomalies flagged in the frames.
+	Findings []finding `json:"findings,omitempty"`
+
+	// Logs describes the log lines of the frames by their patterns.
+	Logs *logSummary `json:"logs,omitempty"`
+
+	// Traces summarize the traces of the frames and those their exemplars
+	// and trace search results reference.
+	Traces []traceSummary `json:"traces,omitempty"`
+
+	// targets and datasource are the panel's queries as saved, which are
+	// run to get its data.
+	targets    []panelTarget
+	datasource *dataSourceRef
+}
+
+type panelQuery struct {
+	RefID      string         `json:"refId"`
+	Datasource *dataSourceRef `json:"datasource,omitempty"`
+	Query      string         `json:"query,omitempty"`
+}
+
+// loadDashboardContext fetches a dashboard as the caller of r, builds its
+// context and runs the panel queries. Grafana enforces the caller's
+// permissions on the dashboard and its data sources.
+func (ds *Datasource) loadDashboardContext(ctx context.Context, r *http.Request, req contextRequest) (*dashboardContext, *requestError) {
+	ctx, span := startSpan(ctx, "context.load_dashboard")
+	defer span.End()
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Error("Cannot call Grafana API", "error", err)
+		return nil, spanError(span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+	}
+
+	var resp dashboardResponse
+	if err := client.get(ctx, "/api/dashboards/uid/"+url.PathEscape(req.DashboardUID), &resp); err != nil {
+		log.DefaultLogger.Warn("Failed to load dashboard", "uid", req.DashboardUID, "error", err)
+		return nil, spanError(span, grafanaRequestError(err, "Dashboard"))
+	}
+
+	dc := buildDashboardContext(&resp, req)
+	ds.queryPanelData(ctx, client, dc)
+
+	dc.Summary = summaryConfig{
+		Detail:     orDefaultString(req.Detail, ds.config.Summary.Detail, detailStandard),
+		TopN:       orDefault(ds.config.Summary.TopN, defaultSummaryTopN),
+		Downsample: orDefaultString(req.Downsample, ds.config.Summary.Downsample, downsampleNone),
+		Points:     orDefault(req.Points, orDefault(ds.config.Summary.Points, defaultDownsamplePoints)),
+	}
+	for i := range dc.Panels {
+		summarizePanel(&dc.Panels[i], dc.Summary)
+		detectAnomalies(&dc.Panels[i])
+	}
+
+	var baseline *dashboardContext
+	if req.CompareFrom != 0 {
+		baselineReq := req
+		baselineReq.From, baselineReq.To = req.CompareFrom, req.CompareTo
+		baseline = buildDashboardContext(&resp, baselineReq)
+		ds.queryPanelData(ctx, client, baseline)
+		for i := range baseline.Panels {
+			summarizePanel(&baseline.Panels[i], dc.Summary)
+		}
+		dc.Comparison = compareContexts(dc, baseline)
+	}
+	ds.summarizeLogPanels(ctx, client, &resp, req, dc, baseline)
+	ds.summarizeTracePanels(ctx, client, dc)
+	return dc, nil
+}
+
+// summarizeLogPanels clusters the lines of log panels into patterns. The
+// patterns are compared with the comparison's baseline if there is one, or
+// else with the window of the same length right before; only the log panels
+// are queried for it.
+func (ds *Datasource) summarizeLogPanels(ctx context.Context, client *grafanaClient, resp *dashboardResponse, req contextRequest, dc *dashboardContext, baseline *dashboardContext) {
+	var logPanels []int64
+	for i := range dc.Panels {
+		if dc.Panels[i].Error == "" && hasLogFrames(&dc.Panels[i]) {
+			logPanels = append(logPanels, dc.Panels[i].ID)
+		}
+	}
+	if len(logPanels) == 0 {
+		return
+	}
+	ctx, span := startSpan(ctx, "context.summarize_logs")
+	defer span.End()
+	span.SetAttributes(attribute.Int("context.log_panels", len(logPanels)))
+
+	if baseline == nil {
+		baselineReq := req
+		baselineReq.From, baselineReq.To, baselineReq.PanelIDs = 2*req.From-req.To, req.From, logPanels
+		baseline = buildDashboardContext(resp, baselineReq)
+		ds.queryPanelData(ctx, client, baseline)
+	}
+	ratio := 1.0
+	if window := baseline.To.Sub(baseline.From); window > 0 {
+		ratio = float64(dc.To.Sub(dc.From)) / float64(window)
+	}
+	for i := range dc.Panels {
+		panel := &dc.Panels[i]
+		if !slices.Contains(logPanels, panel.ID) {
+			continue
+		}
+		j := slices.IndexFunc(baseline.Panels, func(p panelContext) bool { return p.ID == panel.ID })
+		if j >= 0 && baseline.Panels[j].Error == "" {
+			summarizeLogs(panel, baseline.Panels[j].Frames, true, ratio)
+		} else {
+			summarizeLogs(panel, nil, false, 1)
+		}
+	}
+}
+
+// grafanaRequestError converts an error of the Grafana API into the error
+// reported to the client.
+func grafanaRequestError(err error, resource string) *requestError {
+	var statusErr *grafanaStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.status {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &requestError{status: http.StatusForbidden, code: errCodeForbidden, message: "Access denied"}
+		case http.StatusNotFound:
+			return &requestError{status: http.StatusNotFound, code: errCodeNotFound, message: resource + " not found"}
+		}
+	}
+	return &requestError{status: http.StatusBadGateway, code: errCodeGrafanaError, message: "Failed to call Grafana API"}
+}
+
+// buildDashboardContext extracts titles, descriptions, units and queries of
+// the dashboard's panels. Text is stripped of HTML and truncated.
+func buildDashboardContext(resp *dashboardResponse, req contextRequest) *dashboardContext {
+	dash := resp.Dashboard
+	dc := &dashboardContext{
+		UID:         dash.UID,
+		Title:       truncate(stripHTML(dash.Title), maxContextTitle),
+		Description: truncate(stripHTML(dash.Description), maxContextDescription),
+		Folder:      truncate(stripHTML(resp.Meta.FolderTitle), maxContextTitle),
+		From:        time.UnixMilli(req.From).UTC(),
+		To:          time.UnixMilli(req.To).UTC(),
+		Panels:      []panelContext{},
+		variables:   withVariableValues(dash.Templating.List, req.Variables),
+	}
+	for _, tag := range dash.Tags {
+		dc.Tags = append(dc.Tags, truncate(stripHTML(tag), maxContextTitle))
+	}
+
+	for _, v := range dc.variables {
+		if len(dc.Variables) == maxContextVariables {
+			break
+		}
+		dc.Variables = append(dc.Variables, contextVariable{
+			Name:  truncate(v.Name, maxContextTitle),
+			Value: truncate(variableText(v.Current.Text), maxContextTitle),
+		})
+	}
+
+	for _, panel := range flattenPanels(dash.Panels) {
+		if panel.ID == req.PanelID {
+			dc.Instructions = panelInstructions(panel)
+			continue
+		}
+		if len(req.PanelIDs) > 0 && !slices.Contains(req.PanelIDs, panel.ID) {
+			continue
+		}
+		if len(dc.Panels) < maxContextPanels {
+			dc.Panels = append(dc.Panels, buildPanelContext(panel))
+		}
+	}
+	return dc
+}
+
+// flattenPanels returns the panels of a dashboard including those in
+// collapsed rows, without the rows themselves.
+func flattenPanels(panels []dashboardPanel) []dashboardPanel {
+	var result []dashboardPanel
+	for _, panel := range panels {
+		if panel.Type != "row" {
+			result = append(result, panel)
+		}
+		result = append(result, flattenPanels(panel.Panels)...)
+	}
+	return result
+}
+
+func buildPanelContext(panel dashboardPanel) panelContext {
+	pc := panelContext{
+		ID:          panel.ID,
+		Title:       truncate(stripHTML(panel.Title), maxContextTitle),
+		Description: truncate(stripHTML(panel.Description), maxContextDescription),
+		Type:        truncate(panel.Type, maxContextTitle),
+		Unit:        truncate(panel.FieldConfig.Defaults.Unit, maxContextTitle),
+		targets:     panel.Targets,
+		datasource:  panel.Datasource,
+	}
+	if steps := panel.FieldConfig.Defaults.Thresholds.Steps; len(steps) > 0 {
+		pc.Thresholds = steps
+		pc.ThresholdMode = truncate(panel.FieldConfig.Defaults.Thresholds.Mode, maxContextTitle)
+		for i := range pc.Thresholds {
+			pc.Thresholds[i].Color = truncate(pc.Thresholds[i].Color, maxContextTitle)
+		}
+	}
+	for _, target := range panel.Targets {
+		if target.Hide || len(pc.Queries) == maxContextQueries {
+			continue
+		}
+		datasource := target.Datasource
+		if datasource == nil {
+			datasource = panel.Datasource
+		}
+		pc.Queries = append(pc.Queries, panelQuery{
+			RefID:      truncate(target.RefID, maxContextTitle),
+			Datasource: datasource,
+			Query:      truncate(target.queryText(), maxContextQuery),
+		})
+	}
+	return pc
+}
+
+// withVariableValues returns the variables with the current values replaced
+// by those selected in the browser. The saved dashboard is left unchanged.
+func withVariableValues(variables []dashboardVariable, values map[string][]string) []dashboardVariable {
+	if len(values) == 0 {
+		return variables
+	}
+	result := slices.Clone(variables)
+	for i, v := range result {
+		selected, ok := values[v.Name]
+		if !ok {
+			continue
+		}
+		current := make([]any, len(selected))
+		for j, value := range selected {
+			current[j] = value
+		}
+		result[i].Current.Value, result[i].Current.Text = current, current
+		if len(selected) == 1 && selected[0] == "$__all" {
+			result[i].Current.Text = "All"
+		}
+	}
+	return result
+}
+
+// panelInstructions returns the initial chat message of a chatbot panel.
+func panelInstructions(panel dashboardPanel) string {
+	var options struct {
+		InitialChatMessage string `json:"initialChatMessage"`
+	}
+	if err := json.Unmarshal(panel.Options, &options); err != nil {
+		return ""
+	}
+	return truncate(options.InitialChatMessage, maxContextInstructions)
+}
+
+// variableText formats the current value of a template variable, which is a
+// list for multi-value variables.
+func variableText(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []any:
+		texts := make([]string, 0, len(v))
+		for _, item := range v {
+			texts = append(texts, fmt.Sprint(item))
+		}
+		return strings.Join(texts, ", ")
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func stripHTML(s string) string {
+	return strings.TrimSpace(htmlTagRegex.ReplaceAllString(s, ""))
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+// prompt renders the context as the system message of a chat.
+func (dc *dashboardContext) prompt() string {
+	var b strings.Builder
+	if dc.Instructions != "" {
+		b.WriteString(dc.Instructions)
+		b.WriteString("\n\n")
+	}
+
+	fmt.Fprintf(&b, "The user is looking at the Grafana dashboard %q", dc.Title)
+	if dc.Folder != "" {
+		fmt.Fprintf(&b, " in folder %q", dc.Folder)
+	}
+	b.WriteString(".\n")
+	if dc.Description != "" {
+		fmt.Fprintf(&b, "Description: %s\n", dc.Description)
+	}
+	if len(dc.Tags) > 0 {
+		fmt.Fprintf(&b, "Tags: %s\n", strings.Join(dc.Tags, ", "))
+	}
+	fmt.Fprintf(&b, "Time range: %s to %s\n", dc.From.Format(time.RFC3339), dc.To.Format(time.RFC3339))
+	if len(dc.Variables) > 0 {
+		vars := make([]string, len(dc.Variables))
+		for i, v := range dc.Variables {
+			vars[i] = v.Name + "=" + v.Value
+		}
+		fmt.Fprintf(&b, "Variables: %s\n", strings.Join(vars, ", "))
+	}
+
+	writeFindings(&b, dc.Panels)
+	writeComparison(&b, dc.Comparison)
+
+	b.WriteString("\nPanels:\n")
+	for _, panel := range dc.Panels {
+		writePanel(&b, panel, dc.Summary.Detail, dc.From)
+	}
+	return b.String()
+}
+
+// writePanel writes a panel's metadata, queries, thresholds and data summary.
+func writePanel(b *strings.Builder, panel panelContext, detail string, from time.Time) {
+	fmt.Fprintf(b, "- Panel %d %q (%s", panel.ID, panel.Title, panel.Type)
+	if panel.Unit != "" {
+		fmt.Fprintf(b, ", unit %s", panel.Unit)
+	}
+	b.WriteString(")")
+	if panel.Description != "" {
+		fmt.Fprintf(b, ": %s", panel.Description)
+	}
+	b.WriteString("\n")
+	for _, q := range panel.Queries {
+		if q.Query == "" {
+			continue
+		}
+		fmt.Fprintf(b, "  - Query %s", q.RefID)
+		if q.Datasource != nil && q.Datasource.Type != "" {
+			fmt.Fprintf(b, " (%s)", q.Datasource.Type)
+		}
+		fmt.Fprintf(b, ": %s\n", q.Query)
+	}
+	if len(panel.Thresholds) > 0 {
+		steps := make([]string, len(panel.Thresholds))
+		for i, t := range panel.Thresholds {
+			steps[i] = "base " + t.Color
+			if t.Value != nil {
+				steps[i] = formatNumber(*t.Value) + " " + t.Color
+			}
+		}
+		b.WriteString("  Thresholds")
+		if panel.ThresholdMode != "" {
+			fmt.Fprintf(b, " (%s)", panel.ThresholdMode)
+		}
+		fmt.Fprintf(b, ": %s\n", strings.Join(steps, ", "))
+	}
+	writePanelSummary(b, panel, detail, from)
+}
+
+// withSystemContext replaces the system messages sent by the client with the
+// context built by the backend.
+func withSystemContext(messages []chatMessage, prompt string) []chatMessage {
+	return append([]chatMessage{{Role: "system", Content: prompt}}, withoutSystemMessages(messages)...)
+}
+
+// withoutSystemMessages returns the messages of the user and the assistant.
+func withoutSystemMessages(messages []chatMessage) []chatMessage {
+	result := make([]chatMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Role != "system" {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// handleContext returns the context the backend builds for a dashboard, and
+// the system message rendered from it.
+//
+// Query parameters: dashboardUid, from and to (Unix milliseconds), panelId
+// (the chatbot panel, optional), detail (minimal, standard or full),
+// downsample (none, lttb or minmax), points, compareFrom and compareTo (a
+// baseline range, optional), and var-<name> for the values of template
+// variables, as in Grafana's dashboard URLs.
+func (ds *Datasource) handleContext(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "context.handle")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		writeRequestError(w, span, &requestError{status: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed, message: "Method not allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	req := contextRequest{DashboardUID: query.Get("dashboardUid"), Detail: query.Get("detail"), Downsample: query.Get("downsample")}
+	var points int64
+	for name, target := range map[string]*int64{"from": &req.From, "to": &req.To, "panelId": &req.PanelID, "points": &points, "compareFrom": &req.CompareFrom, "compareTo": &req.CompareTo} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid " + name})
+				return
+			}
+			*target = parsed
+		}
+	}
+	req.Points = int(points)
+	for name, values := range query {
+		if variable, ok := strings.CutPrefix(name, "var-"); ok {
+			if req.Variables == nil {
+				req.Variables = make(map[string][]string)
+			}
+			req.Variables[variable] = values
+		}
+	}
+	if reqErr := req.validate(); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	dc, reqErr := ds.loadDashboardContext(ctx, r, req)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"context": dc, "prompt": dc.prompt()}); err != nil {
+		log.DefaultLogger.Error("Failed to encode context response", "error", err)
+	}
+}
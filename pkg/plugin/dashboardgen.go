@@ -0,0 +1,403 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxGeneratedPanels bounds the panels of a generated dashboard, and
+	// maxGeneratedQueries the queries of a panel.
+	maxGeneratedPanels  = 12
+	maxGeneratedQueries = 3
+
+	// dashboardSchemaVersion is the version of Grafana's dashboard schema
+	// generated dashboards are written in.
+	dashboardSchemaVersion = 39
+
+	// dashboardGridColumns is the width of Grafana's dashboard grid, and
+	// maxPanelHeight bounds the height of a panel in grid rows.
+	dashboardGridColumns = 24
+	defaultPanelHeight   = 8
+	maxPanelHeight       = 20
+
+	// draftTag marks the dashboards saved by /generate-dashboard, which are
+	// meant to be reviewed before use.
+	draftTag = "draft"
+
+	// maxDashboardTags bounds the tags of a generated dashboard, and
+	// maxDashboardTag the length of a tag.
+	maxDashboardTags = 10
+	maxDashboardTag  = 50
+)
+
+// generatedPanelTypes are the panel types the model may use.
+var generatedPanelTypes = []string{"timeseries", "stat", "gauge", "bargauge", "table", "piechart", "barchart", "heatmap"}
+
+// grafanaUnits are the unit IDs of Grafana's standard units the model may
+// use.
+var grafanaUnits = []string{
+	"none", "short", "percent", "percentunit", "sci",
+	"ns", "µs", "ms", "s", "m", "h", "d", "dtdurations",
+	"bytes", "decbytes", "bits", "decbits", "kbytes", "mbytes", "gbytes",
+	"Bps", "binBps", "bps", "binbps", "KBs", "MBs", "pps",
+	"reqps", "rps", "wps", "ops", "iops", "opm", "rpm", "cps",
+	"hertz", "celsius", "watt", "kwatt", "volt", "amp",
+	"currencyUSD", "currencyEUR", "currencyGBP", "dateTimeAsIso",
+}
+
+const generateDashboardInstructions = `You design Grafana dashboards for engineers.
+Build a dashboard for the description of the user, with the panels a team would expect on it: the key rates, errors and latencies or the key figures of the data, with stats for the headline numbers and time series for their history.
+Every query is run against the data source described below, so follow its rules.
+Answer with a JSON object with these keys:
+- "title": the dashboard title.
+- "description": one sentence on what the dashboard shows.
+- "tags": up to five short tags.
+- "panels": up to %d panels in reading order, each an object with these keys:
+  - "title": a short panel title.
+  - "description": one sentence on what the panel shows and how to read it.
+  - "type": one of %s.
+  - "unit": the Grafana unit ID of the values, one of %s.
+  - "width": the width in grid columns, 1 to %d; %d is the full width. Use 6 for stats and gauges and 12 or 24 for the others.
+  - "height": the height in grid rows, usually 8, or 4 for stats.
+  - "queries": 1 to %d objects with the keys "query" (the query) and "legend" (the legend of its series, with {{label}} for label values, or "").
+`
+
+// generateDashboardRequest is the body accepted by /generate-dashboard.
+// FolderUID selects the folder a saved draft goes into; it's the General
+// folder if empty.
+type generateDashboardRequest struct {
+	Model         string `json:"model"`
+	Description   string `json:"description"`
+	DatasourceUID string `json:"datasourceUid"`
+	Title         string `json:"title"`
+	Save          bool   `json:"save"`
+	FolderUID     string `json:"folderUid"`
+}
+
+// generatedDashboard is the model's answer.
+type generatedDashboard struct {
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	Tags        []string         `json:"tags"`
+	Panels      []generatedPanel `json:"panels"`
+}
+
+type generatedPanel struct {
+	Title       string                `json:"title"`
+	Description string                `json:"description"`
+	Type        string                `json:"type"`
+	Unit        string                `json:"unit"`
+	Width       int                   `json:"width"`
+	Height      int                   `json:"height"`
+	Queries     []generatedPanelQuery `json:"queries"`
+}
+
+type generatedPanelQuery struct {
+	Query  string `json:"query"`
+	Legend string `json:"legend"`
+}
+
+// savedDashboard is the response of Grafana's /api/dashboards/db.
+type savedDashboard struct {
+	UID       string `json:"uid"`
+	URL       string `json:"url"`
+	Version   int    `json:"version"`
+	FolderUID string `json:"folderUid,omitempty"`
+}
+
+// validate checks the panels and their queries against what the data
+// source has, and normalizes the queries. Errors are sent back to the
+// model, but a *requestError fails the request.
+func (d *generatedDashboard) validate(ctx context.Context, generator queryGenerator) error {
+	if strings.TrimSpace(d.Title) == "" {
+		return errors.New("the dashboard has no title")
+	}
+	if len(d.Panels) == 0 || len(d.Panels) > maxGeneratedPanels {
+		return fmt.Errorf("the dashboard has %d panels, but it must have 1 to %d", len(d.Panels), maxGeneratedPanels)
+	}
+	for i := range d.Panels {
+		panel := &d.Panels[i]
+		if strings.TrimSpace(panel.Title) == "" {
+			return fmt.Errorf("panel %d has no title", i+1)
+		}
+		if !slices.Contains(generatedPanelTypes, panel.Type) {
+			return fmt.Errorf("panel %q has the type %q, which is not one of %s", panel.Title, panel.Type, strings.Join(generatedPanelTypes, ", "))
+		}
+		if panel.Unit != "" && !slices.Contains(grafanaUnits, panel.Unit) {
+			return fmt.Errorf("panel %q has the unit %q, which is not one of %s", panel.Title, panel.Unit, strings.Join(grafanaUnits, ", "))
+		}
+		if len(panel.Queries) == 0 || len(panel.Queries) > maxGeneratedQueries {
+			return fmt.Errorf("panel %q has %d queries, but it must have 1 to %d", panel.Title, len(panel.Queries), maxGeneratedQueries)
+		}
+		for j := range panel.Queries {
+			query, err := generator.validate(ctx, panel.Queries[j].Query)
+			var reqErr *requestError
+			if errors.As(err, &reqErr) {
+				return reqErr
+			}
+			if err != nil {
+				return fmt.Errorf("query %d of panel %q is invalid: %w", j+1, panel.Title, err)
+			}
+			panel.Queries[j].Query = query
+		}
+	}
+	return nil
+}
+
+// dashboardModel builds the dashboard JSON model of a generated dashboard:
+// the panels are laid out left to right in rows of the grid, and their
+// queries run against ref.
+func (d *generatedDashboard) dashboardModel(ref dataSourceRef, tags []string) map[string]any {
+	panels := make([]map[string]any, 0, len(d.Panels))
+	x, y, rowHeight := 0, 0, 0
+	for i, p := range d.Panels {
+		width := min(max(p.Width, 1), dashboardGridColumns)
+		if p.Width == 0 {
+			width = dashboardGridColumns / 2
+		}
+		height := min(max(p.Height, 2), maxPanelHeight)
+		if p.Height == 0 {
+			height = defaultPanelHeight
+		}
+		if x+width > dashboardGridColumns {
+			x, y, rowHeight = 0, y+rowHeight, 0
+		}
+
+		targets := make([]map[string]any, len(p.Queries))
+		for j, q := range p.Queries {
+			refID := string(rune('A' + j))
+			if sqlDialect(ref.Type) != "" {
+				targets[j] = sqlQuery(refID, ref, q.Query)
+				if p.Type == "timeseries" || p.Type == "heatmap" {
+					targets[j]["format"] = "time_series"
+				}
+				continue
+			}
+			targets[j] = map[string]any{
+				"refId":        refID,
+				"datasource":   ref,
+				"expr":         q.Query,
+				"legendFormat": orDefaultString(q.Legend, "__auto"),
+				"editorMode":   "code",
+				"range":        true,
+			}
+		}
+
+		panels = append(panels, map[string]any{
+			"id":          i + 1,
+			"type":        p.Type,
+			"title":       truncate(strings.TrimSpace(p.Title), maxContextTitle),
+			"description": truncate(strings.TrimSpace(p.Description), maxContextDescription),
+			"datasource":  ref,
+			"gridPos":     map[string]int{"x": x, "y": y, "w": width, "h": height},
+			"fieldConfig": map[string]any{"defaults": map[string]any{"unit": orDefaultString(p.Unit, "short")}, "overrides": []any{}},
+			"options":     map[string]any{},
+			"targets":     targets,
+		})
+		x, rowHeight = x+width, max(rowHeight, height)
+	}
+
+	return map[string]any{
+		"title":         truncate(strings.TrimSpace(d.Title), maxContextTitle),
+		"description":   truncate(strings.TrimSpace(d.Description), maxContextDescription),
+		"tags":          tags,
+		"editable":      true,
+		"schemaVersion": dashboardSchemaVersion,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"timezone":      "browser",
+		"refresh":       "",
+		"templating":    map[string]any{"list": []any{}},
+		"annotations":   map[string]any{"list": []any{}},
+		"panels":        panels,
+	}
+}
+
+// dashboardTags cleans up the tags of a generated dashboard: trimmed,
+// deduplicated and bounded.
+func dashboardTags(tags ...[]string) []string {
+	result := []string{}
+	for _, list := range tags {
+		for _, tag := range list {
+			tag = truncate(strings.TrimSpace(tag), maxDashboardTag)
+			if tag != "" && !slices.Contains(result, tag) && len(result) < maxDashboardTags {
+				result = append(result, tag)
+			}
+		}
+	}
+	return result
+}
+
+// saveDraft saves a generated dashboard as a new dashboard in a folder, with
+// the caller's permissions. It never overwrites an existing dashboard.
+func saveDraft(ctx context.Context, client *grafanaClient, model map[string]any, folderUID string) (*savedDashboard, *requestError) {
+	ctx, span := startSpan(ctx, "generate_dashboard.save")
+	defer span.End()
+
+	body := map[string]any{
+		"dashboard": model,
+		"folderUid": folderUID,
+		"overwrite": false,
+		"message":   "Draft generated by the chatbot",
+	}
+	var saved savedDashboard
+	if err := client.post(ctx, "/api/dashboards/db", body, &saved); err != nil {
+		log.DefaultLogger.Warn("Failed to save dashboard", "folder", folderUID, "error", err)
+		var statusErr *grafanaStatusError
+		if errors.As(err, &statusErr) && statusErr.status == http.StatusPreconditionFailed {
+			return nil, spanError(span, &requestError{status: http.StatusConflict, code: errCodeConflict, message: "A dashboard with the same title exists in the folder"})
+		}
+		return nil, spanError(span, grafanaRequestError(err, "Folder"))
+	}
+	saved.FolderUID = folderUID
+	return &saved, nil
+}
+
+// handleGenerateDashboard generates a dashboard for a description, with
+// queries for a data source. The queries are validated like those of
+// /generate-query and the dashboard against the dashboard schema; the model
+// is asked again with the error if either is invalid. With save, the
+// dashboard is saved as a draft.
+func (ds *Datasource) handleGenerateDashboard(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "generate_dashboard.handle")
+	defer span.End()
+
+	apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req generateDashboardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	req.Model = orDefaultString(req.Model, defaultChatModel)
+	if !validModel(req.Model) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+		return
+	}
+	if strings.TrimSpace(req.Description) == "" || len(req.Description) > maxQuestionLength {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid description"})
+		return
+	}
+	if len(req.Title) > maxContextTitle {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid title"})
+		return
+	}
+	if !dashboardUIDRegex.MatchString(req.DatasourceUID) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidDatasource, message: "Invalid data source UID"})
+		return
+	}
+	if req.FolderUID != "" && !dashboardUIDRegex.MatchString(req.FolderUID) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid folder UID"})
+		return
+	}
+	span.SetAttributes(attribute.String(attrModel, req.Model), attribute.Bool("generate_dashboard.save", req.Save))
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Error("Cannot call Grafana API", "error", err)
+		writeRequestError(w, span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+		return
+	}
+	var ref dataSourceRef
+	if err := client.get(ctx, "/api/datasources/uid/"+url.PathEscape(req.DatasourceUID), &ref); err != nil {
+		log.DefaultLogger.Warn("Failed to load data source", "datasource", req.DatasourceUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Data source"))
+		return
+	}
+	ref = dataSourceRef{Type: ref.Type, UID: req.DatasourceUID}
+	span.SetAttributes(attribute.String("generate_dashboard.datasource_type", ref.Type))
+
+	var generator queryGenerator
+	switch {
+	case ref.Type == "prometheus":
+		generator, err = loadPromCatalog(ctx, client, req.DatasourceUID, req.Description)
+	case sqlDialect(ref.Type) != "":
+		generator, err = loadSQLCatalog(ctx, client, ref, req.Description, false)
+	default:
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidDatasource, message: "Unsupported data source type " + ref.Type})
+		return
+	}
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to load data source metadata", "datasource", req.DatasourceUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Data source"))
+		return
+	}
+
+	instructions := fmt.Sprintf(generateDashboardInstructions, maxGeneratedPanels, strings.Join(generatedPanelTypes, ", "),
+		strings.Join(grafanaUnits, ", "), dashboardGridColumns, dashboardGridColumns, maxGeneratedQueries)
+	chatReq := &chatRequest{Model: req.Model, Messages: []chatMessage{
+		{Role: "system", Content: instructions + "\n" + generator.grounding()},
+		{Role: "user", Content: req.Description},
+	}}
+	var answer generatedDashboard
+	var validationErr error
+	attempts := 0
+	for attempts < maxQueryAttempts {
+		attempts++
+		answer = generatedDashboard{}
+		if _, reqErr := ds.completeJSON(ctx, apiKey, "generate-dashboard", chatReq, &answer); reqErr != nil {
+			writeRequestError(w, span, reqErr)
+			return
+		}
+		if req.Title != "" {
+			answer.Title = req.Title
+		}
+		validationErr = answer.validate(ctx, generator)
+		var reqErr *requestError
+		if errors.As(validationErr, &reqErr) {
+			writeRequestError(w, span, reqErr)
+			return
+		}
+		if validationErr == nil {
+			break
+		}
+		log.DefaultLogger.Info("Generated dashboard is invalid", "attempt", attempts, "error", validationErr)
+		encoded, _ := json.Marshal(answer)
+		chatReq.Messages = append(chatReq.Messages,
+			chatMessage{Role: "assistant", Content: string(encoded)},
+			chatMessage{Role: "user", Content: fmt.Sprintf("The dashboard is invalid: %s. Answer with a corrected dashboard.", validationErr)},
+		)
+	}
+	span.SetAttributes(attribute.Int("generate_dashboard.attempts", attempts))
+	if validationErr != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusUnprocessableEntity, code: errCodeInvalidDashboard, message: "Could not generate a valid dashboard: " + validationErr.Error()})
+		return
+	}
+
+	tags := dashboardTags(answer.Tags)
+	if req.Save {
+		tags = dashboardTags([]string{draftTag}, answer.Tags)
+	}
+	model := answer.dashboardModel(ref, tags)
+
+	resp := map[string]any{
+		"datasourceUid": req.DatasourceUID,
+		"language":      generator.fields()["language"],
+		"dashboard":     model,
+		"attempts":      attempts,
+	}
+	if req.Save {
+		saved, reqErr := saveDraft(ctx, client, model, req.FolderUID)
+		if reqErr != nil {
+			writeRequestError(w, span, reqErr)
+			return
+		}
+		resp["saved"] = saved
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	writeJSON(w, resp)
+}
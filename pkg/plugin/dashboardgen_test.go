@@ -0,0 +1,301 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const testGeneratedDashboard = `{"title":"HTTP service","description":"Traffic and latency of the service.","tags":["http"],"panels":[
+	{"title":"Request rate","type":"stat","unit":"reqps","width":6,"height":4,"queries":[{"query":"sum(rate(http_requests_total[5m]))","legend":""}]},
+	{"title":"Error ratio","type":"stat","unit":"percentunit","width":6,"height":4,"queries":[{"query":"sum(rate(http_requests_total{code=~\"5..\"}[5m])) / sum(rate(http_requests_total[5m]))","legend":""}]},
+	{"title":"Requests by code","type":"timeseries","unit":"reqps","width":24,"queries":[{"query":"sum by (code) (rate(http_requests_total[5m]))","legend":"{{code}}"}]}
+]}`
+
+// newTestDashboardGrafana serves the data source "prom" like
+// newTestPrometheus, and saves dashboards in the folder "team". The folder
+// "readonly" can't be written to, and the title "Taken" exists.
+func newTestDashboardGrafana(t *testing.T, saved *[]map[string]any) *httptest.Server {
+	t.Helper()
+	target, _ := url.Parse(newTestPrometheus(t).URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/dashboards/db" {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		dashboard, _ := body["dashboard"].(map[string]any)
+		switch {
+		case body["folderUid"] == "readonly":
+			w.WriteHeader(http.StatusForbidden)
+		case dashboard["title"] == "Taken":
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"status":"name-exists"}`))
+		default:
+			*saved = append(*saved, body)
+			w.Write([]byte(`{"id":3,"uid":"gen-1","url":"/d/gen-1/http-service","status":"success","version":1}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHandleGenerateDashboard(t *testing.T) {
+	testCases := []struct {
+		name             string
+		body             string
+		answers          []string
+		expectedStatus   int
+		expectedAttempts int
+		expectedRetry    string
+		expectedSaved    bool
+	}{
+		{name: "valid", body: `{"description":"A dashboard for our HTTP service","datasourceUid":"prom"}`,
+			answers: []string{testGeneratedDashboard}, expectedStatus: http.StatusOK, expectedAttempts: 1},
+		{name: "retry with unknown unit", body: `{"description":"A dashboard for our HTTP service","datasourceUid":"prom"}`,
+			answers:        []string{strings.Replace(testGeneratedDashboard, `"percentunit"`, `"ratio"`, 1), testGeneratedDashboard},
+			expectedStatus: http.StatusOK, expectedAttempts: 2, expectedRetry: `panel "Error ratio" has the unit "ratio"`},
+		{name: "retry with unknown metric", body: `{"description":"A dashboard for our HTTP service","datasourceUid":"prom"}`,
+			answers:        []string{strings.Replace(testGeneratedDashboard, "sum(rate(http_requests_total[5m]))", "sum(rate(http_requests[5m]))", 1), testGeneratedDashboard},
+			expectedStatus: http.StatusOK, expectedAttempts: 2, expectedRetry: `query 1 of panel "Request rate" is invalid: the metric "http_requests" doesn't exist`},
+		{name: "saved", body: `{"description":"A dashboard for our HTTP service","datasourceUid":"prom","save":true,"folderUid":"team"}`,
+			answers: []string{testGeneratedDashboard}, expectedStatus: http.StatusOK, expectedAttempts: 1, expectedSaved: true},
+		{name: "title exists", body: `{"description":"A dashboard for our HTTP service","datasourceUid":"prom","title":"Taken","save":true}`,
+			answers: []string{testGeneratedDashboard}, expectedStatus: http.StatusConflict},
+		{name: "folder not writable", body: `{"description":"A dashboard for our HTTP service","datasourceUid":"prom","save":true,"folderUid":"readonly"}`,
+			answers: []string{testGeneratedDashboard}, expectedStatus: http.StatusForbidden},
+		{name: "no valid dashboard", body: `{"description":"A dashboard for our HTTP service","datasourceUid":"prom"}`,
+			answers: []string{strings.ReplaceAll(testGeneratedDashboard, `"stat"`, `"singlestat"`)}, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "missing description", body: `{"datasourceUid":"prom"}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid folder", body: `{"description":"HTTP","datasourceUid":"prom","save":true,"folderUid":"../x"}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var saved []map[string]any
+			grafana := newTestDashboardGrafana(t, &saved)
+
+			var sent []groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req groqChatRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				sent = append(sent, req)
+				answer := tc.answers[min(len(sent), len(tc.answers))-1]
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: answer}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest("POST", "/generate-dashboard", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleGenerateDashboard(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusUnprocessableEntity && len(sent) != maxQueryAttempts {
+				t.Errorf("Expected %d attempts, got %d", maxQueryAttempts, len(sent))
+			}
+			if (len(saved) == 1) != tc.expectedSaved {
+				t.Errorf("Expected a saved dashboard: %v, got %+v", tc.expectedSaved, saved)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			system := sent[0].Messages[0].Content
+			if !strings.Contains(system, "- http_requests_total (counter) labels: code, job: Total HTTP requests.") || !strings.Contains(system, `"unit": the Grafana unit ID`) {
+				t.Errorf("Expected the metrics and answer format in the prompt, got %q", system)
+			}
+			if tc.expectedRetry != "" {
+				retry := sent[1].Messages[len(sent[1].Messages)-1]
+				if retry.Role != "user" || !strings.Contains(retry.Content, tc.expectedRetry) {
+					t.Errorf("Expected the retry to carry the error, got %+v", retry)
+				}
+			}
+
+			var resp struct {
+				Attempts  int `json:"attempts"`
+				Dashboard struct {
+					Tags   []string `json:"tags"`
+					Panels []struct {
+						GridPos struct{ X, Y, W, H int } `json:"gridPos"`
+						Targets []struct {
+							Expr         string         `json:"expr"`
+							LegendFormat string         `json:"legendFormat"`
+							Datasource   *dataSourceRef `json:"datasource"`
+						} `json:"targets"`
+					} `json:"panels"`
+				} `json:"dashboard"`
+				Saved *savedDashboard `json:"saved"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			panels := resp.Dashboard.Panels
+			if resp.Attempts != tc.expectedAttempts || len(panels) != 3 {
+				t.Fatalf("Unexpected response: %+v", resp)
+			}
+			if panels[1].GridPos != (struct{ X, Y, W, H int }{6, 0, 6, 4}) || panels[2].GridPos != (struct{ X, Y, W, H int }{0, 4, 24, 8}) {
+				t.Errorf("Expected the panels to be laid out in rows, got %+v", panels)
+			}
+			target := panels[2].Targets[0]
+			if target.Expr != "sum by (code) (rate(http_requests_total[5m]))" || target.LegendFormat != "{{code}}" || target.Datasource == nil || target.Datasource.UID != "prom" {
+				t.Errorf("Unexpected target %+v", target)
+			}
+
+			if !tc.expectedSaved {
+				if resp.Saved != nil || !slices.Equal(resp.Dashboard.Tags, []string{"http"}) {
+					t.Errorf("Expected an unsaved dashboard, got %+v", resp)
+				}
+				return
+			}
+			if resp.Saved == nil || resp.Saved.UID != "gen-1" || resp.Saved.FolderUID != "team" || !slices.Equal(resp.Dashboard.Tags, []string{draftTag, "http"}) {
+				t.Errorf("Unexpected saved dashboard %+v, tags %v", resp.Saved, resp.Dashboard.Tags)
+			}
+			if saved[0]["folderUid"] != "team" || saved[0]["overwrite"] != false {
+				t.Errorf("Expected a new dashboard in the folder, got %+v", saved[0])
+			}
+		})
+	}
+}
+
+func TestDashboardModel(t *testing.T) {
+	ref := dataSourceRef{Type: "prometheus", UID: "prom"}
+	testCases := []struct {
+		name      string
+		dashboard string
+	}{
+		{name: "rows", dashboard: testGeneratedDashboard},
+		{name: "sizes out of range", dashboard: `{"title":"Sizes","panels":[
+			{"title":"Wide","type":"timeseries","width":30,"height":50,"queries":[{"query":"up"},{"query":"up"}]},
+			{"title":"Default","type":"table","queries":[{"query":"up"}]},
+			{"title":"Narrow","type":"gauge","width":-1,"height":1,"queries":[{"query":"up"}]},
+			{"title":"Default too","type":"heatmap","queries":[{"query":"up"}]}
+		]}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var d generatedDashboard
+			if err := json.Unmarshal([]byte(tc.dashboard), &d); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkDashboardModel(d.dashboardModel(ref, dashboardTags(d.Tags)), ref); err != nil {
+				t.Errorf("Expected a valid dashboard model, got %v", err)
+			}
+		})
+	}
+}
+
+// checkDashboardModel checks a dashboard JSON model against the parts of
+// Grafana's dashboard schema generated dashboards use: the required keys and
+// their types, the grid, unique panel IDs and query refIDs, and units and
+// data sources.
+func checkDashboardModel(model map[string]any, ref dataSourceRef) error {
+	// The model is checked as Grafana will read it, after encoding.
+	encoded, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	var dashboard struct {
+		Title         *string `json:"title"`
+		SchemaVersion *int    `json:"schemaVersion"`
+		Time          *struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"time"`
+		Panels []struct {
+			ID          *int64                    `json:"id"`
+			Type        string                    `json:"type"`
+			Title       string                    `json:"title"`
+			Datasource  *dataSourceRef            `json:"datasource"`
+			GridPos     *struct{ X, Y, W, H int } `json:"gridPos"`
+			FieldConfig struct {
+				Defaults struct {
+					Unit string `json:"unit"`
+				} `json:"defaults"`
+			} `json:"fieldConfig"`
+			Targets []struct {
+				RefID      string         `json:"refId"`
+				Datasource *dataSourceRef `json:"datasource"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(encoded, &dashboard); err != nil {
+		return fmt.Errorf("the dashboard doesn't match the schema: %w", err)
+	}
+
+	switch {
+	case dashboard.Title == nil || strings.TrimSpace(*dashboard.Title) == "":
+		return errors.New("the dashboard has no title")
+	case dashboard.SchemaVersion == nil || *dashboard.SchemaVersion <= 0:
+		return errors.New("the dashboard has no schema version")
+	case dashboard.Time == nil || dashboard.Time.From == "" || dashboard.Time.To == "":
+		return errors.New("the dashboard has no time range")
+	case len(dashboard.Panels) == 0:
+		return errors.New("the dashboard has no panels")
+	}
+
+	ids := make(map[int64]bool)
+	cells := make(map[[2]int]bool)
+	for i, p := range dashboard.Panels {
+		name := fmt.Sprintf("panel %d", i+1)
+		switch {
+		case p.ID == nil || *p.ID <= 0 || ids[*p.ID]:
+			return fmt.Errorf("%s has no unique ID", name)
+		case !slices.Contains(generatedPanelTypes, p.Type):
+			return fmt.Errorf("%s has the unknown type %q", name, p.Type)
+		case strings.TrimSpace(p.Title) == "":
+			return fmt.Errorf("%s has no title", name)
+		case p.Datasource == nil || *p.Datasource != ref:
+			return fmt.Errorf("%s doesn't use the data source %s", name, ref.UID)
+		case p.GridPos == nil || p.GridPos.W < 1 || p.GridPos.H < 1 || p.GridPos.X < 0 || p.GridPos.Y < 0 || p.GridPos.X+p.GridPos.W > dashboardGridColumns:
+			return fmt.Errorf("%s is not within the grid", name)
+		case p.FieldConfig.Defaults.Unit != "" && !slices.Contains(grafanaUnits, p.FieldConfig.Defaults.Unit):
+			return fmt.Errorf("%s has the unknown unit %q", name, p.FieldConfig.Defaults.Unit)
+		case len(p.Targets) == 0:
+			return fmt.Errorf("%s has no queries", name)
+		}
+		ids[*p.ID] = true
+
+		refIDs := make(map[string]bool)
+		for _, t := range p.Targets {
+			if t.RefID == "" || refIDs[t.RefID] {
+				return fmt.Errorf("%s has queries without unique refIds", name)
+			}
+			if t.Datasource == nil || *t.Datasource != ref {
+				return fmt.Errorf("query %s of %s doesn't use the data source %s", t.RefID, name, ref.UID)
+			}
+			refIDs[t.RefID] = true
+		}
+
+		for x := p.GridPos.X; x < p.GridPos.X+p.GridPos.W; x++ {
+			for y := p.GridPos.Y; y < p.GridPos.Y+p.GridPos.H; y++ {
+				if cells[[2]int{x, y}] {
+					return fmt.Errorf("%s overlaps another panel", name)
+				}
+				cells[[2]int{x, y}] = true
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Downsampling methods for series included point by point.
+const (
+	downsampleNone = "none"
+	// downsampleLTTB keeps the points that preserve the visual shape, see
+	// Steinarsson, "Downsampling Time Series for Visual Representation".
+	downsampleLTTB = "lttb"
+	// downsampleMinMax keeps the minimum and maximum of each bucket.
+	downsampleMinMax = "minmax"
+)
+
+const (
+	// defaultDownsamplePoints is the default number of points per series.
+	defaultDownsamplePoints = 30
+
+	// maxDownsamplePoints bounds the points per series.
+	maxDownsamplePoints = 500
+)
+
+// seriesPoint is a point of a downsampled series.
+type seriesPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+func validDownsample(method string) bool {
+	return method == "" || method == downsampleNone || method == downsampleLTTB || method == downsampleMinMax
+}
+
+// downsample reduces a series to at most threshold points with method.
+// Series that are short enough are returned unchanged.
+func downsample(values []float64, times []time.Time, method string, threshold int) []seriesPoint {
+	points := make([]seriesPoint, len(values))
+	for i, v := range values {
+		points[i] = seriesPoint{Time: times[i], Value: v}
+	}
+	if len(points) <= threshold {
+		return points
+	}
+	switch method {
+	case downsampleLTTB:
+		return lttb(points, threshold)
+	case downsampleMinMax:
+		return minMaxBuckets(points, threshold)
+	default:
+		return points
+	}
+}
+
+// lttb implements Largest-Triangle-Three-Buckets. The first and last points
+// are kept; of every bucket in between, the point forming the largest
+// triangle with the previously kept point and the average of the next bucket
+// is kept.
+func lttb(points []seriesPoint, threshold int) []seriesPoint {
+	if threshold < 3 {
+		threshold = 3
+	}
+	result := make([]seriesPoint, 0, threshold)
+	result = append(result, points[0])
+
+	bucketSize := float64(len(points)-2) / float64(threshold-2)
+	kept := 0
+	for i := 0; i < threshold-2; i++ {
+		start := int(float64(i)*bucketSize) + 1
+		end := int(float64(i+1)*bucketSize) + 1
+
+		// Average of the next bucket; the last point for the last bucket
+		nextStart, nextEnd := end, min(int(float64(i+2)*bucketSize)+1, len(points))
+		if i == threshold-3 {
+			nextStart, nextEnd = len(points)-1, len(points)
+		}
+		var avgX, avgY float64
+		for _, p := range points[nextStart:nextEnd] {
+			avgX += float64(p.Time.UnixMilli())
+			avgY += p.Value
+		}
+		avgX /= float64(nextEnd - nextStart)
+		avgY /= float64(nextEnd - nextStart)
+
+		ax, ay := float64(points[kept].Time.UnixMilli()), points[kept].Value
+		best, bestArea := start, -1.0
+		for j := start; j < end; j++ {
+			area := math.Abs((ax-avgX)*(points[j].Value-ay) - (ax-float64(points[j].Time.UnixMilli()))*(avgY-ay))
+			if area > bestArea {
+				best, bestArea = j, area
+			}
+		}
+		result = append(result, points[best])
+		kept = best
+	}
+
+	return append(result, points[len(points)-1])
+}
+
+// minMaxBuckets splits the series into threshold/2 buckets and keeps the
+// minimum and maximum of each, in time order.
+func minMaxBuckets(points []seriesPoint, threshold int) []seriesPoint {
+	buckets := max(threshold/2, 1)
+	bucketSize := float64(len(points)) / float64(buckets)
+	result := make([]seriesPoint, 0, 2*buckets)
+	for i := 0; i < buckets; i++ {
+		start, end := int(float64(i)*bucketSize), int(float64(i+1)*bucketSize)
+		if i == buckets-1 {
+			end = len(points)
+		}
+		lo, hi := start, start
+		for j := start; j < end; j++ {
+			if points[j].Value < points[lo].Value {
+				lo = j
+			}
+			if points[j].Value > points[hi].Value {
+				hi = j
+			}
+		}
+		switch {
+		case lo == hi:
+			result = append(result, points[lo])
+		case lo < hi:
+			result = append(result, points[lo], points[hi])
+		default:
+			result = append(result, points[hi], points[lo])
+		}
+	}
+	return result
+}
+
+// writeSeriesPoints renders points with their offset from the start of the
+// time range as ISO 8601 durations, which is shorter than full timestamps.
+func writeSeriesPoints(b *strings.Builder, points []seriesPoint, from time.Time) {
+	values := make([]string, len(points))
+	for i, p := range points {
+		values[i] = isoDuration(p.Time.Sub(from)) + "=" + formatNumber(p.Value)
+	}
+	fmt.Fprintf(b, "    Points (offset from %s): %s\n", from.UTC().Format(time.RFC3339), strings.Join(values, ", "))
+}
+
+// isoDuration formats d as an ISO 8601 duration with second precision, e.g.
+// PT1H30M or P2DT4H.
+func isoDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	d = d.Truncate(time.Second)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours, minutes, seconds := d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second
+
+	var b strings.Builder
+	b.WriteString(sign + "P")
+	if days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+	}
+	if hours > 0 || minutes > 0 || seconds > 0 || days == 0 {
+		b.WriteString("T")
+		if hours > 0 {
+			fmt.Fprintf(&b, "%dH", hours)
+		}
+		if minutes > 0 {
+			fmt.Fprintf(&b, "%dM", minutes)
+		}
+		if seconds > 0 || hours == 0 && minutes == 0 {
+			fmt.Fprintf(&b, "%dS", seconds)
+		}
+	}
+	return b.String()
+}
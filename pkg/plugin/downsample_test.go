@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	// A flat series with a single spike and a single dip
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = 10
+	}
+	values[321], values[777] = 100, -50
+	times := testTimes(len(values))
+
+	for _, method := range []string{downsampleLTTB, downsampleMinMax} {
+		t.Run(method, func(t *testing.T) {
+			points := downsample(values, times, method, 20)
+
+			if len(points) > 20 {
+				t.Errorf("Expected at most 20 points, got %d", len(points))
+			}
+			var spike, dip bool
+			for i, p := range points {
+				if i > 0 && !p.Time.After(points[i-1].Time) {
+					t.Fatalf("Points are not in time order at %d", i)
+				}
+				spike = spike || p.Value == 100 && p.Time.Equal(times[321])
+				dip = dip || p.Value == -50 && p.Time.Equal(times[777])
+			}
+			if !spike || !dip {
+				t.Errorf("Expected spike and dip to be kept, got %+v", points)
+			}
+		})
+	}
+
+	if points := lttb(downsample(values, times, downsampleNone, 20), 20); !points[0].Time.Equal(times[0]) || !points[19].Time.Equal(times[999]) {
+		t.Errorf("Expected LTTB to keep the first and last point")
+	}
+	if points := downsample(values[:10], times[:10], downsampleLTTB, 20); len(points) != 10 {
+		t.Errorf("Expected short series to be kept, got %d points", len(points))
+	}
+}
+
+func TestIsoDuration(t *testing.T) {
+	testCases := map[time.Duration]string{
+		0:                                    "PT0S",
+		90 * time.Second:                     "PT1M30S",
+		2*time.Hour + 15*time.Minute:         "PT2H15M",
+		50*time.Hour + 1500*time.Millisecond: "P2DT2H1S",
+		48 * time.Hour:                       "P2D",
+		-5 * time.Minute:                     "-PT5M",
+	}
+	for d, want := range testCases {
+		if got := isoDuration(d); got != want {
+			t.Errorf("Expected %v to be %s, got %s", d, want, got)
+		}
+	}
+}
+
+func TestSummaryPoints(t *testing.T) {
+	times := testTimes(100)
+	values := make([]float64, 100)
+	for i := range values {
+		values[i] = float64(i)
+	}
+
+	s := summarizeSeries(values, times, summaryConfig{Detail: detailMinimal, Downsample: downsampleLTTB, Points: 5})
+	if len(s.Points) != 5 {
+		t.Fatalf("Expected 5 points, got %d", len(s.Points))
+	}
+
+	var b strings.Builder
+	writePanelSummary(&b, panelContext{Summaries: []seriesSummary{s}}, detailMinimal, times[0])
+	if !strings.Contains(b.String(), "Points (offset from 2025-06-01T00:00:00Z): PT0S=0, ") || !strings.Contains(b.String(), "PT1H39M=99") {
+		t.Errorf("Expected points relative to the range start:\n%s", b.String())
+	}
+}
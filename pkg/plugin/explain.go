@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const explainPanelInstructions = `You explain a single Grafana panel to an engineer who clicked "Explain" on it.
+Answer with a JSON object with these keys:
+- "shows": what the panel measures and how to read it, in one or two sentences
+- "currentState": the current state, citing the latest values and thresholds, in one or two sentences
+- "notableChanges": an array of short sentences on spikes, shifts, trends or anomalies in the time range; empty if there are none
+- "followUps": an array of up to three suggested next steps or questions to investigate
+Base the answer only on the panel data below. Don't invent values.`
+
+// explainPanelRequest is the body accepted by /explain-panel. Times are Unix
+// milliseconds.
+type explainPanelRequest struct {
+	Model        string `json:"model"`
+	DashboardUID string `json:"dashboardUid"`
+	PanelID      int64  `json:"panelId"`
+	From         int64  `json:"from"`
+	To           int64  `json:"to"`
+}
+
+// panelExplanation is the structured explanation of a panel.
+type panelExplanation struct {
+	Shows          string   `json:"shows"`
+	CurrentState   string   `json:"currentState"`
+	NotableChanges []string `json:"notableChanges"`
+	FollowUps      []string `json:"followUps"`
+}
+
+// handleExplainPanel explains a single panel. The context is built from the
+// panel alone: its title, description, queries, unit, thresholds and
+// summarized data, and the anomalies found in it.
+func (ds *Datasource) handleExplainPanel(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "explain.handle")
+	defer span.End()
+
+	apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req explainPanelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	req.Model = orDefaultString(req.Model, defaultChatModel)
+	if !validModel(req.Model) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+		return
+	}
+	contextReq := contextRequest{DashboardUID: req.DashboardUID, From: req.From, To: req.To, PanelIDs: []int64{req.PanelID}}
+	if reqErr := contextReq.validate(); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	span.SetAttributes(attribute.String(attrModel, req.Model), attribute.Int64(attrPanelID, req.PanelID))
+
+	dc, reqErr := ds.loadDashboardContext(ctx, r, contextReq)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	if len(dc.Panels) == 0 {
+		writeRequestError(w, span, &requestError{status: http.StatusNotFound, code: errCodeNotFound, message: "Panel not found"})
+		return
+	}
+	panel := dc.Panels[0]
+	dc.Instructions = explainPanelInstructions
+
+	question := []chatMessage{{Role: "user", Content: fmt.Sprintf("Explain panel %d %q.", panel.ID, panel.Title)}}
+	messages, budget, reqErr := ds.fitContextWindow(ctx, req.Model, dc, question)
+	if reqErr == nil && len(budget.DroppedPanels) > 0 {
+		reqErr = &requestError{status: http.StatusBadRequest, code: errCodeContextTooLong, message: "Panel data too large for the model's context window"}
+	}
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	var explanation panelExplanation
+	chatReq := &chatRequest{Model: req.Model, Messages: messages, DashboardUID: req.DashboardUID}
+	if _, reqErr := ds.completeJSON(ctx, apiKey, "explain-panel", chatReq, &explanation); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Explained panel", "dashboard", req.DashboardUID, "panel", req.PanelID)
+
+	writeJSON(w, map[string]any{
+		"dashboardUid": dc.UID,
+		"panelId":      panel.ID,
+		"title":        panel.Title,
+		"explanation":  explanation,
+		"budget":       budget,
+	})
+}
@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestHandleExplainPanel(t *testing.T) {
+	grafana := newTestGrafana(t, nil)
+
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		answer         string
+		expectedStatus int
+	}{
+		{name: "valid", method: "POST", body: `{"dashboardUid":"dash-1","panelId":2,"from":1700000000000,"to":1700003600000}`,
+			answer: `{"shows":"Requests per second","currentState":"4 req/s","notableChanges":["Rising"],"followUps":["Check errors"]}`, expectedStatus: http.StatusOK},
+		{name: "wrong method", method: "GET", expectedStatus: http.StatusMethodNotAllowed},
+		{name: "invalid model", method: "POST", body: `{"model":"bad model","dashboardUid":"dash-1","panelId":2,"from":1,"to":2}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid time range", method: "POST", body: `{"dashboardUid":"dash-1","panelId":2,"from":2,"to":1}`, expectedStatus: http.StatusBadRequest},
+		{name: "panel not found", method: "POST", body: `{"dashboardUid":"dash-1","panelId":99,"from":1,"to":2}`, expectedStatus: http.StatusNotFound},
+		{name: "invalid answer", method: "POST", body: `{"dashboardUid":"dash-1","panelId":2,"from":1,"to":2}`, answer: "The panel shows requests.", expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var sent groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: tc.answer}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest(tc.method, "/explain-panel", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleExplainPanel(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			if sent.ResponseFormat == nil || sent.ResponseFormat.Type != "json_object" || sent.Model != defaultChatModel {
+				t.Errorf("Expected a JSON mode request with the default model, got %+v", sent)
+			}
+			system := sent.Messages[0].Content
+			if !strings.Contains(system, `"currentState"`) || !strings.Contains(system, "Request rate") || !strings.Contains(system, "80 red") || strings.Contains(system, "Slow queries") {
+				t.Errorf("Expected a prompt focused on the panel, got %q", system)
+			}
+
+			var resp struct {
+				PanelID     int64            `json:"panelId"`
+				Title       string           `json:"title"`
+				Explanation panelExplanation `json:"explanation"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.PanelID != 2 || resp.Title != "Request rate" || resp.Explanation.CurrentState != "4 req/s" || len(resp.Explanation.FollowUps) != 1 {
+				t.Errorf("Unexpected explanation: %+v", resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const explainQueryInstructions = `You review a query of a Grafana panel for an engineer.
+Answer with a JSON object with these keys:
+- "explanation": what the query computes, step by step, in plain language; two to five sentences
+- "issues": an array of possible mistakes or inefficiencies, each an object with "issue", "severity" ("high", "medium" or "low") and "suggestion"; empty if there are none. Don't repeat the issues the checks below already found.
+- "optimizedQuery": a corrected or faster version of the query in the same language, keeping the variables it uses; an empty string if the query is fine as it is
+- "optimizationNotes": what the optimized query changes and why, in one or two sentences; empty if there's no optimized query`
+
+// explainQueryRequest is the body accepted by /explain-query. RefID selects
+// the panel's query; it defaults to the first one.
+type explainQueryRequest struct {
+	Model        string `json:"model"`
+	DashboardUID string `json:"dashboardUid"`
+	PanelID      int64  `json:"panelId"`
+	RefID        string `json:"refId"`
+}
+
+// queryExplanation is the model's review of a query.
+type queryExplanation struct {
+	Explanation       string       `json:"explanation"`
+	Issues            []queryIssue `json:"issues"`
+	OptimizedQuery    string       `json:"optimizedQuery"`
+	OptimizationNotes string       `json:"optimizationNotes"`
+}
+
+// logQLHints are fragments only LogQL queries have, to tell them from PromQL
+// when the data source type is unknown.
+var logQLHints = []string{"|=", "|~", "| json", "| logfmt", "| pattern", "| line_format", "count_over_time({", "rate({", "bytes_over_time({"}
+
+// queryLanguage detects the language of a panel query from its data source
+// type and, for unknown data sources, from the fields of the query.
+func queryLanguage(dsType string, target panelTarget) string {
+	text := target.queryText()
+	switch {
+	case dsType == "prometheus":
+		return queryLanguagePromQL
+	case dsType == "loki":
+		return queryLanguageLogQL
+	case sqlDialect(dsType) != "" || strings.Contains(dsType, "mssql"):
+		return queryLanguageSQL
+	case strings.Contains(dsType, "influxdb"):
+		if strings.Contains(text, "|>") {
+			return queryLanguageFlux
+		}
+		return ""
+	case dsType != "":
+		return ""
+	}
+
+	if _, ok := target.model["rawSql"].(string); ok {
+		return queryLanguageSQL
+	}
+	if strings.Contains(text, "|>") {
+		return queryLanguageFlux
+	}
+	if _, ok := target.model["expr"].(string); ok {
+		for _, hint := range logQLHints {
+			if strings.Contains(text, hint) {
+				return queryLanguageLogQL
+			}
+		}
+		return queryLanguagePromQL
+	}
+	return ""
+}
+
+// queryDataSourceType returns the type of the data source a panel query
+// runs on. References without a type are looked up; if that fails, e.g.
+// because the caller may query but not read the data source, the type is
+// left empty.
+func queryDataSourceType(ctx context.Context, client *grafanaClient, panel dashboardPanel, target panelTarget, variables []dashboardVariable) string {
+	ref := target.Datasource
+	if ref == nil || ref.UID == mixedDataSourceUID {
+		ref = panel.Datasource
+	}
+	if ref == nil || ref.UID == "" && ref.Name == "" {
+		return ""
+	}
+	resolved := interpolateRef(*ref, variables)
+	if resolved.Type != "" && !strings.Contains(resolved.Type, "$") {
+		return resolved.Type
+	}
+
+	path := "/api/datasources/uid/" + url.PathEscape(resolved.UID)
+	if resolved.UID == "" {
+		path = "/api/datasources/name/" + url.PathEscape(resolved.Name)
+	}
+	var lookedUp dataSourceRef
+	if err := client.get(ctx, path, &lookedUp); err != nil {
+		log.DefaultLogger.Warn("Failed to look up data source", "uid", resolved.UID, "name", resolved.Name, "error", err)
+		return ""
+	}
+	return lookedUp.Type
+}
+
+// validateOptimizedQuery checks the model's optimized query with the
+// parser or validator of its language, if there is one.
+func validateOptimizedQuery(query, language, dialect string, variables []dashboardVariable) error {
+	switch language {
+	case queryLanguagePromQL:
+		node, err := parsePromQL(expandPromQL(query, variables))
+		if err != nil {
+			return err
+		}
+		if t := node.Type(); t != promScalar && t != promInstantVector {
+			return fmt.Errorf("the query returns a %s", t)
+		}
+	case queryLanguageSQL:
+		_, err := validateSQL(query, orDefaultString(dialect, sqlDialectPostgres))
+		return err
+	}
+	return nil
+}
+
+// handleExplainQuery explains a panel's query, lists possible mistakes and
+// suggests an optimized version. The query language is detected from the
+// dashboard JSON; mistakes the backend can find itself are checked before
+// the model is asked.
+func (ds *Datasource) handleExplainQuery(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "explain_query.handle")
+	defer span.End()
+
+	apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req explainQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	req.Model = orDefaultString(req.Model, defaultChatModel)
+	if !validModel(req.Model) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+		return
+	}
+	if !dashboardUIDRegex.MatchString(req.DashboardUID) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidDashboard, message: "Invalid dashboard UID"})
+		return
+	}
+	span.SetAttributes(attribute.String(attrModel, req.Model), attribute.Int64(attrPanelID, req.PanelID))
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Error("Cannot call Grafana API", "error", err)
+		writeRequestError(w, span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+		return
+	}
+	var dash dashboardResponse
+	if err := client.get(ctx, "/api/dashboards/uid/"+url.PathEscape(req.DashboardUID), &dash); err != nil {
+		log.DefaultLogger.Warn("Failed to load dashboard", "uid", req.DashboardUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Dashboard"))
+		return
+	}
+
+	panels := flattenPanels(dash.Dashboard.Panels)
+	i := slices.IndexFunc(panels, func(p dashboardPanel) bool { return p.ID == req.PanelID })
+	if i < 0 {
+		writeRequestError(w, span, &requestError{status: http.StatusNotFound, code: errCodeNotFound, message: "Panel not found"})
+		return
+	}
+	panel := panels[i]
+	j := slices.IndexFunc(panel.Targets, func(t panelTarget) bool {
+		return (req.RefID == "" || t.RefID == req.RefID) && t.queryText() != ""
+	})
+	if j < 0 {
+		writeRequestError(w, span, &requestError{status: http.StatusNotFound, code: errCodeNotFound, message: "Query not found"})
+		return
+	}
+	target := panel.Targets[j]
+	variables := dash.Dashboard.Templating.List
+
+	dsType := queryDataSourceType(ctx, client, panel, target, variables)
+	language := queryLanguage(dsType, target)
+	if language == "" {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidQuery, message: "Unsupported query language"})
+		return
+	}
+	span.SetAttributes(attribute.String("explain_query.language", language))
+
+	query := truncate(target.queryText(), maxContextQuery)
+	check := queryCheck{Query: query, Language: language, Dialect: sqlDialect(dsType), PanelType: panel.Type, variables: variables}
+	check.Format, _ = target.model["format"].(string)
+	check.Legend, _ = target.model["legendFormat"].(string)
+	issues := append([]queryIssue{}, checkQuery(check)...)
+
+	var b strings.Builder
+	b.WriteString(explainQueryInstructions)
+	fmt.Fprintf(&b, "\n\nPanel: %q (%s)\n", truncate(stripHTML(panel.Title), maxContextTitle), truncate(panel.Type, maxContextTitle))
+	if dsType != "" {
+		fmt.Fprintf(&b, "Data source type: %s\n", truncate(dsType, maxContextTitle))
+	}
+	fmt.Fprintf(&b, "Language: %s\n", language)
+	if check.Legend != "" {
+		fmt.Fprintf(&b, "Legend: %s\n", truncate(check.Legend, maxContextTitle))
+	}
+	for _, v := range variables[:min(len(variables), maxContextVariables)] {
+		fmt.Fprintf(&b, "Variable $%s = %s\n", truncate(v.Name, maxContextTitle), truncate(variableText(v.Current.Text), maxContextTitle))
+	}
+	if len(issues) > 0 {
+		b.WriteString("Issues the checks found:\n")
+		for _, issue := range issues {
+			fmt.Fprintf(&b, "- [%s] %s\n", issue.Severity, issue.Issue)
+		}
+	}
+
+	messages := []chatMessage{
+		{Role: "system", Content: b.String()},
+		{Role: "user", Content: fmt.Sprintf("Explain this query:\n%s", query)},
+	}
+	var explanation queryExplanation
+	chatReq := &chatRequest{Model: req.Model, Messages: messages, DashboardUID: req.DashboardUID}
+	if _, reqErr := ds.completeJSON(ctx, apiKey, "explain-query", chatReq, &explanation); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	for _, issue := range explanation.Issues {
+		if issue.Issue == "" {
+			continue
+		}
+		if !slices.Contains(concernSeverities, issue.Severity) {
+			issue.Severity = "medium"
+		}
+		issue.Source = "model"
+		issues = append(issues, issue)
+	}
+	slices.SortStableFunc(issues, func(a, b queryIssue) int {
+		return slices.Index(concernSeverities, a.Severity) - slices.Index(concernSeverities, b.Severity)
+	})
+
+	// An optimized query that doesn't parse would only mislead; the
+	// explanation and the issues stay useful without it.
+	optimized := strings.TrimSpace(explanation.OptimizedQuery)
+	if optimized == query {
+		optimized = ""
+	}
+	if optimized != "" {
+		if err := validateOptimizedQuery(optimized, language, check.Dialect, variables); err != nil {
+			log.DefaultLogger.Info("Dropped invalid optimized query", "language", language, "error", err)
+			optimized, explanation.OptimizationNotes = "", ""
+		}
+	}
+	if optimized == "" {
+		explanation.OptimizationNotes = ""
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Explained query", "dashboard", req.DashboardUID, "panel", req.PanelID, "language", language)
+
+	writeJSON(w, map[string]any{
+		"dashboardUid":      req.DashboardUID,
+		"panelId":           panel.ID,
+		"title":             truncate(stripHTML(panel.Title), maxContextTitle),
+		"refId":             target.RefID,
+		"datasourceType":    dsType,
+		"language":          language,
+		"query":             query,
+		"explanation":       explanation.Explanation,
+		"issues":            issues,
+		"optimizedQuery":    optimized,
+		"optimizationNotes": explanation.OptimizationNotes,
+	})
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestHandleExplainQuery(t *testing.T) {
+	grafana := newTestGrafana(t, nil)
+
+	testCases := []struct {
+		name              string
+		body              string
+		answer            string
+		expectedStatus    int
+		expectedLanguage  string
+		expectedIssues    []string
+		expectedOptimized string
+	}{
+		{name: "promql", body: `{"dashboardUid":"dash-1","panelId":2}`,
+			answer: `{"explanation":"Sums the request rate.","issues":[{"issue":"No error ratio","severity":"urgent","suggestion":"Divide by errors"}],` +
+				`"optimizedQuery":"sum(rate(http_requests_total[$__rate_interval]))","optimizationNotes":"Adapts the range."}`,
+			expectedStatus: http.StatusOK, expectedLanguage: queryLanguagePromQL,
+			expectedIssues: []string{"model:medium:No error ratio", "check:low:The rate range [5m] is fixed"}, expectedOptimized: "sum(rate(http_requests_total[$__rate_interval]))"},
+		{name: "invalid optimized promql", body: `{"dashboardUid":"dash-1","panelId":2,"refId":"B"}`,
+			answer:         `{"explanation":"Whether targets are up.","issues":[],"optimizedQuery":"rate(up)","optimizationNotes":"Faster."}`,
+			expectedStatus: http.StatusOK, expectedLanguage: queryLanguagePromQL, expectedIssues: []string{}},
+		{name: "sql", body: `{"dashboardUid":"dash-1","panelId":4}`,
+			answer:         `{"explanation":"Lists slow queries.","issues":[],"optimizedQuery":"DELETE FROM slow_queries","optimizationNotes":"Cleans up."}`,
+			expectedStatus: http.StatusOK, expectedLanguage: queryLanguageSQL, expectedIssues: []string{"check:low:SELECT * reads all columns"}},
+		{name: "panel without queries", body: `{"dashboardUid":"dash-1","panelId":1}`, expectedStatus: http.StatusNotFound},
+		{name: "unknown query", body: `{"dashboardUid":"dash-1","panelId":2,"refId":"Z"}`, expectedStatus: http.StatusNotFound},
+		{name: "panel not found", body: `{"dashboardUid":"dash-1","panelId":99}`, expectedStatus: http.StatusNotFound},
+		{name: "forbidden dashboard", body: `{"dashboardUid":"secret","panelId":2}`, expectedStatus: http.StatusForbidden},
+		{name: "invalid dashboard", body: `{"dashboardUid":"../x","panelId":2}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var sent groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: tc.answer}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest("POST", "/explain-query", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleExplainQuery(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			system := sent.Messages[0].Content
+			if !strings.Contains(system, "Language: "+tc.expectedLanguage) || !strings.Contains(system, "Variable $env = prod") {
+				t.Errorf("Expected the query's context in the prompt, got %q", system)
+			}
+
+			var resp struct {
+				Language          string       `json:"language"`
+				Query             string       `json:"query"`
+				Explanation       string       `json:"explanation"`
+				Issues            []queryIssue `json:"issues"`
+				OptimizedQuery    string       `json:"optimizedQuery"`
+				OptimizationNotes string       `json:"optimizationNotes"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Language != tc.expectedLanguage || resp.Explanation == "" || !strings.Contains(sent.Messages[1].Content, resp.Query) {
+				t.Errorf("Unexpected response: %+v", resp)
+			}
+			issues := []string{}
+			for _, issue := range resp.Issues {
+				issues = append(issues, issue.Source+":"+issue.Severity+":"+issue.Issue)
+			}
+			if len(issues) != len(tc.expectedIssues) {
+				t.Fatalf("Expected issues %v, got %v", tc.expectedIssues, issues)
+			}
+			for i := range issues {
+				if !strings.HasPrefix(issues[i], tc.expectedIssues[i]) {
+					t.Errorf("Expected issue %q, got %q", tc.expectedIssues[i], issues[i])
+				}
+			}
+			if resp.OptimizedQuery != tc.expectedOptimized || (resp.OptimizationNotes == "") != (tc.expectedOptimized == "") {
+				t.Errorf("Unexpected optimized query %q, notes %q", resp.OptimizedQuery, resp.OptimizationNotes)
+			}
+		})
+	}
+}
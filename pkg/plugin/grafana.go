@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// identityHeaders are the request headers that carry the caller's identity.
+// Grafana sets them on resource calls depending on its configuration, e.g.
+// Authorization with OAuth pass-through and X-Grafana-Id with ID forwarding.
+var identityHeaders = []string{
+	backend.OAuthIdentityTokenHeaderName,
+	backend.OAuthIdentityIDTokenHeaderName,
+	backend.GrafanaUserSignInTokenHeaderName,
+	backend.CookiesHeaderName,
+}
+
+// grafanaClient calls Grafana's HTTP API on behalf of the calling user, so
+// that the API enforces the user's permissions.
+type grafanaClient struct {
+	baseURL string
+	headers http.Header
+	client  *http.Client
+}
+
+// grafanaStatusError is returned when Grafana answers with a non-2xx status.
+type grafanaStatusError struct {
+	path   string
+	status int
+
+	// body is the start of the response body, which may describe the error.
+	body []byte
+}
+
+func (e *grafanaStatusError) Error() string {
+	return fmt.Sprintf("grafana API %s returned status %d", e.path, e.status)
+}
+
+// newGrafanaClient creates a client that forwards the identity of r's caller.
+func (ds *Datasource) newGrafanaClient(r *http.Request) (*grafanaClient, error) {
+	baseURL := ds.grafanaURL(r.Context())
+	if baseURL == "" {
+		return nil, fmt.Errorf("grafana URL not configured, set %s or GF_APP_URL", envGrafanaURL)
+	}
+
+	headers := http.Header{}
+	for _, name := range identityHeaders {
+		if value := r.Header.Get(name); value != "" {
+			headers.Set(name, value)
+		}
+	}
+	if orgID := backend.PluginConfigFromContext(r.Context()).OrgID; orgID != 0 {
+		headers.Set("X-Grafana-Org-Id", strconv.FormatInt(orgID, 10))
+	}
+
+	return &grafanaClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		headers: headers,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// grafanaURL returns the configured Grafana URL, falling back to the app URL
+// Grafana passes to the plugin and then to GF_APP_URL.
+func (ds *Datasource) grafanaURL(ctx context.Context) string {
+	if ds.config.GrafanaURL != "" {
+		return ds.config.GrafanaURL
+	}
+	return appURL(ctx)
+}
+
+// get decodes the JSON response of a GET request to path into out.
+func (c *grafanaClient) get(ctx context.Context, path string, out any) error {
+	return c.do(ctx, http.MethodGet, path, nil, out)
+}
+
+// post sends body as JSON to path and decodes the JSON response into out.
+func (c *grafanaClient) post(ctx context.Context, path string, body, out any) error {
+	return c.do(ctx, http.MethodPost, path, body, out)
+}
+
+func (c *grafanaClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return &grafanaStatusError{path: path, status: resp.StatusCode, body: body}
+	}
+	// Limit the response size (32MB)
+	return json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(out)
+}
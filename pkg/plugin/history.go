@@ -0,0 +1,219 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// defaultHistoryModel writes the summaries unless configured otherwise.
+	defaultHistoryModel = "llama-3.1-8b-instant"
+
+	defaultHistoryMaxTurns  = 20
+	defaultHistoryKeepTurns = 5
+
+	// maxConversationMessages bounds the messages of a chat request. Longer
+	// histories are summarized, so this only guards against abuse.
+	maxConversationMessages = 1000
+
+	// maxHistoryChunkTokens bounds the turns summarized in one call. Longer
+	// histories are summarized chunk by chunk, each call extending the
+	// summary of the previous one.
+	maxHistoryChunkTokens = 16000
+
+	// maxHistorySummaries bounds the summaries kept for reuse.
+	maxHistorySummaries = 1000
+
+	// historySummaryTimeout bounds the time spent summarizing a history.
+	historySummaryTimeout = 30 * time.Second
+
+	// historySummaryPrefix starts the system message holding the summary.
+	historySummaryPrefix = "Summary of the earlier conversation:\n"
+)
+
+const historySummaryInstructions = `You summarize the earlier part of a conversation between a user and an assistant investigating Grafana dashboards.
+Keep the questions asked, findings with their numbers, times and names, hypotheses confirmed or ruled out, actions taken and open questions.
+Leave out pleasantries. Write plain text of at most 300 words.`
+
+// historySummaries keeps recent summaries keyed by the turns they cover, so
+// that a growing conversation only summarizes the turns added since the last
+// request.
+type historySummaries struct {
+	mu      sync.Mutex
+	entries map[string]string
+	order   []string
+}
+
+func newHistorySummaries() *historySummaries {
+	return &historySummaries{entries: make(map[string]string)}
+}
+
+func (h *historySummaries) get(key string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	summary, ok := h.entries[key]
+	return summary, ok
+}
+
+func (h *historySummaries) put(key, summary string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.entries[key]; ok {
+		return
+	}
+	if len(h.order) >= maxHistorySummaries {
+		delete(h.entries, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.entries[key] = summary
+	h.order = append(h.order, key)
+}
+
+// historyKeys returns a key for every prefix of messages: keys[i] covers
+// messages[:i+1]. Each key chains the previous one, so the keys of a
+// conversation stay the same as it grows.
+func historyKeys(model string, messages []chatMessage) []string {
+	keys := make([]string, len(messages))
+	prev := model
+	for i, msg := range messages {
+		sum := sha256.Sum256([]byte(prev + "\x00" + msg.Role + "\x00" + msg.Content))
+		keys[i] = hex.EncodeToString(sum[:])
+		prev = keys[i]
+	}
+	return keys
+}
+
+// compressHistory replaces the older turns of a long conversation with a
+// summary written by the history model. System messages and the latest
+// KeepTurns turns are kept verbatim. If summarizing fails, the messages are
+// returned unchanged and left to the context window budget.
+func (ds *Datasource) compressHistory(ctx context.Context, apiKey string, req *chatRequest) []chatMessage {
+	ctx, span := startSpan(ctx, "chat.summarize_history")
+	defer span.End()
+
+	cfg := ds.config.History
+	var system, conversation []chatMessage
+	for _, msg := range req.Messages {
+		if msg.Role == "system" {
+			system = append(system, msg)
+		} else {
+			conversation = append(conversation, msg)
+		}
+	}
+
+	// A turn starts with a user message
+	var turnStarts []int
+	for i, msg := range conversation {
+		if msg.Role == "user" {
+			turnStarts = append(turnStarts, i)
+		}
+	}
+	keepTurns := orDefault(cfg.KeepTurns, defaultHistoryKeepTurns)
+	if len(turnStarts) <= keepTurns {
+		return req.Messages
+	}
+
+	family := familyOf(req.Model)
+	maxTokens := orDefault(cfg.MaxTokens, ds.contextWindow(req.Model)/2)
+	if len(turnStarts) <= orDefault(cfg.MaxTurns, defaultHistoryMaxTurns) && family.estimateMessages(conversation) <= maxTokens {
+		return req.Messages
+	}
+
+	split := turnStarts[len(turnStarts)-keepTurns]
+	older, recent := conversation[:split], conversation[split:]
+	span.SetAttributes(attribute.Int(attrHistoryMessages, len(older)))
+
+	ctx, cancel := context.WithTimeout(ctx, historySummaryTimeout)
+	defer cancel()
+	summary, err := ds.summarizeHistory(ctx, apiKey, req.DashboardUID, older)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to summarize conversation history", "error", err)
+		spanError(span, err)
+		return req.Messages
+	}
+
+	messages := append(system, chatMessage{Role: "system", Content: historySummaryPrefix + summary})
+	return append(messages, recent...)
+}
+
+// summarizeHistory returns a summary of messages. It continues from the
+// longest prefix summarized before and summarizes the remaining messages in
+// chunks of at most maxHistoryChunkTokens.
+func (ds *Datasource) summarizeHistory(ctx context.Context, apiKey, dashboardUID string, messages []chatMessage) (string, *requestError) {
+	model := orDefaultString(ds.config.History.Model, defaultHistoryModel)
+	keys := historyKeys(model, messages)
+
+	summary, done := "", 0
+	for i := len(messages); i > 0; i-- {
+		if cached, ok := ds.history.get(keys[i-1]); ok {
+			summary, done = cached, i
+			break
+		}
+	}
+
+	family := familyOf(model)
+	chunkTokens := min(maxHistoryChunkTokens, ds.contextWindow(model)/2)
+	for done < len(messages) {
+		end, tokens := done, 0
+		for end < len(messages) {
+			tokens += family.estimateTokens(messages[end].Content)
+			if end > done && tokens > chunkTokens {
+				break
+			}
+			end++
+		}
+
+		var err *requestError
+		summary, err = ds.extendSummary(ctx, apiKey, model, dashboardUID, summary, messages[done:end])
+		if err != nil {
+			return "", err
+		}
+		done = end
+		ds.history.put(keys[done-1], summary)
+	}
+	return summary, nil
+}
+
+// extendSummary asks model to extend summary by messages.
+func (ds *Datasource) extendSummary(ctx context.Context, apiKey, model, dashboardUID, summary string, messages []chatMessage) (string, *requestError) {
+	var b strings.Builder
+	if summary != "" {
+		fmt.Fprintf(&b, "Summary so far:\n%s\n\n", summary)
+	}
+	b.WriteString("Conversation to add:\n")
+	for _, msg := range messages {
+		fmt.Fprintf(&b, "%s: %s\n", msg.Role, msg.Content)
+	}
+
+	req := &chatRequest{
+		Model:        model,
+		DashboardUID: dashboardUID,
+		Messages: []chatMessage{
+			{Role: "system", Content: historySummaryInstructions},
+			{Role: "user", Content: b.String()},
+		},
+	}
+	content, _, reqErr := ds.complete(ctx, apiKey, "history-summary", req, nil)
+	if reqErr != nil {
+		return "", reqErr
+	}
+	if content == "" {
+		return "", &requestError{status: http.StatusBadGateway, code: errCodeUpstreamError, message: "Empty summary"}
+	}
+	return content, nil
+}
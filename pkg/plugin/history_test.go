@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// newTestConversation returns turns user/assistant turns after a system
+// message.
+func newTestConversation(turns int) []chatMessage {
+	messages := []chatMessage{{Role: "system", Content: "You are an SRE assistant."}}
+	for i := 1; i <= turns; i++ {
+		messages = append(messages,
+			chatMessage{Role: "user", Content: fmt.Sprintf("question %d", i)},
+			chatMessage{Role: "assistant", Content: fmt.Sprintf("answer %d", i)},
+		)
+	}
+	return messages
+}
+
+// newTestSummarizer serves chat completions and records the requests per
+// model. Summaries name the last question they cover.
+func newTestSummarizer(t *testing.T, status int) (*httptest.Server, func(model string) []groqChatRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := make(map[string][]groqChatRequest)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req groqChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		requests[req.Model] = append(requests[req.Model], req)
+		mu.Unlock()
+
+		if req.Model == defaultHistoryModel && status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		content := "ok"
+		if req.Model == defaultHistoryModel {
+			prompt := req.Messages[len(req.Messages)-1].Content
+			question, _, _ := strings.Cut(prompt[strings.LastIndex(prompt, "question"):], "\n")
+			content = "summary up to " + question
+		}
+		json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: content}}}})
+	}))
+	t.Cleanup(server.Close)
+	return server, func(model string) []groqChatRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[model]
+	}
+}
+
+func TestCompressHistory(t *testing.T) {
+	testCases := []struct {
+		name            string
+		turns           int
+		config          historyConfig
+		expectedSummary string
+		expectedLength  int
+	}{
+		{name: "short", turns: 5, expectedLength: 11},
+		{name: "too many turns", turns: 25, expectedSummary: "summary up to question 20", expectedLength: 12},
+		{name: "configured turns", turns: 8, config: historyConfig{MaxTurns: 6, KeepTurns: 2}, expectedSummary: "summary up to question 6", expectedLength: 6},
+		{name: "too many tokens", turns: 8, config: historyConfig{MaxTokens: 20}, expectedSummary: "summary up to question 3", expectedLength: 12},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			groq, _ := newTestSummarizer(t, http.StatusOK)
+			ds := &Datasource{config: pluginConfig{History: tc.config}, groqURL: groq.URL}
+
+			req := &chatRequest{Model: "llama-3.3-70b-versatile", Messages: newTestConversation(tc.turns)}
+			messages := ds.compressHistory(t.Context(), "test-api-key", req)
+
+			if len(messages) != tc.expectedLength {
+				t.Fatalf("Expected %d messages, got %d: %+v", tc.expectedLength, len(messages), messages)
+			}
+			if messages[0] != req.Messages[0] || messages[len(messages)-1] != req.Messages[len(req.Messages)-1] {
+				t.Errorf("Expected the system message and the latest turns to be kept, got %+v", messages)
+			}
+			if tc.expectedSummary == "" {
+				return
+			}
+			if messages[1].Role != "system" || messages[1].Content != historySummaryPrefix+tc.expectedSummary {
+				t.Errorf("Expected the summary %q after the system message, got %+v", tc.expectedSummary, messages[1])
+			}
+			if messages[2].Role != "user" {
+				t.Errorf("Expected the kept turns to start with a question, got %+v", messages[2])
+			}
+		})
+	}
+}
+
+func TestCompressHistoryReusesSummaries(t *testing.T) {
+	groq, requests := newTestSummarizer(t, http.StatusOK)
+	ds := &Datasource{config: pluginConfig{History: historyConfig{MaxTurns: 6, KeepTurns: 2}}, groqURL: groq.URL, history: newHistorySummaries()}
+
+	for _, turns := range []int{8, 8, 10} {
+		req := &chatRequest{Model: "llama-3.3-70b-versatile", Messages: newTestConversation(turns)}
+		ds.compressHistory(t.Context(), "test-api-key", req)
+	}
+
+	calls := requests(defaultHistoryModel)
+	if len(calls) != 2 {
+		t.Fatalf("Expected two summary calls, got %d", len(calls))
+	}
+	second := calls[1].Messages[1].Content
+	if !strings.Contains(second, "Summary so far:\nsummary up to question 6") || strings.Contains(second, "user: question 6") || !strings.Contains(second, "question 8") {
+		t.Errorf("Expected the second call to extend the first summary by the new turns only, got %q", second)
+	}
+}
+
+func TestChatSummarizesLongHistory(t *testing.T) {
+	testCases := []struct {
+		name             string
+		summaryStatus    int
+		expectedMessages int
+	}{
+		{name: "summarized", summaryStatus: http.StatusOK, expectedMessages: 12},
+		{name: "summary failed", summaryStatus: http.StatusBadRequest, expectedMessages: 61},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			groq, requests := newTestSummarizer(t, tc.summaryStatus)
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				groqURL:  groq.URL,
+			}
+
+			body, _ := json.Marshal(chatRequest{Model: "llama-3.3-70b-versatile", Messages: newTestConversation(30)})
+			req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleGroqChat(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+			}
+			chats := requests("llama-3.3-70b-versatile")
+			if len(chats) != 1 || len(chats[0].Messages) != tc.expectedMessages {
+				t.Fatalf("Expected one chat call with %d messages, got %+v", tc.expectedMessages, chats)
+			}
+		})
+	}
+}
@@ -0,0 +1,532 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// defaultAlertLookback is how far before an alert started its queries
+	// are run, to show what led up to it.
+	defaultAlertLookback = time.Hour
+
+	// maxAlertWindow bounds the time range the alert queries are run over.
+	maxAlertWindow = 7 * 24 * time.Hour
+
+	// maxAlertInstances and maxAlertTransitions bound the firing instances
+	// and state changes in the prompt; maxRelatedDashboards the dashboards
+	// linked besides the one the rule is attached to.
+	maxAlertInstances    = 10
+	maxAlertTransitions  = 20
+	maxRelatedDashboards = 5
+
+	// alertRuleUIDLabel is the label Grafana adds to alerts with the UID of
+	// the rule that fired them.
+	alertRuleUIDLabel = "__alert_rule_uid__"
+)
+
+const investigateAlertInstructions = `You help an on-call engineer investigate a Grafana alert. Below are the alert rule, its firing instances, its recent state changes and the data of its queries over the alert window.
+Answer with a JSON object with these keys:
+- "summary": what the alert means and what is happening, in two or three sentences
+- "probableCauses": an array of objects with "cause", "likelihood" ("high", "medium" or "low") and "evidence" (the values, times or state changes that support it), most likely first
+- "nextSteps": an array of up to five concrete checks or actions, most useful first
+Base the analysis only on the data below. Say so if the data doesn't explain the alert.`
+
+// fingerprintRegex matches the fingerprint of an alert in Alertmanager.
+var fingerprintRegex = regexp.MustCompile(`^[0-9a-fA-F]{1,32}$`)
+
+// investigateAlertRequest is the body accepted by /investigate-alert. One of
+// RuleUID or Fingerprint selects the alert.
+type investigateAlertRequest struct {
+	Model       string `json:"model"`
+	RuleUID     string `json:"ruleUid"`
+	Fingerprint string `json:"fingerprint"`
+	Question    string `json:"question"`
+}
+
+// alertRule is the subset of a Grafana-managed rule from the ruler API the
+// investigation uses.
+type alertRule struct {
+	For          string            `json:"for"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GrafanaAlert struct {
+		UID          string       `json:"uid"`
+		Title        string       `json:"title"`
+		Condition    string       `json:"condition"`
+		NamespaceUID string       `json:"namespace_uid"`
+		RuleGroup    string       `json:"rule_group"`
+		NoDataState  string       `json:"no_data_state"`
+		ExecErrState string       `json:"exec_err_state"`
+		Data         []alertQuery `json:"data"`
+	} `json:"grafana_alert"`
+}
+
+// alertQuery is a query or expression of an alert rule. Relative times are
+// seconds before the evaluation.
+type alertQuery struct {
+	RefID             string `json:"refId"`
+	DatasourceUID     string `json:"datasourceUid"`
+	RelativeTimeRange struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+	} `json:"relativeTimeRange"`
+	Model map[string]any `json:"model"`
+}
+
+// firingAlert is an alert instance from Grafana's Alertmanager.
+type firingAlert struct {
+	Fingerprint string            `json:"fingerprint"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+
+	// Values are the values of the rule's queries that fired the alert.
+	// Only webhook notifications have them.
+	Values map[string]float64 `json:"values,omitempty"`
+
+	Status struct {
+		State string `json:"state"`
+	} `json:"status"`
+}
+
+// alertTransition is a state change of an alert instance.
+type alertTransition struct {
+	Time     time.Time          `json:"time"`
+	Previous string             `json:"previous"`
+	Current  string             `json:"current"`
+	Labels   map[string]string  `json:"labels,omitempty"`
+	Values   map[string]float64 `json:"values,omitempty"`
+}
+
+// alertLink links the investigation to where it can be continued.
+type alertLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// alertAnalysis is the model's probable-cause analysis.
+type alertAnalysis struct {
+	Summary        string          `json:"summary"`
+	ProbableCauses []probableCause `json:"probableCauses"`
+	NextSteps      []string        `json:"nextSteps"`
+}
+
+type probableCause struct {
+	Cause      string `json:"cause"`
+	Likelihood string `json:"likelihood"`
+	Evidence   string `json:"evidence"`
+}
+
+// alertInvestigation is what is gathered about an alert for the analysis.
+type alertInvestigation struct {
+	Rule    *alertRule
+	Alerts  []firingAlert
+	History []alertTransition
+	Queries []panelContext
+	Related []alertLink
+	From    time.Time
+	To      time.Time
+}
+
+// userLabels drops Grafana's internal labels, such as the rule UID.
+func userLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if !strings.HasPrefix(name, "__") {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// loadFiringAlerts returns the active alerts of a rule, or the alert with
+// the fingerprint if ruleUID is empty.
+func loadFiringAlerts(ctx context.Context, client *grafanaClient, ruleUID, fingerprint string) ([]firingAlert, error) {
+	query := url.Values{"active": {"true"}}
+	if ruleUID != "" {
+		query.Set("filter", fmt.Sprintf("%s=%q", alertRuleUIDLabel, ruleUID))
+	}
+	var alerts []firingAlert
+	if err := client.get(ctx, "/api/alertmanager/grafana/api/v2/alerts?"+query.Encode(), &alerts); err != nil {
+		return nil, err
+	}
+	if fingerprint != "" {
+		alerts = slices.DeleteFunc(alerts, func(a firingAlert) bool { return !strings.EqualFold(a.Fingerprint, fingerprint) })
+	}
+	slices.SortFunc(alerts, func(a, b firingAlert) int { return a.StartsAt.Compare(b.StartsAt) })
+	return alerts, nil
+}
+
+// alertWindow is the time range the alert's queries are run over: from
+// before the earliest instance started, or the rule's query range before
+// now if none fires, to now.
+func alertWindow(rule *alertRule, alerts []firingAlert, now time.Time) (time.Time, time.Time) {
+	lookback := defaultAlertLookback
+	for _, q := range rule.GrafanaAlert.Data {
+		lookback = max(lookback, time.Duration(q.RelativeTimeRange.From)*time.Second)
+	}
+	start := now
+	if len(alerts) > 0 && alerts[0].StartsAt.Before(now) {
+		start = alerts[0].StartsAt
+	}
+	from := start.Add(-lookback)
+	if oldest := now.Add(-maxAlertWindow); from.Before(oldest) {
+		from = oldest
+	}
+	return from, now
+}
+
+// queryAlertData runs the rule's queries and expressions over the window
+// and summarizes their results like panel data.
+func queryAlertData(ctx context.Context, client *grafanaClient, rule *alertRule, from, to time.Time) []panelContext {
+	ctx, span := startSpan(ctx, "investigate.query_data")
+	defer span.End()
+
+	req := dsQueryRequest{From: strconv.FormatInt(from.UnixMilli(), 10), To: strconv.FormatInt(to.UnixMilli(), 10)}
+	interval := max(to.Sub(from)/maxPanelDataPoints, time.Millisecond)
+	queries := make([]panelContext, 0, len(rule.GrafanaAlert.Data))
+	for i, q := range rule.GrafanaAlert.Data {
+		query := maps.Clone(q.Model)
+		if query == nil {
+			query = map[string]any{}
+		}
+		ref := dataSourceRef{UID: q.DatasourceUID}
+		if q.DatasourceUID == "__expr__" {
+			ref.Type = "__expr__"
+		}
+		query["refId"] = q.RefID
+		query["datasource"] = ref
+		query["maxDataPoints"] = maxPanelDataPoints
+		query["intervalMs"] = interval.Milliseconds()
+		req.Queries = append(req.Queries, query)
+
+		title := "Query " + q.RefID
+		if q.RefID == rule.GrafanaAlert.Condition {
+			title = "Condition " + q.RefID
+		}
+		queries = append(queries, panelContext{
+			ID:      int64(i + 1),
+			Title:   truncate(title, maxContextTitle),
+			Type:    "alert query",
+			Queries: []panelQuery{{RefID: q.RefID, Datasource: &ref, Query: truncate((&panelTarget{model: q.Model}).queryText(), maxContextQuery)}},
+		})
+	}
+	if len(req.Queries) == 0 {
+		return queries
+	}
+
+	resp, err := queryData(ctx, client, req)
+	opts := summaryConfig{Detail: detailStandard, TopN: defaultSummaryTopN, Downsample: downsampleNone, Points: defaultDownsamplePoints}
+	for i := range queries {
+		panel := &queries[i]
+		refID := panel.Queries[0].RefID
+		switch {
+		case err != nil:
+			panel.Error = panelQueryError(err)
+		case resp.Responses[refID].Error != nil:
+			panel.Error = truncate(resp.Responses[refID].Error.Error(), maxContextDescription)
+		default:
+			panel.Frames = resp.Responses[refID].Frames
+			summarizePanel(panel, opts)
+			detectAnomalies(panel)
+		}
+	}
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to query alert data", "rule", rule.GrafanaAlert.UID, "error", err)
+		span.RecordError(err)
+	}
+	return queries
+}
+
+// loadAlertHistory reads the rule's state changes in the window from the
+// state history API. It returns nothing if the history isn't available,
+// e.g. with the annotation backend of older Grafana versions.
+func loadAlertHistory(ctx context.Context, client *grafanaClient, ruleUID string, from, to time.Time) []alertTransition {
+	query := url.Values{
+		"ruleUID": {ruleUID},
+		"from":    {strconv.FormatInt(from.Unix(), 10)},
+		"to":      {strconv.FormatInt(to.Unix(), 10)},
+		"limit":   {strconv.Itoa(maxAlertTransitions)},
+	}
+	var frame data.Frame
+	if err := client.get(ctx, "/api/v1/rules/history?"+query.Encode(), &frame); err != nil {
+		log.DefaultLogger.Info("Alert state history not available", "rule", ruleUID, "error", err)
+		return nil
+	}
+
+	var times, lines *data.Field
+	for _, field := range frame.Fields {
+		switch field.Name {
+		case "time":
+			times = field
+		case "line":
+			lines = field
+		}
+	}
+	if times == nil || lines == nil {
+		return nil
+	}
+	var history []alertTransition
+	for i := range min(times.Len(), lines.Len()) {
+		t, ok := times.ConcreteAt(i)
+		line, _ := lines.ConcreteAt(i)
+		raw, _ := line.(json.RawMessage)
+		var transition alertTransition
+		if !ok || json.Unmarshal(raw, &transition) != nil {
+			continue
+		}
+		transition.Time, _ = t.(time.Time)
+		transition.Labels = userLabels(transition.Labels)
+		history = append(history, transition)
+	}
+	slices.SortFunc(history, func(a, b alertTransition) int { return b.Time.Compare(a.Time) })
+	return history[:min(len(history), maxAlertTransitions)]
+}
+
+// alertLinks links the rule, the dashboard panel and runbook its annotations
+// name, and dashboards in the rule's folder.
+func alertLinks(ctx context.Context, client *grafanaClient, baseURL string, rule *alertRule, from, to time.Time) []alertLink {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	links := []alertLink{{Title: "Alert rule " + rule.GrafanaAlert.Title, URL: baseURL + "/alerting/grafana/" + url.PathEscape(rule.GrafanaAlert.UID) + "/view"}}
+
+	timeRange := url.Values{"from": {strconv.FormatInt(from.UnixMilli(), 10)}, "to": {strconv.FormatInt(to.UnixMilli(), 10)}}
+	dashboardUID := rule.Annotations["__dashboardUid__"]
+	if dashboardUID != "" {
+		query := maps.Clone(timeRange)
+		if panelID := rule.Annotations["__panelId__"]; panelID != "" {
+			query.Set("viewPanel", panelID)
+		}
+		links = append(links, alertLink{Title: "Dashboard of the alert", URL: baseURL + "/d/" + url.PathEscape(dashboardUID) + "?" + query.Encode()})
+	}
+	if runbook := rule.Annotations["runbook_url"]; strings.HasPrefix(runbook, "https://") || strings.HasPrefix(runbook, "http://") {
+		links = append(links, alertLink{Title: "Runbook", URL: runbook})
+	}
+
+	if rule.GrafanaAlert.NamespaceUID == "" {
+		return links
+	}
+	query := url.Values{"type": {"dash-db"}, "folderUIDs": {rule.GrafanaAlert.NamespaceUID}, "limit": {strconv.Itoa(maxRelatedDashboards + 1)}}
+	var hits []struct {
+		UID   string `json:"uid"`
+		Title string `json:"title"`
+	}
+	if err := client.get(ctx, "/api/search?"+query.Encode(), &hits); err != nil {
+		log.DefaultLogger.Info("Failed to search related dashboards", "folder", rule.GrafanaAlert.NamespaceUID, "error", err)
+		return links
+	}
+	related := 0
+	for _, hit := range hits {
+		if hit.UID == dashboardUID || related == maxRelatedDashboards {
+			continue
+		}
+		links = append(links, alertLink{Title: truncate(stripHTML(hit.Title), maxContextTitle), URL: baseURL + "/d/" + url.PathEscape(hit.UID) + "?" + timeRange.Encode()})
+		related++
+	}
+	return links
+}
+
+// prompt renders the investigation for the model.
+func (inv *alertInvestigation) prompt() string {
+	var b strings.Builder
+	b.WriteString(investigateAlertInstructions)
+	b.WriteString("\n\n")
+	inv.writeTo(&b)
+	return b.String()
+}
+
+// writeTo writes the rule, its instances, state changes, query data and
+// links.
+func (inv *alertInvestigation) writeTo(b *strings.Builder) {
+	rule := inv.Rule
+	fmt.Fprintf(b, "Alert rule %q, group %q, pending period %s", truncate(rule.GrafanaAlert.Title, maxContextTitle), truncate(rule.GrafanaAlert.RuleGroup, maxContextTitle), orDefaultString(rule.For, "0s"))
+	fmt.Fprintf(b, ", condition %s, no data state %s, error state %s\n", rule.GrafanaAlert.Condition, rule.GrafanaAlert.NoDataState, rule.GrafanaAlert.ExecErrState)
+	writeStringMap(b, "Labels", userLabels(rule.Labels))
+	writeStringMap(b, "Annotations", userLabels(rule.Annotations))
+	fmt.Fprintf(b, "Time range: %s to %s\n", inv.From.Format(time.RFC3339), inv.To.Format(time.RFC3339))
+
+	if len(inv.Alerts) == 0 {
+		b.WriteString("\nNo instance of the rule is firing now.\n")
+	} else {
+		fmt.Fprintf(b, "\nFiring instances (%d):\n", len(inv.Alerts))
+		for _, a := range inv.Alerts[:min(len(inv.Alerts), maxAlertInstances)] {
+			fmt.Fprintf(b, "- since %s, state %s, labels %s", a.StartsAt.UTC().Format(time.RFC3339), a.Status.State, formatStringMap(userLabels(a.Labels)))
+			writeAlertValues(b, a.Values)
+			b.WriteString("\n")
+		}
+	}
+
+	if len(inv.History) > 0 {
+		b.WriteString("\nState changes, newest first:\n")
+		for _, t := range inv.History {
+			fmt.Fprintf(b, "- %s: %s -> %s, labels %s", t.Time.UTC().Format(time.RFC3339), t.Previous, t.Current, formatStringMap(t.Labels))
+			writeAlertValues(b, t.Values)
+			b.WriteString("\n")
+		}
+	}
+
+	writeFindings(b, inv.Queries)
+	b.WriteString("\nQueries:\n")
+	for _, q := range inv.Queries {
+		fmt.Fprintf(b, "- %s", q.Title)
+		if query := q.Queries[0]; query.Query != "" {
+			fmt.Fprintf(b, " on data source %s: %s", query.Datasource.UID, query.Query)
+		}
+		b.WriteString("\n")
+		writePanelSummary(b, q, detailStandard, inv.From)
+	}
+
+	if len(inv.Related) > 1 {
+		b.WriteString("\nLinked dashboards and runbooks:\n")
+		for _, link := range inv.Related[1:] {
+			fmt.Fprintf(b, "- %s\n", link.Title)
+		}
+	}
+}
+
+// writeAlertValues writes the values of a rule's queries at an evaluation.
+func writeAlertValues(b *strings.Builder, values map[string]float64) {
+	if len(values) == 0 {
+		return
+	}
+	pairs := make([]string, 0, len(values))
+	for _, refID := range slices.Sorted(maps.Keys(values)) {
+		pairs = append(pairs, refID+"="+formatNumber(values[refID]))
+	}
+	fmt.Fprintf(b, ", values %s", strings.Join(pairs, " "))
+}
+
+func writeStringMap(b *strings.Builder, title string, m map[string]string) {
+	if len(m) > 0 {
+		fmt.Fprintf(b, "%s: %s\n", title, formatStringMap(m))
+	}
+}
+
+// formatStringMap formats labels or annotations, sorted by name, with long
+// values truncated.
+func formatStringMap(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", truncate(name, maxContextTitle), truncate(stripHTML(m[name]), maxContextDescription)))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// handleInvestigateAlert analyzes the probable cause of an alert, selected
+// by its rule UID or the fingerprint of a firing instance, from the rule,
+// its state history and the data of its queries.
+func (ds *Datasource) handleInvestigateAlert(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "investigate.handle")
+	defer span.End()
+
+	apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req investigateAlertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	req.Model = orDefaultString(req.Model, defaultChatModel)
+	if !validModel(req.Model) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+		return
+	}
+	if (req.RuleUID == "") == (req.Fingerprint == "") ||
+		req.RuleUID != "" && !dashboardUIDRegex.MatchString(req.RuleUID) ||
+		req.Fingerprint != "" && !fingerprintRegex.MatchString(req.Fingerprint) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Either a rule UID or a fingerprint is required"})
+		return
+	}
+	if len(req.Question) > maxQuestionLength {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeContentTooLong, message: "Question too long"})
+		return
+	}
+	span.SetAttributes(attribute.String(attrModel, req.Model))
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Error("Cannot call Grafana API", "error", err)
+		writeRequestError(w, span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+		return
+	}
+
+	alerts, err := loadFiringAlerts(ctx, client, req.RuleUID, req.Fingerprint)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to load alerts", "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Alerts"))
+		return
+	}
+	ruleUID := req.RuleUID
+	if req.Fingerprint != "" {
+		if len(alerts) == 0 || alerts[0].Labels[alertRuleUIDLabel] == "" {
+			writeRequestError(w, span, &requestError{status: http.StatusNotFound, code: errCodeNotFound, message: "Alert not found"})
+			return
+		}
+		ruleUID = alerts[0].Labels[alertRuleUIDLabel]
+	}
+	span.SetAttributes(attribute.String("investigate.rule_uid", ruleUID), attribute.Int("investigate.alerts", len(alerts)))
+
+	var rule alertRule
+	if err := client.get(ctx, "/api/ruler/grafana/api/v1/rule/"+url.PathEscape(ruleUID), &rule); err != nil {
+		log.DefaultLogger.Warn("Failed to load alert rule", "rule", ruleUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Alert rule"))
+		return
+	}
+
+	inv := &alertInvestigation{Rule: &rule, Alerts: alerts}
+	inv.From, inv.To = alertWindow(&rule, alerts, time.Now().UTC())
+	inv.History = loadAlertHistory(ctx, client, ruleUID, inv.From, inv.To)
+	inv.Queries = queryAlertData(ctx, client, &rule, inv.From, inv.To)
+	inv.Related = alertLinks(ctx, client, appURL(ctx), &rule, inv.From, inv.To)
+
+	question := orDefaultString(req.Question, "Why is this alert firing, and what should I check first?")
+	chatReq := &chatRequest{Model: req.Model, Messages: []chatMessage{
+		{Role: "system", Content: inv.prompt()},
+		{Role: "user", Content: question},
+	}, DashboardUID: rule.Annotations["__dashboardUid__"]}
+	var analysis alertAnalysis
+	if _, reqErr := ds.completeJSON(ctx, apiKey, "investigate-alert", chatReq, &analysis); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	for i := range analysis.ProbableCauses {
+		if !slices.Contains(concernSeverities, analysis.ProbableCauses[i].Likelihood) {
+			analysis.ProbableCauses[i].Likelihood = "medium"
+		}
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Investigated alert", "rule", ruleUID, "alerts", len(alerts))
+
+	instances := make([]map[string]any, 0, len(alerts))
+	for _, a := range alerts {
+		instances = append(instances, map[string]any{"fingerprint": a.Fingerprint, "labels": userLabels(a.Labels), "startsAt": a.StartsAt, "state": a.Status.State})
+	}
+	writeJSON(w, map[string]any{
+		"ruleUid":  ruleUID,
+		"title":    rule.GrafanaAlert.Title,
+		"from":     inv.From,
+		"to":       inv.To,
+		"alerts":   instances,
+		"history":  inv.History,
+		"links":    inv.Related,
+		"analysis": analysis,
+	})
+}
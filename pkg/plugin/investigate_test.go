@@ -0,0 +1,198 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// newTestAlertGrafana serves the rule "cpu-high", which fires with the
+// fingerprint "abc123", and its state history, query data and folder. Other
+// rules are forbidden.
+func newTestAlertGrafana(t *testing.T, queries *[]dsQueryRequest) *httptest.Server {
+	t.Helper()
+	startsAt := time.Now().UTC().Add(-30 * time.Minute).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/alertmanager/grafana/api/v2/alerts":
+			alerts := []map[string]any{{
+				"fingerprint": "abc123",
+				"labels":      map[string]string{"alertname": "CPU high", "instance": "web-1", alertRuleUIDLabel: "cpu-high"},
+				"startsAt":    startsAt,
+				"status":      map[string]string{"state": "active"},
+			}}
+			if filter := r.URL.Query().Get("filter"); filter != "" && filter != `__alert_rule_uid__="cpu-high"` {
+				alerts = nil
+			}
+			json.NewEncoder(w).Encode(alerts)
+		case "/api/ruler/grafana/api/v1/rule/cpu-high":
+			w.Write([]byte(`{"for":"5m","labels":{"team":"web"},"annotations":{"summary":"CPU above 90%","__dashboardUid__":"dash-1","__panelId__":"2","runbook_url":"https://runbooks.example.com/cpu"},
+				"grafana_alert":{"uid":"cpu-high","title":"CPU high","condition":"C","namespace_uid":"folder-1","rule_group":"web","no_data_state":"NoData","exec_err_state":"Error",
+				"data":[{"refId":"A","datasourceUid":"prom","relativeTimeRange":{"from":600,"to":0},"model":{"expr":"avg by (instance) (rate(cpu_seconds_total[5m]))"}},
+				{"refId":"C","datasourceUid":"__expr__","model":{"type":"threshold","expression":"A"}}]}}`))
+		case "/api/ruler/grafana/api/v1/rule/secret":
+			w.WriteHeader(http.StatusForbidden)
+		case "/api/v1/rules/history":
+			if r.URL.Query().Get("ruleUID") != "cpu-high" {
+				t.Errorf("Unexpected history query %q", r.URL.RawQuery)
+			}
+			frame := data.NewFrame("states",
+				data.NewField("time", nil, []time.Time{startsAt.Add(-5 * time.Minute), startsAt}),
+				data.NewField("line", nil, []json.RawMessage{
+					json.RawMessage(`{"previous":"Normal","current":"Pending","labels":{"instance":"web-1","__alert_rule_uid__":"cpu-high"},"values":{"A":0.93}}`),
+					json.RawMessage(`{"previous":"Pending","current":"Alerting","labels":{"instance":"web-1"},"values":{"A":0.97}}`),
+				}),
+			)
+			json.NewEncoder(w).Encode(frame)
+		case "/api/ds/query":
+			var req dsQueryRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			*queries = append(*queries, req)
+			times := make([]time.Time, 60)
+			values := make([]float64, 60)
+			for i := range times {
+				times[i] = startsAt.Add(time.Duration(i-30) * time.Minute)
+				values[i] = 0.4
+				if i >= 30 {
+					values[i] = 0.95
+				}
+			}
+			resp := backend.NewQueryDataResponse()
+			resp.Responses["A"] = backend.DataResponse{Frames: data.Frames{data.NewFrame("",
+				data.NewField("time", nil, times),
+				data.NewField("value", data.Labels{"instance": "web-1"}, values),
+			)}}
+			resp.Responses["C"] = backend.ErrDataResponse(backend.StatusBadRequest, "threshold failed")
+			json.NewEncoder(w).Encode(resp)
+		case "/api/search":
+			if r.URL.Query().Get("folderUIDs") != "folder-1" {
+				t.Errorf("Unexpected search %q", r.URL.RawQuery)
+			}
+			w.Write([]byte(`[{"uid":"dash-1","title":"Web"},{"uid":"dash-2","title":"Web hosts"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAlertWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var rule alertRule
+	rule.GrafanaAlert.Data = []alertQuery{{RefID: "A"}}
+	rule.GrafanaAlert.Data[0].RelativeTimeRange.From = 3 * 3600
+
+	testCases := []struct {
+		name         string
+		alerts       []firingAlert
+		expectedFrom time.Time
+	}{
+		{name: "not firing", expectedFrom: now.Add(-3 * time.Hour)},
+		{name: "firing", alerts: []firingAlert{{StartsAt: now.Add(-time.Hour)}}, expectedFrom: now.Add(-4 * time.Hour)},
+		{name: "firing for long", alerts: []firingAlert{{StartsAt: now.Add(-30 * 24 * time.Hour)}}, expectedFrom: now.Add(-maxAlertWindow)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			from, to := alertWindow(&rule, tc.alerts, now)
+			if !from.Equal(tc.expectedFrom) || !to.Equal(now) {
+				t.Errorf("Expected %s to %s, got %s to %s", tc.expectedFrom, now, from, to)
+			}
+		})
+	}
+}
+
+func TestHandleInvestigateAlert(t *testing.T) {
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{name: "rule", body: `{"ruleUid":"cpu-high"}`, expectedStatus: http.StatusOK},
+		{name: "fingerprint", body: `{"fingerprint":"abc123","question":"Is web-1 overloaded?"}`, expectedStatus: http.StatusOK},
+		{name: "unknown fingerprint", body: `{"fingerprint":"fff"}`, expectedStatus: http.StatusNotFound},
+		{name: "forbidden rule", body: `{"ruleUid":"secret"}`, expectedStatus: http.StatusForbidden},
+		{name: "rule and fingerprint", body: `{"ruleUid":"cpu-high","fingerprint":"abc123"}`, expectedStatus: http.StatusBadRequest},
+		{name: "neither", body: `{}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid fingerprint", body: `{"fingerprint":"not-hex"}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var queries []dsQueryRequest
+			grafana := newTestAlertGrafana(t, &queries)
+			var sent groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				answer := `{"summary":"CPU of web-1 doubled 30 minutes ago.","probableCauses":[{"cause":"Traffic spike","likelihood":"certain","evidence":"A rose from 0.4 to 0.95"}],"nextSteps":["Check the request rate"]}`
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: answer}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest("POST", "/investigate-alert", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleInvestigateAlert(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			if len(queries) != 1 || len(queries[0].Queries) != 2 || queries[0].Queries[1]["datasource"].(map[string]any)["type"] != "__expr__" {
+				t.Fatalf("Expected the rule's queries to run together, got %+v", queries)
+			}
+			system := sent.Messages[0].Content
+			for _, expected := range []string{`Alert rule "CPU high"`, "pending period 5m", `instance="web-1"`, "Pending -> Alerting", "A=0.97",
+				"Condition C", "threshold failed", "rate(cpu_seconds_total[5m])", "Series", "Web hosts"} {
+				if !strings.Contains(system, expected) {
+					t.Errorf("Expected %q in the prompt, got %q", expected, system)
+				}
+			}
+			if strings.Contains(system, alertRuleUIDLabel) || strings.Contains(system, "__dashboardUid__") {
+				t.Errorf("Expected no internal labels in the prompt, got %q", system)
+			}
+
+			var resp struct {
+				RuleUID  string            `json:"ruleUid"`
+				Alerts   []map[string]any  `json:"alerts"`
+				History  []alertTransition `json:"history"`
+				Links    []alertLink       `json:"links"`
+				Analysis alertAnalysis     `json:"analysis"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.RuleUID != "cpu-high" || len(resp.Alerts) != 1 || len(resp.History) != 2 || resp.History[0].Current != "Alerting" {
+				t.Errorf("Unexpected response: %+v", resp)
+			}
+			if len(resp.Analysis.ProbableCauses) != 1 || resp.Analysis.ProbableCauses[0].Likelihood != "medium" {
+				t.Errorf("Expected the likelihood to be normalized, got %+v", resp.Analysis)
+			}
+			links := make([]string, len(resp.Links))
+			for i, link := range resp.Links {
+				links[i] = link.URL
+			}
+			if len(links) != 4 || !strings.HasSuffix(links[0], "/alerting/grafana/cpu-high/view") || !strings.Contains(links[1], "/d/dash-1?") ||
+				!strings.Contains(links[1], "viewPanel=2") || links[2] != "https://runbooks.example.com/cpu" || !strings.Contains(links[3], "/d/dash-2?") {
+				t.Errorf("Unexpected links %v", links)
+			}
+		})
+	}
+}
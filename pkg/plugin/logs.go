@@ -0,0 +1,416 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// drainDepth is the depth of the parse tree: the token count, then the
+	// first drainDepth-2 tokens, then the templates.
+	drainDepth = 4
+
+	// drainSimilarity is the share of tokens a line must have in common
+	// with a template to be clustered into it.
+	drainSimilarity = 0.4
+
+	// maxDrainChildren bounds the children of a tree node; further tokens
+	// are routed to the wildcard.
+	maxDrainChildren = 100
+
+	// maxLogTemplates bounds the templates of a panel; lines that don't fit
+	// one are counted as unclustered.
+	maxLogTemplates = 1000
+
+	// maxLogLine bounds the length of a line before it is clustered, and
+	// maxLogTokens its tokens.
+	maxLogLine   = 1000
+	maxLogTokens = 64
+
+	// maxContextLogPatterns bounds the patterns in the prompt, and
+	// maxContextLogTemplate the length of a template.
+	maxContextLogPatterns = 20
+	maxContextLogTemplate = 300
+
+	// A pattern is rising if it occurs risingLogFactor times as often as in
+	// the baseline, and at least minRisingLogCount times.
+	risingLogFactor   = 2
+	minRisingLogCount = 5
+
+	// logWildcard stands for the variable tokens of a template.
+	logWildcard = "<*>"
+)
+
+// logLineFields are the names of the field that holds the line in the log
+// frames of Loki and other data sources.
+var logLineFields = []string{"Line", "line", "body", "Body", "message"}
+
+var (
+	// logMaskRegexes match variable parts of a line, such as IDs and
+	// numbers, which are masked before clustering.
+	logMaskRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`),
+		regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`),
+		regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`),
+		regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`),
+		regexp.MustCompile(`\b[0-9a-fA-F]*\d[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\b|\b[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\d[0-9a-fA-F]*\b`),
+		regexp.MustCompile(`\b\d+(\.\d+)?([a-zA-Z]{1,3})?\b`),
+	}
+
+	logLevelFieldRegex = regexp.MustCompile(`(?i)\b(?:level|lvl|severity)["']?\s*[=:]\s*["']?([a-zA-Z]+)`)
+	logLevelWordRegex  = regexp.MustCompile(`(?i)\b(fatal|panic|critical|error|err|warning|warn|info|debug|trace)\b`)
+)
+
+// logSummary describes the log lines of a panel by their patterns.
+type logSummary struct {
+	Lines int `json:"lines"`
+
+	// Baseline is set if the panel's queries were run over a baseline
+	// window too; BaselineLines are its lines.
+	Baseline      bool `json:"baseline"`
+	BaselineLines int  `json:"baselineLines,omitempty"`
+
+	// Patterns are the templates of the lines, new and rising first.
+	// PatternCount includes those left out, and Unclustered counts the
+	// lines beyond maxLogTemplates.
+	Patterns     []logPattern `json:"patterns"`
+	PatternCount int          `json:"patternCount"`
+	Unclustered  int          `json:"unclustered,omitempty"`
+}
+
+// logPattern is a template of log lines with variable tokens masked.
+type logPattern struct {
+	Template      string    `json:"template"`
+	Level         string    `json:"level,omitempty"`
+	Count         int       `json:"count"`
+	BaselineCount int       `json:"baselineCount,omitempty"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+	Sample        string    `json:"sample"`
+	New           bool      `json:"new,omitempty"`
+	Rising        bool      `json:"rising,omitempty"`
+}
+
+type logCluster struct {
+	tokens []string
+	logPattern
+}
+
+type drainNode struct {
+	children map[string]*drainNode
+	clusters []*logCluster
+}
+
+// drainTree clusters log lines into templates with the Drain algorithm: a
+// line is routed by its token count and first tokens to a few candidate
+// templates, and joins the most similar one, whose differing tokens become
+// wildcards.
+type drainTree struct {
+	root     map[int]*drainNode
+	clusters []*logCluster
+}
+
+func newDrainTree() *drainTree {
+	return &drainTree{root: make(map[int]*drainNode)}
+}
+
+// tokenizeLogLine masks the variable parts of a line and splits it into
+// tokens. Tokens beyond maxLogTokens are joined into the last one.
+func tokenizeLogLine(line string) []string {
+	line = truncate(line, maxLogLine)
+	for _, re := range logMaskRegexes {
+		line = re.ReplaceAllString(line, logWildcard)
+	}
+	tokens := strings.Fields(line)
+	if len(tokens) > maxLogTokens {
+		tokens[maxLogTokens-1] = strings.Join(tokens[maxLogTokens-1:], " ")
+		tokens = tokens[:maxLogTokens]
+	}
+	return tokens
+}
+
+// add clusters a line and returns its cluster, or nil if the line fits no
+// template and there are maxLogTemplates already.
+func (t *drainTree) add(tokens []string) *logCluster {
+	node, ok := t.root[len(tokens)]
+	if !ok {
+		node = &drainNode{children: make(map[string]*drainNode)}
+		t.root[len(tokens)] = node
+	}
+	for _, token := range tokens[:min(len(tokens), drainDepth-2)] {
+		if strings.ContainsAny(token, "0123456789") {
+			token = logWildcard
+		}
+		child, ok := node.children[token]
+		if !ok {
+			if len(node.children) >= maxDrainChildren {
+				token = logWildcard
+				child = node.children[token]
+			}
+			if child == nil {
+				child = &drainNode{children: make(map[string]*drainNode)}
+				node.children[token] = child
+			}
+		}
+		node = child
+	}
+
+	var best *logCluster
+	bestSimilarity := -1.0
+	for _, c := range node.clusters {
+		if s := drainSimilarityOf(c.tokens, tokens); s > bestSimilarity {
+			best, bestSimilarity = c, s
+		}
+	}
+	if best != nil && bestSimilarity >= drainSimilarity {
+		for i, token := range tokens {
+			if best.tokens[i] != token {
+				best.tokens[i] = logWildcard
+			}
+		}
+		return best
+	}
+	if len(t.clusters) >= maxLogTemplates {
+		return nil
+	}
+	c := &logCluster{tokens: slices.Clone(tokens)}
+	node.clusters = append(node.clusters, c)
+	t.clusters = append(t.clusters, c)
+	return c
+}
+
+// drainSimilarityOf is the share of a line's tokens that equal the
+// template's, not counting the template's wildcards as equal.
+func drainSimilarityOf(template, tokens []string) float64 {
+	if len(tokens) == 0 {
+		return 1
+	}
+	same := 0
+	for i, token := range tokens {
+		if template[i] == token && token != logWildcard {
+			same++
+		}
+	}
+	return float64(same) / float64(len(tokens))
+}
+
+// logLine is a line of a log frame.
+type logLine struct {
+	Time   time.Time
+	Text   string
+	Labels map[string]string
+}
+
+// isLogFrame reports whether a frame holds log lines.
+func isLogFrame(frame *data.Frame) bool {
+	if frame.Meta != nil && frame.Meta.PreferredVisualization == data.VisTypeLogs {
+		return true
+	}
+	return logLineField(frame) != nil && firstTimeField(frame) != nil
+}
+
+func logLineField(frame *data.Frame) *data.Field {
+	for _, name := range logLineFields {
+		if field, _ := frame.FieldByName(name); field != nil && (field.Type() == data.FieldTypeString || field.Type() == data.FieldTypeNullableString) {
+			return field
+		}
+	}
+	if frame.Meta != nil && frame.Meta.PreferredVisualization == data.VisTypeLogs {
+		for _, field := range frame.Fields {
+			if field.Type() == data.FieldTypeString || field.Type() == data.FieldTypeNullableString {
+				return field
+			}
+		}
+	}
+	return nil
+}
+
+// logLines returns the lines of the log frames, with the labels of the
+// labels field Loki adds or of the line field.
+func logLines(frames data.Frames) []logLine {
+	var lines []logLine
+	for _, frame := range frames {
+		if !isLogFrame(frame) {
+			continue
+		}
+		lineField, timeField := logLineField(frame), firstTimeField(frame)
+		if lineField == nil {
+			continue
+		}
+		labelsField, _ := frame.FieldByName("labels")
+		for i := range lineField.Len() {
+			text, ok := lineField.ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			line := logLine{Text: fmt.Sprint(text), Labels: lineField.Labels}
+			if timeField != nil {
+				if t, ok := timeField.ConcreteAt(i); ok {
+					line.Time, _ = t.(time.Time)
+				}
+			}
+			if labelsField != nil {
+				if raw, ok := labelsField.ConcreteAt(i); ok {
+					if encoded, ok := raw.(json.RawMessage); ok {
+						var labels map[string]string
+						if json.Unmarshal(encoded, &labels) == nil {
+							line.Labels = labels
+						}
+					}
+				}
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// logLevel returns the normalized level of a line: from its labels, from a
+// level field in the line, or from the first level word in it.
+func logLevel(line logLine) string {
+	level := line.Labels["level"]
+	if level == "" {
+		level = line.Labels["detected_level"]
+	}
+	if level == "" {
+		if m := logLevelFieldRegex.FindStringSubmatch(line.Text); m != nil {
+			level = m[1]
+		} else if m := logLevelWordRegex.FindStringSubmatch(line.Text); m != nil {
+			level = m[1]
+		}
+	}
+	switch strings.ToLower(level) {
+	case "fatal", "panic", "critical", "crit", "error", "err", "eror":
+		return "error"
+	case "warning", "warn":
+		return "warn"
+	case "info", "information":
+		return "info"
+	case "debug", "trace", "dbug":
+		return "debug"
+	}
+	return ""
+}
+
+// logLevelRank orders levels by severity, unknown ones last.
+var logLevelRank = map[string]int{"error": 0, "warn": 1, "info": 2, "debug": 3, "": 4}
+
+// summarizeLogs clusters the log lines of a panel into patterns and counts
+// them. With baseline frames, it flags patterns that are new or rising
+// compared with the baseline window; ratio is the length of the panel's
+// window over the baseline's, which scales the baseline counts.
+func summarizeLogs(panel *panelContext, baseline data.Frames, hasBaseline bool, ratio float64) {
+	lines := logLines(panel.Frames)
+	if len(lines) == 0 {
+		return
+	}
+	summary := &logSummary{Lines: len(lines), Baseline: hasBaseline}
+
+	// The panel's lines are clustered first, so that a baseline with
+	// maxLogTemplates patterns can't leave new patterns unclustered.
+	tree := newDrainTree()
+	for _, line := range lines {
+		c := tree.add(tokenizeLogLine(line.Text))
+		if c == nil {
+			summary.Unclustered++
+			continue
+		}
+		if c.Count == 0 {
+			c.Sample, c.Level = truncate(line.Text, maxContextLogTemplate), logLevel(line)
+		}
+		c.Count++
+		if c.FirstSeen.IsZero() || line.Time.Before(c.FirstSeen) {
+			c.FirstSeen = line.Time
+		}
+		if line.Time.After(c.LastSeen) {
+			c.LastSeen = line.Time
+		}
+	}
+	if hasBaseline {
+		for _, line := range logLines(baseline) {
+			summary.BaselineLines++
+			if c := tree.add(tokenizeLogLine(line.Text)); c != nil {
+				c.BaselineCount++
+			}
+		}
+	}
+
+	for _, c := range tree.clusters {
+		if c.Count == 0 {
+			continue
+		}
+		p := c.logPattern
+		p.Template = truncate(strings.Join(c.tokens, " "), maxContextLogTemplate)
+		if hasBaseline {
+			p.New = p.BaselineCount == 0
+			p.Rising = p.BaselineCount > 0 && p.Count >= minRisingLogCount && float64(p.Count) >= risingLogFactor*float64(p.BaselineCount)*ratio
+		}
+		summary.Patterns = append(summary.Patterns, p)
+	}
+	summary.PatternCount = len(summary.Patterns)
+	slices.SortStableFunc(summary.Patterns, func(a, b logPattern) int {
+		if a.changed() != b.changed() {
+			if a.changed() {
+				return -1
+			}
+			return 1
+		}
+		if a.Level != b.Level {
+			return logLevelRank[a.Level] - logLevelRank[b.Level]
+		}
+		return b.Count - a.Count
+	})
+	summary.Patterns = summary.Patterns[:min(len(summary.Patterns), maxContextLogPatterns)]
+	panel.Logs = summary
+}
+
+// changed reports whether a pattern is new or rising.
+func (p logPattern) changed() bool {
+	return p.New || p.Rising
+}
+
+// hasLogFrames reports whether a panel's data holds log lines.
+func hasLogFrames(panel *panelContext) bool {
+	return slices.ContainsFunc(panel.Frames, isLogFrame)
+}
+
+// writeLogSummary renders the log patterns of a panel.
+func writeLogSummary(b *strings.Builder, logs *logSummary) {
+	fmt.Fprintf(b, "  Log lines: %d in %d patterns", logs.Lines, logs.PatternCount)
+	if logs.Baseline {
+		fmt.Fprintf(b, ", %d lines in the baseline window before", logs.BaselineLines)
+	}
+	if logs.Unclustered > 0 {
+		fmt.Fprintf(b, ", %d lines unclustered", logs.Unclustered)
+	}
+	b.WriteString("\n  Patterns, new and rising first, then by level and count (<*> marks variable parts):\n")
+	for _, p := range logs.Patterns {
+		var flags []string
+		if p.Level != "" {
+			flags = append(flags, p.Level)
+		}
+		if p.New {
+			flags = append(flags, "new")
+		}
+		if p.Rising {
+			flags = append(flags, "rising")
+		}
+		fmt.Fprintf(b, "  - count=%d", p.Count)
+		if logs.Baseline {
+			fmt.Fprintf(b, " baseline=%d", p.BaselineCount)
+		}
+		if len(flags) > 0 {
+			fmt.Fprintf(b, " [%s]", strings.Join(flags, ", "))
+		}
+		fmt.Fprintf(b, " %s to %s: %s\n", p.FirstSeen.UTC().Format(time.RFC3339), p.LastSeen.UTC().Format(time.RFC3339), p.Template)
+	}
+	if omitted := logs.PatternCount - len(logs.Patterns); omitted > 0 {
+		fmt.Fprintf(b, "  (%d rarer patterns omitted)\n", omitted)
+	}
+}
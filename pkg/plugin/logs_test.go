@@ -0,0 +1,189 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// newTestLogFrame builds a frame like Loki's, with a labels field, from
+// lines repeated count times each, a second apart from start.
+func newTestLogFrame(start time.Time, lines map[string]int) *data.Frame {
+	var times []time.Time
+	var texts []string
+	var labels []json.RawMessage
+	for line, count := range lines {
+		for i := range count {
+			times = append(times, start.Add(time.Duration(len(times))*time.Second))
+			texts = append(texts, fmt.Sprintf(line, i, i*7))
+			labels = append(labels, json.RawMessage(`{"app":"checkout"}`))
+		}
+	}
+	frame := data.NewFrame("",
+		data.NewField("labels", nil, labels),
+		data.NewField("Time", nil, times),
+		data.NewField("Line", nil, texts),
+	)
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeLogs}
+	return frame
+}
+
+var (
+	testBaselineLogs = map[string]int{
+		"GET /api/cart/%d 200 %dms":                             20,
+		"level=info msg=\"connection to db-%d opened in %dms\"": 5,
+		"payment %d settled in %dms":                            4,
+	}
+	testCurrentLogs = map[string]int{
+		"GET /api/cart/%d 200 %dms":                                        20,
+		"level=info msg=\"connection to db-%d opened in %dms\"":            15,
+		"payment %d settled in %dms":                                       4,
+		"ERROR timeout calling payments at 10.0.0.%d:8443 after %ds":       6,
+		"user a3f9%dbc0 logged in from 192.168.1.%d":                       2,
+		"WARN retrying request 7c9e6679-7425-40de-944b-e07fc1f90ae7 #%d%d": 3,
+	}
+)
+
+func TestTokenizeLogLine(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected string
+	}{
+		{line: "GET /api/cart/42 200 12ms", expected: "GET /api/cart/<*> <*> <*>"},
+		{line: "timeout calling 10.0.0.5:8443 after 30s", expected: "timeout calling <*> after <*>"},
+		{line: "request 7c9e6679-7425-40de-944b-e07fc1f90ae7 at 2024-05-01T14:00:00Z", expected: "request <*> at <*>"},
+		{line: "commit deadbeef1 pushed by 0x1f", expected: "commit <*> pushed by <*>"},
+		{line: "level=error msg=failed", expected: "level=error msg=failed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.line, func(t *testing.T) {
+			if got := strings.Join(tokenizeLogLine(tc.line), " "); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSummarizeLogs(t *testing.T) {
+	start := time.UnixMilli(1700000000000).UTC()
+	panel := &panelContext{Frames: data.Frames{newTestLogFrame(start, testCurrentLogs)}}
+	summarizeLogs(panel, data.Frames{newTestLogFrame(start.Add(-time.Hour), testBaselineLogs)}, true, 1)
+
+	logs := panel.Logs
+	if logs == nil || logs.Lines != 50 || logs.BaselineLines != 29 || logs.PatternCount != 6 {
+		t.Fatalf("Unexpected log summary %+v", logs)
+	}
+	var patterns []string
+	for _, p := range logs.Patterns {
+		patterns = append(patterns, fmt.Sprintf("%s|%d|%d|%v|%v|%s", p.Level, p.Count, p.BaselineCount, p.New, p.Rising, p.Template))
+	}
+	expected := []string{
+		"error|6|0|true|false|ERROR timeout calling payments at <*> after <*>",
+		"warn|3|0|true|false|WARN retrying request <*> #<*>",
+		"info|15|5|false|true|level=info msg=\"connection to db-<*> opened in <*>\"",
+		"|2|0|true|false|user <*> logged in from <*>",
+		"|20|20|false|false|GET /api/cart/<*> <*> <*>",
+		"|4|4|false|false|payment <*> settled in <*>",
+	}
+	if strings.Join(patterns, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected patterns\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(patterns, "\n"))
+	}
+
+	var b strings.Builder
+	writePanelSummary(&b, *panel, detailStandard, start)
+	for _, want := range []string{"Log lines: 50 in 6 patterns, 29 lines in the baseline window before", "count=6 baseline=0 [error, new]", "[info, rising]"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected %q in the summary:\n%s", want, b.String())
+		}
+	}
+
+	panel = &panelContext{Frames: data.Frames{newTestLogFrame(start, testCurrentLogs)}}
+	summarizeLogs(panel, nil, false, 1)
+	if panel.Logs.Baseline || panel.Logs.Patterns[0].New || panel.Logs.Patterns[0].Level != "error" {
+		t.Errorf("Expected patterns by level without a baseline, got %+v", panel.Logs.Patterns[0])
+	}
+}
+
+func TestSummarizeLogsSaturatedBaseline(t *testing.T) {
+	// A baseline of more distinct lines than maxLogTemplates must not leave
+	// the panel's new patterns unclustered.
+	start := time.UnixMilli(1700000000000).UTC()
+	var times []time.Time
+	var texts []string
+	for i := range maxLogTemplates + 100 {
+		times = append(times, start.Add(-time.Hour+time.Duration(i)*time.Millisecond))
+		texts = append(texts, "baseline"+string([]byte{byte('a' + i/676), byte('a' + i/26%26), byte('a' + i%26)}))
+	}
+	baseline := data.NewFrame("", data.NewField("Time", nil, times), data.NewField("Line", nil, texts))
+	baseline.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeLogs}
+
+	panel := &panelContext{Frames: data.Frames{newTestLogFrame(start, map[string]int{"ERROR disk %d full after %ds": 3})}}
+	summarizeLogs(panel, data.Frames{baseline}, true, 1)
+
+	logs := panel.Logs
+	if logs.Unclustered != 0 || logs.PatternCount != 1 || !logs.Patterns[0].New || logs.Patterns[0].Count != 3 {
+		t.Errorf("Expected the panel's pattern to be flagged new, got %+v", logs)
+	}
+}
+
+func TestContextLogPatterns(t *testing.T) {
+	const dashboard = `{"dashboard": {"uid": "logs", "title": "Checkout logs", "panels": [
+		{"id": 1, "type": "logs", "title": "Errors", "datasource": {"type": "loki", "uid": "loki"}, "targets": [{"refId": "A", "expr": "{app=\"checkout\"}"}]}
+	]}}`
+	const from, to = 1700003600000, 1700007200000
+
+	var mu sync.Mutex
+	var ranges []string
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/dashboards/uid/logs":
+			w.Write([]byte(dashboard))
+		case "/api/ds/query":
+			var req dsQueryRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			mu.Lock()
+			ranges = append(ranges, req.From+"-"+req.To)
+			mu.Unlock()
+			lines := testCurrentLogs
+			if req.From != strconv.Itoa(from) {
+				lines = testBaselineLogs
+			}
+			start, _ := strconv.ParseInt(req.From, 10, 64)
+			resp := backend.NewQueryDataResponse()
+			resp.Responses["A"] = backend.DataResponse{Frames: data.Frames{newTestLogFrame(time.UnixMilli(start), lines)}}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer grafana.Close()
+
+	ds := &Datasource{config: pluginConfig{GrafanaURL: grafana.URL}}
+	req := httptest.NewRequest("GET", fmt.Sprintf("/context?dashboardUid=logs&from=%d&to=%d", from, to), nil)
+	rr := httptest.NewRecorder()
+	ds.handleContext(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if strings.Join(ranges, ",") != fmt.Sprintf("%d-%d,%d-%d", from, to, 2*from-to, from) {
+		t.Errorf("Expected the panel to be queried over its window and the one before, got %v", ranges)
+	}
+	var resp struct {
+		Prompt string `json:"prompt"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if !strings.Contains(resp.Prompt, "[error, new] 2023-11-14T23:1") || !strings.Contains(resp.Prompt, "ERROR timeout calling payments at <*> after <*>") {
+		t.Errorf("Expected the log patterns in the prompt, got %s", resp.Prompt)
+	}
+}
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsNamespace prefixes all metrics exposed by the plugin.
+const metricsNamespace = "bsure_chatbot"
+
+// Metrics are registered with the default registry, which the plugin SDK
+// exposes to Grafana through its metrics collection.
+var (
+	chatRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Chat requests by model, HTTP status and error code.",
+	}, []string{"model", "status", "error_code"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Duration of single Groq API attempts by model and upstream status.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 15, 30},
+	}, []string{"model", "status"})
+
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time until the first byte of a successful Groq response arrived.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30},
+	}, []string{"model"})
+
+	tokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tokens_total",
+		Help:      "Tokens reported by Groq by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+
+	toolCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tool_calls_total",
+		Help:      "Tool calls of the agent loop by tool and status (ok or error).",
+	}, []string{"tool", "status"})
+
+	rateLimitRejectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Chat requests rejected by the rate limiter.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limiter_keys",
+		Help:      "Clients with requests inside the rate limit window.",
+	}, func() float64 {
+		return float64(globalRateLimiter.activeClients(time.Minute))
+	})
+)
+
+// otherModel is the model label of models that are neither priced nor have
+// a known context window.
+const otherModel = "other"
+
+// metricModel returns the model label for model. Any name that passes
+// validModel can be requested, so only known models get their own series.
+func (ds *Datasource) metricModel(model string) string {
+	if model == "" {
+		return ""
+	}
+	_, priced := defaultPricing[model]
+	_, configured := ds.config.Pricing[model]
+	_, known := defaultContextWindows[model]
+	_, windowed := ds.config.ContextWindows[model]
+	if priced || configured || known || windowed {
+		return model
+	}
+	return otherModel
+}
+
+// recordChatRequest counts a finished chat request.
+func recordChatRequest(model string, status int, errCode string) {
+	chatRequestsTotal.WithLabelValues(model, strconv.Itoa(status), errCode).Inc()
+}
+
+// observeUpstreamLatency records the duration of an upstream attempt.
+func observeUpstreamLatency(model, status string, start time.Time) {
+	upstreamDuration.WithLabelValues(model, status).Observe(time.Since(start).Seconds())
+}
+
+// recordTokenUsage adds the token counts of a response.
+func recordTokenUsage(model string, usage chatUsage) {
+	tokensTotal.WithLabelValues(model, "prompt").Add(float64(usage.PromptTokens))
+	tokensTotal.WithLabelValues(model, "completion").Add(float64(usage.CompletionTokens))
+}
+
+// recordToolCall counts a tool call of the agent loop. Names the model made
+// up are counted as unknown.
+func recordToolCall(tool string, ok bool) {
+	if _, known := grafanaTools[tool]; !known {
+		tool = "unknown"
+	}
+	status := "ok"
+	if !ok {
+		status = "error"
+	}
+	toolCallsTotal.WithLabelValues(tool, status).Inc()
+}
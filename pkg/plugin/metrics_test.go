@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestChatMetrics(t *testing.T) {
+	globalRateLimiter.reset()
+
+	groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[],"usage":{"prompt_tokens":20,"completion_tokens":5,"total_tokens":25}}`))
+	}))
+	defer groq.Close()
+
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		groqURL:  groq.URL,
+	}
+	model := "llama-3.3-70b-versatile"
+
+	requests := chatRequestsTotal.WithLabelValues(model, "200", "")
+	prompt := tokensTotal.WithLabelValues(model, "prompt")
+	completion := tokensTotal.WithLabelValues(model, "completion")
+	before := []float64{counterValue(t, requests), counterValue(t, prompt), counterValue(t, completion)}
+	latencyBefore := histogramCount(t, upstreamDuration.WithLabelValues(model, "200"))
+	ttftBefore := histogramCount(t, timeToFirstToken.WithLabelValues(model))
+
+	rr := httptest.NewRecorder()
+	ds.handleGroqChat(rr, newTestChatRequest())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	if got := counterValue(t, requests) - before[0]; got != 1 {
+		t.Errorf("Expected 1 successful request, got %v", got)
+	}
+	if got := counterValue(t, prompt) - before[1]; got != 20 {
+		t.Errorf("Expected 20 prompt tokens, got %v", got)
+	}
+	if got := counterValue(t, completion) - before[2]; got != 5 {
+		t.Errorf("Expected 5 completion tokens, got %v", got)
+	}
+	if got := histogramCount(t, upstreamDuration.WithLabelValues(model, "200")) - latencyBefore; got != 1 {
+		t.Errorf("Expected 1 upstream latency observation, got %d", got)
+	}
+	if got := histogramCount(t, timeToFirstToken.WithLabelValues(model)) - ttftBefore; got != 1 {
+		t.Errorf("Expected 1 time to first token observation, got %d", got)
+	}
+}
+
+func TestMetricModel(t *testing.T) {
+	ds := &Datasource{config: pluginConfig{
+		Pricing:        map[string]modelPrice{"priced-model": {}},
+		ContextWindows: map[string]int{"windowed-model": 8192},
+	}}
+	testCases := []struct {
+		model    string
+		expected string
+	}{
+		{model: "llama-3.3-70b-versatile", expected: "llama-3.3-70b-versatile"},
+		{model: "priced-model", expected: "priced-model"},
+		{model: "windowed-model", expected: "windowed-model"},
+		{model: "made-up-model-1", expected: otherModel},
+		{model: "", expected: ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.model, func(t *testing.T) {
+			if got := ds.metricModel(tc.model); got != tc.expected {
+				t.Errorf("Expected label %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestChatMetricsErrors(t *testing.T) {
+	globalRateLimiter.reset()
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+	}
+
+	invalid := chatRequestsTotal.WithLabelValues("", "400", errCodeInvalidModel)
+	before := counterValue(t, invalid)
+
+	req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(`{"model":"bad model","messages":[]}`))
+	req.Header.Set("Content-Type", "application/json")
+	ds.handleGroqChat(httptest.NewRecorder(), req)
+
+	if got := counterValue(t, invalid) - before; got != 1 {
+		t.Errorf("Expected 1 invalid model request, got %v", got)
+	}
+
+	rejectionsBefore := counterValue(t, rateLimitRejectionsTotal)
+	for i := 0; i < 11; i++ {
+		req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		ds.handleGroqChat(httptest.NewRecorder(), req)
+	}
+	if got := counterValue(t, rateLimitRejectionsTotal) - rejectionsBefore; got != 1 {
+		t.Errorf("Expected 1 rate limit rejection, got %v", got)
+	}
+}
+
+func TestRateLimiterActiveClients(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.isAllowed("a", 10, time.Minute)
+	rl.isAllowed("b", 10, time.Minute)
+	rl.requests["stale"] = []time.Time{time.Now().Add(-2 * time.Minute)}
+
+	if got := rl.activeClients(time.Minute); got != 2 {
+		t.Errorf("Expected 2 active clients, got %d", got)
+	}
+	if _, ok := rl.requests["stale"]; !ok {
+		t.Error("Expected counting clients not to drop any")
+	}
+
+	// The next request after a window drops the stale client
+	rl.isAllowed("a", 10, time.Minute)
+	if _, ok := rl.requests["stale"]; !ok {
+		t.Error("Expected stale clients to be dropped once per window only")
+	}
+	rl.pruned = time.Now().Add(-time.Minute)
+	rl.isAllowed("a", 10, time.Minute)
+	if _, ok := rl.requests["stale"]; ok || len(rl.requests) != 2 {
+		t.Errorf("Expected stale client to be dropped, got %v", rl.requests)
+	}
+}
@@ -0,0 +1,368 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxPanelDataPoints is the resolution panel queries are run with.
+	maxPanelDataPoints = 500
+
+	// panelQueryConcurrency bounds the panel queries run at the same time.
+	panelQueryConcurrency = 4
+
+	// maxContextSeries bounds the series of a panel included in the prompt.
+	maxContextSeries = 20
+)
+
+// Data source UIDs that don't refer to a real data source.
+const (
+	mixedDataSourceUID     = "-- Mixed --"
+	dashboardDataSourceUID = "-- Dashboard --"
+)
+
+// variableRegex matches the template variable syntaxes $var, ${var},
+// ${var:format} and [[var]].
+var variableRegex = regexp.MustCompile(`\$(\w+)|\$\{(\w+)(?::(\w+))?\}|\[\[(\w+)(?::(\w+))?\]\]`)
+
+// dsQueryRequest is the body of Grafana's /api/ds/query.
+type dsQueryRequest struct {
+	Queries []map[string]any `json:"queries"`
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+}
+
+// queryData runs req through Grafana's query API. Grafana answers with a
+// non-2xx status when a query fails, but still includes the responses, whose
+// errors say more than the status.
+func queryData(ctx context.Context, client *grafanaClient, req dsQueryRequest) (*backend.QueryDataResponse, error) {
+	var resp backend.QueryDataResponse
+	err := client.post(ctx, "/api/ds/query", req, &resp)
+	var statusErr *grafanaStatusError
+	if errors.As(err, &statusErr) && (statusErr.status == http.StatusBadRequest || statusErr.status == http.StatusInternalServerError) &&
+		json.Unmarshal(statusErr.body, &resp) == nil && len(resp.Responses) > 0 {
+		return &resp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// queryPanelData runs the queries of all panels of dc through Grafana's
+// query API and attaches the resulting frames to the panels. Panels whose
+// queries fail get an error instead; the context is still usable.
+func (ds *Datasource) queryPanelData(ctx context.Context, client *grafanaClient, dc *dashboardContext) {
+	ctx, span := startSpan(ctx, "context.query_panels")
+	defer span.End()
+	span.SetAttributes(attribute.Int("context.panels", len(dc.Panels)))
+
+	resolver := &dataSourceResolver{client: client, refs: make(map[string]dataSourceRef)}
+	sem := make(chan struct{}, panelQueryConcurrency)
+	var wg sync.WaitGroup
+	for i := range dc.Panels {
+		panel := &dc.Panels[i]
+		if len(panel.targets) == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := queryPanel(ctx, client, resolver, dc, panel); err != nil {
+				log.DefaultLogger.Warn("Failed to query panel", "dashboard", dc.UID, "panel", panel.ID, "error", err)
+				panel.Error = panelQueryError(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// queryPanel runs the queries of a single panel. Hidden queries are run too,
+// since expressions may depend on them, but their frames are dropped.
+func queryPanel(ctx context.Context, client *grafanaClient, resolver *dataSourceResolver, dc *dashboardContext, panel *panelContext) error {
+	interval := dc.To.Sub(dc.From) / maxPanelDataPoints
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	req := dsQueryRequest{
+		From: strconv.FormatInt(dc.From.UnixMilli(), 10),
+		To:   strconv.FormatInt(dc.To.UnixMilli(), 10),
+	}
+	hidden := make(map[string]bool)
+	for _, target := range panel.targets {
+		ref := panel.targetDataSource(target)
+		if ref == nil || ref.UID == dashboardDataSourceUID {
+			continue
+		}
+
+		resolved, err := resolver.resolve(ctx, interpolateRef(*ref, dc.variables))
+		if err != nil {
+			return err
+		}
+
+		query := make(map[string]any, len(target.model)+3)
+		for key, value := range target.model {
+			query[key] = interpolateValue(value, dc.variables, resolved.Type)
+		}
+		query["datasource"] = resolved
+		query["maxDataPoints"] = maxPanelDataPoints
+		query["intervalMs"] = interval.Milliseconds()
+		req.Queries = append(req.Queries, query)
+		hidden[target.RefID] = target.Hide
+	}
+	if len(req.Queries) == 0 {
+		return nil
+	}
+
+	resp, err := queryData(ctx, client, req)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range req.Queries {
+		refID, _ := query["refId"].(string)
+		result, ok := resp.Responses[refID]
+		if !ok || hidden[refID] {
+			continue
+		}
+		if result.Error != nil {
+			return fmt.Errorf("query %s: %w", refID, result.Error)
+		}
+		panel.Frames = append(panel.Frames, result.Frames...)
+	}
+	return nil
+}
+
+// targetDataSource returns the data source a target of the panel is run
+// against: its own, or the panel's if it has none or the panel is mixed.
+func (p *panelContext) targetDataSource(target panelTarget) *dataSourceRef {
+	if target.Datasource == nil || target.Datasource.UID == mixedDataSourceUID {
+		return p.datasource
+	}
+	return target.Datasource
+}
+
+// panelQueryError describes a failed panel query for the context. Details of
+// data source errors are left to the logs.
+func panelQueryError(err error) string {
+	var statusErr *grafanaStatusError
+	if errors.As(err, &statusErr) {
+		return fmt.Sprintf("query failed with status %d", statusErr.status)
+	}
+	return "query failed"
+}
+
+// dataSourceResolver looks up the UIDs of data sources referenced by name,
+// as in dashboards saved by older Grafana versions.
+type dataSourceResolver struct {
+	client *grafanaClient
+
+	mu   sync.Mutex
+	refs map[string]dataSourceRef
+}
+
+func (r *dataSourceResolver) resolve(ctx context.Context, ref dataSourceRef) (dataSourceRef, error) {
+	if ref.UID != "" {
+		return dataSourceRef{Type: ref.Type, UID: ref.UID}, nil
+	}
+	if ref.Name == "" {
+		return ref, errors.New("data source without UID or name")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resolved, ok := r.refs[ref.Name]; ok {
+		return resolved, nil
+	}
+
+	var resolved dataSourceRef
+	if err := r.client.get(ctx, "/api/datasources/name/"+url.PathEscape(ref.Name), &resolved); err != nil {
+		return ref, err
+	}
+	resolved.Name = ""
+	r.refs[ref.Name] = resolved
+	return resolved, nil
+}
+
+// interpolateRef replaces template variables in a data source reference, for
+// dashboards whose data source is chosen by a variable.
+func interpolateRef(ref dataSourceRef, variables []dashboardVariable) dataSourceRef {
+	ref.UID = interpolate(ref.UID, variables, "raw")
+	ref.Name = interpolate(ref.Name, variables, "raw")
+	return ref
+}
+
+// interpolateValue replaces template variables in all strings of a query
+// model. Grafana's built-in variables, such as $__interval, are left to the
+// data sources.
+func interpolateValue(value any, variables []dashboardVariable, dsType string) any {
+	switch v := value.(type) {
+	case string:
+		return interpolate(v, variables, defaultVariableFormat(dsType))
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			result[key] = interpolateValue(item, variables, dsType)
+		}
+		return result
+	case []any:
+		result := make([]any, len(v))
+		for i, item := range v {
+			result[i] = interpolateValue(item, variables, dsType)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// defaultVariableFormat returns how multi-value variables are formatted for a
+// data source type when the query doesn't specify a format.
+func defaultVariableFormat(dsType string) string {
+	switch {
+	case dsType == "prometheus" || dsType == "loki":
+		return "regex"
+	case strings.Contains(dsType, "postgres") || strings.Contains(dsType, "mysql") || strings.Contains(dsType, "mssql"):
+		return "singlequote"
+	default:
+		return "glob"
+	}
+}
+
+// interpolate replaces the template variables in s with their current values.
+func interpolate(s string, variables []dashboardVariable, defaultFormat string) string {
+	if !strings.ContainsAny(s, "$[") {
+		return s
+	}
+	return variableRegex.ReplaceAllStringFunc(s, func(match string) string {
+		groups := variableRegex.FindStringSubmatch(match)
+		name, format := groups[1]+groups[2]+groups[4], groups[3]+groups[5]
+		if strings.HasPrefix(name, "__") {
+			return match
+		}
+		for _, v := range variables {
+			if v.Name != name {
+				continue
+			}
+			values, raw := variableValues(v)
+			if raw {
+				return values[0]
+			}
+			if format == "" {
+				format = defaultFormat
+			}
+			return formatVariable(values, format)
+		}
+		return match
+	})
+}
+
+// variableValues returns the current values of a variable. For "All" with a
+// custom all value, that value is returned and must not be formatted.
+func variableValues(v dashboardVariable) ([]string, bool) {
+	values := variableStrings(v.Current.Value)
+	if len(values) != 1 || values[0] != "$__all" {
+		return values, false
+	}
+	if v.AllValue != "" {
+		return []string{v.AllValue}, true
+	}
+
+	values = values[:0]
+	for _, option := range v.Options {
+		for _, value := range variableStrings(option.Value) {
+			if value != "$__all" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values, false
+}
+
+func variableStrings(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	case nil:
+		return []string{""}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// formatVariable formats variable values like Grafana's variable formats
+// raw, csv, pipe, regex, singlequote, doublequote and glob. A single value is
+// only escaped, not wrapped.
+func formatVariable(values []string, format string) string {
+	switch format {
+	case "csv":
+		return strings.Join(values, ",")
+	case "pipe":
+		return strings.Join(values, "|")
+	case "regex":
+		escaped := make([]string, len(values))
+		for i, value := range values {
+			escaped[i] = regexp.QuoteMeta(value)
+		}
+		if len(escaped) == 1 {
+			return escaped[0]
+		}
+		return "(" + strings.Join(escaped, "|") + ")"
+	case "singlequote", "doublequote":
+		quote := "'"
+		if format == "doublequote" {
+			quote = `"`
+		}
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = quote + strings.ReplaceAll(value, quote, `\`+quote) + quote
+		}
+		return strings.Join(quoted, ",")
+	case "glob":
+		if len(values) == 1 {
+			return values[0]
+		}
+		return "{" + strings.Join(values, ",") + "}"
+	default:
+		return strings.Join(values, ",")
+	}
+}
+
+// seriesName names a field like Grafana's legend does by default.
+func seriesName(frame *data.Frame, field *data.Field) string {
+	if field.Config != nil && field.Config.DisplayNameFromDS != "" {
+		return field.Config.DisplayNameFromDS
+	}
+	name := field.Name
+	if frame.Name != "" && (name == "" || name == "Value") {
+		name = frame.Name
+	}
+	if len(field.Labels) > 0 {
+		name += "{" + field.Labels.String() + "}"
+	}
+	return name
+}
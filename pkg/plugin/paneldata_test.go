@@ -0,0 +1,117 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestInterpolate(t *testing.T) {
+	variables := []dashboardVariable{
+		{Name: "env"},
+		{Name: "pod"},
+		{Name: "job", AllValue: ".+"},
+		{Name: "node"},
+	}
+	variables[0].Current.Value = "prod"
+	variables[1].Current.Value = []any{"a", "b.1"}
+	variables[2].Current.Value = "$__all"
+	variables[3].Current.Value = []any{"$__all"}
+	for _, value := range []any{"$__all", "n1", "n2"} {
+		variables[3].Options = append(variables[3].Options, struct {
+			Value any `json:"value"`
+		}{Value: value})
+	}
+
+	testCases := []struct {
+		input    string
+		format   string
+		expected string
+	}{
+		{input: `up{env="$env"}`, format: "regex", expected: `up{env="prod"}`},
+		{input: `up{pod=~"$pod"}`, format: "regex", expected: `up{pod=~"(a|b\.1)"}`},
+		{input: `up{pod=~"${pod:pipe}"}`, format: "regex", expected: `up{pod=~"a|b.1"}`},
+		{input: `SELECT * FROM t WHERE pod IN ($pod)`, format: "singlequote", expected: `SELECT * FROM t WHERE pod IN ('a','b.1')`},
+		{input: `servers.[[pod]].cpu`, format: "glob", expected: `servers.{a,b.1}.cpu`},
+		{input: `up{job=~"$job"}`, format: "regex", expected: `up{job=~".+"}`},
+		{input: `up{node=~"$node"}`, format: "regex", expected: `up{node=~"(n1|n2)"}`},
+		{input: `rate(x[$__rate_interval]) $unknown`, format: "regex", expected: `rate(x[$__rate_interval]) $unknown`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if got := interpolate(tc.input, variables, tc.format); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestQueryPanelData(t *testing.T) {
+	grafana := newTestGrafana(t, nil)
+	ds := &Datasource{config: pluginConfig{GrafanaURL: grafana.URL}}
+
+	r := httptest.NewRequest("GET", "/context", nil)
+	dc, reqErr := ds.loadDashboardContext(context.Background(), r, contextRequest{DashboardUID: "dash-1", From: 1700000000000, To: 1700003600000, PanelID: 1})
+	if reqErr != nil {
+		t.Fatalf("Failed to load context: %v", reqErr)
+	}
+
+	rate := dc.Panels[0]
+	if rate.Error != "" || len(rate.Frames) != 1 {
+		t.Fatalf("Expected one frame for the visible query, got %d (%s)", len(rate.Frames), rate.Error)
+	}
+	if rate.Frames[0].Name != "A" || rate.Frames[0].Rows() != 3 {
+		t.Errorf("Unexpected frame: %s with %d rows", rate.Frames[0].Name, rate.Frames[0].Rows())
+	}
+
+	slow := dc.Panels[1]
+	if slow.Error == "" || len(slow.Frames) != 0 {
+		t.Errorf("Expected the failing Postgres query to be reported, got %+v", slow)
+	}
+
+	prompt := dc.prompt()
+	if !strings.Contains(prompt, "n=3, last=4 at 2023-11-14T22:15:20Z") || !strings.Contains(prompt, "Data: query failed") {
+		t.Errorf("Expected panel data in prompt:\n%s", prompt)
+	}
+}
+
+func TestQueryPanelDataPartialFailure(t *testing.T) {
+	// Grafana answers 400 if any query fails, with the responses of all
+	// queries in the body. A failed hidden query doesn't fail the panel.
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/dashboards/uid/dash-1" {
+			w.Write([]byte(`{"dashboard": {"uid": "dash-1", "panels": [
+				{"id": 1, "type": "timeseries", "title": "Rate", "datasource": {"type": "prometheus", "uid": "prom"},
+				 "targets": [{"refId": "A", "expr": "up"}, {"refId": "B", "expr": "up{", "hide": true}]}
+			]}}`))
+			return
+		}
+		resp := backend.NewQueryDataResponse()
+		resp.Responses["A"] = backend.DataResponse{Frames: data.Frames{data.NewFrame("A",
+			data.NewField("time", nil, []time.Time{time.UnixMilli(1700000000000)}),
+			data.NewField("Value", nil, []float64{1}),
+		)}}
+		resp.Responses["B"] = backend.ErrDataResponse(backend.StatusBadRequest, "parse error")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer grafana.Close()
+
+	ds := &Datasource{config: pluginConfig{GrafanaURL: grafana.URL}}
+	r := httptest.NewRequest("GET", "/context", nil)
+	dc, reqErr := ds.loadDashboardContext(context.Background(), r, contextRequest{DashboardUID: "dash-1", From: 1700000000000, To: 1700003600000})
+	if reqErr != nil {
+		t.Fatalf("Failed to load context: %v", reqErr)
+	}
+	if panel := dc.Panels[0]; panel.Error != "" || len(panel.Frames) != 1 || panel.Frames[0].Name != "A" {
+		t.Errorf("Expected the frame of the visible query, got %d frames (%s)", len(panel.Frames), panel.Error)
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,12 +19,97 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// groqChatCompletionsURL is Groq's OpenAI-compatible chat completions endpoint.
+	groqChatCompletionsURL = "https://api.groq.com/openai/v1/chat/completions"
+)
+
+// chatMessage is a single message of a conversation.
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatRequest is the body accepted by /groq-chat.
+type chatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+
+	// DashboardUID identifies the dashboard the chat belongs to. It is not
+	// forwarded to Groq.
+	DashboardUID string `json:"dashboardUid,omitempty"`
+
+	// Context asks the backend to build the system message from the
+	// dashboard, replacing any system message sent by the client.
+	Context *contextRequest `json:"context,omitempty"`
+
+	// Tools lets the model call grafanaTools in an agent loop before it
+	// answers.
+	Tools bool `json:"tools,omitempty"`
+}
+
+// groqChatRequest is the body sent to the Groq chat completions API.
+type groqChatRequest struct {
+	Model          string          `json:"model"`
+	Messages       []chatMessage   `json:"messages"`
+	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+}
+
+// chatUsage holds the token counts reported by Groq.
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// requestError is an error that is reported to the client with an HTTP status.
+// The message is safe to expose; details belong in the logs.
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// Error codes identify why a request failed, e.g. in metrics.
+const (
+	errCodeMethodNotAllowed    = "method_not_allowed"
+	errCodeInvalidContentType  = "invalid_content_type"
+	errCodeRateLimited         = "rate_limited"
+	errCodeNotConfigured       = "not_configured"
+	errCodeInvalidBody         = "invalid_body"
+	errCodeTooManyMessages     = "too_many_messages"
+	errCodeInvalidModel        = "invalid_model"
+	errCodeContentTooLong      = "content_too_long"
+	errCodeInvalidRole         = "invalid_role"
+	errCodeContextTooLong      = "context_too_long"
+	errCodeInvalidDashboard    = "invalid_dashboard"
+	errCodeInvalidTimeRange    = "invalid_time_range"
+	errCodeInvalidDatasource   = "invalid_datasource"
+	errCodeInvalidQuery        = "invalid_query"
+	errCodeForbidden           = "forbidden"
+	errCodeNotFound            = "not_found"
+	errCodeConflict            = "conflict"
+	errCodeGrafanaError        = "grafana_error"
+	errCodeInternal            = "internal"
+	errCodeUpstreamUnavailable = "upstream_unavailable"
+	errCodeUpstreamError       = "upstream_error"
 )
 
 // Rate limiter for API requests
 type RateLimiter struct {
 	mu       sync.Mutex
 	requests map[string][]time.Time
+
+	// pruned is when clients without recent requests were last dropped.
+	pruned time.Time
 }
 
 func NewRateLimiter() *RateLimiter {
@@ -56,9 +145,35 @@ func (rl *RateLimiter) isAllowed(clientID string, maxRequests int, timeWindow ti
 	validRequests = append(validRequests, now)
 	rl.requests[clientID] = validRequests
 
+	// Drop clients without requests inside the window once per window, so
+	// the map doesn't grow without bound.
+	if now.Sub(rl.pruned) >= timeWindow {
+		for id, requests := range rl.requests {
+			if !requests[len(requests)-1].After(cutoff) {
+				delete(rl.requests, id)
+			}
+		}
+		rl.pruned = now
+	}
+
 	return true
 }
 
+// activeClients returns the number of clients with requests inside timeWindow.
+func (rl *RateLimiter) activeClients(timeWindow time.Duration) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cutoff := time.Now().Add(-timeWindow)
+	active := 0
+	for _, requests := range rl.requests {
+		if len(requests) > 0 && requests[len(requests)-1].After(cutoff) {
+			active++
+		}
+	}
+	return active
+}
+
 func (rl *RateLimiter) reset() {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
@@ -68,11 +183,15 @@ func (rl *RateLimiter) reset() {
 // Make sure Datasource implements required interfaces.
 var (
 	_ backend.CallResourceHandler   = (*Datasource)(nil)
+	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
-	
+
 	// Regular expression for validating model names
 	modelNameRegex = regexp.MustCompile(`^[a-zA-Z0-9\-\.]+$`)
-	
+
+	// Regular expression for validating dashboard UIDs
+	dashboardUIDRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,40}$`)
+
 	// Global rate limiter - 10 requests per minute per IP
 	globalRateLimiter = NewRateLimiter()
 )
@@ -80,19 +199,64 @@ var (
 // Datasource represents an instance of the plugin.
 type Datasource struct {
 	settings backend.DataSourceInstanceSettings
+	config   pluginConfig
+
+	// usage records completed chat requests for cost accounting.
+	usage *usageLedger
+
+	// audit records exchanges with the LLM; nil if no data directory is set.
+	audit *auditLog
+
+	// history keeps summaries of long conversations for reuse.
+	history *historySummaries
+
+	// annotations keeps proposed annotations until the user confirms them.
+	annotations *pendingAnnotations
+
+	// groqURL overrides groqChatCompletionsURL, e.g. in tests.
+	groqURL string
 }
 
 // NewDatasource creates a new plugin instance.
 func NewDatasource(_ context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+	config, err := loadPluginConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	var audit *auditLog
+	usage := newUsageLedger(config.Pricing)
+	if config.DataDir != "" {
+		// An unwritable data directory shouldn't keep the chatbot from
+		// starting; the redaction level was validated with the config.
+		audit, err = newAuditLog(filepath.Join(config.DataDir, auditDir), config.Audit)
+		if err != nil {
+			log.DefaultLogger.Error("Failed to open the audit log - audit log disabled", "error", err)
+		}
+		if persisted, err := openUsageLedger(filepath.Join(config.DataDir, usageDir), config.Pricing); err != nil {
+			log.DefaultLogger.Error("Failed to open the usage ledger - usage kept in memory only", "error", err)
+		} else {
+			usage = persisted
+		}
+	} else {
+		log.DefaultLogger.Warn("No data directory configured - audit log disabled and usage kept in memory only", "env", envDataDir)
+	}
+
 	return &Datasource{
-		settings: settings,
+		settings:    settings,
+		config:      config,
+		usage:       usage,
+		audit:       audit,
+		history:     newHistorySummaries(),
+		annotations: newPendingAnnotations(),
 	}, nil
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
 // created.
 func (ds *Datasource) Dispose() {
-	// cleanup
+	ds.audit.close()
+	ds.usage.close()
 }
 
 // CallResource handles incoming resource calls from frontend
@@ -101,10 +265,22 @@ func (ds *Datasource) CallResource(ctx context.Context, req *backend.CallResourc
 
 	// Create a new handler for HTTP-like handling
 	mux := http.NewServeMux()
-	
+
 	// Add your routes
 	mux.HandleFunc("/groq-chat", ds.handleGroqChat)
-	
+	mux.HandleFunc("/usage", ds.handleUsage)
+	mux.HandleFunc("/audit", ds.handleAudit)
+	mux.HandleFunc("/context", ds.handleContext)
+	mux.HandleFunc("/explain-panel", ds.handleExplainPanel)
+	mux.HandleFunc("/summarize-dashboard", ds.handleSummarizeDashboard)
+	mux.HandleFunc("/compare", ds.handleCompare)
+	mux.HandleFunc("/generate-query", ds.handleGenerateQuery)
+	mux.HandleFunc("/generate-dashboard", ds.handleGenerateDashboard)
+	mux.HandleFunc("/explain-query", ds.handleExplainQuery)
+	mux.HandleFunc("/investigate-alert", ds.handleInvestigateAlert)
+	mux.HandleFunc("/alert-webhook", ds.handleAlertWebhook)
+	mux.HandleFunc("/annotations", ds.handleAnnotations)
+
 	// Use the HTTP adapter
 	httpResourceHandler := httpadapter.New(mux)
 	return httpResourceHandler.CallResource(ctx, req, sender)
@@ -112,99 +288,245 @@ func (ds *Datasource) CallResource(ctx context.Context, req *backend.CallResourc
 
 // handleGroqChat handles Groq API requests securely with environment variable
 func (ds *Datasource) handleGroqChat(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "chat.handle")
+	defer span.End()
+
+	// The model label is only set once the name has been validated, and
+	// unknown models are counted as other, to keep arbitrary client input out
+	// of the metric labels.
+	model, status, errCode := "", http.StatusOK, ""
+	defer func() {
+		recordChatRequest(ds.metricModel(model), status, errCode)
+	}()
+	fail := func(err *requestError) {
+		status, errCode = err.status, err.code
+		writeRequestError(w, span, err)
+	}
+
 	// Only allow POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		fail(&requestError{status: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed, message: "Method not allowed"})
 		return
 	}
 
 	// Validate Content-Type
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		http.Error(w, "Invalid Content-Type", http.StatusBadRequest)
+		fail(&requestError{status: http.StatusBadRequest, code: errCodeInvalidContentType, message: "Invalid Content-Type"})
 		return
 	}
 
 	// Rate limiting - use client IP as identifier
-	clientIP := r.RemoteAddr
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		clientIP = forwardedFor
-	}
-	
+	clientIP := requestClientID(r)
+
 	// Allow 10 requests per minute per IP
-	if !globalRateLimiter.isAllowed(clientIP, 10, time.Minute) {
+	if !checkRateLimit(ctx, clientIP) {
 		log.DefaultLogger.Warn("Rate limit exceeded", "client", clientIP)
-		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		rateLimitRejectionsTotal.Inc()
+		fail(&requestError{status: http.StatusTooManyRequests, code: errCodeRateLimited, message: "Too many requests"})
 		return
 	}
 
-	// Get API key from plugin configuration
-	// For production use, the API key should be configured via the plugin's secure configuration
-	apiKey, exists := ds.settings.DecryptedSecureJSONData["groqApiKey"]
-	if !exists || apiKey == "" {
-		log.DefaultLogger.Error("GROQ API key not configured - please configure through Grafana plugin settings")
-		http.Error(w, "API key not configured - please set up GROQ API key in plugin configuration", http.StatusInternalServerError)
+	// Get API key from plugin configuration, falling back to the environment for local development
+	apiKey := ds.groqAPIKey()
+	if apiKey == "" {
+		log.DefaultLogger.Error("GROQ API key not configured - please configure through Grafana plugin settings or GROQ_API_KEY")
+		fail(&requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
 		return
 	}
 
 	// Limit request body size (1MB)
 	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
 
-	// Parse request body
-	var reqBody struct {
-		Model    string `json:"model"`
-		Messages []struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"messages"`
+	reqBody, reqErr := validateChatRequest(ctx, r.Body)
+	if reqErr != nil {
+		fail(reqErr)
+		return
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		log.DefaultLogger.Error("Failed to decode request body", "error", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	model = reqBody.Model
+	span.SetAttributes(
+		attribute.String(attrModel, reqBody.Model),
+		attribute.Int(attrMessagesCount, len(reqBody.Messages)),
+	)
+
+	// The dashboard context replaces the client's system messages
+	var dashboard *dashboardContext
+	if reqBody.Context != nil {
+		dashboard, reqErr = ds.loadDashboardContext(ctx, r, *reqBody.Context)
+		if reqErr != nil {
+			fail(reqErr)
+			return
+		}
+		reqBody.Messages = withoutSystemMessages(reqBody.Messages)
+	}
+
+	reqBody.Messages = ds.compressHistory(ctx, apiKey, reqBody)
+
+	messages, budget, reqErr := ds.fitContextWindow(ctx, reqBody.Model, dashboard, reqBody.Messages)
+	if reqErr != nil {
+		fail(reqErr)
 		return
 	}
+	reqBody.Messages = messages
+
+	log.DefaultLogger.Info("Groq API call", "model", reqBody.Model, "messages_count", len(reqBody.Messages), "tools", reqBody.Tools)
+
+	auditEntry := newAuditEntry(ctx, "groq-chat", reqBody)
+	upstreamStart := time.Now()
+	var respBody []byte
+	var agent *agentTrace
+	if reqBody.Tools {
+		// The audit log records the tool calls and their results too
+		respBody, auditEntry.Messages, agent, reqErr = ds.runAgent(ctx, r, apiKey, reqBody)
+	} else {
+		var groqReqBody []byte
+		groqReqBody, reqErr = buildChatContext(ctx, reqBody)
+		if reqErr != nil {
+			fail(reqErr)
+			return
+		}
+		respBody, reqErr = ds.callGroq(ctx, apiKey, reqBody.Model, groqReqBody)
+	}
+	if reqErr != nil {
+		auditEntry.Status, auditEntry.ErrorCode = reqErr.status, reqErr.code
+		ds.audit.write(auditEntry, "")
+		fail(reqErr)
+		return
+	}
+
+	usage, content := processChatResponse(ctx, respBody)
+	if agent != nil {
+		usage = agent.Usage
+	}
+	recordTokenUsage(ds.metricModel(model), usage)
+	ds.usage.record(newUsageRecord(ctx, reqBody, usage, time.Since(upstreamStart)))
+
+	auditEntry.Status = http.StatusOK
+	auditEntry.PromptTokens, auditEntry.CompletionTokens = usage.PromptTokens, usage.CompletionTokens
+	ds.audit.write(auditEntry, content)
+	span.SetAttributes(usageAttributes(usage)...)
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+
+	// Return the response from Groq API, with what was trimmed to fit it
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	respBody = withField(respBody, "budget", budget)
+	if agent != nil {
+		respBody = withField(respBody, "agent", agent)
+	}
+	w.Write(respBody)
+
+	log.DefaultLogger.Info("Groq API call successful")
+}
+
+// groqAPIKey returns the Groq API key from the secure plugin configuration, or
+// from the GROQ_API_KEY environment variable when none is configured.
+func (ds *Datasource) groqAPIKey() string {
+	if apiKey := ds.settings.DecryptedSecureJSONData["groqApiKey"]; apiKey != "" {
+		return apiKey
+	}
+	return os.Getenv("GROQ_API_KEY")
+}
+
+// groqEndpoint returns the chat completions URL, which tests may override.
+func (ds *Datasource) groqEndpoint() string {
+	if ds.groqURL != "" {
+		return ds.groqURL
+	}
+	return groqChatCompletionsURL
+}
+
+// checkRateLimit reports whether the client may issue another chat request.
+func checkRateLimit(ctx context.Context, clientID string) bool {
+	_, span := startSpan(ctx, "chat.rate_limit")
+	defer span.End()
+
+	allowed := globalRateLimiter.isAllowed(clientID, 10, time.Minute)
+	span.SetAttributes(attribute.Bool(attrRateLimitAllowed, allowed))
+	return allowed
+}
+
+// validateChatRequest decodes the request body and validates model and messages.
+func validateChatRequest(ctx context.Context, body io.Reader) (*chatRequest, *requestError) {
+	_, span := startSpan(ctx, "chat.validate")
+	defer span.End()
+
+	var reqBody chatRequest
+	if err := json.NewDecoder(body).Decode(&reqBody); err != nil {
+		log.DefaultLogger.Error("Failed to decode request body", "error", err)
+		return nil, spanError(span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+	}
+	span.SetAttributes(
+		attribute.String(attrModel, reqBody.Model),
+		attribute.Int(attrMessagesCount, len(reqBody.Messages)),
+	)
 
 	// Validate request data
-	if len(reqBody.Messages) > 100 { // Limit conversation history
-		http.Error(w, "Too many messages in conversation", http.StatusBadRequest)
-		return
+	if len(reqBody.Messages) > maxConversationMessages {
+		return nil, spanError(span, &requestError{status: http.StatusBadRequest, code: errCodeTooManyMessages, message: "Too many messages in conversation"})
 	}
 
 	// Validate model name (allow only alphanumeric, hyphens, dots)
-	if reqBody.Model == "" || len(reqBody.Model) > 50 || !modelNameRegex.MatchString(reqBody.Model) {
-		http.Error(w, "Invalid model name", http.StatusBadRequest)
-		return
+	if !validModel(reqBody.Model) {
+		return nil, spanError(span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+	}
+
+	if reqBody.DashboardUID != "" && !dashboardUIDRegex.MatchString(reqBody.DashboardUID) {
+		return nil, spanError(span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidDashboard, message: "Invalid dashboard UID"})
+	}
+
+	if reqBody.Context != nil {
+		reqBody.Context.DashboardUID = reqBody.DashboardUID
+		if err := reqBody.Context.validate(); err != nil {
+			return nil, spanError(span, err)
+		}
 	}
 
 	// Validate each message
 	for _, msg := range reqBody.Messages {
 		if len(msg.Content) > 10000 { // Match frontend limit
-			http.Error(w, "Message content too long", http.StatusBadRequest)
-			return
+			return nil, spanError(span, &requestError{status: http.StatusBadRequest, code: errCodeContentTooLong, message: "Message content too long"})
 		}
 		if msg.Role != "user" && msg.Role != "system" && msg.Role != "assistant" {
-			http.Error(w, "Invalid message role", http.StatusBadRequest)
-			return
+			return nil, spanError(span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidRole, message: "Invalid message role"})
 		}
 	}
 
-	log.DefaultLogger.Info("Groq API call", "model", reqBody.Model, "messages_count", len(reqBody.Messages))
+	return &reqBody, nil
+}
+
+// buildChatContext prepares the request body that is sent to Groq.
+func buildChatContext(ctx context.Context, reqBody *chatRequest) ([]byte, *requestError) {
+	_, span := startSpan(ctx, "chat.build_context")
+	defer span.End()
 
-	// Prepare Groq API request
-	groqReqBody, err := json.Marshal(reqBody)
+	groqReqBody, err := json.Marshal(groqChatRequest{Model: reqBody.Model, Messages: reqBody.Messages})
 	if err != nil {
 		log.DefaultLogger.Error("Failed to marshal request", "error", err)
-		http.Error(w, "Failed to prepare request", http.StatusInternalServerError)
-		return
+		return nil, spanError(span, &requestError{status: http.StatusInternalServerError, code: errCodeInternal, message: "Failed to prepare request"})
 	}
+	span.SetAttributes(attribute.Int(attrPayloadBytes, len(groqReqBody)))
+
+	return groqReqBody, nil
+}
+
+// callGroq sends the prepared request to Groq. It makes a single attempt,
+// which its span records with the retry attributes: failures are returned
+// to the client, not retried.
+func (ds *Datasource) callGroq(ctx context.Context, apiKey, model string, payload []byte) ([]byte, *requestError) {
+	ctx, span := startSpan(ctx, "chat.upstream_attempt")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String(attrModel, model),
+		attribute.Int(attrRetryAttempt, 1),
+		attribute.Bool(attrRetryWillRetry, false),
+	)
 
 	// Create HTTP request to Groq API
-	groqReq, err := http.NewRequest("POST", "https://api.groq.com/openai/v1/chat/completions", bytes.NewBuffer(groqReqBody))
+	groqReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ds.groqEndpoint(), bytes.NewReader(payload))
 	if err != nil {
 		log.DefaultLogger.Error("Failed to create Groq request", "error", err)
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
+		return nil, spanError(span, &requestError{status: http.StatusInternalServerError, code: errCodeInternal, message: "Failed to create request"})
 	}
 
 	// Set headers
@@ -215,35 +537,66 @@ func (ds *Datasource) handleGroqChat(w http.ResponseWriter, r *http.Request) {
 	client := &http.Client{
 		Timeout: 30 * time.Second,
 	}
+	// Responses are not streamed, so the first response byte is when the first
+	// token becomes available to us.
+	start := time.Now()
+	var firstByte time.Duration
+	groqReq = groqReq.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			firstByte = time.Since(start)
+		},
+	}))
 	groqResp, err := client.Do(groqReq)
 	if err != nil {
+		observeUpstreamLatency(ds.metricModel(model), "error", start)
 		log.DefaultLogger.Error("Failed to call Groq API", "error", err)
-		http.Error(w, "Failed to call Groq API", http.StatusInternalServerError)
-		return
+		return nil, spanError(span, &requestError{status: http.StatusInternalServerError, code: errCodeUpstreamUnavailable, message: "Failed to call Groq API"})
 	}
 	defer groqResp.Body.Close()
+	span.SetAttributes(attribute.Int(attrStatusCode, groqResp.StatusCode))
 
 	// Read response body
 	respBody, err := io.ReadAll(groqResp.Body)
+	observeUpstreamLatency(ds.metricModel(model), strconv.Itoa(groqResp.StatusCode), start)
 	if err != nil {
 		log.DefaultLogger.Error("Failed to read Groq response", "error", err)
-		http.Error(w, "Failed to read response", http.StatusInternalServerError)
-		return
+		return nil, spanError(span, &requestError{status: http.StatusInternalServerError, code: errCodeUpstreamUnavailable, message: "Failed to read response"})
 	}
 
 	// Check if Groq API returned an error
 	if groqResp.StatusCode != http.StatusOK {
 		log.DefaultLogger.Error("Groq API error", "status", groqResp.StatusCode)
 		// Don't expose internal API error details to client
-		http.Error(w, "External API error occurred", http.StatusBadGateway)
-		return
+		return nil, spanError(span, &requestError{status: http.StatusBadGateway, code: errCodeUpstreamError, message: "External API error occurred"})
 	}
 
-	// Return the response from Groq API
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(respBody)
-	
-	log.DefaultLogger.Info("Groq API call successful")
+	timeToFirstToken.WithLabelValues(ds.metricModel(model)).Observe(firstByte.Seconds())
+
+	return respBody, nil
 }
 
+// processChatResponse extracts the token usage and the answer from a Groq
+// response. The body itself is passed through to the client unchanged.
+func processChatResponse(ctx context.Context, respBody []byte) (chatUsage, string) {
+	_, span := startSpan(ctx, "chat.process_response")
+	defer span.End()
+
+	var groqResp struct {
+		Choices []struct {
+			Message chatMessage `json:"message"`
+		} `json:"choices"`
+		Usage chatUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(respBody, &groqResp); err != nil {
+		log.DefaultLogger.Warn("Failed to parse Groq response usage", "error", err)
+		tracing.Error(span, err)
+		return chatUsage{}, ""
+	}
+	span.SetAttributes(usageAttributes(groqResp.Usage)...)
+
+	var content string
+	if len(groqResp.Choices) > 0 {
+		content = groqResp.Choices[0].Message.Content
+	}
+	return groqResp.Usage, content
+}
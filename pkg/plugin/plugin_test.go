@@ -201,15 +201,15 @@ func TestMessageValidation(t *testing.T) {
 		{
 			name: "too many messages",
 			messages: func() []map[string]string {
-				msgs := make([]map[string]string, 101)
-				for i := 0; i < 101; i++ {
+				msgs := make([]map[string]string, 1001)
+				for i := 0; i < 1001; i++ {
 					msgs[i] = map[string]string{"role": "user", "content": "test"}
 				}
 				return msgs
 			}(),
 			expectedCode: http.StatusBadRequest,
 			shouldReject: true,
-			description:  "More than 100 messages should be rejected",
+			description:  "More than 1000 messages should be rejected",
 		},
 		{
 			name: "message content too long",
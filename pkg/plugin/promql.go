@@ -0,0 +1,1062 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This file holds a PromQL parser that is used to validate and inspect
+// queries written by the model. It follows the grammar and type rules of
+// Prometheus 3 closely enough to catch the usual mistakes: unknown
+// functions, missing ranges, misplaced grouping and unbalanced syntax. It
+// doesn't evaluate queries.
+//
+// It stands in for github.com/prometheus/prometheus/promql/parser, which
+// isn't a dependency of the plugin: the module requires a newer Go version
+// than the plugin's go.mod and brings the Prometheus server's
+// dependencies along. Callers only use parsePromQL, walkPromQL and the node
+// types, which keeps a switch to the upstream parser to this file and the
+// checks in querycheck.go.
+
+// promType is the type of a PromQL expression.
+type promType string
+
+const (
+	promScalar        promType = "scalar"
+	promString        promType = "string"
+	promInstantVector promType = "instant vector"
+	promRangeVector   promType = "range vector"
+)
+
+// promNode is a node of a parsed PromQL expression.
+type promNode interface {
+	Type() promType
+}
+
+type promNumber struct {
+	Value float64
+}
+
+type promStringLiteral struct {
+	Value string
+}
+
+// promVectorSelector selects series by metric name and label matchers.
+type promVectorSelector struct {
+	Name     string
+	Matchers []promMatcher
+	Offset   time.Duration
+	At       string
+}
+
+type promMatcher struct {
+	Label string
+	Op    string
+	Value string
+}
+
+// promMatrixSelector is a vector selector with a range, e.g. x[5m].
+type promMatrixSelector struct {
+	Vector *promVectorSelector
+	Range  time.Duration
+}
+
+type promSubquery struct {
+	Expr   promNode
+	Range  time.Duration
+	Step   time.Duration
+	Offset time.Duration
+	At     string
+}
+
+type promCall struct {
+	Func string
+	Args []promNode
+}
+
+type promAggregate struct {
+	Op       string
+	Param    promNode
+	Expr     promNode
+	Grouping []string
+	Without  bool
+
+	// Grouped is set if the aggregation has a by or without clause.
+	Grouped bool
+}
+
+type promBinary struct {
+	Op         string
+	LHS, RHS   promNode
+	ReturnBool bool
+
+	// On and Labels are the vector matching of on(...) or ignoring(...);
+	// Card is group_left or group_right, if given, with the labels to
+	// include from the other side.
+	Matching bool
+	On       bool
+	Labels   []string
+	Card     string
+	Include  []string
+}
+
+type promUnary struct {
+	Op   string
+	Expr promNode
+}
+
+type promParen struct {
+	Expr promNode
+}
+
+func (n *promNumber) Type() promType         { return promScalar }
+func (n *promStringLiteral) Type() promType  { return promString }
+func (n *promVectorSelector) Type() promType { return promInstantVector }
+func (n *promMatrixSelector) Type() promType { return promRangeVector }
+func (n *promSubquery) Type() promType       { return promRangeVector }
+func (n *promAggregate) Type() promType      { return promInstantVector }
+func (n *promUnary) Type() promType          { return n.Expr.Type() }
+func (n *promParen) Type() promType          { return n.Expr.Type() }
+
+func (n *promCall) Type() promType {
+	return promFunctions[n.Func].Return
+}
+
+func (n *promBinary) Type() promType {
+	if n.LHS.Type() == promScalar && n.RHS.Type() == promScalar {
+		return promScalar
+	}
+	return promInstantVector
+}
+
+// promFunction is the signature of a PromQL function. Args lists the types
+// of the arguments; the last Optional of them may be left out, and Variadic
+// functions repeat the last argument any number of times.
+type promFunction struct {
+	Args     []promType
+	Optional int
+	Variadic bool
+	Return   promType
+}
+
+var (
+	promFuncInstant  = promFunction{Args: []promType{promInstantVector}, Return: promInstantVector}
+	promFuncRange    = promFunction{Args: []promType{promRangeVector}, Return: promInstantVector}
+	promFuncDateTime = promFunction{Args: []promType{promInstantVector}, Optional: 1, Return: promInstantVector}
+)
+
+// promFunctions are the functions of PromQL by name.
+var promFunctions = map[string]promFunction{
+	"abs": promFuncInstant, "absent": promFuncInstant, "absent_over_time": promFuncRange,
+	"acos": promFuncInstant, "acosh": promFuncInstant, "asin": promFuncInstant, "asinh": promFuncInstant,
+	"atan": promFuncInstant, "atanh": promFuncInstant, "cos": promFuncInstant, "cosh": promFuncInstant,
+	"sin": promFuncInstant, "sinh": promFuncInstant, "tan": promFuncInstant, "tanh": promFuncInstant,
+	"deg": promFuncInstant, "rad": promFuncInstant, "ceil": promFuncInstant, "floor": promFuncInstant,
+	"exp": promFuncInstant, "ln": promFuncInstant, "log2": promFuncInstant, "log10": promFuncInstant,
+	"sgn": promFuncInstant, "sqrt": promFuncInstant, "sort": promFuncInstant, "sort_desc": promFuncInstant,
+	"timestamp": promFuncInstant, "changes": promFuncRange, "delta": promFuncRange, "deriv": promFuncRange,
+	"idelta": promFuncRange, "increase": promFuncRange, "irate": promFuncRange, "rate": promFuncRange,
+	"resets": promFuncRange, "avg_over_time": promFuncRange, "min_over_time": promFuncRange,
+	"max_over_time": promFuncRange, "sum_over_time": promFuncRange, "count_over_time": promFuncRange,
+	"stddev_over_time": promFuncRange, "stdvar_over_time": promFuncRange, "last_over_time": promFuncRange,
+	"present_over_time": promFuncRange, "mad_over_time": promFuncRange,
+	"histogram_avg": promFuncInstant, "histogram_count": promFuncInstant, "histogram_sum": promFuncInstant,
+	"histogram_stddev": promFuncInstant, "histogram_stdvar": promFuncInstant,
+	"day_of_month": promFuncDateTime, "day_of_week": promFuncDateTime, "day_of_year": promFuncDateTime,
+	"days_in_month": promFuncDateTime, "hour": promFuncDateTime, "minute": promFuncDateTime,
+	"month": promFuncDateTime, "year": promFuncDateTime,
+	"clamp":                        {Args: []promType{promInstantVector, promScalar, promScalar}, Return: promInstantVector},
+	"clamp_max":                    {Args: []promType{promInstantVector, promScalar}, Return: promInstantVector},
+	"clamp_min":                    {Args: []promType{promInstantVector, promScalar}, Return: promInstantVector},
+	"histogram_quantile":           {Args: []promType{promScalar, promInstantVector}, Return: promInstantVector},
+	"histogram_fraction":           {Args: []promType{promScalar, promScalar, promInstantVector}, Return: promInstantVector},
+	"double_exponential_smoothing": {Args: []promType{promRangeVector, promScalar, promScalar}, Return: promInstantVector},
+	"info":                         {Args: []promType{promInstantVector, promInstantVector}, Optional: 1, Return: promInstantVector},
+	"label_join":                   {Args: []promType{promInstantVector, promString, promString, promString}, Optional: 1, Variadic: true, Return: promInstantVector},
+	"label_replace":                {Args: []promType{promInstantVector, promString, promString, promString, promString}, Return: promInstantVector},
+	"predict_linear":               {Args: []promType{promRangeVector, promScalar}, Return: promInstantVector},
+	"quantile_over_time":           {Args: []promType{promScalar, promRangeVector}, Return: promInstantVector},
+	"round":                        {Args: []promType{promInstantVector, promScalar}, Optional: 1, Return: promInstantVector},
+	"scalar":                       {Args: []promType{promInstantVector}, Return: promScalar},
+	"sort_by_label":                {Args: []promType{promInstantVector, promString}, Optional: 1, Variadic: true, Return: promInstantVector},
+	"sort_by_label_desc":           {Args: []promType{promInstantVector, promString}, Optional: 1, Variadic: true, Return: promInstantVector},
+	"time":                         {Return: promScalar},
+	"pi":                           {Return: promScalar},
+	"vector":                       {Args: []promType{promScalar}, Return: promInstantVector},
+}
+
+// promAggregations are the aggregation operators, with the type of their
+// parameter if they take one.
+var promAggregations = map[string]promType{
+	"sum": "", "avg": "", "min": "", "max": "", "count": "", "group": "", "stddev": "", "stdvar": "",
+	"topk": promScalar, "bottomk": promScalar, "quantile": promScalar, "limitk": promScalar,
+	"limit_ratio": promScalar, "count_values": promString,
+}
+
+// promBinaryPrecedence orders the binary operators; higher binds tighter.
+var promBinaryPrecedence = map[string]int{
+	"or": 1, "and": 2, "unless": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4, "*": 5, "/": 5, "%": 5, "atan2": 5, "^": 6,
+}
+
+func isPromComparison(op string) bool {
+	return promBinaryPrecedence[op] == 3
+}
+
+func isPromSetOperator(op string) bool {
+	return op == "and" || op == "or" || op == "unless"
+}
+
+// promToken is a token of the PromQL lexer.
+type promToken struct {
+	kind  promTokenKind
+	value string
+	pos   int
+}
+
+type promTokenKind int
+
+const (
+	promTokenEOF promTokenKind = iota
+	promTokenIdentifier
+	promTokenNumber
+	promTokenDuration
+	promTokenString
+	promTokenOperator
+)
+
+// promDurationRegex matches durations, whose units must be in descending
+// order, as in 1h30m.
+var promDurationRegex = regexp.MustCompile(`^(\d+y)?(\d+w)?(\d+d)?(\d+h)?(\d+m)?(\d+s)?(\d+ms)?$`)
+
+// promOperators are the punctuation tokens, longest first.
+var promOperators = []string{"==", "!=", "=~", "!~", "<=", ">=", "(", ")", "{", "}", "[", "]", ",", ":", "=", "<", ">", "+", "-", "*", "/", "%", "^", "@"}
+
+// lexPromQL splits a query into tokens.
+func lexPromQL(query string) ([]promToken, error) {
+	var tokens []promToken
+	for pos := 0; pos < len(query); {
+		r, size := utf8.DecodeRuneInString(query[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+		case r == '#':
+			for pos < len(query) && query[pos] != '\n' {
+				pos++
+			}
+		case r == '"' || r == '\'' || r == '`':
+			end, value, err := lexPromString(query, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, promToken{kind: promTokenString, value: value, pos: pos})
+			pos = end
+		case r >= '0' && r <= '9' || r == '.' && pos+1 < len(query) && query[pos+1] >= '0' && query[pos+1] <= '9':
+			start := pos
+			for pos < len(query) && (isPromIdentChar(query[pos]) || query[pos] == '.' ||
+				(query[pos] == '+' || query[pos] == '-') && (query[pos-1] == 'e' || query[pos-1] == 'E') && !strings.ContainsAny(query[start:pos], "xX")) {
+				pos++
+			}
+			text := query[start:pos]
+			switch {
+			case isPromNumber(text):
+				tokens = append(tokens, promToken{kind: promTokenNumber, value: text, pos: start})
+			case promDurationRegex.MatchString(text):
+				tokens = append(tokens, promToken{kind: promTokenDuration, value: text, pos: start})
+			default:
+				return nil, promError(start, "bad number or duration syntax: %q", text)
+			}
+		case r == '_' || r == ':' && !followsRangeStart(tokens) || unicode.IsLetter(r) && r < utf8.RuneSelf:
+			start := pos
+			for pos < len(query) && (isPromIdentChar(query[pos]) || query[pos] == ':' && !followsRangeStart(tokens)) {
+				pos++
+			}
+			tokens = append(tokens, promToken{kind: promTokenIdentifier, value: query[start:pos], pos: start})
+		default:
+			matched := false
+			for _, op := range promOperators {
+				if strings.HasPrefix(query[pos:], op) {
+					tokens = append(tokens, promToken{kind: promTokenOperator, value: op, pos: pos})
+					pos += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, promError(pos, "unexpected character: %q", r)
+			}
+		}
+	}
+	return append(tokens, promToken{kind: promTokenEOF, pos: len(query)}), nil
+}
+
+// followsRangeStart reports whether the lexer is inside brackets, where a
+// colon separates the range and step of a subquery instead of being part of
+// a metric name.
+func followsRangeStart(tokens []promToken) bool {
+	depth := 0
+	for _, t := range tokens {
+		if t.kind == promTokenOperator && t.value == "[" {
+			depth++
+		} else if t.kind == promTokenOperator && t.value == "]" {
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+func isPromIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isPromNumber(text string) bool {
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		return true
+	}
+	_, err := strconv.ParseInt(text, 0, 64)
+	return err == nil
+}
+
+// lexPromString reads a quoted string starting at pos and returns the
+// position after it and its unquoted value.
+func lexPromString(query string, pos int) (int, string, error) {
+	quote := query[pos]
+	for end := pos + 1; end < len(query); end++ {
+		switch query[end] {
+		case '\\':
+			if quote != '`' {
+				end++
+			}
+		case quote:
+			raw := query[pos : end+1]
+			value := raw[1 : len(raw)-1]
+			if quote != '`' {
+				if quote == '\'' {
+					raw = `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\'`, `'`), `"`, `\"`) + `"`
+				}
+				var err error
+				if value, err = strconv.Unquote(raw); err != nil {
+					return 0, "", promError(pos, "invalid string %s", query[pos:end+1])
+				}
+			}
+			if !utf8.ValidString(value) {
+				return 0, "", promError(pos, "invalid UTF-8 rune in string %s", query[pos:end+1])
+			}
+			return end + 1, value, nil
+		case '\n':
+			if quote != '`' {
+				return 0, "", promError(pos, "unterminated quoted string")
+			}
+		}
+	}
+	return 0, "", promError(pos, "unterminated quoted string")
+}
+
+// promParseError is an error of parsing or checking a query, at a byte
+// offset of the query.
+type promParseError struct {
+	pos     int
+	message string
+}
+
+func (e *promParseError) Error() string {
+	return fmt.Sprintf("parse error at char %d: %s", e.pos+1, e.message)
+}
+
+func promError(pos int, format string, args ...any) error {
+	return &promParseError{pos: pos, message: fmt.Sprintf(format, args...)}
+}
+
+// parsePromQL parses and type checks a query.
+func parsePromQL(query string) (promNode, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, promError(0, "no expression found in input")
+	}
+	tokens, err := lexPromQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &promParser{tokens: tokens}
+	node, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != promTokenEOF {
+		return nil, promError(t.pos, "unexpected %s", describePromToken(t))
+	}
+	return node, nil
+}
+
+type promParser struct {
+	tokens []promToken
+	pos    int
+}
+
+func (p *promParser) peek() promToken {
+	return p.tokens[p.pos]
+}
+
+func (p *promParser) next() promToken {
+	t := p.tokens[p.pos]
+	if t.kind != promTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *promParser) isOperator(value string) bool {
+	t := p.peek()
+	return t.kind == promTokenOperator && t.value == value
+}
+
+func (p *promParser) isKeyword(value string) bool {
+	t := p.peek()
+	return t.kind == promTokenIdentifier && strings.EqualFold(t.value, value)
+}
+
+func (p *promParser) expect(value string) (promToken, error) {
+	t := p.next()
+	if t.kind != promTokenOperator || t.value != value {
+		return t, promError(t.pos, "unexpected %s, expected %q", describePromToken(t), value)
+	}
+	return t, nil
+}
+
+func describePromToken(t promToken) string {
+	switch t.kind {
+	case promTokenEOF:
+		return "end of input"
+	case promTokenString:
+		return "string " + strconv.Quote(t.value)
+	default:
+		return strconv.Quote(t.value)
+	}
+}
+
+// binaryOperator returns the binary operator at the current token, if any.
+func (p *promParser) binaryOperator() (string, bool) {
+	t := p.peek()
+	if t.kind == promTokenOperator || t.kind == promTokenIdentifier {
+		op := t.value
+		if t.kind == promTokenIdentifier {
+			op = strings.ToLower(op)
+			if !isPromSetOperator(op) && op != "atan2" {
+				return "", false
+			}
+		}
+		if _, ok := promBinaryPrecedence[op]; ok {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// parseExpr parses binary expressions by precedence climbing.
+func (p *promParser) parseExpr(minPrecedence int) (promNode, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.binaryOperator()
+		if !ok || promBinaryPrecedence[op] <= minPrecedence {
+			return lhs, nil
+		}
+		opToken := p.next()
+		bin := &promBinary{Op: op, LHS: lhs}
+		if p.isKeyword("bool") {
+			if !isPromComparison(op) {
+				return nil, promError(p.peek().pos, "bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			bin.ReturnBool = true
+		}
+		if err := p.parseVectorMatching(bin); err != nil {
+			return nil, err
+		}
+
+		// ^ is right-associative, all other operators are left-associative
+		nextMin := promBinaryPrecedence[op]
+		if op == "^" {
+			nextMin--
+		}
+		if bin.RHS, err = p.parseExpr(nextMin); err != nil {
+			return nil, err
+		}
+		if err := checkPromBinary(bin, opToken.pos); err != nil {
+			return nil, err
+		}
+		lhs = bin
+	}
+}
+
+// parseVectorMatching parses on(...)/ignoring(...) and group_left/right.
+func (p *promParser) parseVectorMatching(bin *promBinary) error {
+	if !p.isKeyword("on") && !p.isKeyword("ignoring") {
+		return nil
+	}
+	bin.Matching, bin.On = true, strings.EqualFold(p.next().value, "on")
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return err
+	}
+	bin.Labels = labels
+	if p.isKeyword("group_left") || p.isKeyword("group_right") {
+		t := p.next()
+		if isPromSetOperator(bin.Op) {
+			return promError(t.pos, "no grouping allowed for %q operation", bin.Op)
+		}
+		bin.Card = strings.ToLower(t.value)
+		if p.isOperator("(") {
+			if bin.Include, err = p.parseLabelList(); err != nil {
+				return err
+			}
+		}
+		for _, label := range bin.Include {
+			if bin.On && slices.Contains(bin.Labels, label) {
+				return promError(t.pos, "label %q must not occur in ON and GROUP clause at once", label)
+			}
+		}
+	}
+	return nil
+}
+
+func checkPromBinary(bin *promBinary, pos int) error {
+	lt, rt := bin.LHS.Type(), bin.RHS.Type()
+	for _, t := range []promType{lt, rt} {
+		if t != promScalar && t != promInstantVector {
+			return promError(pos, "binary expression must contain only scalar and instant vector types")
+		}
+	}
+	if isPromSetOperator(bin.Op) && (lt != promInstantVector || rt != promInstantVector) {
+		return promError(pos, "set operator %q not allowed in binary scalar expression", bin.Op)
+	}
+	if isPromComparison(bin.Op) && lt == promScalar && rt == promScalar && !bin.ReturnBool {
+		return promError(pos, "comparisons between scalars must use BOOL modifier")
+	}
+	if bin.Matching && (lt != promInstantVector || rt != promInstantVector) {
+		return promError(pos, "vector matching only allowed between instant vectors")
+	}
+	return nil
+}
+
+func (p *promParser) parseUnary() (promNode, error) {
+	if p.isOperator("-") || p.isOperator("+") {
+		t := p.next()
+		expr, err := p.parseExpr(promBinaryPrecedence["*"])
+		if err != nil {
+			return nil, err
+		}
+		if ty := expr.Type(); ty != promScalar && ty != promInstantVector {
+			return nil, promError(t.pos, "unary expression only allowed on expressions of type scalar or instant vector, got %q", ty)
+		}
+		if n, ok := expr.(*promNumber); ok && t.value == "-" {
+			return &promNumber{Value: -n.Value}, nil
+		}
+		return &promUnary{Op: t.value, Expr: expr}, nil
+	}
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return p.parsePostfix(expr)
+}
+
+// parsePostfix parses ranges, subqueries, offset and @ after an expression.
+func (p *promParser) parsePostfix(expr promNode) (promNode, error) {
+	for {
+		switch {
+		case p.isOperator("["):
+			open := p.next()
+			rng, err := p.parseDuration()
+			if err != nil {
+				return nil, err
+			}
+			if p.isOperator(":") {
+				p.next()
+				sub := &promSubquery{Expr: expr, Range: rng}
+				if !p.isOperator("]") {
+					if sub.Step, err = p.parseDuration(); err != nil {
+						return nil, err
+					}
+				}
+				if _, err := p.expect("]"); err != nil {
+					return nil, err
+				}
+				if expr.Type() != promInstantVector {
+					return nil, promError(open.pos, "subquery is only allowed on instant vector, got %s", expr.Type())
+				}
+				expr = sub
+				continue
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			vs, ok := expr.(*promVectorSelector)
+			switch {
+			case !ok:
+				return nil, promError(open.pos, "ranges only allowed for vector selectors")
+			case vs.Offset != 0:
+				return nil, promError(open.pos, "no offset modifiers allowed before range")
+			case vs.At != "":
+				return nil, promError(open.pos, "no @ modifiers allowed before range")
+			}
+			expr = &promMatrixSelector{Vector: vs, Range: rng}
+		case p.isKeyword("offset"):
+			t := p.next()
+			negative := false
+			if p.isOperator("-") {
+				p.next()
+				negative = true
+			}
+			d, err := p.parseDuration()
+			if err != nil {
+				return nil, err
+			}
+			if negative {
+				d = -d
+			}
+			var offset *time.Duration
+			switch n := expr.(type) {
+			case *promVectorSelector:
+				offset = &n.Offset
+			case *promMatrixSelector:
+				offset = &n.Vector.Offset
+			case *promSubquery:
+				offset = &n.Offset
+			default:
+				return nil, promError(t.pos, "offset modifier must be preceded by an instant vector selector or range vector selector or a subquery")
+			}
+			if *offset != 0 {
+				return nil, promError(t.pos, "offset may not be set multiple times")
+			}
+			*offset = d
+		case p.isOperator("@"):
+			t := p.next()
+			at, err := p.parseAt()
+			if err != nil {
+				return nil, err
+			}
+			var atp *string
+			switch n := expr.(type) {
+			case *promVectorSelector:
+				atp = &n.At
+			case *promMatrixSelector:
+				atp = &n.Vector.At
+			case *promSubquery:
+				atp = &n.At
+			default:
+				return nil, promError(t.pos, "@ modifier must be preceded by an instant vector selector or range vector selector or a subquery")
+			}
+			if *atp != "" {
+				return nil, promError(t.pos, "@ <timestamp> may not be set multiple times")
+			}
+			*atp = at
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// parseAt parses the timestamp of an @ modifier: a number of seconds,
+// start() or end().
+func (p *promParser) parseAt() (string, error) {
+	sign := ""
+	if p.isOperator("-") || p.isOperator("+") {
+		sign = p.next().value
+	}
+	at := p.next()
+	switch {
+	case at.kind == promTokenNumber:
+		return sign + at.value, nil
+	case at.kind == promTokenIdentifier && (strings.EqualFold(at.value, "inf") || strings.EqualFold(at.value, "nan")):
+		return "", promError(at.pos, "timestamp out of bounds for @ modifier: %s%s", sign, at.value)
+	case at.kind == promTokenIdentifier && sign == "" && (at.value == "start" || at.value == "end"):
+		if _, err := p.expect("("); err != nil {
+			return "", err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return "", err
+		}
+		return at.value + "()", nil
+	}
+	return "", promError(at.pos, "unexpected %s in @ modifier", describePromToken(at))
+}
+
+func (p *promParser) parseDuration() (time.Duration, error) {
+	t := p.next()
+	if t.kind != promTokenDuration && !(t.kind == promTokenNumber && t.value == "0") {
+		return 0, promError(t.pos, "unexpected %s, expected duration", describePromToken(t))
+	}
+	d, err := parsePromDuration(t.value)
+	if err != nil {
+		return 0, promError(t.pos, "%s", err)
+	}
+	return d, nil
+}
+
+// parsePromDuration parses durations like 5m or 1h30m.
+func parsePromDuration(text string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour,
+		"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour,
+	}
+	var total time.Duration
+	for rest := text; rest != ""; {
+		i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			if rest == "0" {
+				return 0, nil
+			}
+			return 0, fmt.Errorf("invalid duration %q", text)
+		}
+		n, _ := strconv.ParseInt(rest[:i], 10, 64)
+		unit := rest[i : i+1]
+		if strings.HasPrefix(rest[i:], "ms") {
+			unit = "ms"
+		}
+		total += time.Duration(n) * units[unit]
+		rest = rest[i+len(unit):]
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("duration must be greater than 0")
+	}
+	return total, nil
+}
+
+func (p *promParser) parsePrimary() (promNode, error) {
+	t := p.peek()
+	switch t.kind {
+	case promTokenNumber:
+		p.next()
+		if v, err := strconv.ParseFloat(t.value, 64); err == nil {
+			return &promNumber{Value: v}, nil
+		}
+		v, _ := strconv.ParseInt(t.value, 0, 64)
+		return &promNumber{Value: float64(v)}, nil
+	case promTokenString:
+		p.next()
+		return &promStringLiteral{Value: t.value}, nil
+	case promTokenDuration:
+		return nil, promError(t.pos, "unexpected duration %q", t.value)
+	case promTokenEOF:
+		return nil, promError(t.pos, "unexpected end of input")
+	case promTokenOperator:
+		switch t.value {
+		case "(":
+			p.next()
+			expr, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return &promParen{Expr: expr}, nil
+		case "{":
+			return p.parseVectorSelector("", t.pos)
+		}
+		return nil, promError(t.pos, "unexpected %s", describePromToken(t))
+	}
+
+	// Identifiers: numbers, aggregations, functions and metric names
+	name := t.value
+	lower := strings.ToLower(name)
+	if lower == "inf" || lower == "nan" {
+		p.next()
+		v, _ := strconv.ParseFloat(lower, 64)
+		return &promNumber{Value: v}, nil
+	}
+	if _, ok := promAggregations[lower]; ok && p.isAggregationStart() {
+		return p.parseAggregate()
+	}
+	if isPromKeyword(lower) {
+		return nil, promError(t.pos, "unexpected %s", describePromToken(t))
+	}
+	if p.tokens[p.pos+1].kind == promTokenOperator && p.tokens[p.pos+1].value == "(" {
+		if _, ok := promFunctions[name]; !ok {
+			return nil, promError(t.pos, "unknown function with name %q", name)
+		}
+		return p.parseCall()
+	}
+	p.next()
+	return p.parseVectorSelector(name, t.pos)
+}
+
+// isAggregationStart reports whether the identifier at the current token
+// starts an aggregation rather than naming a metric like "count".
+func (p *promParser) isAggregationStart() bool {
+	next := p.tokens[p.pos+1]
+	return next.kind == promTokenOperator && next.value == "(" ||
+		next.kind == promTokenIdentifier && (strings.EqualFold(next.value, "by") || strings.EqualFold(next.value, "without"))
+}
+
+// isPromLabel reports whether a token can be a label name. Names with
+// other characters than letters, digits and underscores must be quoted.
+func isPromLabel(t promToken) bool {
+	return t.kind == promTokenString || t.kind == promTokenIdentifier && !strings.Contains(t.value, ":")
+}
+
+func isPromKeyword(word string) bool {
+	switch word {
+	case "by", "without", "on", "ignoring", "group_left", "group_right", "offset", "bool", "and", "or", "unless", "atan2":
+		return true
+	}
+	return false
+}
+
+func (p *promParser) parseAggregate() (promNode, error) {
+	opToken := p.next()
+	agg := &promAggregate{Op: strings.ToLower(opToken.value)}
+	if err := p.parseGrouping(agg); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var args []promNode
+	for !p.isOperator(")") {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.isOperator(",") {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if !agg.Grouped {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+
+	paramType := promAggregations[agg.Op]
+	expected := 1
+	if paramType != "" {
+		expected = 2
+	}
+	if len(args) == 0 {
+		return nil, promError(opToken.pos, "no arguments for aggregate expression provided")
+	}
+	if len(args) != expected {
+		return nil, promError(opToken.pos, "wrong number of arguments for aggregate expression provided, expected %d, got %d", expected, len(args))
+	}
+	if paramType != "" {
+		agg.Param = args[0]
+		if agg.Param.Type() != paramType {
+			return nil, promError(opToken.pos, "expected type %s in aggregation parameter, got %s", paramType, agg.Param.Type())
+		}
+	}
+	agg.Expr = args[len(args)-1]
+	if agg.Expr.Type() != promInstantVector {
+		return nil, promError(opToken.pos, "expected type instant vector in aggregation expression, got %s", agg.Expr.Type())
+	}
+	return agg, nil
+}
+
+// parseGrouping parses a by or without clause, which may come before or
+// after the arguments of an aggregation, but only once.
+func (p *promParser) parseGrouping(agg *promAggregate) error {
+	if !p.isKeyword("by") && !p.isKeyword("without") {
+		return nil
+	}
+	t := p.next()
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return err
+	}
+	agg.Grouped, agg.Without, agg.Grouping = true, strings.EqualFold(t.value, "without"), labels
+	return nil
+}
+
+func (p *promParser) parseLabelList() ([]string, error) {
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for !p.isOperator(")") {
+		t := p.next()
+		if !isPromLabel(t) {
+			return nil, promError(t.pos, "unexpected %s in grouping opts, expected label", describePromToken(t))
+		}
+		labels = append(labels, t.value)
+		if !p.isOperator(",") {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (p *promParser) parseCall() (promNode, error) {
+	nameToken := p.next()
+	call := &promCall{Func: nameToken.value}
+	fn := promFunctions[call.Func]
+	p.next() // (
+	for !p.isOperator(")") {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if !p.isOperator(",") {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	minArgs := len(fn.Args) - fn.Optional
+	switch {
+	case fn.Optional == 0 && !fn.Variadic && len(call.Args) != len(fn.Args):
+		return nil, promError(nameToken.pos, "expected %d argument(s) in call to %q, got %d", len(fn.Args), call.Func, len(call.Args))
+	case len(call.Args) < minArgs:
+		return nil, promError(nameToken.pos, "expected at least %d argument(s) in call to %q, got %d", minArgs, call.Func, len(call.Args))
+	case !fn.Variadic && len(call.Args) > len(fn.Args):
+		return nil, promError(nameToken.pos, "expected at most %d argument(s) in call to %q, got %d", len(fn.Args), call.Func, len(call.Args))
+	}
+	for i, arg := range call.Args {
+		want := fn.Args[min(i, len(fn.Args)-1)]
+		if got := arg.Type(); got != want {
+			return nil, promError(nameToken.pos, "expected type %s in call to function %q, got %s", want, call.Func, got)
+		}
+	}
+	return call, nil
+}
+
+// parseVectorSelector parses the label matchers after a metric name, if any.
+func (p *promParser) parseVectorSelector(name string, pos int) (promNode, error) {
+	vs := &promVectorSelector{Name: name}
+	if p.isOperator("{") {
+		p.next()
+		for !p.isOperator("}") {
+			label := p.next()
+			if !isPromLabel(label) {
+				return nil, promError(label.pos, "unexpected %s in label matching, expected label", describePromToken(label))
+			}
+			if label.kind == promTokenString && (p.isOperator(",") || p.isOperator("}")) {
+				// A quoted name on its own is the metric name, as in {"some.metric"}
+				vs.Matchers = append(vs.Matchers, promMatcher{Label: "__name__", Op: "=", Value: label.value})
+				if p.isOperator(",") {
+					p.next()
+				}
+				continue
+			}
+			op := p.next()
+			if op.kind != promTokenOperator || (op.value != "=" && op.value != "!=" && op.value != "=~" && op.value != "!~") {
+				return nil, promError(op.pos, "unexpected %s in label matching, expected one of \"=\", \"!=\", \"=~\" or \"!~\"", describePromToken(op))
+			}
+			value := p.next()
+			if value.kind != promTokenString {
+				return nil, promError(value.pos, "unexpected %s in label matching, expected string", describePromToken(value))
+			}
+			if op.value == "=~" || op.value == "!~" {
+				if _, err := regexp.Compile("^(?:" + value.value + ")$"); err != nil {
+					return nil, promError(value.pos, "invalid regular expression %q: %s", value.value, err)
+				}
+			}
+			vs.Matchers = append(vs.Matchers, promMatcher{Label: label.value, Op: op.value, Value: value.value})
+			if !p.isOperator(",") {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range vs.Matchers {
+		if m.Label == "__name__" && m.Op == "=" && m.Value != "" {
+			if vs.Name != "" {
+				return nil, promError(pos, "metric name must not be set twice: %q or %q", vs.Name, m.Value)
+			}
+			vs.Name = m.Value
+		}
+	}
+	if vs.Name == "" && !hasNonEmptyMatcher(vs.Matchers) {
+		return nil, promError(pos, "vector selector must contain at least one non-empty matcher")
+	}
+	return vs, nil
+}
+
+// hasNonEmptyMatcher reports whether a matcher doesn't match the empty
+// string, which Prometheus requires to bound the selected series.
+func hasNonEmptyMatcher(matchers []promMatcher) bool {
+	for _, m := range matchers {
+		switch m.Op {
+		case "=":
+			if m.Value != "" {
+				return true
+			}
+		case "!=":
+			if m.Value == "" {
+				return true
+			}
+		default:
+			matchesEmpty := regexp.MustCompile("^(?:" + m.Value + ")$").MatchString("")
+			if matchesEmpty == (m.Op == "!~") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkPromQL calls fn for node and its descendants, parents first.
+func walkPromQL(node promNode, fn func(promNode)) {
+	if node == nil {
+		return
+	}
+	fn(node)
+	switch n := node.(type) {
+	case *promMatrixSelector:
+		walkPromQL(n.Vector, fn)
+	case *promSubquery:
+		walkPromQL(n.Expr, fn)
+	case *promCall:
+		for _, arg := range n.Args {
+			walkPromQL(arg, fn)
+		}
+	case *promAggregate:
+		walkPromQL(n.Param, fn)
+		walkPromQL(n.Expr, fn)
+	case *promBinary:
+		walkPromQL(n.LHS, fn)
+		walkPromQL(n.RHS, fn)
+	case *promUnary:
+		walkPromQL(n.Expr, fn)
+	case *promParen:
+		walkPromQL(n.Expr, fn)
+	}
+}
+
+// promMetricNames returns the metric names a query selects, in order of
+// appearance.
+func promMetricNames(node promNode) []string {
+	var names []string
+	walkPromQL(node, func(n promNode) {
+		if vs, ok := n.(*promVectorSelector); ok && vs.Name != "" && !slices.Contains(names, vs.Name) {
+			names = append(names, vs.Name)
+		}
+	})
+	return names
+}
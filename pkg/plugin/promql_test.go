@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePromQL(t *testing.T) {
+	testCases := []struct {
+		query         string
+		expectedType  promType
+		expectedNames []string
+		expectedError string
+	}{
+		// Literals
+		{query: `1`, expectedType: promScalar},
+		{query: `+Inf`, expectedType: promScalar},
+		{query: `-Inf`, expectedType: promScalar},
+		{query: `.5`, expectedType: promScalar},
+		{query: `5.`, expectedType: promScalar},
+		{query: `5e-3`, expectedType: promScalar},
+		{query: `0x1F`, expectedType: promScalar},
+		{query: `"double \" quoted"`, expectedType: promString},
+		{query: `'single \' quoted'`, expectedType: promString},
+		{query: "`raw \\ string`", expectedType: promString},
+		{query: `1 # comment`, expectedType: promScalar},
+		{query: `2.5.`, expectedError: "bad number or duration syntax"},
+		{query: `0deadbeef`, expectedError: "bad number or duration syntax"},
+		{query: `.`, expectedError: "unexpected character"},
+		{query: `"\xff"`, expectedError: "invalid UTF-8"},
+		{query: `"unterminated`, expectedError: "unterminated quoted string"},
+		{query: ``, expectedError: "no expression found"},
+
+		// Operators
+		{query: `time() - 60 * 5`, expectedType: promScalar},
+		{query: `2 ^ 3 ^ 2`, expectedType: promScalar},
+		{query: `-1 ^ 2`, expectedType: promScalar},
+		{query: `1 == bool 1`, expectedType: promScalar},
+		{query: `1 atan2 2`, expectedType: promScalar},
+		{query: `-some_metric`, expectedType: promInstantVector, expectedNames: []string{"some_metric"}},
+		{query: `foo * bar`, expectedType: promInstantVector, expectedNames: []string{"foo", "bar"}},
+		{query: `foo == bool 1`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `foo + bar or bla and blub`, expectedType: promInstantVector, expectedNames: []string{"foo", "bar", "bla", "blub"}},
+		{query: `foo and on() bar`, expectedType: promInstantVector, expectedNames: []string{"foo", "bar"}},
+		{query: `foo unless ignoring(a, b) bar`, expectedType: promInstantVector, expectedNames: []string{"foo", "bar"}},
+		{query: `errors_total / on(job) group_left requests_total > bool 0.1`, expectedType: promInstantVector, expectedNames: []string{"errors_total", "requests_total"}},
+		{query: `foo - ignoring(a) group_right(b, c) bar`, expectedType: promInstantVector, expectedNames: []string{"foo", "bar"}},
+		{query: `foo atan2 bar`, expectedType: promInstantVector, expectedNames: []string{"foo", "bar"}},
+		{query: `1 > 2`, expectedError: "BOOL modifier"},
+		{query: `1 and up`, expectedError: `set operator "and" not allowed`},
+		{query: `foo or 1`, expectedError: `set operator "or" not allowed`},
+		{query: `foo + bool bar`, expectedError: "bool modifier can only be used on comparison operators"},
+		{query: `foo == on(bar) 10`, expectedError: "vector matching only allowed between instant vectors"},
+		{query: `foo and on(bar) group_left(baz) bar`, expectedError: `no grouping allowed for "and" operation`},
+		{query: `foo + on(instance) group_left(job, instance) bar`, expectedError: `label "instance" must not occur in ON and GROUP clause at once`},
+		{query: `foo + group_left(baz) bar`, expectedError: `unexpected "group_left"`},
+		{query: `a - on(b) ignoring(c) d`, expectedError: `unexpected "ignoring"`},
+		{query: `1 + foo[5m]`, expectedError: "binary expression must contain only scalar and instant vector types"},
+		{query: `-foo[5m]`, expectedError: "unary expression only allowed on expressions of type scalar or instant vector"},
+		{query: `-"string"`, expectedError: "unary expression only allowed on expressions of type scalar or instant vector"},
+		{query: `1+`, expectedError: "unexpected end of input"},
+		{query: `*1`, expectedError: `unexpected "*"`},
+		{query: `(1))`, expectedError: `unexpected ")"`},
+		{query: `((1)`, expectedError: "unexpected end of input"},
+
+		// Selectors
+		{query: `min`, expectedType: promInstantVector, expectedNames: []string{"min"}},
+		{query: `foo:bar{a="bc"}`, expectedType: promInstantVector, expectedNames: []string{"foo:bar"}},
+		{query: `foo{a="b", c!="d", e=~"f.*", g!~"h",}`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `foo{and="x", by="y"}`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `{__name__="up", job=~"api.*"} and on() vector(1)`, expectedType: promInstantVector, expectedNames: []string{"up"}},
+		{query: `{"some.metric", "label.name"="x"}`, expectedType: promInstantVector, expectedNames: []string{"some.metric"}},
+		{query: `up{job="api"`, expectedError: "unexpected end of input"},
+		{query: `foo{a=b}`, expectedError: "expected string"},
+		{query: `foo{a>="b"}`, expectedError: `unexpected ">="`},
+		{query: `foo{a:b="c"}`, expectedError: `unexpected "a:b" in label matching`},
+		{query: `foo{a=~"("}`, expectedError: "invalid regular expression"},
+		{query: `{}`, expectedError: "at least one non-empty matcher"},
+		{query: `{x=~".*"}`, expectedError: "at least one non-empty matcher"},
+		{query: `foo{__name__="bar"}`, expectedError: "metric name must not be set twice"},
+		{query: `{"foo", "bar"}`, expectedError: "metric name must not be set twice"},
+
+		// Ranges and modifiers
+		{query: `up[5m]`, expectedType: promRangeVector, expectedNames: []string{"up"}},
+		{query: `foo[1h30m]`, expectedType: promRangeVector, expectedNames: []string{"foo"}},
+		{query: `foo[5m] offset 1w`, expectedType: promRangeVector, expectedNames: []string{"foo"}},
+		{query: `foo offset -7m`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `foo OFFSET 1h30m`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `foo @ 1603774568 offset 5m`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `foo offset 5m @ -100`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `foo[5m] @ end()`, expectedType: promRangeVector, expectedNames: []string{"foo"}},
+		{query: `foo[5m30m]`, expectedError: "bad number or duration syntax"},
+		{query: `foo[5mm]`, expectedError: "bad number or duration syntax"},
+		{query: `foo["5m"]`, expectedError: "expected duration"},
+		{query: `foo[]`, expectedError: "expected duration"},
+		{query: `foo offset 5m [1m]`, expectedError: "no offset modifiers allowed before range"},
+		{query: `foo @ 123 [1m]`, expectedError: "no @ modifiers allowed before range"},
+		{query: `foo offset 1s offset 2d`, expectedError: "offset may not be set multiple times"},
+		{query: `foo[5m] offset 1d offset 2d`, expectedError: "offset may not be set multiple times"},
+		{query: `foo @ start() @ end()`, expectedError: "@ <timestamp> may not be set multiple times"},
+		{query: `foo @ +Inf`, expectedError: "timestamp out of bounds for @ modifier"},
+		{query: `1 offset 1d`, expectedError: "offset modifier must be preceded by an instant vector selector"},
+		{query: `rate(foo[5m]) @ 1234`, expectedError: "@ modifier must be preceded by an instant vector selector"},
+		{query: `(foo + bar)[5m]`, expectedError: "ranges only allowed for vector selectors"},
+
+		// Subqueries
+		{query: `foo[10m:]`, expectedType: promRangeVector, expectedNames: []string{"foo"}},
+		{query: `max_over_time(up[1h:5m] offset 1d)`, expectedType: promInstantVector, expectedNames: []string{"up"}},
+		{query: `min_over_time(rate(foo[2s])[5m:])[4m:3s]`, expectedType: promRangeVector, expectedNames: []string{"foo"}},
+		{query: `some_metric offset 1m [10m:5s]`, expectedType: promRangeVector, expectedNames: []string{"some_metric"}},
+		{query: `(foo + bar @ 1234)[5m:] @ 1603775019`, expectedType: promRangeVector, expectedNames: []string{"foo", "bar"}},
+		{query: `foo[5m][10m:5s]`, expectedError: "subquery is only allowed on instant vector"},
+		{query: `foo[10m:6s] offset 1m offset 2m`, expectedError: "offset may not be set multiple times"},
+
+		// Aggregations
+		{query: `sum by (code) (rate(http_requests_total[5m]))`, expectedType: promInstantVector, expectedNames: []string{"http_requests_total"}},
+		{query: `sum(rate(http_requests_total[5m])) without (instance)`, expectedType: promInstantVector, expectedNames: []string{"http_requests_total"}},
+		{query: `SUM BY () (foo)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `sum without(and, by, avg, count) (foo)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `sum by ("label.name") (foo)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `topk(3, -node_memory_free_bytes)`, expectedType: promInstantVector, expectedNames: []string{"node_memory_free_bytes"}},
+		{query: `count_values("version", build_info)`, expectedType: promInstantVector, expectedNames: []string{"build_info"}},
+		{query: `quantile(0.9, foo)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `sum(count)`, expectedType: promInstantVector, expectedNames: []string{"count"}},
+		{query: `sum()`, expectedError: "no arguments for aggregate expression provided"},
+		{query: `topk(foo)`, expectedError: "wrong number of arguments for aggregate expression provided, expected 2, got 1"},
+		{query: `topk(foo, bar)`, expectedError: "expected type scalar in aggregation parameter, got instant vector"},
+		{query: `count_values(5, foo)`, expectedError: "expected type string in aggregation parameter, got scalar"},
+		{query: `sum(foo[5m])`, expectedError: "expected type instant vector in aggregation expression, got range vector"},
+		{query: `sum (foo) without (a) by (b)`, expectedError: `unexpected "by"`},
+		{query: `sum by (a) (foo) by (b)`, expectedError: `unexpected "by"`},
+		{query: `sum (foo) by b`, expectedError: `unexpected "b", expected "("`},
+		{query: `sum without(==) (foo)`, expectedError: "expected label"},
+		{query: `sum by (a:b) (foo)`, expectedError: `unexpected "a:b" in grouping opts`},
+		{query: `sum(rate(x[5m])`, expectedError: "unexpected end of input"},
+
+		// Functions
+		{query: `rate(http_requests_total{job="api"}[5m])`, expectedType: promInstantVector, expectedNames: []string{"http_requests_total"}},
+		{query: `histogram_quantile(0.95, sum by (le) (rate(request_duration_seconds_bucket[5m])))`, expectedType: promInstantVector, expectedNames: []string{"request_duration_seconds_bucket"}},
+		{query: `round(foo)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `round(foo, 5)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `hour()`, expectedType: promInstantVector},
+		{query: `label_join(foo, "dst", ",")`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `label_join(foo, "dst", ",", "a", "b")`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `label_replace(foo, "dst", "$1", "src", "(.*)")`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `info(foo)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `info(foo, target_info{k8s_cluster_name=~".+"})`, expectedType: promInstantVector, expectedNames: []string{"foo", "target_info"}},
+		{query: `double_exponential_smoothing(foo[1h], 0.5, 0.5)`, expectedType: promInstantVector, expectedNames: []string{"foo"}},
+		{query: `scalar(foo)`, expectedType: promScalar, expectedNames: []string{"foo"}},
+		{query: `vector(1)`, expectedType: promInstantVector},
+		{query: `rate(http_requests_total)`, expectedError: `expected type range vector in call to function "rate", got instant vector`},
+		{query: `floor(1)`, expectedError: `expected type instant vector in call to function "floor", got scalar`},
+		{query: `floor()`, expectedError: `expected 1 argument(s) in call to "floor", got 0`},
+		{query: `floor(foo, bar)`, expectedError: `expected 1 argument(s) in call to "floor", got 2`},
+		{query: `hour(foo, foo)`, expectedError: `expected at most 1 argument(s) in call to "hour", got 2`},
+		{query: `clamp_max(foo)`, expectedError: `expected 2 argument(s) in call to "clamp_max", got 1`},
+		{query: `label_join(foo, "dst")`, expectedError: `expected at least 3 argument(s) in call to "label_join", got 2`},
+		{query: `increase_by(up[5m])`, expectedError: `unknown function with name "increase_by"`},
+		{query: `holt_winters(foo[1h], 0.5, 0.5)`, expectedError: `unknown function with name "holt_winters"`},
+		{query: `RATE(foo[5m])`, expectedError: `unknown function with name "RATE"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			node, err := parsePromQL(tc.query)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("Expected error containing %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if node.Type() != tc.expectedType {
+				t.Errorf("Expected type %s, got %s", tc.expectedType, node.Type())
+			}
+			if names := promMetricNames(node); !slices.Equal(names, tc.expectedNames) {
+				t.Errorf("Expected metric names %v, got %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Query types supported by QueryData.
+const (
+	queryTypeTimeSeries = "timeseries"
+	queryTypeTable      = "table"
+)
+
+const (
+	// minUsageInterval is the smallest bucket of a usage time series.
+	minUsageInterval = time.Minute
+
+	// maxUsageBuckets bounds the length of a usage time series.
+	maxUsageBuckets = 10000
+)
+
+// usageQuery is the JSON model of a usage query, e.g. "tokens by model over
+// time" is {"metric": "tokens", "groupBy": "model"} with the timeseries query
+// type.
+type usageQuery struct {
+	// Metric is one of the keys of usageMetrics; defaults to requests.
+	Metric string `json:"metric"`
+
+	// GroupBy is one of the keys of usageGroupings; defaults to model.
+	GroupBy string `json:"groupBy"`
+}
+
+// usageMetrics maps the supported metrics to their value in an aggregate.
+var usageMetrics = map[string]func(usageAggregate) float64{
+	"requests":          func(a usageAggregate) float64 { return float64(a.Requests) },
+	"tokens":            func(a usageAggregate) float64 { return float64(a.TotalTokens) },
+	"prompt_tokens":     func(a usageAggregate) float64 { return float64(a.PromptTokens) },
+	"completion_tokens": func(a usageAggregate) float64 { return float64(a.CompletionTokens) },
+	"cost":              func(a usageAggregate) float64 { return a.EstimatedCost },
+	"latency_ms":        func(a usageAggregate) float64 { return a.AvgLatencyMs },
+}
+
+// QueryData returns usage ledger data as frames, so that admins can chart
+// chatbot adoption and cost on regular dashboards.
+func (ds *Datasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	response := backend.NewQueryDataResponse()
+
+	for _, q := range req.Queries {
+		if !isOrgAdmin(req.PluginContext.User) {
+			response.Responses[q.RefID] = backend.ErrDataResponse(backend.StatusForbidden, "usage data is only available to organization admins")
+			continue
+		}
+		response.Responses[q.RefID] = ds.queryUsage(req.PluginContext.OrgID, q)
+	}
+
+	return response, nil
+}
+
+// queryUsage runs a single usage query.
+func (ds *Datasource) queryUsage(orgID int64, q backend.DataQuery) backend.DataResponse {
+	var qm usageQuery
+	if len(q.JSON) > 0 {
+		if err := json.Unmarshal(q.JSON, &qm); err != nil {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("invalid query: %v", err))
+		}
+	}
+	if qm.Metric == "" {
+		qm.Metric = "requests"
+	}
+	if qm.GroupBy == "" {
+		qm.GroupBy = "model"
+	}
+
+	metric, ok := usageMetrics[qm.Metric]
+	if !ok {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unknown metric %q", qm.Metric))
+	}
+	key, ok := usageGroupings[qm.GroupBy]
+	if !ok {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unknown groupBy %q", qm.GroupBy))
+	}
+
+	records := ds.usage.query(orgID, q.TimeRange.From, q.TimeRange.To)
+
+	switch q.QueryType {
+	case queryTypeTable:
+		return backend.DataResponse{Frames: data.Frames{ds.usageTable(records, qm, key, metric)}}
+	case "", queryTypeTimeSeries:
+		return backend.DataResponse{Frames: ds.usageTimeSeries(records, qm, key, metric, q)}
+	default:
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unknown query type %q", q.QueryType))
+	}
+}
+
+// usageTable returns one row per group, e.g. requests by user.
+func (ds *Datasource) usageTable(records []usageRecord, qm usageQuery, key func(usageRecord) string, metric func(usageAggregate) float64) *data.Frame {
+	aggregates := ds.usage.aggregate(records, key)
+	keys := make([]string, len(aggregates))
+	values := make([]float64, len(aggregates))
+	for i, agg := range aggregates {
+		keys[i] = agg.Key
+		values[i] = metric(agg)
+	}
+
+	frame := data.NewFrame("usage",
+		data.NewField(qm.GroupBy, nil, keys),
+		data.NewField(qm.Metric, nil, values),
+	)
+	frame.Meta = &data.FrameMeta{Type: data.FrameTypeTable}
+	return frame
+}
+
+// usageTimeSeries returns one frame per group with the metric bucketed over
+// the query's time range. Empty buckets are reported as zero.
+func (ds *Datasource) usageTimeSeries(records []usageRecord, qm usageQuery, key func(usageRecord) string, metric func(usageAggregate) float64, q backend.DataQuery) data.Frames {
+	from, to := q.TimeRange.From, q.TimeRange.To
+	interval := usageInterval(q)
+	buckets := int(to.Sub(from) / interval)
+	if to.Sub(from)%interval != 0 {
+		buckets++
+	}
+
+	byGroup := make(map[string][]usageRecord)
+	for _, rec := range records {
+		k := key(rec)
+		byGroup[k] = append(byGroup[k], rec)
+	}
+
+	var frames data.Frames
+	for _, group := range ds.usage.aggregate(records, key) {
+		perBucket := make([][]usageRecord, buckets)
+		for _, rec := range byGroup[group.Key] {
+			if i := int(rec.Time.Sub(from) / interval); i >= 0 && i < buckets {
+				perBucket[i] = append(perBucket[i], rec)
+			}
+		}
+
+		times := make([]time.Time, buckets)
+		values := make([]float64, buckets)
+		for i, bucket := range perBucket {
+			times[i] = from.Add(time.Duration(i) * interval)
+			if len(bucket) > 0 {
+				values[i] = metric(ds.usage.aggregate(bucket, usageTotalKey)[0])
+			}
+		}
+
+		frame := data.NewFrame(qm.Metric,
+			data.NewField("time", nil, times),
+			data.NewField(qm.Metric, data.Labels{qm.GroupBy: group.Key}, values),
+		)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// usageInterval picks the bucket size of a usage time series from the query's
+// interval, bounded by maxUsageBuckets and minUsageInterval.
+func usageInterval(q backend.DataQuery) time.Duration {
+	interval := q.Interval
+	if interval < minUsageInterval {
+		interval = minUsageInterval
+	}
+	if span := q.TimeRange.To.Sub(q.TimeRange.From); span/interval > maxUsageBuckets {
+		interval = span / maxUsageBuckets
+	}
+	return interval
+}
@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func newUsageQueryRequest(role string, queries ...backend.DataQuery) *backend.QueryDataRequest {
+	return &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{OrgID: 1, User: &backend.User{Login: "admin", Role: role}},
+		Queries:       queries,
+	}
+}
+
+func TestQueryDataUsage(t *testing.T) {
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	ds := &Datasource{usage: newUsageLedger(nil)}
+	ds.usage.records = []usageRecord{
+		{Time: from.Add(10 * time.Minute), OrgID: 1, User: "alice", Model: "a", PromptTokens: 10, CompletionTokens: 5},
+		{Time: from.Add(20 * time.Minute), OrgID: 1, User: "bob", Model: "a", PromptTokens: 1},
+		{Time: from.Add(90 * time.Minute), OrgID: 1, User: "alice", Model: "b", PromptTokens: 100},
+		{Time: from.Add(30 * time.Minute), OrgID: 2, User: "carol", Model: "a", PromptTokens: 1000},
+	}
+	timeRange := backend.TimeRange{From: from, To: from.Add(2 * time.Hour)}
+
+	resp, err := ds.QueryData(context.Background(), newUsageQueryRequest("Admin",
+		backend.DataQuery{RefID: "A", QueryType: queryTypeTimeSeries, Interval: time.Hour, TimeRange: timeRange, JSON: json.RawMessage(`{"metric":"tokens","groupBy":"model"}`)},
+		backend.DataQuery{RefID: "B", QueryType: queryTypeTable, TimeRange: timeRange, JSON: json.RawMessage(`{"groupBy":"user"}`)},
+		backend.DataQuery{RefID: "C", TimeRange: timeRange, JSON: json.RawMessage(`{"metric":"vibes"}`)},
+	))
+	if err != nil {
+		t.Fatalf("QueryData failed: %v", err)
+	}
+
+	series := resp.Responses["A"]
+	if series.Error != nil {
+		t.Fatalf("Unexpected error: %v", series.Error)
+	}
+	if len(series.Frames) != 2 {
+		t.Fatalf("Expected one frame per model, got %d", len(series.Frames))
+	}
+	modelA := series.Frames[0]
+	if modelA.Fields[1].Labels["model"] != "a" || modelA.Rows() != 2 {
+		t.Fatalf("Unexpected frame for model a: labels %v, %d rows", modelA.Fields[1].Labels, modelA.Rows())
+	}
+	if got := modelA.Fields[1].At(0).(float64); got != 16 {
+		t.Errorf("Expected 16 tokens in the first hour, got %v", got)
+	}
+	if got := series.Frames[1].Fields[1].At(1).(float64); got != 100 {
+		t.Errorf("Expected 100 tokens for model b in the second hour, got %v", got)
+	}
+
+	table := resp.Responses["B"]
+	if len(table.Frames) != 1 || table.Frames[0].Rows() != 2 {
+		t.Fatalf("Expected a table with one row per user, got %+v", table.Frames)
+	}
+	if table.Frames[0].Fields[0].At(0) != "alice" || table.Frames[0].Fields[1].At(0).(float64) != 2 {
+		t.Errorf("Expected alice with 2 requests, got %v/%v", table.Frames[0].Fields[0].At(0), table.Frames[0].Fields[1].At(0))
+	}
+
+	if resp.Responses["C"].Status != backend.StatusBadRequest {
+		t.Errorf("Expected bad request for unknown metric, got %v", resp.Responses["C"].Status)
+	}
+}
+
+func TestQueryDataRequiresAdmin(t *testing.T) {
+	ds := &Datasource{usage: newUsageLedger(nil)}
+	resp, err := ds.QueryData(context.Background(), newUsageQueryRequest("Editor", backend.DataQuery{RefID: "A"}))
+	if err != nil {
+		t.Fatalf("QueryData failed: %v", err)
+	}
+	if resp.Responses["A"].Status != backend.StatusForbidden {
+		t.Errorf("Expected forbidden for non-admins, got %v", resp.Responses["A"].Status)
+	}
+}
+
+func TestUsageInterval(t *testing.T) {
+	day := backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(0, 0).Add(24 * time.Hour)}
+	if got := usageInterval(backend.DataQuery{TimeRange: day}); got != minUsageInterval {
+		t.Errorf("Expected minimum interval, got %v", got)
+	}
+	year := backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(0, 0).Add(365 * 24 * time.Hour)}
+	if got := usageInterval(backend.DataQuery{TimeRange: year, Interval: time.Second}); year.To.Sub(year.From)/got > maxUsageBuckets {
+		t.Errorf("Expected at most %d buckets, got interval %v", maxUsageBuckets, got)
+	}
+}
@@ -0,0 +1,333 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Query languages that queries are generated, explained and checked for.
+const (
+	queryLanguagePromQL = "promql"
+	queryLanguageLogQL  = "logql"
+	queryLanguageSQL    = "sql"
+	queryLanguageFlux   = "flux"
+)
+
+var (
+	// legendLabelRegex matches the label references of a legend format,
+	// e.g. {{instance}}.
+	legendLabelRegex = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+	// builtinVariableRegex matches Grafana's built-in variables, such as
+	// $__rate_interval, which the data sources replace.
+	builtinVariableRegex = regexp.MustCompile(`\$\{?(__\w+)\}?`)
+
+	// logQLFilterRegex matches LogQL line filters and logQLParserRegex the
+	// parser stages.
+	logQLFilterRegex = regexp.MustCompile(`(\|=|\|~|!=|!~)\s*("|` + "`" + `)`)
+	logQLParserRegex = regexp.MustCompile(`\|\s*(json|logfmt|pattern|regexp|unpack)\b`)
+
+	// logQLRegexFilterRegex matches a regex line filter and its expression.
+	logQLRegexFilterRegex = regexp.MustCompile(`\|~\s*(?:"((?:[^"\\]|\\.)*)"|` + "`([^`]*)`)")
+)
+
+// builtinVariableValues are values Grafana's built-in variables are
+// replaced with so that a query parses; the values don't matter.
+var builtinVariableValues = map[string]string{
+	"__rate_interval": "1m",
+	"__interval":      "1m",
+	"__range":         "1h",
+	"__auto":          "1m",
+	"__interval_ms":   "60000",
+	"__range_s":       "3600",
+	"__range_ms":      "3600000",
+}
+
+// queryIssue is a possible mistake in a query. Source is "check" for issues
+// found by the backend's checks and "model" for those the model reported.
+type queryIssue struct {
+	Issue      string `json:"issue"`
+	Severity   string `json:"severity"`
+	Suggestion string `json:"suggestion,omitempty"`
+	Source     string `json:"source"`
+}
+
+// queryCheck is the input of the checks of a query.
+type queryCheck struct {
+	Query     string
+	Language  string
+	Dialect   string
+	PanelType string
+
+	// Format is the query's result format, e.g. "time_series" or "table",
+	// and Legend its legend format.
+	Format string
+	Legend string
+
+	variables []dashboardVariable
+}
+
+// timeSeries reports whether the query feeds a time series.
+func (c queryCheck) timeSeries() bool {
+	return c.Format == "time_series" || c.Format == "" && (c.PanelType == "timeseries" || c.PanelType == "graph")
+}
+
+// checkQuery runs the checks of the query's language. They catch common
+// mistakes that don't need the model; it is asked about the rest.
+func checkQuery(c queryCheck) []queryIssue {
+	var issues []queryIssue
+	switch c.Language {
+	case queryLanguagePromQL:
+		issues = checkPromQL(c)
+	case queryLanguageLogQL:
+		issues = checkLogQL(c)
+	case queryLanguageSQL:
+		issues = checkSQL(c)
+	case queryLanguageFlux:
+		issues = checkFlux(c)
+	}
+	for i := range issues {
+		issues[i].Source = "check"
+	}
+	return issues
+}
+
+// expandPromQL replaces the dashboard's and Grafana's variables in a PromQL
+// query, so that it can be parsed.
+func expandPromQL(query string, variables []dashboardVariable) string {
+	query = interpolate(query, variables, "regex")
+	return builtinVariableRegex.ReplaceAllStringFunc(query, func(match string) string {
+		if value, ok := builtinVariableValues[builtinVariableRegex.FindStringSubmatch(match)[1]]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// isCounterName reports whether a metric is named like a counter, or the
+// series of a histogram or summary, which are counters too.
+func isCounterName(name string) bool {
+	for _, suffix := range []string{"_total", "_count", "_sum", "_bucket"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unparen returns the expression inside any parentheses.
+func unparen(node promNode) promNode {
+	for {
+		paren, ok := node.(*promParen)
+		if !ok {
+			return node
+		}
+		node = paren.Expr
+	}
+}
+
+func checkPromQL(c queryCheck) []queryIssue {
+	node, err := parsePromQL(expandPromQL(c.Query, c.variables))
+	if err != nil {
+		// Variables the dashboard doesn't define may be the cause.
+		if strings.Contains(c.Query, "$") {
+			return nil
+		}
+		return []queryIssue{{Issue: "The query doesn't parse: " + err.Error(), Severity: "high"}}
+	}
+
+	var issues []queryIssue
+	fixedRange := ""
+	walkPromQL(node, func(n promNode) {
+		call, ok := n.(*promCall)
+		if !ok || len(call.Args) == 0 {
+			return
+		}
+		arg := unparen(call.Args[len(call.Args)-1])
+		switch call.Func {
+		case "rate", "irate", "increase":
+			if matrix, ok := arg.(*promMatrixSelector); ok {
+				fixedRange = formatPromDuration(matrix.Range)
+				if name := matrix.Vector.Name; name != "" && !isCounterName(name) {
+					issues = append(issues, queryIssue{
+						Issue:      fmt.Sprintf("%s() is applied to %s, which is named like a gauge; %s() is only meaningful for counters", call.Func, name, call.Func),
+						Severity:   "high",
+						Suggestion: fmt.Sprintf("Use the gauge directly, or deriv(%s[...]) for its rate of change", name),
+					})
+				}
+			}
+			if sub, ok := arg.(*promSubquery); ok {
+				if agg, ok := unparen(sub.Expr).(*promAggregate); ok && agg.Op == "sum" {
+					issues = append(issues, queryIssue{
+						Issue:      fmt.Sprintf("%s() is applied to a sum, which turns the resets of single counters into drops of the sum", call.Func),
+						Severity:   "high",
+						Suggestion: fmt.Sprintf("Take the %s() of each series first and sum the results: sum(%s(...))", call.Func, call.Func),
+					})
+				}
+			}
+		case "delta", "deriv", "predict_linear", "idelta":
+			if matrix, ok := arg.(*promMatrixSelector); ok && isCounterName(matrix.Vector.Name) {
+				issues = append(issues, queryIssue{
+					Issue:      fmt.Sprintf("%s() is applied to the counter %s and doesn't handle counter resets", call.Func, matrix.Vector.Name),
+					Severity:   "medium",
+					Suggestion: "Use rate() or increase() for counters",
+				})
+			}
+		case "histogram_quantile":
+			agg, ok := arg.(*promAggregate)
+			if !ok {
+				return
+			}
+			if agg.Without == slices.Contains(agg.Grouping, "le") {
+				issues = append(issues, queryIssue{
+					Issue:      fmt.Sprintf("The %s() inside histogram_quantile() removes the le label, which histogram_quantile() needs to find the buckets", agg.Op),
+					Severity:   "high",
+					Suggestion: fmt.Sprintf("Keep le in the aggregation, e.g. %s by (le) (...)", agg.Op),
+				})
+			}
+		}
+	})
+
+	// Ranges given by a variable, e.g. [$__rate_interval], aren't fixed.
+	if fixedRange != "" && !strings.Contains(c.Query, "[$") {
+		issues = append(issues, queryIssue{
+			Issue:      fmt.Sprintf("The rate range [%s] is fixed, so it doesn't adapt to the scrape interval and the panel's resolution", fixedRange),
+			Severity:   "low",
+			Suggestion: "Use [$__rate_interval] as the range",
+		})
+	}
+
+	// The legend can only show labels the result has.
+	if agg, ok := unparen(node).(*promAggregate); ok && !slices.Contains([]string{"topk", "bottomk", "limitk", "limit_ratio"}, agg.Op) {
+		for _, match := range legendLabelRegex.FindAllStringSubmatch(c.Legend, -1) {
+			label := match[1]
+			if label == "__name__" || agg.Without != slices.Contains(agg.Grouping, label) {
+				continue
+			}
+			issue := queryIssue{
+				Issue:      fmt.Sprintf("The legend shows {{%s}}, but the outer %s() removes the %s label, so all series get the same name", label, agg.Op, label),
+				Severity:   "medium",
+				Suggestion: fmt.Sprintf("Aggregate by the label, e.g. %s by (%s) (...)", agg.Op, strings.Join(append(slices.Clone(agg.Grouping), label), ", ")),
+			}
+			if agg.Without {
+				issue.Suggestion = fmt.Sprintf("Remove %s from the without clause", label)
+			}
+			if !agg.Grouped {
+				issue.Issue = fmt.Sprintf("The legend shows {{%s}}, but %s() has no by clause and removes all labels", label, agg.Op)
+			}
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+func checkLogQL(c queryCheck) []queryIssue {
+	var issues []queryIssue
+	if parser := logQLParserRegex.FindStringIndex(c.Query); parser != nil {
+		if filter := logQLFilterRegex.FindStringIndex(c.Query[parser[1]:]); filter != nil {
+			issues = append(issues, queryIssue{
+				Issue:      "A line filter comes after a parser stage, so every line is parsed before it's filtered",
+				Severity:   "medium",
+				Suggestion: "Put line filters such as |= right after the stream selector, before parsers",
+			})
+		}
+	}
+	for _, match := range logQLRegexFilterRegex.FindAllStringSubmatch(c.Query, -1) {
+		expr := match[1] + match[2]
+		if expr != "" && !strings.ContainsAny(expr, `.*+?()[]{}|^$\`) {
+			issues = append(issues, queryIssue{
+				Issue:      fmt.Sprintf("The regex filter |~ %q matches a plain string", expr),
+				Severity:   "low",
+				Suggestion: fmt.Sprintf("Use |= %q, which is faster", expr),
+			})
+		}
+	}
+	return issues
+}
+
+func checkSQL(c queryCheck) []queryIssue {
+	if _, err := validateSQL(c.Query, orDefaultString(c.Dialect, sqlDialectPostgres)); err != nil {
+		return []queryIssue{{Issue: "The query isn't a single read-only SELECT: " + err.Error(), Severity: "high"}}
+	}
+	tokens, _ := lexSQL(c.Query, orDefaultString(c.Dialect, sqlDialectPostgres))
+	hasKeywords := func(keywords ...string) bool {
+		for i := range tokens[:max(len(tokens)-len(keywords)+1, 0)] {
+			matched := true
+			for j, kw := range keywords {
+				matched = matched && tokens[i+j].keyword() == kw
+			}
+			if matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	var issues []queryIssue
+	if hasKeywords("SELECT", "*") {
+		issues = append(issues, queryIssue{
+			Issue:      "SELECT * reads all columns",
+			Severity:   "low",
+			Suggestion: "Select only the columns the panel shows",
+		})
+	}
+	if c.timeSeries() {
+		if !strings.Contains(c.Query, "$__timeFilter") && !strings.Contains(c.Query, "$__unixEpochFilter") && !strings.Contains(c.Query, "$__timeFrom") {
+			issues = append(issues, queryIssue{
+				Issue:      "The query isn't filtered by the dashboard's time range, so it reads all rows",
+				Severity:   "high",
+				Suggestion: "Add WHERE $__timeFilter(<time column>)",
+			})
+		}
+		if !hasKeywords("ORDER", "BY") {
+			issues = append(issues, queryIssue{
+				Issue:      "The time series isn't ordered by time",
+				Severity:   "medium",
+				Suggestion: "Add ORDER BY on the time column",
+			})
+		}
+	}
+	return issues
+}
+
+func checkFlux(c queryCheck) []queryIssue {
+	var issues []queryIssue
+	switch {
+	case !strings.Contains(c.Query, "range("):
+		issues = append(issues, queryIssue{
+			Issue:      "The query has no range(), so it reads the whole bucket",
+			Severity:   "high",
+			Suggestion: "Add |> range(start: v.timeRangeStart, stop: v.timeRangeStop) after from()",
+		})
+	case !strings.Contains(c.Query, "v.timeRangeStart"):
+		issues = append(issues, queryIssue{
+			Issue:      "The range() is fixed, so the query ignores the dashboard's time range",
+			Severity:   "medium",
+			Suggestion: "Use range(start: v.timeRangeStart, stop: v.timeRangeStop)",
+		})
+	}
+	if c.timeSeries() && !strings.Contains(c.Query, "aggregateWindow(") {
+		issues = append(issues, queryIssue{
+			Issue:      "The query returns every point instead of aggregating to the panel's resolution",
+			Severity:   "low",
+			Suggestion: "Add |> aggregateWindow(every: v.windowPeriod, fn: mean)",
+		})
+	}
+	return issues
+}
+
+// formatPromDuration formats a duration the way PromQL writes it, e.g. 5m.
+func formatPromDuration(d time.Duration) string {
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if d >= unit.d && d%unit.d == 0 {
+			return fmt.Sprintf("%d%s", d/unit.d, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCheckQuery(t *testing.T) {
+	variables := []dashboardVariable{{Name: "job"}}
+	variables[0].Current.Value = "api"
+
+	testCases := []struct {
+		name           string
+		check          queryCheck
+		expectedIssues []string
+	}{
+		{name: "good promql", check: queryCheck{Language: queryLanguagePromQL, Legend: "{{code}}",
+			Query: `sum by (code) (rate(http_requests_total{job="$job"}[$__rate_interval]))`}},
+		{name: "rate on a gauge", check: queryCheck{Language: queryLanguagePromQL, Query: `rate(node_memory_free_bytes[$__rate_interval])`},
+			expectedIssues: []string{"named like a gauge"}},
+		{name: "rate of a sum", check: queryCheck{Language: queryLanguagePromQL, Query: `rate(sum(http_requests_total)[5m:1m])`},
+			expectedIssues: []string{"applied to a sum"}},
+		{name: "delta on a counter", check: queryCheck{Language: queryLanguagePromQL, Query: `delta(http_requests_total[$__interval])`},
+			expectedIssues: []string{"doesn't handle counter resets"}},
+		{name: "histogram without le", check: queryCheck{Language: queryLanguagePromQL,
+			Query: `histogram_quantile(0.99, sum by (job) (rate(request_duration_seconds_bucket[$__rate_interval])))`},
+			expectedIssues: []string{"removes the le label"}},
+		{name: "fixed range", check: queryCheck{Language: queryLanguagePromQL, Query: `sum by (le) (rate(request_duration_seconds_bucket[5m]))`},
+			expectedIssues: []string{"[5m] is fixed"}},
+		{name: "missing by", check: queryCheck{Language: queryLanguagePromQL, Legend: "{{instance}}", Query: `sum(rate(http_requests_total[$__rate_interval]))`},
+			expectedIssues: []string{"has no by clause"}},
+		{name: "by without legend label", check: queryCheck{Language: queryLanguagePromQL, Legend: "{{instance}} {{job}}", Query: `sum by (job) (up)`},
+			expectedIssues: []string{"removes the instance label"}},
+		{name: "unparsable", check: queryCheck{Language: queryLanguagePromQL, Query: `sum(rate(x[5m])`},
+			expectedIssues: []string{"doesn't parse"}},
+		{name: "unknown variable", check: queryCheck{Language: queryLanguagePromQL, Query: `rate(x[$window]`}},
+		{name: "logql", check: queryCheck{Language: queryLanguageLogQL, Query: `{app="api"} | json |~ "timeout"`},
+			expectedIssues: []string{"after a parser stage", "matches a plain string"}},
+		{name: "good logql", check: queryCheck{Language: queryLanguageLogQL, Query: `{app="api"} |= "timeout" |~ "status=5.." | logfmt`}},
+		{name: "sql time series", check: queryCheck{Language: queryLanguageSQL, PanelType: "timeseries", Query: `SELECT * FROM orders`},
+			expectedIssues: []string{"SELECT * reads", "isn't filtered", "isn't ordered"}},
+		{name: "good sql", check: queryCheck{Language: queryLanguageSQL, Format: "time_series",
+			Query: `SELECT $__timeGroupAlias(created_at, $__interval), count(*) FROM orders WHERE $__timeFilter(created_at) GROUP BY 1 ORDER BY 1`}},
+		{name: "sql write", check: queryCheck{Language: queryLanguageSQL, Query: `DELETE FROM orders`},
+			expectedIssues: []string{"isn't a single read-only SELECT"}},
+		{name: "flux without range", check: queryCheck{Language: queryLanguageFlux, PanelType: "timeseries", Query: `from(bucket: "app") |> filter(fn: (r) => r._measurement == "cpu")`},
+			expectedIssues: []string{"has no range()", "aggregating"}},
+		{name: "flux fixed range", check: queryCheck{Language: queryLanguageFlux, Format: "table", Query: `from(bucket: "app") |> range(start: -1h)`},
+			expectedIssues: []string{"range() is fixed"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.check.variables = variables
+			issues := checkQuery(tc.check)
+			if len(issues) != len(tc.expectedIssues) {
+				t.Fatalf("Expected %d issues, got %+v", len(tc.expectedIssues), issues)
+			}
+			for i, expected := range tc.expectedIssues {
+				if !strings.Contains(issues[i].Issue, expected) || issues[i].Source != "check" || issues[i].Suggestion == "" && issues[i].Severity != "high" {
+					t.Errorf("Expected issue %d to contain %q, got %+v", i, expected, issues[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQueryLanguage(t *testing.T) {
+	testCases := []struct {
+		dsType   string
+		target   string
+		expected string
+	}{
+		{dsType: "prometheus", target: `{"expr": "up"}`, expected: queryLanguagePromQL},
+		{dsType: "loki", target: `{"expr": "{app=\"api\"}"}`, expected: queryLanguageLogQL},
+		{dsType: "grafana-postgresql-datasource", target: `{"rawSql": "SELECT 1"}`, expected: queryLanguageSQL},
+		{dsType: "influxdb", target: `{"query": "from(bucket: \"a\") |> range(start: -1h)"}`, expected: queryLanguageFlux},
+		{dsType: "influxdb", target: `{"query": "SELECT mean(value) FROM cpu"}`},
+		{dsType: "graphite", target: `{"target": "a.b.c"}`},
+		{target: `{"expr": "sum(rate({app=\"api\"} |= \"error\" [5m]))"}`, expected: queryLanguageLogQL},
+		{target: `{"expr": "sum(rate(http_requests_total[5m]))"}`, expected: queryLanguagePromQL},
+		{target: `{"rawSql": "SELECT 1"}`, expected: queryLanguageSQL},
+	}
+
+	for _, tc := range testCases {
+		var target panelTarget
+		if err := json.Unmarshal([]byte(tc.target), &target); err != nil {
+			t.Fatal(err)
+		}
+		if language := queryLanguage(tc.dsType, target); language != tc.expected {
+			t.Errorf("Expected %q for %s %s, got %q", tc.expected, tc.dsType, tc.target, language)
+		}
+	}
+}
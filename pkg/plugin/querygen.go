@@ -0,0 +1,385 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxQueryAttempts bounds how often the model is asked for a query; the
+	// retries carry the validation error of the previous answer.
+	maxQueryAttempts = 3
+
+	// maxPromptMetrics bounds the metrics listed in the prompt, and
+	// maxLabeledMetrics those of them whose label names are looked up.
+	maxPromptMetrics  = 40
+	maxLabeledMetrics = 10
+
+	// maxQuestionLength bounds the question of a query generation.
+	maxQuestionLength = 2000
+)
+
+const generatePromQLInstructions = `You write PromQL queries for Prometheus.
+Use only the metrics and labels listed below; they are the ones the data source has that match the question best. Prefer rate() over counters, histogram_quantile() over _bucket series, and aggregate with "by" to the labels the question asks about.
+The query must be valid PromQL that returns a scalar or an instant vector, so that Grafana can graph it.`
+
+const generatePromQLAnswer = `Answer with a JSON object with the keys "query" (the PromQL expression) and "explanation" (one to three sentences on what it computes and how to read the result).`
+
+// generateQueryRequest is the body accepted by /generate-query.
+type generateQueryRequest struct {
+	Model         string `json:"model"`
+	Question      string `json:"question"`
+	DatasourceUID string `json:"datasourceUid"`
+
+	// DryRun runs generated SQL queries with a LIMIT before returning them.
+	DryRun bool `json:"dryRun"`
+}
+
+// queryGenerator grounds the model in what a data source has, and checks
+// the queries it writes.
+type queryGenerator interface {
+	// instructions returns the system prompt.
+	instructions() string
+
+	// grounding returns the rules for the queries and what the data source
+	// has, for prompts that ask for queries in another shape.
+	grounding() string
+
+	// validate checks a generated query and returns it normalized. A
+	// *requestError fails the request; other errors are sent back to the
+	// model to fix the query.
+	validate(ctx context.Context, query string) (string, error)
+
+	// fields returns what the response reports about the generation besides
+	// the query.
+	fields() map[string]any
+}
+
+// generatedQuery is the model's answer.
+type generatedQuery struct {
+	Query       string `json:"query"`
+	Explanation string `json:"explanation"`
+}
+
+// promMetric describes a metric of a Prometheus data source for the prompt.
+type promMetric struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type,omitempty"`
+	Help   string   `json:"help,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// promCatalog is what the prompt is told about a data source's metrics.
+type promCatalog struct {
+	// Metrics are the metrics most relevant to the question.
+	Metrics []promMetric
+
+	// names holds all metric names of the data source.
+	names map[string]bool
+}
+
+// prometheusAPIResponse is the envelope of Prometheus HTTP API responses.
+type prometheusAPIResponse[T any] struct {
+	Status string `json:"status"`
+	Data   T      `json:"data"`
+}
+
+// promResourcePath is the path of a Prometheus API endpoint through the
+// data source's resource proxy, which applies the caller's permissions.
+func promResourcePath(datasourceUID, endpoint string, query url.Values) string {
+	path := "/api/datasources/uid/" + url.PathEscape(datasourceUID) + "/resources/api/v1/" + endpoint
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path
+}
+
+// loadPromCatalog fetches the metric names of a data source and, for those
+// most relevant to the question, their metadata and label names.
+func loadPromCatalog(ctx context.Context, client *grafanaClient, datasourceUID, question string) (*promCatalog, error) {
+	ctx, span := startSpan(ctx, "generate_query.load_metadata")
+	defer span.End()
+
+	var names prometheusAPIResponse[[]string]
+	if err := client.get(ctx, promResourcePath(datasourceUID, "label/__name__/values", nil), &names); err != nil {
+		return nil, err
+	}
+	catalog := &promCatalog{names: make(map[string]bool, len(names.Data))}
+	for _, name := range names.Data {
+		catalog.names[name] = true
+	}
+	span.SetAttributes(attribute.Int("generate_query.metrics", len(names.Data)))
+
+	relevant := rankNames(names.Data, question, maxPromptMetrics)
+
+	// Metadata is keyed by the metric family, without the suffixes of
+	// counters and histograms. It's optional: not every setup serves it.
+	var metadata prometheusAPIResponse[map[string][]struct {
+		Type string `json:"type"`
+		Help string `json:"help"`
+	}]
+	if err := client.get(ctx, promResourcePath(datasourceUID, "metadata", nil), &metadata); err != nil {
+		log.DefaultLogger.Warn("Failed to load metric metadata", "datasource", datasourceUID, "error", err)
+	}
+	catalog.Metrics = make([]promMetric, len(relevant))
+	for i, name := range relevant {
+		catalog.Metrics[i].Name = name
+		for _, family := range metricFamilies(name) {
+			if entries := metadata.Data[family]; len(entries) > 0 {
+				catalog.Metrics[i].Type, catalog.Metrics[i].Help = entries[0].Type, truncate(entries[0].Help, maxContextTitle)
+				break
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, panelQueryConcurrency)
+	for i := range catalog.Metrics[:min(len(catalog.Metrics), maxLabeledMetrics)] {
+		metric := &catalog.Metrics[i]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var labels prometheusAPIResponse[[]string]
+			query := url.Values{"match[]": {fmt.Sprintf("{__name__=%q}", metric.Name)}}
+			if err := client.get(ctx, promResourcePath(datasourceUID, "labels", query), &labels); err != nil {
+				log.DefaultLogger.Warn("Failed to load label names", "metric", metric.Name, "error", err)
+				return
+			}
+			for _, label := range labels.Data {
+				if label != "__name__" {
+					metric.Labels = append(metric.Labels, label)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return catalog, nil
+}
+
+// metricFamilies returns the names metadata may list a metric under.
+func metricFamilies(name string) []string {
+	families := []string{name}
+	for _, suffix := range []string{"_bucket", "_count", "_sum", "_total", "_created"} {
+		if family, ok := strings.CutSuffix(name, suffix); ok {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// rankNames returns up to n metric or table names that share the most words
+// with the question, shorter names first on ties.
+func rankNames(names []string, question string, n int) []string {
+	isSeparator := func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}
+	words := strings.FieldsFunc(strings.ToLower(question), isSeparator)
+	score := func(name string) int {
+		s := 0
+		parts := strings.FieldsFunc(strings.ToLower(name), isSeparator)
+		for _, word := range words {
+			if len(word) < 3 {
+				continue
+			}
+			for _, part := range parts {
+				if part == word || len(part) >= 4 && strings.HasPrefix(word, part) || len(word) >= 4 && strings.HasPrefix(part, word) {
+					s++
+					break
+				}
+			}
+		}
+		return s
+	}
+
+	type scored struct {
+		name  string
+		score int
+	}
+	ranked := make([]scored, len(names))
+	for i, name := range names {
+		ranked[i] = scored{name: name, score: score(name)}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return len(ranked[i].name) < len(ranked[j].name)
+	})
+
+	result := make([]string, 0, min(n, len(ranked)))
+	for _, r := range ranked[:min(n, len(ranked))] {
+		result = append(result, r.name)
+	}
+	return result
+}
+
+func (c *promCatalog) instructions() string {
+	return c.grounding() + generatePromQLAnswer
+}
+
+func (c *promCatalog) grounding() string {
+	var b strings.Builder
+	b.WriteString(generatePromQLInstructions)
+	fmt.Fprintf(&b, "\n\nMetrics (%d of %d):\n", len(c.Metrics), len(c.names))
+	for _, m := range c.Metrics {
+		fmt.Fprintf(&b, "- %s", m.Name)
+		if m.Type != "" {
+			fmt.Fprintf(&b, " (%s)", m.Type)
+		}
+		if len(m.Labels) > 0 {
+			fmt.Fprintf(&b, " labels: %s", strings.Join(m.Labels, ", "))
+		}
+		if m.Help != "" {
+			fmt.Fprintf(&b, ": %s", m.Help)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// validate parses a generated query and checks that it can be graphed and
+// only uses metrics of the data source. Grafana's built-in variables, such
+// as $__rate_interval, are expanded for parsing but kept in the query.
+func (c *promCatalog) validate(_ context.Context, query string) (string, error) {
+	node, err := parsePromQL(expandPromQL(query, nil))
+	if err != nil {
+		return "", err
+	}
+	if t := node.Type(); t != promScalar && t != promInstantVector {
+		return "", fmt.Errorf("the query returns a %s, but it must return a scalar or an instant vector", t)
+	}
+	for _, name := range promMetricNames(node) {
+		if !c.names[name] {
+			return "", fmt.Errorf("the metric %q doesn't exist in the data source", name)
+		}
+	}
+	return strings.TrimSpace(query), nil
+}
+
+func (c *promCatalog) fields() map[string]any {
+	return map[string]any{"language": queryLanguagePromQL, "metrics": c.Metrics}
+}
+
+// handleGenerateQuery writes a PromQL or SQL query for a question, depending
+// on the type of the data source. The query is validated, and the model is
+// asked again with the error if it's invalid.
+func (ds *Datasource) handleGenerateQuery(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "generate_query.handle")
+	defer span.End()
+
+	apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req generateQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	req.Model = orDefaultString(req.Model, defaultChatModel)
+	if !validModel(req.Model) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+		return
+	}
+	if strings.TrimSpace(req.Question) == "" || len(req.Question) > maxQuestionLength {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid question"})
+		return
+	}
+	if !dashboardUIDRegex.MatchString(req.DatasourceUID) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidDatasource, message: "Invalid data source UID"})
+		return
+	}
+	span.SetAttributes(attribute.String(attrModel, req.Model))
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Error("Cannot call Grafana API", "error", err)
+		writeRequestError(w, span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+		return
+	}
+	var ref dataSourceRef
+	if err := client.get(ctx, "/api/datasources/uid/"+url.PathEscape(req.DatasourceUID), &ref); err != nil {
+		log.DefaultLogger.Warn("Failed to load data source", "datasource", req.DatasourceUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Data source"))
+		return
+	}
+	ref = dataSourceRef{Type: ref.Type, UID: req.DatasourceUID}
+	span.SetAttributes(attribute.String("generate_query.datasource_type", ref.Type))
+
+	var generator queryGenerator
+	switch {
+	case ref.Type == "prometheus":
+		generator, err = loadPromCatalog(ctx, client, req.DatasourceUID, req.Question)
+	case sqlDialect(ref.Type) != "":
+		generator, err = loadSQLCatalog(ctx, client, ref, req.Question, req.DryRun)
+	default:
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidDatasource, message: "Unsupported data source type " + ref.Type})
+		return
+	}
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to load data source metadata", "datasource", req.DatasourceUID, "error", err)
+		writeRequestError(w, span, grafanaRequestError(err, "Data source"))
+		return
+	}
+
+	chatReq := &chatRequest{Model: req.Model, Messages: []chatMessage{
+		{Role: "system", Content: generator.instructions()},
+		{Role: "user", Content: req.Question},
+	}}
+	var answer generatedQuery
+	var validationErr error
+	attempts := 0
+	for attempts < maxQueryAttempts {
+		attempts++
+		answer = generatedQuery{}
+		if _, reqErr := ds.completeJSON(ctx, apiKey, "generate-query", chatReq, &answer); reqErr != nil {
+			writeRequestError(w, span, reqErr)
+			return
+		}
+		var query string
+		query, validationErr = generator.validate(ctx, answer.Query)
+		var reqErr *requestError
+		if errors.As(validationErr, &reqErr) {
+			writeRequestError(w, span, reqErr)
+			return
+		}
+		if validationErr == nil {
+			answer.Query = query
+			break
+		}
+		log.DefaultLogger.Info("Generated query is invalid", "attempt", attempts, "error", validationErr)
+		encoded, _ := json.Marshal(answer)
+		chatReq.Messages = append(chatReq.Messages,
+			chatMessage{Role: "assistant", Content: string(encoded)},
+			chatMessage{Role: "user", Content: fmt.Sprintf("The query is invalid: %s. Answer with a corrected query.", validationErr)},
+		)
+	}
+	span.SetAttributes(attribute.Int("generate_query.attempts", attempts))
+	if validationErr != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusUnprocessableEntity, code: errCodeInvalidQuery, message: "Could not generate a valid query: " + validationErr.Error()})
+		return
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+
+	resp := generator.fields()
+	resp["datasourceUid"] = req.DatasourceUID
+	resp["query"] = answer.Query
+	resp["explanation"] = answer.Explanation
+	resp["attempts"] = attempts
+	writeJSON(w, resp)
+}
@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// newTestPrometheus serves the data source "prom" and its Prometheus
+// metadata API through Grafana's resource proxy.
+func newTestPrometheus(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/datasources/uid/prom" {
+			w.Write([]byte(`{"uid":"prom","name":"Prometheus","type":"prometheus"}`))
+			return
+		}
+		const prefix = "/api/datasources/uid/prom/resources/api/v1/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var data any
+		switch strings.TrimPrefix(r.URL.Path, prefix) {
+		case "label/__name__/values":
+			data = []string{"go_goroutines", "http_requests_total", "http_request_duration_seconds_bucket", "up"}
+		case "metadata":
+			data = map[string]any{
+				"http_requests_total":           []any{map[string]string{"type": "counter", "help": "Total HTTP requests."}},
+				"http_request_duration_seconds": []any{map[string]string{"type": "histogram", "help": "HTTP request latency."}},
+			}
+		case "labels":
+			data = []string{"__name__", "code", "job"}
+			if r.URL.Query().Get("match[]") != `{__name__="http_requests_total"}` {
+				data = []string{"__name__", "job"}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": data})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRankNames(t *testing.T) {
+	names := []string{"node_cpu_seconds_total", "http_requests_total", "http_request_duration_seconds_bucket", "up"}
+	ranked := rankNames(names, "What is the rate of HTTP requests by status code?", 2)
+	if strings.Join(ranked, ",") != "http_requests_total,http_request_duration_seconds_bucket" {
+		t.Errorf("Unexpected ranking: %v", ranked)
+	}
+}
+
+func TestHandleGenerateQuery(t *testing.T) {
+	prometheus := newTestPrometheus(t)
+
+	testCases := []struct {
+		name             string
+		body             string
+		answers          []string
+		expectedStatus   int
+		expectedAttempts int
+		expectedRetry    string
+		expectedQuery    string
+	}{
+		{name: "valid", body: `{"question":"HTTP requests per second by code","datasourceUid":"prom"}`,
+			answers:        []string{`{"query":"sum by (code) (rate(http_requests_total[5m]))","explanation":"Requests per second."}`},
+			expectedStatus: http.StatusOK, expectedAttempts: 1},
+		{name: "grafana variables", body: `{"question":"HTTP requests per second","datasourceUid":"prom"}`,
+			answers:        []string{`{"query":"sum(rate(http_requests_total[$__rate_interval]))","explanation":"Requests per second."}`},
+			expectedStatus: http.StatusOK, expectedAttempts: 1, expectedQuery: "sum(rate(http_requests_total[$__rate_interval]))"},
+		{name: "retry with parse error", body: `{"question":"HTTP requests per second","datasourceUid":"prom"}`,
+			answers: []string{
+				`{"query":"sum(rate(http_requests_total))","explanation":"Requests per second."}`,
+				`{"query":"sum(rate(http_requests_total[5m]))","explanation":"Requests per second."}`,
+			},
+			expectedStatus: http.StatusOK, expectedAttempts: 2, expectedRetry: `expected type range vector in call to function "rate"`},
+		{name: "retry with unknown metric", body: `{"question":"HTTP requests per second","datasourceUid":"prom"}`,
+			answers: []string{
+				`{"query":"rate(http_requests[5m])","explanation":"Requests per second."}`,
+				`{"query":"rate(http_requests_total[5m])","explanation":"Requests per second."}`,
+			},
+			expectedStatus: http.StatusOK, expectedAttempts: 2, expectedRetry: `the metric "http_requests" doesn't exist`},
+		{name: "no valid query", body: `{"question":"HTTP requests","datasourceUid":"prom"}`,
+			answers:        []string{`{"query":"http_requests_total[5m]","explanation":"Requests."}`},
+			expectedStatus: http.StatusUnprocessableEntity},
+		{name: "missing question", body: `{"datasourceUid":"prom"}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid data source", body: `{"question":"Requests","datasourceUid":"../prom"}`, expectedStatus: http.StatusBadRequest},
+		{name: "unknown data source", body: `{"question":"Requests","datasourceUid":"loki"}`, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var sent []groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req groqChatRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				sent = append(sent, req)
+				answer := tc.answers[min(len(sent), len(tc.answers))-1]
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: answer}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: prometheus.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest("POST", "/generate-query", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleGenerateQuery(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusUnprocessableEntity && len(sent) != maxQueryAttempts {
+				t.Errorf("Expected %d attempts, got %d", maxQueryAttempts, len(sent))
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			system := sent[0].Messages[0].Content
+			if !strings.Contains(system, "- http_requests_total (counter) labels: code, job: Total HTTP requests.") ||
+				!strings.Contains(system, "- http_request_duration_seconds_bucket (histogram)") {
+				t.Errorf("Expected the metrics in the prompt, got %q", system)
+			}
+			if tc.expectedRetry != "" {
+				retry := sent[1].Messages[len(sent[1].Messages)-1]
+				if retry.Role != "user" || !strings.Contains(retry.Content, tc.expectedRetry) {
+					t.Errorf("Expected the retry to carry the error, got %+v", retry)
+				}
+			}
+
+			var resp struct {
+				Query       string `json:"query"`
+				Explanation string `json:"explanation"`
+				Attempts    int    `json:"attempts"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Attempts != tc.expectedAttempts || resp.Query == "" || resp.Explanation == "" {
+				t.Errorf("Unexpected response: %+v", resp)
+			}
+			if tc.expectedQuery != "" && resp.Query != tc.expectedQuery {
+				t.Errorf("Expected query %q, got %q", tc.expectedQuery, resp.Query)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQL dialects queries are generated for.
+const (
+	sqlDialectPostgres = "postgres"
+	sqlDialectMySQL    = "mysql"
+)
+
+// sqlWriteKeywords are the keywords with which a single statement that
+// starts with SELECT or WITH can still write: data-modifying common table
+// expressions, SELECT INTO and INTO OUTFILE.
+var sqlWriteKeywords = map[string]bool{
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"MERGE":  true,
+	"INTO":   true,
+}
+
+// sqlUnsafeFunctions are functions with side effects on the database server,
+// or that run SQL given as a string.
+var sqlUnsafeFunctions = map[string]bool{
+	"pg_sleep": true, "pg_sleep_for": true, "pg_sleep_until": true,
+	"pg_terminate_backend": true, "pg_cancel_backend": true, "pg_reload_conf": true,
+	"set_config": true, "nextval": true, "setval": true,
+	"lo_import": true, "lo_export": true, "lo_unlink": true,
+	"pg_read_file": true, "pg_read_binary_file": true, "pg_ls_dir": true,
+	"dblink": true, "dblink_exec": true,
+	"query_to_xml": true, "query_to_xmlschema": true, "query_to_xml_and_xmlschema": true,
+	"sleep": true, "benchmark": true, "load_file": true, "get_lock": true, "release_lock": true,
+}
+
+// sqlToken is a token of a SQL statement. Quoted identifiers and string
+// literals are tokens whose text can't be a keyword.
+type sqlToken struct {
+	text   string
+	pos    int
+	quoted bool
+}
+
+func (t sqlToken) keyword() string {
+	if t.quoted {
+		return ""
+	}
+	return strings.ToUpper(t.text)
+}
+
+// lexSQL splits a statement into tokens, dropping comments and whitespace.
+// It only knows as much SQL as validateSQL needs: where strings, quoted
+// identifiers and comments start and end. MySQL's executable comments are
+// rejected, as they aren't comments to the server.
+func lexSQL(query, dialect string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(query[i:], "--") && (dialect != sqlDialectMySQL || sqlMySQLDashComment(query[i+2:])) || c == '#' && dialect == sqlDialectMySQL:
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end
+		case strings.HasPrefix(query[i:], "/*"):
+			if dialect == sqlDialectMySQL && (strings.HasPrefix(query[i+2:], "!") || strings.HasPrefix(query[i+2:], "+")) {
+				// MySQL runs the contents of /*! */ and reads hints from /*+ */.
+				return nil, errors.New("MySQL executable comments and optimizer hints are not allowed")
+			}
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			end, err := sqlQuotedEnd(query, i, dialect == sqlDialectMySQL && c != '`')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{text: query[i:end], pos: i, quoted: true})
+			i = end
+		case (c == 'E' || c == 'e') && strings.HasPrefix(query[i+1:], "'") && dialect == sqlDialectPostgres:
+			// Postgres escape strings, E'...', escape quotes with a backslash.
+			end, err := sqlQuotedEnd(query, i+1, true)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{text: query[i:end], pos: i, quoted: true})
+			i = end
+		case c == '$' && dialect == sqlDialectPostgres && sqlDollarTag(query[i:]) != "":
+			tag := sqlDollarTag(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				return nil, errors.New("unterminated dollar-quoted string")
+			}
+			end = i + len(tag) + end + len(tag)
+			tokens = append(tokens, sqlToken{text: query[i:end], pos: i, quoted: true})
+			i = end
+		case isSQLWordChar(c):
+			start := i
+			for i < len(query) && isSQLWordChar(query[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{text: query[start:i], pos: start})
+		default:
+			tokens = append(tokens, sqlToken{text: query[i : i+1], pos: i})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// sqlMySQLDashComment reports whether "--" followed by rest starts a comment
+// in MySQL, which requires whitespace or the end of the line after the
+// dashes: "1--1" is a subtraction.
+func sqlMySQLDashComment(rest string) bool {
+	return rest == "" || strings.ContainsRune(" \t\n\r\f\v", rune(rest[0]))
+}
+
+// sqlQuotedEnd returns the end of the string or quoted identifier starting
+// at start. Quotes are escaped by doubling them, and with a backslash if
+// backslash is set, as in MySQL strings and Postgres escape strings.
+func sqlQuotedEnd(query string, start int, backslash bool) (int, error) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case query[i] == '\\' && backslash:
+			i++
+		case query[i] == quote && i+1 < len(query) && query[i+1] == quote:
+			i++
+		case query[i] == quote:
+			return i + 1, nil
+		}
+	}
+	if quote == '\'' {
+		return 0, errors.New("unterminated string")
+	}
+	return 0, errors.New("unterminated quoted identifier")
+}
+
+// sqlDollarTag returns the opening tag of a Postgres dollar-quoted string at
+// the start of s, e.g. "$$" or "$body$", or "" if there's none. Grafana's
+// macros, such as $__timeFilter(time), aren't followed by a dollar sign.
+func sqlDollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1]
+		case !(isSQLWordChar(s[i]) && s[i] != '$') || i == 1 && s[i] >= '0' && s[i] <= '9':
+			return ""
+		}
+	}
+	return ""
+}
+
+func isSQLWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
+
+// validateSQL checks that query is a single statement that only reads: a
+// SELECT, optionally with common table expressions, without INTO, locking
+// clauses or functions with side effects. It returns the statement without
+// a trailing semicolon.
+//
+// It is a safeguard against what a model may generate, not a substitute for
+// a read-only database user.
+func validateSQL(query, dialect string) (string, error) {
+	tokens, err := lexSQL(query, dialect)
+	if err != nil {
+		return "", err
+	}
+	statement := strings.TrimSpace(query)
+	for i, t := range tokens {
+		if t.text == ";" && !t.quoted {
+			if i != len(tokens)-1 {
+				return "", errors.New("only a single statement is allowed")
+			}
+			tokens = tokens[:i]
+			statement = strings.TrimSpace(query[:t.pos])
+		}
+	}
+
+	first := 0
+	for first < len(tokens) && tokens[first].text == "(" && !tokens[first].quoted {
+		first++
+	}
+	if first == len(tokens) {
+		return "", errors.New("the query is empty")
+	}
+	if kw := tokens[first].keyword(); kw != "SELECT" && kw != "WITH" {
+		return "", fmt.Errorf("the query must be a SELECT statement, not %s", tokens[first].text)
+	}
+
+	for i, t := range tokens {
+		kw, name, next := t.keyword(), strings.ToLower(strings.Trim(t.text, "\"`")), ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1].keyword()
+		}
+		switch {
+		case sqlWriteKeywords[kw]:
+			return "", fmt.Errorf("%s is not allowed, the query must only read data", kw)
+		case kw == "FOR" && (next == "SHARE" || next == "NO" || next == "KEY"), kw == "LOCK" && next == "IN":
+			return "", errors.New("locking clauses are not allowed")
+		case next == "(" && sqlUnsafeFunctions[name]:
+			return "", fmt.Errorf("the function %s is not allowed", name)
+		}
+	}
+	return statement, nil
+}
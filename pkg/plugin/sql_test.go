@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSQL(t *testing.T) {
+	testCases := []struct {
+		name              string
+		query             string
+		dialect           string
+		expectedStatement string
+		expectedError     string
+	}{
+		{name: "select", query: "SELECT id FROM orders;\n", expectedStatement: "SELECT id FROM orders"},
+		{name: "grafana macros", query: "SELECT $__timeGroupAlias(created_at, $__interval), count(*) FROM orders WHERE $__timeFilter(created_at) GROUP BY 1",
+			expectedStatement: "SELECT $__timeGroupAlias(created_at, $__interval), count(*) FROM orders WHERE $__timeFilter(created_at) GROUP BY 1"},
+		{name: "with clause", query: "WITH t AS (SELECT 1 AS x) SELECT x FROM t", expectedStatement: "WITH t AS (SELECT 1 AS x) SELECT x FROM t"},
+		{name: "union in parentheses", query: "(SELECT 1) UNION (SELECT 2)", expectedStatement: "(SELECT 1) UNION (SELECT 2)"},
+		{name: "keywords in strings and comments", query: "SELECT 'it''s; delete' AS \"update\" -- drop; table\n/* ; */", expectedStatement: "SELECT 'it''s; delete' AS \"update\" -- drop; table\n/* ; */"},
+		{name: "semicolon in trailing comment", query: "SELECT 1; -- done; really", expectedStatement: "SELECT 1"},
+		{name: "dollar quoted string", query: "SELECT $tag$ ; DELETE $tag$", expectedStatement: "SELECT $tag$ ; DELETE $tag$"},
+		{name: "mysql backslash escape", query: `SELECT 'a\'; DELETE FROM t' FROM t`, dialect: sqlDialectMySQL, expectedStatement: `SELECT 'a\'; DELETE FROM t' FROM t`},
+		{name: "escape string", query: `SELECT E'it\'s; \\' AS s`, expectedStatement: `SELECT E'it\'s; \\' AS s`},
+		{name: "escape string with write", query: `SELECT E'\'';DELETE FROM t;--'`, expectedError: "single statement"},
+		{name: "escape string with unsafe function", query: `SELECT e'\'' , pg_sleep(10) --'`, expectedError: "function pg_sleep is not allowed"},
+		{name: "multiple statements", query: "SELECT 1; DROP TABLE orders", expectedError: "single statement"},
+		{name: "mysql hash comment", query: "SELECT 1 # ;\n; DELETE FROM t", dialect: sqlDialectMySQL, expectedError: "single statement"},
+		{name: "mysql executable comment", query: "SELECT * FROM t /*! INTO OUTFILE '/tmp/x' */", dialect: sqlDialectMySQL, expectedError: "executable comments"},
+		{name: "mysql versioned comment", query: "SELECT /*!50000 sleep(100) */", dialect: sqlDialectMySQL, expectedError: "executable comments"},
+		{name: "mysql optimizer hint", query: "SELECT /*+ MAX_EXECUTION_TIME(1) */ 1", dialect: sqlDialectMySQL, expectedError: "optimizer hints"},
+		{name: "mysql double dash without space", query: "SELECT 1 --1 INTO OUTFILE '/tmp/x'", dialect: sqlDialectMySQL, expectedError: "INTO is not allowed"},
+		{name: "mysql double dash comment", query: "SELECT 1 -- INTO\n", dialect: sqlDialectMySQL, expectedStatement: "SELECT 1 -- INTO"},
+		{name: "not a select", query: "UPDATE orders SET amount = 0", expectedError: "must be a SELECT statement"},
+		{name: "data-modifying cte", query: "WITH d AS (DELETE FROM orders RETURNING *) SELECT * FROM d", expectedError: "DELETE is not allowed"},
+		{name: "select into", query: "SELECT * INTO backup FROM orders", expectedError: "INTO is not allowed"},
+		{name: "for update", query: "SELECT * FROM orders FOR UPDATE", expectedError: "UPDATE is not allowed"},
+		{name: "for share", query: "SELECT * FROM orders FOR SHARE", expectedError: "locking clauses"},
+		{name: "lock in share mode", query: "SELECT * FROM orders LOCK IN SHARE MODE", dialect: sqlDialectMySQL, expectedError: "locking clauses"},
+		{name: "unsafe function", query: `SELECT pg_catalog."pg_sleep"(10)`, expectedError: "function pg_sleep is not allowed"},
+		{name: "unterminated string", query: "SELECT 'abc", expectedError: "unterminated string"},
+		{name: "empty", query: " ; ", expectedError: "empty"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			statement, err := validateSQL(tc.query, orDefaultString(tc.dialect, sqlDialectPostgres))
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("Expected error containing %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if statement != tc.expectedStatement {
+				t.Errorf("Expected statement %q, got %q", tc.expectedStatement, statement)
+			}
+		})
+	}
+}
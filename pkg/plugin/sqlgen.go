@@ -0,0 +1,239 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxPromptTables bounds the tables listed in the prompt, and
+	// maxPromptColumns the columns listed per table.
+	maxPromptTables  = 20
+	maxPromptColumns = 40
+
+	// maxSchemaColumns bounds the columns read from the information schema.
+	maxSchemaColumns = 5000
+
+	// dryRunLimit is the LIMIT a generated query is dry-run with.
+	dryRunLimit = 10
+
+	// maxDryRunError bounds the database error sent back to the model.
+	maxDryRunError = 500
+)
+
+// sqlSchemaQueries read the columns of the tables a data source's user can
+// see. Columns are aliased since MySQL names them in upper case.
+var sqlSchemaQueries = map[string]string{
+	sqlDialectPostgres: `SELECT table_schema AS table_schema, table_name AS table_name, column_name AS column_name, data_type AS data_type
+FROM information_schema.columns
+WHERE table_schema NOT IN ('pg_catalog', 'information_schema')
+ORDER BY table_schema, table_name, ordinal_position
+LIMIT ` + fmt.Sprint(maxSchemaColumns),
+	sqlDialectMySQL: `SELECT table_schema AS table_schema, table_name AS table_name, column_name AS column_name, data_type AS data_type
+FROM information_schema.columns
+WHERE table_schema = DATABASE()
+ORDER BY table_name, ordinal_position
+LIMIT ` + fmt.Sprint(maxSchemaColumns),
+}
+
+var sqlDialectNames = map[string]string{
+	sqlDialectPostgres: "PostgreSQL",
+	sqlDialectMySQL:    "MySQL",
+}
+
+const generateSQLInstructions = `You write SQL queries for a %s database that Grafana queries.
+Use only the tables and columns listed below; they are the ones of the database that match the question best.
+Write a single SELECT statement, optionally with a WITH clause. Never write statements that modify data or the schema.
+For time series, use Grafana's macros: filter with $__timeFilter(column), group with $__timeGroupAlias(column, $__interval), name the time column "time" and order by it.`
+
+const generateSQLAnswer = `Answer with a JSON object with the keys "query" (the SQL statement) and "explanation" (one to three sentences on what it computes and how to read the result).`
+
+// sqlTable describes a table of a SQL data source for the prompt.
+type sqlTable struct {
+	Name    string      `json:"name"`
+	Columns []sqlColumn `json:"columns"`
+}
+
+type sqlColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// sqlDryRun is the result of running a generated query with a LIMIT.
+type sqlDryRun struct {
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+}
+
+// sqlCatalog is what the prompt is told about a database's tables. It
+// validates generated queries and, if dryRun is set, runs them.
+type sqlCatalog struct {
+	client     *grafanaClient
+	datasource dataSourceRef
+	dialect    string
+	dryRun     bool
+
+	// Tables are the tables most relevant to the question.
+	Tables     []sqlTable
+	tableCount int
+
+	// result is the dry run of the last valid query.
+	result *sqlDryRun
+}
+
+// sqlDialect returns the dialect of a SQL data source type, or "" for other
+// data sources.
+func sqlDialect(dsType string) string {
+	switch {
+	case strings.Contains(dsType, "postgres"):
+		return sqlDialectPostgres
+	case strings.Contains(dsType, "mysql"):
+		return sqlDialectMySQL
+	default:
+		return ""
+	}
+}
+
+// sqlQuery is the model of a raw SQL query of Grafana's SQL data sources.
+func sqlQuery(refID string, ref dataSourceRef, rawSQL string) map[string]any {
+	return map[string]any{
+		"refId":      refID,
+		"datasource": ref,
+		"rawSql":     rawSQL,
+		"rawQuery":   true,
+		"editorMode": "code",
+		"format":     "table",
+	}
+}
+
+// loadSQLCatalog reads the schema of a SQL data source through Grafana, with
+// the caller's permissions, and keeps the tables most relevant to the
+// question.
+func loadSQLCatalog(ctx context.Context, client *grafanaClient, ref dataSourceRef, question string, dryRun bool) (*sqlCatalog, error) {
+	ctx, span := startSpan(ctx, "generate_query.load_schema")
+	defer span.End()
+
+	catalog := &sqlCatalog{client: client, datasource: ref, dialect: sqlDialect(ref.Type), dryRun: dryRun}
+	resp, err := queryData(ctx, client, dsQueryRequest{
+		Queries: []map[string]any{sqlQuery("schema", ref, sqlSchemaQueries[catalog.dialect])},
+		From:    "now-1h",
+		To:      "now",
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := resp.Responses["schema"]
+	if result.Error != nil {
+		return nil, fmt.Errorf("schema query: %w", result.Error)
+	}
+
+	tables := make(map[string]*sqlTable)
+	var names []string
+	for _, frame := range result.Frames {
+		if len(frame.Fields) < 4 {
+			continue
+		}
+		for i := range frame.Rows() {
+			schema, table := frameString(frame, 0, i), frameString(frame, 1, i)
+			name := table
+			if catalog.dialect == sqlDialectPostgres && schema != "public" {
+				name = schema + "." + table
+			}
+			t, ok := tables[name]
+			if !ok {
+				t = &sqlTable{Name: name}
+				tables[name] = t
+				names = append(names, name)
+			}
+			if len(t.Columns) < maxPromptColumns {
+				t.Columns = append(t.Columns, sqlColumn{Name: frameString(frame, 2, i), Type: frameString(frame, 3, i)})
+			}
+		}
+	}
+	catalog.tableCount = len(names)
+	span.SetAttributes(attribute.Int("generate_query.tables", len(names)))
+
+	for _, name := range rankNames(names, question, maxPromptTables) {
+		catalog.Tables = append(catalog.Tables, *tables[name])
+	}
+	return catalog, nil
+}
+
+// frameString returns the value of a frame's cell as a string, "" for null.
+func frameString(frame *data.Frame, field, row int) string {
+	value, ok := frame.Fields[field].ConcreteAt(row)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func (c *sqlCatalog) instructions() string {
+	return c.grounding() + generateSQLAnswer
+}
+
+func (c *sqlCatalog) grounding() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, generateSQLInstructions, sqlDialectNames[c.dialect])
+	fmt.Fprintf(&b, "\n\nTables (%d of %d):\n", len(c.Tables), c.tableCount)
+	for _, t := range c.Tables {
+		columns := make([]string, len(t.Columns))
+		for i, col := range t.Columns {
+			columns[i] = col.Name + " " + col.Type
+		}
+		fmt.Fprintf(&b, "- %s: %s\n", t.Name, strings.Join(columns, ", "))
+	}
+	return b.String()
+}
+
+// validate checks that query is a single read-only statement and, with
+// dryRun, runs it with a LIMIT over the last hour. Errors of the database
+// are returned like validation errors, so the model can fix the query.
+func (c *sqlCatalog) validate(ctx context.Context, query string) (string, error) {
+	statement, err := validateSQL(query, c.dialect)
+	if err != nil || !c.dryRun {
+		return statement, err
+	}
+
+	ctx, span := startSpan(ctx, "generate_query.dry_run")
+	defer span.End()
+
+	// The statement is wrapped on lines of its own, so that a trailing line
+	// comment doesn't swallow the LIMIT.
+	wrapped := fmt.Sprintf("SELECT * FROM (\n%s\n) AS dry_run LIMIT %d", statement, dryRunLimit)
+	resp, err := queryData(ctx, c.client, dsQueryRequest{
+		Queries: []map[string]any{sqlQuery("dry_run", c.datasource, wrapped)},
+		From:    "now-1h",
+		To:      "now",
+	})
+	if err != nil {
+		span.RecordError(err)
+		return "", grafanaRequestError(err, "Data source")
+	}
+	result := resp.Responses["dry_run"]
+	if result.Error != nil {
+		return "", fmt.Errorf("running the query failed: %s", truncate(result.Error.Error(), maxDryRunError))
+	}
+
+	c.result = &sqlDryRun{Columns: []string{}}
+	for _, frame := range result.Frames {
+		for _, field := range frame.Fields {
+			c.result.Columns = append(c.result.Columns, field.Name)
+		}
+		c.result.Rows += frame.Rows()
+	}
+	span.SetAttributes(attribute.Int("generate_query.rows", c.result.Rows))
+	return statement, nil
+}
+
+func (c *sqlCatalog) fields() map[string]any {
+	fields := map[string]any{"language": queryLanguageSQL, "dialect": c.dialect, "tables": c.Tables}
+	if c.result != nil {
+		fields["dryRun"] = c.result
+	}
+	return fields
+}
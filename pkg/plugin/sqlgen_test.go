@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// newTestSQLGrafana serves the Postgres data source "pg" and the Loki data
+// source "loki". Queries of "pg" return the schema or, for dry runs, a
+// table, unless they use the column "total", which doesn't exist.
+func newTestSQLGrafana(t *testing.T, queries *[]string) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/datasources/uid/pg":
+			w.Write([]byte(`{"uid":"pg","name":"Shop","type":"grafana-postgresql-datasource"}`))
+		case "/api/datasources/uid/loki":
+			w.Write([]byte(`{"uid":"loki","name":"Logs","type":"loki"}`))
+		case "/api/ds/query":
+			var req dsQueryRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			query := req.Queries[0]
+			refID, rawSQL := query["refId"].(string), query["rawSql"].(string)
+			mu.Lock()
+			*queries = append(*queries, rawSQL)
+			mu.Unlock()
+
+			resp := backend.NewQueryDataResponse()
+			switch {
+			case refID == "schema":
+				resp.Responses[refID] = backend.DataResponse{Frames: data.Frames{data.NewFrame("",
+					data.NewField("table_schema", nil, []string{"public", "public", "public", "billing", "public", "public"}),
+					data.NewField("table_name", nil, []string{"orders", "orders", "orders", "invoices", "users", "users"}),
+					data.NewField("column_name", nil, []string{"id", "created_at", "amount", "id", "id", "email"}),
+					data.NewField("data_type", nil, []string{"integer", "timestamp with time zone", "numeric", "integer", "integer", "text"}),
+				)}}
+			case strings.Contains(rawSQL, "total"):
+				resp.Responses[refID] = backend.ErrDataResponse(backend.StatusBadRequest, `pq: column "total" does not exist`)
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				start := time.UnixMilli(1700000000000)
+				resp.Responses[refID] = backend.DataResponse{Frames: data.Frames{data.NewFrame("",
+					data.NewField("time", nil, []time.Time{start, start.Add(time.Minute), start.Add(2 * time.Minute)}),
+					data.NewField("amount", nil, []float64{10, 20, 30}),
+				)}}
+			}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHandleGenerateSQLQuery(t *testing.T) {
+	const validQuery = "SELECT $__timeGroupAlias(created_at, $__interval), sum(amount) AS amount FROM orders WHERE $__timeFilter(created_at) GROUP BY 1 ORDER BY 1"
+
+	testCases := []struct {
+		name             string
+		body             string
+		answers          []string
+		expectedStatus   int
+		expectedAttempts int
+		expectedRetry    string
+		expectedDryRuns  int
+	}{
+		{name: "valid", body: `{"question":"Order amount over time","datasourceUid":"pg"}`,
+			answers:        []string{`{"query":"` + validQuery + `;","explanation":"Order amount per interval."}`},
+			expectedStatus: http.StatusOK, expectedAttempts: 1},
+		{name: "dry run", body: `{"question":"Order amount over time","datasourceUid":"pg","dryRun":true}`,
+			answers:        []string{`{"query":"` + validQuery + `","explanation":"Order amount per interval."}`},
+			expectedStatus: http.StatusOK, expectedAttempts: 1, expectedDryRuns: 1},
+		{name: "retry with database error", body: `{"question":"Order amount over time","datasourceUid":"pg","dryRun":true}`,
+			answers: []string{
+				`{"query":"SELECT sum(total) FROM orders","explanation":"Order amount."}`,
+				`{"query":"` + validQuery + `","explanation":"Order amount per interval."}`,
+			},
+			expectedStatus: http.StatusOK, expectedAttempts: 2, expectedRetry: `pq: column "total" does not exist`, expectedDryRuns: 2},
+		{name: "retry with write", body: `{"question":"Order amount over time","datasourceUid":"pg","dryRun":true}`,
+			answers: []string{
+				`{"query":"DELETE FROM orders","explanation":"Deletes orders."}`,
+				`{"query":"` + validQuery + `","explanation":"Order amount per interval."}`,
+			},
+			expectedStatus: http.StatusOK, expectedAttempts: 2, expectedRetry: "must be a SELECT statement", expectedDryRuns: 1},
+		{name: "multiple statements", body: `{"question":"Orders","datasourceUid":"pg","dryRun":true}`,
+			answers:        []string{`{"query":"SELECT 1; DROP TABLE orders","explanation":"Orders."}`},
+			expectedStatus: http.StatusUnprocessableEntity},
+		{name: "escape string with write", body: `{"question":"Orders","datasourceUid":"pg","dryRun":true}`,
+			answers:        []string{`{"query":"SELECT E'\\'';DELETE FROM t;--'","explanation":"Orders."}`},
+			expectedStatus: http.StatusUnprocessableEntity},
+		{name: "escape string with unsafe function", body: `{"question":"Orders","datasourceUid":"pg","dryRun":true}`,
+			answers:        []string{`{"query":"SELECT E'\\'' , pg_sleep(10) --'","explanation":"Orders."}`},
+			expectedStatus: http.StatusUnprocessableEntity},
+		{name: "unsupported data source", body: `{"question":"Errors","datasourceUid":"loki"}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var queries []string
+			grafana := newTestSQLGrafana(t, &queries)
+			var sent []groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req groqChatRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				sent = append(sent, req)
+				answer := tc.answers[min(len(sent), len(tc.answers))-1]
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: answer}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest("POST", "/generate-query", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleGenerateQuery(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			for _, query := range queries {
+				if strings.Contains(query, "DELETE") || strings.Contains(query, "DROP") || strings.Contains(query, "pg_sleep") {
+					t.Errorf("Expected invalid queries not to run, ran %q", query)
+				}
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			system := sent[0].Messages[0].Content
+			if !strings.Contains(system, "PostgreSQL") || !strings.Contains(system, "- orders: id integer, created_at timestamp with time zone, amount numeric") ||
+				!strings.Contains(system, "- billing.invoices: id integer") {
+				t.Errorf("Expected the schema in the prompt, got %q", system)
+			}
+			if len(queries)-1 != tc.expectedDryRuns {
+				t.Errorf("Expected %d dry runs, got %v", tc.expectedDryRuns, queries)
+			}
+			if tc.expectedDryRuns > 0 && !strings.HasSuffix(queries[len(queries)-1], "\n) AS dry_run LIMIT 10") {
+				t.Errorf("Expected the dry run to be limited, got %q", queries[len(queries)-1])
+			}
+			if tc.expectedRetry != "" {
+				retry := sent[1].Messages[len(sent[1].Messages)-1]
+				if !strings.Contains(retry.Content, tc.expectedRetry) {
+					t.Errorf("Expected the retry to carry the error, got %+v", retry)
+				}
+			}
+
+			var resp struct {
+				Query    string     `json:"query"`
+				Language string     `json:"language"`
+				Attempts int        `json:"attempts"`
+				Tables   []sqlTable `json:"tables"`
+				DryRun   *sqlDryRun `json:"dryRun"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Query != validQuery || resp.Language != "sql" || resp.Attempts != tc.expectedAttempts || len(resp.Tables) != 3 {
+				t.Errorf("Unexpected response: %+v", resp)
+			}
+			if (resp.DryRun != nil) != (tc.expectedDryRuns > 0) || resp.DryRun != nil && (resp.DryRun.Rows != 3 || strings.Join(resp.DryRun.Columns, ",") != "time,amount") {
+				t.Errorf("Unexpected dry run: %+v", resp.DryRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const summarizeDashboardInstructions = `You write the summary of a Grafana dashboard for a weekly operations review.
+Cover every panel below. Answer with a JSON object with these keys:
+- "headline": one sentence on the overall state in the time range
+- "keyMetrics": an array of up to six objects with "name", "value" (with unit) and "panelId"
+- "concerns": an array of objects with "severity" ("high", "medium" or "low"), "description" and "panelIds"; empty if nothing needs attention
+- "sections": an array of objects with "title", "summary" (two to four sentences) and "panelIds", grouping related panels; every panel belongs to one section
+Refer to panels by their numeric ID. Base everything on the panel data below. Don't invent values.`
+
+// Severities of a concern, from most to least severe.
+var concernSeverities = []string{"high", "medium", "low"}
+
+// summarizeDashboardRequest is the body accepted by /summarize-dashboard.
+// Times are Unix milliseconds.
+type summarizeDashboardRequest struct {
+	Model        string `json:"model"`
+	DashboardUID string `json:"dashboardUid"`
+	From         int64  `json:"from"`
+	To           int64  `json:"to"`
+}
+
+// dashboardSummary is the structured summary of a dashboard.
+type dashboardSummary struct {
+	Headline   string           `json:"headline"`
+	KeyMetrics []keyMetric      `json:"keyMetrics"`
+	Concerns   []summaryConcern `json:"concerns"`
+	Sections   []summarySection `json:"sections"`
+
+	// Panels are the panels referenced by the summary, with links.
+	Panels []panelRef `json:"panels"`
+}
+
+type keyMetric struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	PanelID int64  `json:"panelId,omitempty"`
+}
+
+type summaryConcern struct {
+	Severity    string  `json:"severity"`
+	Description string  `json:"description"`
+	PanelIDs    []int64 `json:"panelIds,omitempty"`
+}
+
+type summarySection struct {
+	Title    string  `json:"title"`
+	Summary  string  `json:"summary"`
+	PanelIDs []int64 `json:"panelIds,omitempty"`
+}
+
+// panelRef links to a panel in the summarized time range.
+type panelRef struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// handleSummarizeDashboard writes a summary of all panels of a dashboard,
+// returned as JSON and rendered as Markdown.
+func (ds *Datasource) handleSummarizeDashboard(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "summarize.handle")
+	defer span.End()
+
+	apiKey, reqErr := ds.checkLLMRequest(ctx, r)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	var req summarizeDashboardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	req.Model = orDefaultString(req.Model, defaultChatModel)
+	if !validModel(req.Model) {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidModel, message: "Invalid model name"})
+		return
+	}
+	contextReq := contextRequest{DashboardUID: req.DashboardUID, From: req.From, To: req.To}
+	if reqErr := contextReq.validate(); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	span.SetAttributes(attribute.String(attrModel, req.Model))
+
+	dc, reqErr := ds.loadDashboardContext(ctx, r, contextReq)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	dc.Instructions = summarizeDashboardInstructions
+
+	question := []chatMessage{{Role: "user", Content: fmt.Sprintf("Summarize the dashboard %q.", dc.Title)}}
+	messages, budget, reqErr := ds.fitContextWindow(ctx, req.Model, dc, question)
+	if reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+
+	var summary dashboardSummary
+	chatReq := &chatRequest{Model: req.Model, Messages: messages, DashboardUID: req.DashboardUID}
+	if _, reqErr := ds.completeJSON(ctx, apiKey, "summarize-dashboard", chatReq, &summary); reqErr != nil {
+		writeRequestError(w, span, reqErr)
+		return
+	}
+	summary.resolvePanels(dc, appURL(ctx))
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Summarized dashboard", "dashboard", req.DashboardUID, "panels", len(dc.Panels))
+
+	writeJSON(w, map[string]any{
+		"dashboardUid": dc.UID,
+		"title":        dc.Title,
+		"from":         dc.From,
+		"to":           dc.To,
+		"summary":      summary,
+		"markdown":     summary.markdown(dc),
+		"budget":       budget,
+	})
+}
+
+// resolvePanels drops references to panels that aren't in the context, as
+// the model may invent them, orders concerns by severity and links the
+// referenced panels.
+func (s *dashboardSummary) resolvePanels(dc *dashboardContext, baseURL string) {
+	titles := make(map[int64]string, len(dc.Panels))
+	for _, panel := range dc.Panels {
+		titles[panel.ID] = panel.Title
+	}
+	var referenced []int64
+	known := func(ids []int64) []int64 {
+		result := []int64{}
+		for _, id := range ids {
+			if _, ok := titles[id]; ok && !slices.Contains(result, id) {
+				result = append(result, id)
+				if !slices.Contains(referenced, id) {
+					referenced = append(referenced, id)
+				}
+			}
+		}
+		return result
+	}
+
+	for i := range s.KeyMetrics {
+		if ids := known([]int64{s.KeyMetrics[i].PanelID}); len(ids) == 0 {
+			s.KeyMetrics[i].PanelID = 0
+		}
+	}
+	for i := range s.Concerns {
+		s.Concerns[i].PanelIDs = known(s.Concerns[i].PanelIDs)
+		if !slices.Contains(concernSeverities, s.Concerns[i].Severity) {
+			s.Concerns[i].Severity = "medium"
+		}
+	}
+	slices.SortStableFunc(s.Concerns, func(a, b summaryConcern) int {
+		return slices.Index(concernSeverities, a.Severity) - slices.Index(concernSeverities, b.Severity)
+	})
+	for i := range s.Sections {
+		s.Sections[i].PanelIDs = known(s.Sections[i].PanelIDs)
+	}
+
+	slices.Sort(referenced)
+	s.Panels = make([]panelRef, len(referenced))
+	for i, id := range referenced {
+		s.Panels[i] = panelRef{ID: id, Title: titles[id], URL: panelURL(baseURL, dc, id)}
+	}
+}
+
+// markdown renders the summary for pasting into a document.
+func (s *dashboardSummary) markdown(dc *dashboardContext) string {
+	refs := make(map[int64]panelRef, len(s.Panels))
+	for _, ref := range s.Panels {
+		refs[ref.ID] = ref
+	}
+	links := func(ids []int64) string {
+		parts := make([]string, 0, len(ids))
+		for _, id := range ids {
+			parts = append(parts, fmt.Sprintf("[%s](%s)", markdownEscape(refs[id].Title), refs[id].URL))
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", markdownEscape(dc.Title))
+	fmt.Fprintf(&b, "_%s to %s_\n\n", dc.From.Format(time.RFC3339), dc.To.Format(time.RFC3339))
+	if s.Headline != "" {
+		fmt.Fprintf(&b, "**%s**\n\n", s.Headline)
+	}
+
+	if len(s.KeyMetrics) > 0 {
+		b.WriteString("## Key metrics\n\n")
+		for _, m := range s.KeyMetrics {
+			fmt.Fprintf(&b, "- **%s**: %s", m.Name, m.Value)
+			if m.PanelID != 0 {
+				fmt.Fprintf(&b, " (%s)", links([]int64{m.PanelID}))
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("## Concerns\n\n")
+	if len(s.Concerns) == 0 {
+		b.WriteString("None.\n\n")
+	}
+	for _, c := range s.Concerns {
+		fmt.Fprintf(&b, "- **%s**: %s", strings.ToUpper(c.Severity), c.Description)
+		if len(c.PanelIDs) > 0 {
+			fmt.Fprintf(&b, " (%s)", links(c.PanelIDs))
+		}
+		b.WriteString("\n")
+	}
+	if len(s.Concerns) > 0 {
+		b.WriteString("\n")
+	}
+
+	for _, section := range s.Sections {
+		fmt.Fprintf(&b, "## %s\n\n%s\n", section.Title, section.Summary)
+		if len(section.PanelIDs) > 0 {
+			fmt.Fprintf(&b, "\nPanels: %s\n", links(section.PanelIDs))
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
+
+// markdownEscape escapes the characters of text that would be read as
+// Markdown link or emphasis syntax.
+func markdownEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "*", `\*`, "_", `\_`).Replace(text)
+}
+
+// panelURL links to a panel of a dashboard in the context's time range.
+// Without a base URL the link is relative to Grafana's root.
+func panelURL(baseURL string, dc *dashboardContext, panelID int64) string {
+	query := url.Values{}
+	query.Set("viewPanel", fmt.Sprint(panelID))
+	query.Set("from", fmt.Sprint(dc.From.UnixMilli()))
+	query.Set("to", fmt.Sprint(dc.To.UnixMilli()))
+	return strings.TrimSuffix(baseURL, "/") + "/d/" + url.PathEscape(dc.UID) + "?" + query.Encode()
+}
+
+// appURL returns the URL users reach Grafana at, which may differ from the
+// URL the backend calls it at.
+func appURL(ctx context.Context) string {
+	if appURL, err := backend.GrafanaConfigFromContext(ctx).AppURL(); err == nil && appURL != "" {
+		return appURL
+	}
+	return os.Getenv("GF_APP_URL")
+}
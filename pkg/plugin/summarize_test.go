@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestHandleSummarizeDashboard(t *testing.T) {
+	grafana := newTestGrafana(t, nil)
+	answer := `{"headline":"Traffic is steady.",
+		"keyMetrics":[{"name":"Request rate","value":"4 req/s","panelId":2},{"name":"Made up","value":"1","panelId":42}],
+		"concerns":[{"severity":"low","description":"Slow queries persist.","panelIds":[4]},{"severity":"high","description":"Errors rising.","panelIds":[2,2,99]}],
+		"sections":[{"title":"Traffic","summary":"Requests are flat.","panelIds":[2]},{"title":"Database","summary":"Queries are slow.","panelIds":[4]}]}`
+
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		answer         string
+		expectedStatus int
+	}{
+		{name: "valid", method: "POST", body: `{"dashboardUid":"dash-1","from":1700000000000,"to":1700003600000}`, answer: answer, expectedStatus: http.StatusOK},
+		{name: "wrong method", method: "GET", expectedStatus: http.StatusMethodNotAllowed},
+		{name: "missing dashboard", method: "POST", body: `{"from":1,"to":2}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid model", method: "POST", body: `{"model":"bad model","dashboardUid":"dash-1","from":1,"to":2}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid answer", method: "POST", body: `{"dashboardUid":"dash-1","from":1,"to":2}`, answer: "All good.", expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var sent groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: tc.answer}}}})
+			}))
+			defer groq.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+				config:   pluginConfig{GrafanaURL: grafana.URL},
+				groqURL:  groq.URL,
+			}
+			req := httptest.NewRequest(tc.method, "/summarize-dashboard", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ds.handleSummarizeDashboard(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			system := sent.Messages[0].Content
+			if sent.ResponseFormat == nil || !strings.Contains(system, `"keyMetrics"`) || !strings.Contains(system, "Request rate") || !strings.Contains(system, "Slow queries") {
+				t.Errorf("Expected a JSON mode request covering all panels, got %+v", sent)
+			}
+
+			var resp struct {
+				Summary  dashboardSummary `json:"summary"`
+				Markdown string           `json:"markdown"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			summary := resp.Summary
+			if summary.KeyMetrics[1].PanelID != 0 || len(summary.Concerns[0].PanelIDs) != 1 || summary.Concerns[0].Severity != "high" {
+				t.Errorf("Expected unknown panel references to be dropped and concerns ordered, got %+v", summary)
+			}
+			if len(summary.Panels) != 2 || summary.Panels[0].URL != "/d/dash-1?from=1700000000000&to=1700003600000&viewPanel=2" {
+				t.Errorf("Unexpected panel references: %+v", summary.Panels)
+			}
+			for _, want := range []string{
+				"**Traffic is steady.**",
+				"## Key metrics\n\n- **Request rate**: 4 req/s ([Request rate](/d/dash-1?from=1700000000000&to=1700003600000&viewPanel=2))\n- **Made up**: 1\n",
+				"- **HIGH**: Errors rising.",
+				"## Database\n\nQueries are slow.\n\nPanels: [Slow queries](",
+			} {
+				if !strings.Contains(resp.Markdown, want) {
+					t.Errorf("Expected Markdown to contain %q:\n%s", want, resp.Markdown)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Detail levels of the panel data in the prompt.
+const (
+	// detailMinimal reports count, last value, min, max and mean.
+	detailMinimal = "minimal"
+	// detailStandard adds first value, percentiles, trend and breakdowns.
+	detailStandard = "standard"
+	// detailFull adds standard deviation and change points.
+	detailFull = "full"
+)
+
+const (
+	// defaultSummaryTopN is how many label values a breakdown lists.
+	defaultSummaryTopN = 5
+
+	// maxChangePoints bounds the change points reported per series.
+	maxChangePoints = 3
+
+	// minChangePointSegment is the fewest points on either side of a change
+	// point.
+	minChangePointSegment = 5
+
+	// changePointThreshold is the score, roughly a t-statistic of the mean
+	// shift, a change point must reach.
+	changePointThreshold = 4
+)
+
+// seriesSummary describes a numeric field of a frame.
+type seriesSummary struct {
+	Name         string        `json:"name"`
+	Labels       data.Labels   `json:"labels,omitempty"`
+	Count        int           `json:"count"`
+	Nulls        int           `json:"nulls,omitempty"`
+	Min          float64       `json:"min"`
+	Max          float64       `json:"max"`
+	Mean         float64       `json:"mean"`
+	StdDev       float64       `json:"stdDev,omitempty"`
+	P50          float64       `json:"p50,omitempty"`
+	P90          float64       `json:"p90,omitempty"`
+	P99          float64       `json:"p99,omitempty"`
+	First        float64       `json:"first"`
+	Last         float64       `json:"last"`
+	FirstTime    *time.Time    `json:"firstTime,omitempty"`
+	LastTime     *time.Time    `json:"lastTime,omitempty"`
+	TrendPerHour *float64      `json:"trendPerHour,omitempty"`
+	ChangePoints []changePoint `json:"changePoints,omitempty"`
+	Points       []seriesPoint `json:"points,omitempty"`
+}
+
+// changePoint is where the mean of a series shifts.
+type changePoint struct {
+	Time   time.Time `json:"time"`
+	Before float64   `json:"before"`
+	After  float64   `json:"after"`
+
+	// index is the position of the first value after the shift.
+	index int
+	score float64
+}
+
+// labelBreakdown lists the label values with the largest means, e.g. the
+// pods with the highest CPU usage.
+type labelBreakdown struct {
+	Label  string       `json:"label"`
+	Field  string       `json:"field,omitempty"`
+	Values []labelShare `json:"values"`
+}
+
+type labelShare struct {
+	Value string  `json:"value"`
+	Mean  float64 `json:"mean"`
+
+	// Share is the fraction of the total, if all values are non-negative.
+	Share float64 `json:"share,omitempty"`
+}
+
+func validDetail(detail string) bool {
+	return detail == detailMinimal || detail == detailStandard || detail == detailFull
+}
+
+// summarizePanel summarizes the series of a panel and breaks them down by
+// label for the prompt, which includes the summaries instead of raw values.
+// The largest series are kept if there are more than maxContextSeries.
+// Trace frames are left to summarizeTraces.
+func summarizePanel(panel *panelContext, opts summaryConfig) {
+	var series []seriesSummary
+	for _, frame := range panel.Frames {
+		if isTraceFrame(frame) {
+			continue
+		}
+		timeField := firstTimeField(frame)
+		for _, field := range frame.Fields {
+			if field == timeField || !field.Type().Numeric() {
+				continue
+			}
+			values, times, nulls := fieldValues(field, timeField)
+			if len(values) == 0 {
+				continue
+			}
+			s := summarizeSeries(values, times, opts)
+			s.Name, s.Labels, s.Nulls = seriesName(frame, field), field.Labels, nulls
+			series = append(series, s)
+		}
+
+		if timeField == nil && opts.Detail != detailMinimal {
+			panel.Breakdowns = append(panel.Breakdowns, tableBreakdowns(frame, opts.TopN)...)
+		}
+	}
+	if opts.Detail != detailMinimal {
+		panel.Breakdowns = append(panel.Breakdowns, seriesBreakdowns(series, opts.TopN)...)
+	}
+
+	panel.SeriesCount = len(series)
+	if len(series) > maxContextSeries {
+		sort.SliceStable(series, func(i, j int) bool { return series[i].Max > series[j].Max })
+		series = series[:maxContextSeries]
+	}
+	panel.Summaries = series
+}
+
+// summarizeSeries computes the statistics of the values of a series, and
+// downsamples it if requested. Times are nil for fields of a table.
+func summarizeSeries(values []float64, times []time.Time, opts summaryConfig) seriesSummary {
+	s := seriesSummary{
+		Count: len(values),
+		Min:   math.Inf(1),
+		Max:   math.Inf(-1),
+		First: values[0],
+		Last:  values[len(values)-1],
+	}
+	var sum float64
+	for _, v := range values {
+		s.Min = math.Min(s.Min, v)
+		s.Max = math.Max(s.Max, v)
+		sum += v
+	}
+	s.Mean = sum / float64(len(values))
+
+	if times != nil {
+		s.FirstTime, s.LastTime = &times[0], &times[len(times)-1]
+		if opts.Downsample != "" && opts.Downsample != downsampleNone {
+			s.Points = downsample(values, times, opts.Downsample, opts.Points)
+		}
+	}
+	if opts.Detail == detailMinimal {
+		return s
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	s.P50, s.P90, s.P99 = percentile(sorted, 0.5), percentile(sorted, 0.9), percentile(sorted, 0.99)
+	if times != nil && len(values) > 1 {
+		slope := trendPerHour(values, times)
+		s.TrendPerHour = &slope
+	}
+	if opts.Detail == detailStandard {
+		return s
+	}
+
+	var squares float64
+	for _, v := range values {
+		squares += (v - s.Mean) * (v - s.Mean)
+	}
+	s.StdDev = math.Sqrt(squares / float64(len(values)))
+	if times != nil {
+		s.ChangePoints = changePoints(values, times)
+	}
+	return s
+}
+
+// firstTimeField returns the time field of a frame, or nil for a table.
+func firstTimeField(frame *data.Frame) *data.Field {
+	for _, field := range frame.Fields {
+		if field.Type().Time() {
+			return field
+		}
+	}
+	return nil
+}
+
+// fieldValues returns the finite values of a numeric field and, if there is
+// a time field, their times. Null, NaN and infinite values are counted as
+// nulls.
+func fieldValues(field, timeField *data.Field) ([]float64, []time.Time, int) {
+	var values []float64
+	var times []time.Time
+	nulls := 0
+	for i := 0; i < field.Len(); i++ {
+		v, err := field.NullableFloatAt(i)
+		if err != nil || v == nil || math.IsNaN(*v) || math.IsInf(*v, 0) {
+			nulls++
+			continue
+		}
+		if timeField != nil {
+			t, ok := timeField.ConcreteAt(i)
+			if !ok {
+				nulls++
+				continue
+			}
+			times = append(times, t.(time.Time))
+		}
+		values = append(values, *v)
+	}
+	return values, times, nulls
+}
+
+// percentile interpolates the p-th quantile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
+}
+
+// trendPerHour is the slope of the least squares line through the values,
+// in units per hour.
+func trendPerHour(values []float64, times []time.Time) float64 {
+	n := float64(len(values))
+	var sumX, sumY, sumXY, sumXX float64
+	for i, v := range values {
+		x := times[i].Sub(times[0]).Hours()
+		sumX += x
+		sumY += v
+		sumXY += x * v
+		sumXX += x * x
+	}
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denom
+}
+
+// changePoints finds shifts of the mean by binary segmentation and returns the
+// strongest ones in the order of the series.
+func changePoints(values []float64, times []time.Time) []changePoint {
+	var points []changePoint
+	segmentChangePoints(values, times, 0, &points)
+
+	sort.Slice(points, func(i, j int) bool { return points[i].score > points[j].score })
+	if len(points) > maxChangePoints {
+		points = points[:maxChangePoints]
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].index < points[j].index })
+	return points
+}
+
+// segmentChangePoints adds the change points of values, which start at
+// offset in the series, to points.
+func segmentChangePoints(values []float64, times []time.Time, offset int, points *[]changePoint) {
+	n := len(values)
+	if n < 2*minChangePointSegment {
+		return
+	}
+
+	prefix := make([]float64, n+1)
+	for i, v := range values {
+		prefix[i+1] = prefix[i] + v
+	}
+	mean := prefix[n] / float64(n)
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	stdDev := math.Sqrt(squares / float64(n))
+	if stdDev == 0 {
+		return
+	}
+
+	best, bestScore := -1, 0.0
+	for i := minChangePointSegment; i <= n-minChangePointSegment; i++ {
+		before := prefix[i] / float64(i)
+		after := (prefix[n] - prefix[i]) / float64(n-i)
+		score := math.Abs(after-before) / stdDev * math.Sqrt(float64(i*(n-i))/float64(n))
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if bestScore < changePointThreshold {
+		return
+	}
+
+	*points = append(*points, changePoint{
+		Time:   times[best],
+		Before: prefix[best] / float64(best),
+		After:  (prefix[n] - prefix[best]) / float64(n-best),
+		index:  offset + best,
+		score:  bestScore,
+	})
+	segmentChangePoints(values[:best], times[:best], offset, points)
+	segmentChangePoints(values[best:], times[best:], offset+best, points)
+}
+
+// seriesBreakdowns ranks the values of each label that differs between
+// series by the mean of their series.
+func seriesBreakdowns(series []seriesSummary, topN int) []labelBreakdown {
+	if len(series) < 2 {
+		return nil
+	}
+
+	byLabel := make(map[string]map[string][]float64)
+	for _, s := range series {
+		for label, value := range s.Labels {
+			if byLabel[label] == nil {
+				byLabel[label] = make(map[string][]float64)
+			}
+			byLabel[label][value] = append(byLabel[label][value], s.Mean)
+		}
+	}
+
+	labels := make([]string, 0, len(byLabel))
+	for label, values := range byLabel {
+		if len(values) > 1 {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	var breakdowns []labelBreakdown
+	for _, label := range labels {
+		means := make(map[string]float64)
+		for value, seriesMeans := range byLabel[label] {
+			for _, m := range seriesMeans {
+				means[value] += m
+			}
+		}
+		breakdowns = append(breakdowns, labelBreakdown{Label: label, Values: topShares(means, topN)})
+	}
+	return breakdowns
+}
+
+// tableBreakdowns ranks the rows of a table by its first numeric field, once
+// for each string field.
+func tableBreakdowns(frame *data.Frame, topN int) []labelBreakdown {
+	var numeric *data.Field
+	for _, field := range frame.Fields {
+		if field.Type().Numeric() {
+			numeric = field
+			break
+		}
+	}
+	if numeric == nil {
+		return nil
+	}
+
+	var breakdowns []labelBreakdown
+	for _, field := range frame.Fields {
+		if field.Type() != data.FieldTypeString && field.Type() != data.FieldTypeNullableString {
+			continue
+		}
+		values := make(map[string]float64)
+		for i := 0; i < frame.Rows(); i++ {
+			key, ok := field.ConcreteAt(i)
+			v, err := numeric.NullableFloatAt(i)
+			if !ok || err != nil || v == nil || math.IsNaN(*v) || math.IsInf(*v, 0) {
+				continue
+			}
+			values[fmt.Sprint(key)] += *v
+		}
+		if len(values) > 1 {
+			breakdowns = append(breakdowns, labelBreakdown{Label: field.Name, Field: numeric.Name, Values: topShares(values, topN)})
+		}
+	}
+	return breakdowns
+}
+
+// topShares returns the topN largest values with their share of the total.
+func topShares(values map[string]float64, topN int) []labelShare {
+	shares := make([]labelShare, 0, len(values))
+	var total float64
+	negative := false
+	for value, mean := range values {
+		shares = append(shares, labelShare{Value: value, Mean: mean})
+		total += mean
+		negative = negative || mean < 0
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Mean != shares[j].Mean {
+			return shares[i].Mean > shares[j].Mean
+		}
+		return shares[i].Value < shares[j].Value
+	})
+	if len(shares) > topN {
+		shares = shares[:topN]
+	}
+	if !negative && total > 0 {
+		for i := range shares {
+			shares[i].Share = shares[i].Mean / total
+		}
+	}
+	return shares
+}
+
+// writePanelSummary renders the summaries and breakdowns of a panel.
+func writePanelSummary(b *strings.Builder, panel panelContext, detail string, from time.Time) {
+	if panel.Error != "" {
+		fmt.Fprintf(b, "  Data: %s\n", panel.Error)
+		return
+	}
+
+	for _, s := range panel.Summaries {
+		fmt.Fprintf(b, "  Series %s: n=%d", truncate(s.Name, maxContextTitle), s.Count)
+		if s.Nulls > 0 {
+			fmt.Fprintf(b, " (%d null)", s.Nulls)
+		}
+		fmt.Fprintf(b, ", last=%s", formatNumber(s.Last))
+		if s.LastTime != nil {
+			fmt.Fprintf(b, " at %s", s.LastTime.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintf(b, ", min=%s, max=%s, mean=%s", formatNumber(s.Min), formatNumber(s.Max), formatNumber(s.Mean))
+		if s.StdDev != 0 {
+			fmt.Fprintf(b, ", stddev=%s", formatNumber(s.StdDev))
+		}
+		if detail != detailMinimal {
+			fmt.Fprintf(b, ", first=%s, p50=%s, p90=%s, p99=%s", formatNumber(s.First), formatNumber(s.P50), formatNumber(s.P90), formatNumber(s.P99))
+		}
+		if s.TrendPerHour != nil {
+			fmt.Fprintf(b, ", trend=%s/h", formatNumber(*s.TrendPerHour))
+		}
+		b.WriteString("\n")
+		for _, cp := range s.ChangePoints {
+			fmt.Fprintf(b, "    Change at %s: mean %s -> %s\n", cp.Time.UTC().Format(time.RFC3339), formatNumber(cp.Before), formatNumber(cp.After))
+		}
+		if len(s.Points) > 0 {
+			writeSeriesPoints(b, s.Points, from)
+		}
+	}
+	if omitted := panel.SeriesCount - len(panel.Summaries); omitted > 0 {
+		fmt.Fprintf(b, "  (%d smaller series omitted)\n", omitted)
+	}
+
+	for _, bd := range panel.Breakdowns {
+		values := make([]string, len(bd.Values))
+		for i, v := range bd.Values {
+			values[i] = truncate(v.Value, maxContextTitle) + "=" + formatNumber(v.Mean)
+			if v.Share > 0 {
+				values[i] += fmt.Sprintf(" (%.0f%%)", v.Share*100)
+			}
+		}
+		label := bd.Label
+		if bd.Field != "" {
+			label = bd.Field + " by " + bd.Label
+		}
+		fmt.Fprintf(b, "  Top %s: %s\n", truncate(label, maxContextTitle), strings.Join(values, ", "))
+	}
+	if panel.Logs != nil {
+		writeLogSummary(b, panel.Logs)
+	}
+	writeTraceSummary(b, panel.Traces)
+}
+
+// formatNumber formats a value with four significant digits.
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// testTimes returns n timestamps one minute apart.
+func testTimes(n int) []time.Time {
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	times := make([]time.Time, n)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i) * time.Minute)
+	}
+	return times
+}
+
+func TestSummarizeSeries(t *testing.T) {
+	// A level shift from 10 to 50 half way, with a little noise
+	values := make([]float64, 60)
+	for i := range values {
+		values[i] = 10 + float64(i%3)
+		if i >= 30 {
+			values[i] += 40
+		}
+	}
+	times := testTimes(len(values))
+
+	testCases := []struct {
+		detail           string
+		wantTrend        bool
+		wantChangePoints int
+	}{
+		{detail: detailMinimal},
+		{detail: detailStandard, wantTrend: true},
+		{detail: detailFull, wantTrend: true, wantChangePoints: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.detail, func(t *testing.T) {
+			s := summarizeSeries(values, times, summaryConfig{Detail: tc.detail})
+
+			if s.Count != 60 || s.Min != 10 || s.Max != 52 || s.First != 10 || s.Last != 52 || s.Mean != 31 {
+				t.Errorf("Unexpected basic statistics: %+v", s)
+			}
+			if s.LastTime == nil || !s.LastTime.Equal(times[59]) {
+				t.Errorf("Expected last time %v, got %v", times[59], s.LastTime)
+			}
+			if (s.TrendPerHour != nil) != tc.wantTrend {
+				t.Fatalf("Expected trend %v, got %v", tc.wantTrend, s.TrendPerHour)
+			}
+			if tc.wantTrend && *s.TrendPerHour <= 0 {
+				t.Errorf("Expected an upward trend, got %v", *s.TrendPerHour)
+			}
+			if len(s.ChangePoints) != tc.wantChangePoints {
+				t.Fatalf("Expected %d change points, got %+v", tc.wantChangePoints, s.ChangePoints)
+			}
+			if tc.wantChangePoints > 0 && !s.ChangePoints[0].Time.Equal(times[30]) {
+				t.Errorf("Expected the change at %v, got %v", times[30], s.ChangePoints[0].Time)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5}
+	for p, want := range map[float64]float64{0: 1, 0.5: 3, 0.9: 4.6, 1: 5} {
+		if got := percentile(sorted, p); math.Abs(got-want) > 1e-9 {
+			t.Errorf("Expected p%v = %v, got %v", p*100, want, got)
+		}
+	}
+}
+
+func TestSummarizePanel(t *testing.T) {
+	times := testTimes(3)
+	panel := panelContext{Frames: data.Frames{
+		data.NewFrame("A",
+			data.NewField("time", nil, times),
+			data.NewField("cpu", data.Labels{"pod": "a"}, []*float64{ptr(1.0), nil, ptr(3.0)}),
+		),
+		data.NewFrame("A",
+			data.NewField("time", nil, times),
+			data.NewField("cpu", data.Labels{"pod": "b"}, []float64{6, 6, math.NaN()}),
+		),
+		data.NewFrame("B",
+			data.NewField("host", nil, []string{"x", "y", "z"}),
+			data.NewField("errors", nil, []int64{5, 20, 1}),
+		),
+	}}
+
+	summarizePanel(&panel, summaryConfig{Detail: detailStandard, TopN: 2})
+
+	if len(panel.Summaries) != 3 {
+		t.Fatalf("Expected 3 summaries, got %d", len(panel.Summaries))
+	}
+	if s := panel.Summaries[0]; s.Count != 2 || s.Nulls != 1 || s.Mean != 2 {
+		t.Errorf("Expected nulls to be skipped, got %+v", s)
+	}
+	if len(panel.Breakdowns) != 2 {
+		t.Fatalf("Expected a table and a label breakdown, got %+v", panel.Breakdowns)
+	}
+	table := panel.Breakdowns[0]
+	if table.Label != "host" || len(table.Values) != 2 || table.Values[0].Value != "y" || table.Values[1].Value != "x" {
+		t.Errorf("Expected the top 2 hosts by errors, got %+v", table)
+	}
+	pods := panel.Breakdowns[1]
+	if pods.Label != "pod" || pods.Values[0].Value != "b" || math.Abs(pods.Values[0].Share-0.75) > 1e-9 {
+		t.Errorf("Expected pod b to have 75%% of the mean, got %+v", pods)
+	}
+
+	var b strings.Builder
+	writePanelSummary(&b, panel, detailStandard, times[0])
+	for _, want := range []string{"Series cpu{pod=a}: n=2 (1 null), last=3", "Top pod: b=6 (75%), a=2 (25%)", "Top errors by host: y=20"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected summary to contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
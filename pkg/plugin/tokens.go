@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// modelFamily describes how a family of models tokenizes text, closely enough
+// to estimate token counts without shipping the vocabularies.
+type modelFamily struct {
+	name     string
+	prefixes []string
+
+	// charsPerToken is the average length of a token within a word.
+	charsPerToken float64
+
+	// digitsPerToken is how many digits the tokenizer groups; SentencePiece
+	// vocabularies split numbers into single digits.
+	digitsPerToken int
+
+	// messageOverhead is the tokens the chat template adds per message.
+	messageOverhead int
+}
+
+var modelFamilies = []modelFamily{
+	// Llama 3 uses a tiktoken-style BPE with a 128k vocabulary
+	{name: "llama3", prefixes: []string{"llama-3", "llama3", "meta-llama/llama-4", "deepseek-r1-distill-llama"}, charsPerToken: 4, digitsPerToken: 3, messageOverhead: 5},
+	{name: "mistral", prefixes: []string{"mixtral", "mistral"}, charsPerToken: 3.2, digitsPerToken: 1, messageOverhead: 4},
+	{name: "gemma", prefixes: []string{"gemma"}, charsPerToken: 4.2, digitsPerToken: 1, messageOverhead: 5},
+	{name: "qwen", prefixes: []string{"qwen"}, charsPerToken: 3.8, digitsPerToken: 1, messageOverhead: 5},
+	{name: "gpt", prefixes: []string{"openai/gpt", "gpt-"}, charsPerToken: 4, digitsPerToken: 3, messageOverhead: 4},
+}
+
+// defaultModelFamily is used for unknown models. It estimates on the high side.
+var defaultModelFamily = modelFamily{name: "default", charsPerToken: 3, digitsPerToken: 1, messageOverhead: 5}
+
+// defaultContextWindows are the context windows of the models offered on Groq,
+// in tokens.
+var defaultContextWindows = map[string]int{
+	"llama-3.3-70b-versatile": 131072,
+	"llama-3.1-8b-instant":    131072,
+	"llama3-70b-8192":         8192,
+	"llama3-8b-8192":          8192,
+	"mixtral-8x7b-32768":      32768,
+	"gemma2-9b-it":            8192,
+}
+
+const (
+	// defaultContextWindow is assumed for models missing from the table.
+	defaultContextWindow = 8192
+
+	// completionTokenReserve is kept free in the context window for the
+	// answer.
+	completionTokenReserve = 1024
+
+	// replyPrimingTokens are added once per request for the assistant's
+	// reply header.
+	replyPrimingTokens = 3
+)
+
+// promptTokenLimit is how many prompt tokens fit into a context window with
+// room left for the answer.
+func promptTokenLimit(window int) int {
+	return window - min(completionTokenReserve, window/4)
+}
+
+// familyOf returns the tokenizer family of a model.
+func familyOf(model string) modelFamily {
+	model = strings.ToLower(model)
+	for _, family := range modelFamilies {
+		for _, prefix := range family.prefixes {
+			if strings.HasPrefix(model, prefix) {
+				return family
+			}
+		}
+	}
+	return defaultModelFamily
+}
+
+// contextWindow returns the context window of a model, preferring the
+// configured table.
+func (ds *Datasource) contextWindow(model string) int {
+	if window, ok := ds.config.ContextWindows[model]; ok && window > 0 {
+		return window
+	}
+	if window, ok := defaultContextWindows[model]; ok {
+		return window
+	}
+	return defaultContextWindow
+}
+
+// estimateTokens estimates the tokens of text by splitting it the way BPE
+// pre-tokenizers do: words with their leading space, digit groups,
+// punctuation and line breaks. Each piece is then costed by the family's
+// average token length. Other scripts count a token per character.
+func (f modelFamily) estimateTokens(text string) int {
+	tokens := 0
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		j := i + 1
+		switch {
+		case r == ' ' && j < len(runes) && isWordRune(runes[j]):
+			// A single space is part of the following word
+		case unicode.IsSpace(r):
+			for j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+			tokens++
+		case unicode.IsDigit(r):
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
+			}
+			tokens += (j - i + f.digitsPerToken - 1) / f.digitsPerToken
+		case r < unicode.MaxLatin1 && unicode.IsLetter(r):
+			for j < len(runes) && runes[j] < unicode.MaxLatin1 && unicode.IsLetter(runes[j]) {
+				j++
+			}
+			tokens += int(math.Ceil(float64(j-i) / f.charsPerToken))
+		case unicode.IsLetter(r):
+			tokens++
+		default:
+			for j < len(runes) && unicode.IsPunct(runes[j]) || j < len(runes) && unicode.IsSymbol(runes[j]) {
+				j++
+			}
+			tokens += (j - i + 1) / 2
+		}
+		i = j
+	}
+	return tokens
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// estimateMessages estimates the prompt tokens of a chat request.
+func (f modelFamily) estimateMessages(messages []chatMessage) int {
+	tokens := replyPrimingTokens
+	for _, msg := range messages {
+		tokens += f.messageOverhead + f.estimateTokens(msg.Content)
+	}
+	return tokens
+}
+
+// truncateTokens shortens text to about maxTokens tokens. It reports whether
+// text was shortened.
+func (f modelFamily) truncateTokens(text string, maxTokens int) (string, bool) {
+	if f.estimateTokens(text) <= maxTokens {
+		return text, false
+	}
+	runes := []rune(text)
+	n := sort.Search(len(runes), func(n int) bool {
+		return f.estimateTokens(string(runes[:n+1])) > maxTokens
+	})
+	return string(runes[:n]), true
+}
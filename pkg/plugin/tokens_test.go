@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFamilyOf(t *testing.T) {
+	testCases := []struct {
+		model    string
+		expected string
+	}{
+		{model: "llama-3.3-70b-versatile", expected: "llama3"},
+		{model: "llama3-8b-8192", expected: "llama3"},
+		{model: "mixtral-8x7b-32768", expected: "mistral"},
+		{model: "gemma2-9b-it", expected: "gemma"},
+		{model: "openai/gpt-oss-120b", expected: "gpt"},
+		{model: "unknown-model", expected: "default"},
+	}
+
+	for _, tc := range testCases {
+		if family := familyOf(tc.model); family.name != tc.expected {
+			t.Errorf("Expected family %s for %s, got %s", tc.expected, tc.model, family.name)
+		}
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	llama := familyOf("llama-3.3-70b-versatile")
+	testCases := []struct {
+		name     string
+		text     string
+		min, max int
+	}{
+		{name: "empty", text: "", min: 0, max: 0},
+		{name: "words", text: "Why is the checkout latency high?", min: 6, max: 10},
+		{name: "numbers", text: "1700000000000", min: 4, max: 5},
+		{name: "query", text: `sum(rate(http_requests_total{job="api"}[5m]))`, min: 12, max: 30},
+		{name: "other scripts", text: "延迟很高", min: 4, max: 4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tokens := llama.estimateTokens(tc.text); tokens < tc.min || tokens > tc.max {
+				t.Errorf("Expected %d to %d tokens, got %d", tc.min, tc.max, tokens)
+			}
+		})
+	}
+
+	if mistral := familyOf("mixtral-8x7b-32768"); mistral.estimateTokens("1700000000000") <= llama.estimateTokens("1700000000000") {
+		t.Error("Expected digit-splitting tokenizers to count more tokens for numbers")
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	ds := &Datasource{config: pluginConfig{ContextWindows: map[string]int{"llama3-8b-8192": 4096, "custom": 32000}}}
+
+	for model, expected := range map[string]int{
+		"llama3-8b-8192":          4096,
+		"custom":                  32000,
+		"llama-3.3-70b-versatile": 131072,
+		"unknown":                 defaultContextWindow,
+	} {
+		if window := ds.contextWindow(model); window != expected {
+			t.Errorf("Expected a context window of %d for %s, got %d", expected, model, window)
+		}
+	}
+}
+
+func TestTruncateTokens(t *testing.T) {
+	family := familyOf("llama-3.3-70b-versatile")
+	text := strings.Repeat("The checkout service answered 1234 requests with status 500. ", 50)
+
+	for _, maxTokens := range []int{0, 1, 10, 100, 500} {
+		truncated, shortened := family.truncateTokens(text, maxTokens)
+		if !shortened || !strings.HasPrefix(text, truncated) || family.estimateTokens(truncated) > maxTokens {
+			t.Errorf("Expected at most %d tokens, got %d in %q", maxTokens, family.estimateTokens(truncated), truncated)
+		}
+		if maxTokens > 0 && family.estimateTokens(truncated) < maxTokens-5 {
+			t.Errorf("Expected about %d tokens, got %d", maxTokens, family.estimateTokens(truncated))
+		}
+	}
+	if truncated, shortened := family.truncateTokens(text, family.estimateTokens(text)); shortened || truncated != text {
+		t.Error("Expected text within the limit to be unchanged")
+	}
+}
@@ -0,0 +1,409 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxToolResultBytes bounds what a tool call adds to the conversation.
+	maxToolResultBytes = 8000
+
+	// defaultToolListLimit and maxToolListLimit bound the items a listing
+	// tool returns.
+	defaultToolListLimit = 20
+	maxToolListLimit     = 100
+
+	// maxToolLookback bounds relative times like now-52w.
+	maxToolLookback = 10 * 365 * 24 * time.Hour
+)
+
+// toolDefinition declares a tool to the model in the OpenAI format.
+type toolDefinition struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// toolCall is a call of a tool requested by the model.
+type toolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function toolCallFunction `json:"function"`
+}
+
+type toolCallFunction struct {
+	Name string `json:"name"`
+
+	// Arguments is a JSON object encoded as a string.
+	Arguments string `json:"arguments"`
+}
+
+// toolEnv is what tools run with: a Grafana client that forwards the
+// caller's identity, so every tool is limited to what the caller may see.
+type toolEnv struct {
+	ds     *Datasource
+	r      *http.Request
+	client *grafanaClient
+	now    time.Time
+}
+
+// grafanaTool is a tool the agent loop offers the model.
+type grafanaTool struct {
+	function toolFunction
+	run      func(ctx context.Context, env *toolEnv, args json.RawMessage) (any, error)
+}
+
+// toolError is an error of a tool call that is safe to show the model.
+type toolError struct {
+	message string
+}
+
+func (e *toolError) Error() string {
+	return e.message
+}
+
+// grafanaTools are the tools of the agent loop, by name.
+var grafanaTools = map[string]grafanaTool{
+	"list_dashboards": {
+		function: toolFunction{
+			Name:        "list_dashboards",
+			Description: "Search the Grafana dashboards the user can see, by title and tag.",
+			Parameters: json.RawMessage(`{"type":"object","properties":{
+				"query":{"type":"string","description":"Text the dashboard title contains"},
+				"tag":{"type":"string","description":"Tag the dashboards have"},
+				"limit":{"type":"integer","description":"Maximum number of dashboards, default 20"}}}`),
+		},
+		run: listDashboardsTool,
+	},
+	"get_panel_data": {
+		function: toolFunction{
+			Name:        "get_panel_data",
+			Description: "Run the queries of a dashboard panel for a time range and return statistics of its series.",
+			Parameters: json.RawMessage(`{"type":"object","properties":{
+				"dashboardUid":{"type":"string"},
+				"panelId":{"type":"integer"},
+				"from":{"type":"string","description":"Start as RFC 3339 time or relative like now-6h, default now-1h"},
+				"to":{"type":"string","description":"End as RFC 3339 time or relative, default now"}},
+				"required":["dashboardUid","panelId"]}`),
+		},
+		run: getPanelDataTool,
+	},
+	"list_alerts": {
+		function: toolFunction{
+			Name:        "list_alerts",
+			Description: "List the alerts that are currently firing, optionally filtered by label.",
+			Parameters: json.RawMessage(`{"type":"object","properties":{
+				"matchers":{"type":"array","items":{"type":"string"},"description":"Label matchers like severity=\"critical\""},
+				"limit":{"type":"integer","description":"Maximum number of alerts, default 20"}}}`),
+		},
+		run: listAlertsTool,
+	},
+	"search_annotations": {
+		function: toolFunction{
+			Name:        "search_annotations",
+			Description: "Search annotations such as deployments and incidents in a time range.",
+			Parameters: json.RawMessage(`{"type":"object","properties":{
+				"from":{"type":"string","description":"Start as RFC 3339 time or relative like now-24h, default now-24h"},
+				"to":{"type":"string","description":"End as RFC 3339 time or relative, default now"},
+				"dashboardUid":{"type":"string","description":"Only annotations of this dashboard"},
+				"tags":{"type":"array","items":{"type":"string"}},
+				"limit":{"type":"integer","description":"Maximum number of annotations, default 20"}}}`),
+		},
+		run: searchAnnotationsTool,
+	},
+}
+
+// toolDefinitions returns the definitions of grafanaTools in a stable order.
+func toolDefinitions() []toolDefinition {
+	names := []string{"list_dashboards", "get_panel_data", "list_alerts", "search_annotations"}
+	defs := make([]toolDefinition, len(names))
+	for i, name := range names {
+		defs[i] = toolDefinition{Type: "function", Function: grafanaTools[name].function}
+	}
+	return defs
+}
+
+// runTool executes a tool call and returns the result for the model. Errors
+// are returned to the model as results, so that it can correct the call.
+func runTool(ctx context.Context, env *toolEnv, call toolCall) (string, error) {
+	tool, ok := grafanaTools[call.Function.Name]
+	if !ok {
+		err := &toolError{message: "unknown tool " + strconv.Quote(call.Function.Name)}
+		return toolErrorResult(err.message), err
+	}
+	args := json.RawMessage(orDefaultString(call.Function.Arguments, "{}"))
+	result, err := tool.run(ctx, env, args)
+	if err != nil {
+		return toolErrorResult(toolErrorMessage(err)), err
+	}
+
+	text, ok := result.(string)
+	if !ok {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return toolErrorResult("tool failed"), err
+		}
+		text = string(encoded)
+	}
+	if len(text) > maxToolResultBytes {
+		text = strings.ToValidUTF8(text[:maxToolResultBytes], "") + "\n(truncated)"
+	}
+	return text, nil
+}
+
+// toolErrorMessage returns the message of err that may be shown to the model
+// and the client.
+func toolErrorMessage(err error) string {
+	var tErr *toolError
+	if errors.As(err, &tErr) {
+		return tErr.message
+	}
+	return "tool failed"
+}
+
+func toolErrorResult(message string) string {
+	encoded, _ := json.Marshal(map[string]string{"error": message})
+	return string(encoded)
+}
+
+// decodeToolArgs decodes the arguments of a call into out.
+func decodeToolArgs(args json.RawMessage, out any) error {
+	if err := json.Unmarshal(args, out); err != nil {
+		return &toolError{message: "invalid arguments: " + err.Error()}
+	}
+	return nil
+}
+
+// grafanaToolError converts an error of the Grafana API for the model.
+func grafanaToolError(err error, resource string) error {
+	return &toolError{message: grafanaRequestError(err, resource).message}
+}
+
+// toolLimit returns the requested number of items within bounds.
+func toolLimit(limit int) int {
+	if limit <= 0 {
+		return defaultToolListLimit
+	}
+	return min(limit, maxToolListLimit)
+}
+
+// parseToolTime parses a time given by the model: an RFC 3339 time, Unix
+// milliseconds, or relative to now like Grafana's now-6h.
+func parseToolTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "now" {
+		return now, nil
+	}
+	if offset, ok := strings.CutPrefix(value, "now-"); ok {
+		d, err := parseRelativeDuration(offset)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-d), nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, &toolError{message: fmt.Sprintf("invalid time %q, use RFC 3339 or now-<duration>", value)}
+	}
+	return t, nil
+}
+
+// parseRelativeDuration parses durations like 30m, 6h, 7d or 2w.
+func parseRelativeDuration(value string) (time.Duration, error) {
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if len(value) >= 2 {
+		if unit, ok := units[value[len(value)-1]]; ok {
+			if n, err := strconv.Atoi(value[:len(value)-1]); err == nil && n >= 0 && time.Duration(n) <= maxToolLookback/unit {
+				return time.Duration(n) * unit, nil
+			}
+		}
+	}
+	return 0, &toolError{message: fmt.Sprintf("invalid relative time now-%s", value)}
+}
+
+// toolTimeRange parses a time range with defaults relative to now.
+func toolTimeRange(from, to string, defaultFrom time.Duration, now time.Time) (time.Time, time.Time, error) {
+	start, end := now.Add(-defaultFrom), now
+	var err error
+	if from != "" {
+		if start, err = parseToolTime(from, now); err != nil {
+			return start, end, err
+		}
+	}
+	if to != "" {
+		if end, err = parseToolTime(to, now); err != nil {
+			return start, end, err
+		}
+	}
+	if !end.After(start) {
+		return start, end, &toolError{message: "from must be before to"}
+	}
+	return start, end, nil
+}
+
+func listDashboardsTool(ctx context.Context, env *toolEnv, raw json.RawMessage) (any, error) {
+	var args struct {
+		Query string `json:"query"`
+		Tag   string `json:"tag"`
+		Limit int    `json:"limit"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"type": {"dash-db"}, "limit": {strconv.Itoa(toolLimit(args.Limit))}}
+	if args.Query != "" {
+		query.Set("query", args.Query)
+	}
+	if args.Tag != "" {
+		query.Set("tag", args.Tag)
+	}
+	var hits []struct {
+		UID         string   `json:"uid"`
+		Title       string   `json:"title"`
+		FolderTitle string   `json:"folderTitle,omitempty"`
+		Tags        []string `json:"tags,omitempty"`
+	}
+	if err := env.client.get(ctx, "/api/search?"+query.Encode(), &hits); err != nil {
+		return nil, grafanaToolError(err, "Dashboards")
+	}
+	return hits, nil
+}
+
+func getPanelDataTool(ctx context.Context, env *toolEnv, raw json.RawMessage) (any, error) {
+	var args struct {
+		DashboardUID string `json:"dashboardUid"`
+		PanelID      int64  `json:"panelId"`
+		From         string `json:"from"`
+		To           string `json:"to"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	from, to, err := toolTimeRange(args.From, args.To, time.Hour, env.now)
+	if err != nil {
+		return nil, err
+	}
+
+	req := contextRequest{DashboardUID: args.DashboardUID, From: from.UnixMilli(), To: to.UnixMilli(), PanelIDs: []int64{args.PanelID}}
+	if reqErr := req.validate(); reqErr != nil {
+		return nil, &toolError{message: reqErr.message}
+	}
+	dc, reqErr := env.ds.loadDashboardContext(ctx, env.r, req)
+	if reqErr != nil {
+		return nil, &toolError{message: reqErr.message}
+	}
+	if len(dc.Panels) == 0 {
+		return nil, &toolError{message: "Panel not found"}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dashboard %q, time range %s to %s\n", dc.Title, dc.From.Format(time.RFC3339), dc.To.Format(time.RFC3339))
+	writeFindings(&b, dc.Panels)
+	writePanel(&b, dc.Panels[0], dc.Summary.Detail, dc.From)
+	return b.String(), nil
+}
+
+func listAlertsTool(ctx context.Context, env *toolEnv, raw json.RawMessage) (any, error) {
+	var args struct {
+		Matchers []string `json:"matchers"`
+		Limit    int      `json:"limit"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"active": {"true"}, "silenced": {"false"}, "inhibited": {"false"}}
+	for _, matcher := range args.Matchers {
+		query.Add("filter", matcher)
+	}
+	var alerts []struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+		StartsAt    time.Time         `json:"startsAt"`
+	}
+	if err := env.client.get(ctx, "/api/alertmanager/grafana/api/v2/alerts?"+query.Encode(), &alerts); err != nil {
+		return nil, grafanaToolError(err, "Alerts")
+	}
+
+	result := map[string]any{"firing": len(alerts)}
+	if limit := toolLimit(args.Limit); len(alerts) > limit {
+		alerts = alerts[:limit]
+	}
+	result["alerts"] = alerts
+	return result, nil
+}
+
+func searchAnnotationsTool(ctx context.Context, env *toolEnv, raw json.RawMessage) (any, error) {
+	var args struct {
+		From         string   `json:"from"`
+		To           string   `json:"to"`
+		DashboardUID string   `json:"dashboardUid"`
+		Tags         []string `json:"tags"`
+		Limit        int      `json:"limit"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	from, to, err := toolTimeRange(args.From, args.To, 24*time.Hour, env.now)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"from":  {strconv.FormatInt(from.UnixMilli(), 10)},
+		"to":    {strconv.FormatInt(to.UnixMilli(), 10)},
+		"limit": {strconv.Itoa(toolLimit(args.Limit))},
+	}
+	if args.DashboardUID != "" {
+		query.Set("dashboardUID", args.DashboardUID)
+	}
+	for _, tag := range args.Tags {
+		query.Add("tags", tag)
+	}
+	var annotations []struct {
+		DashboardUID string   `json:"dashboardUID,omitempty"`
+		PanelID      int64    `json:"panelId,omitempty"`
+		Time         int64    `json:"time"`
+		TimeEnd      int64    `json:"timeEnd,omitempty"`
+		Text         string   `json:"text"`
+		Tags         []string `json:"tags,omitempty"`
+	}
+	if err := env.client.get(ctx, "/api/annotations?"+query.Encode(), &annotations); err != nil {
+		return nil, grafanaToolError(err, "Annotations")
+	}
+
+	type annotation struct {
+		DashboardUID string   `json:"dashboardUid,omitempty"`
+		PanelID      int64    `json:"panelId,omitempty"`
+		Time         string   `json:"time"`
+		TimeEnd      string   `json:"timeEnd,omitempty"`
+		Text         string   `json:"text"`
+		Tags         []string `json:"tags,omitempty"`
+	}
+	result := make([]annotation, len(annotations))
+	for i, a := range annotations {
+		result[i] = annotation{DashboardUID: a.DashboardUID, PanelID: a.PanelID, Text: truncate(stripHTML(a.Text), maxContextDescription), Tags: a.Tags,
+			Time: time.UnixMilli(a.Time).UTC().Format(time.RFC3339)}
+		if a.TimeEnd > a.Time {
+			result[i].TimeEnd = time.UnixMilli(a.TimeEnd).UTC().Format(time.RFC3339)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,713 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxContextTraces bounds the traces summarized per panel, and
+	// maxDashboardTraces the traces fetched for the exemplars and search
+	// results of a dashboard.
+	maxContextTraces   = 3
+	maxDashboardTraces = 5
+
+	// maxTraceSpans bounds the spans of a trace that are analyzed.
+	maxTraceSpans = 10000
+
+	// maxContextTraceSpans bounds the slowest and error spans in the
+	// prompt, and maxTraceCriticalPath the spans of the critical path.
+	maxContextTraceSpans = 5
+	maxTraceCriticalPath = 10
+
+	// maxTraceTreeLines and maxTraceTreeDepth bound the span tree in the
+	// prompt.
+	maxTraceTreeLines = 30
+	maxTraceTreeDepth = 8
+
+	// traceStatusError is the OpenTelemetry status code of a failed span,
+	// as Tempo reports it in the statusCode field.
+	traceStatusError = 2
+
+	// exemplarFrameName is the name of the frames Prometheus returns the
+	// exemplars of a query in.
+	exemplarFrameName = "exemplar"
+
+	tempoDataSourceType = "tempo"
+)
+
+// Sources of the traces of a panel.
+const (
+	traceSourcePanel    = "panel"
+	traceSourceExemplar = "exemplar"
+	traceSourceSearch   = "search"
+)
+
+// traceSummary describes a trace by its critical path, slowest and failed
+// spans, and a compact tree of its spans.
+type traceSummary struct {
+	TraceID    string    `json:"traceId"`
+	Source     string    `json:"source"`
+	Service    string    `json:"service,omitempty"`
+	Operation  string    `json:"operation,omitempty"`
+	Start      time.Time `json:"start"`
+	Duration   float64   `json:"durationMs"`
+	SpanCount  int       `json:"spanCount"`
+	Services   int       `json:"services"`
+	ErrorCount int       `json:"errorCount,omitempty"`
+
+	// CriticalPath are the spans that determine the duration of the trace,
+	// in the order they run. CriticalPathLength includes those left out.
+	CriticalPath       []traceSpan `json:"criticalPath"`
+	CriticalPathLength int         `json:"criticalPathLength"`
+
+	// Slowest are the spans with the most time not spent in child spans,
+	// and Errors the first failed spans.
+	Slowest []traceSpan `json:"slowest"`
+	Errors  []traceSpan `json:"errors,omitempty"`
+
+	// Tree is the span tree as indented lines, with repeated sibling spans
+	// collapsed. TreeOmitted counts the spans left out.
+	Tree        []string `json:"tree"`
+	TreeOmitted int      `json:"treeOmitted,omitempty"`
+}
+
+type traceSpan struct {
+	Service   string  `json:"service,omitempty"`
+	Operation string  `json:"operation"`
+	Duration  float64 `json:"durationMs"`
+	SelfTime  float64 `json:"selfTimeMs"`
+
+	// Status is the status message of a failed span.
+	Status string `json:"status,omitempty"`
+}
+
+func (s traceSpan) name() string {
+	return truncate(strings.TrimSpace(s.Service+" "+s.Operation), maxContextTitle)
+}
+
+type spanNode struct {
+	traceSpan
+	id, parentID string
+	start        float64
+	failed       bool
+	critical     bool
+	children     []*spanNode
+}
+
+func (n *spanNode) end() float64 {
+	return n.start + n.Duration
+}
+
+// isTraceFrame reports whether a frame holds the spans of traces, as those
+// of Tempo, Jaeger and Zipkin.
+func isTraceFrame(frame *data.Frame) bool {
+	if frame.Meta != nil && frame.Meta.PreferredVisualization == data.VisTypeTrace {
+		return true
+	}
+	spanID, _ := frame.FieldByName("spanID")
+	parentSpanID, _ := frame.FieldByName("parentSpanID")
+	return spanID != nil && parentSpanID != nil
+}
+
+// isTraceSearchFrame reports whether a frame lists traces, as the search
+// results of Tempo and Jaeger.
+func isTraceSearchFrame(frame *data.Frame) bool {
+	if isTraceFrame(frame) || isExemplarFrame(frame) {
+		return false
+	}
+	field, _ := frame.FieldByName("traceID")
+	return field != nil
+}
+
+func isExemplarFrame(frame *data.Frame) bool {
+	return strings.EqualFold(frame.Name, exemplarFrameName)
+}
+
+// hasTraceData reports whether a panel's data holds traces or references
+// them.
+func hasTraceData(panel *panelContext) bool {
+	return slices.ContainsFunc(panel.Frames, func(frame *data.Frame) bool {
+		return isTraceFrame(frame) || isTraceSearchFrame(frame) || isExemplarFrame(frame)
+	})
+}
+
+func traceString(field *data.Field, i int) string {
+	if field == nil {
+		return ""
+	}
+	v, ok := field.ConcreteAt(i)
+	if !ok {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.RawMessage:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// traceNumber returns a numeric value of a field; times are returned in
+// milliseconds since the epoch, which trace frames use for span starts.
+func traceNumber(field *data.Field, i int) float64 {
+	if field == nil {
+		return 0
+	}
+	if v, ok := field.ConcreteAt(i); ok {
+		if t, ok := v.(time.Time); ok {
+			return float64(t.UnixMicro()) / 1000
+		}
+	}
+	v, err := field.NullableFloatAt(i)
+	if err != nil || v == nil {
+		return 0
+	}
+	return *v
+}
+
+// errorTagged reports whether the tags of a span, a JSON list of key/value
+// pairs, mark it as failed.
+func errorTagged(tags string) bool {
+	if !strings.Contains(tags, "error") && !strings.Contains(tags, "ERROR") {
+		return false
+	}
+	var pairs []struct {
+		Key   string `json:"key"`
+		Value any    `json:"value"`
+	}
+	if json.Unmarshal([]byte(tags), &pairs) != nil {
+		return false
+	}
+	for _, p := range pairs {
+		value := strings.ToLower(fmt.Sprint(p.Value))
+		if (p.Key == "error" && value == "true") || (p.Key == "otel.status_code" && value == "error") {
+			return true
+		}
+	}
+	return false
+}
+
+// traceSpans returns the spans of the trace frames by trace ID, and the
+// trace IDs in the order they occur.
+func traceSpans(frames data.Frames) ([]string, map[string][]*spanNode) {
+	var traceIDs []string
+	spans := make(map[string][]*spanNode)
+	for _, frame := range frames {
+		if !isTraceFrame(frame) {
+			continue
+		}
+		field := func(name string) *data.Field {
+			f, _ := frame.FieldByName(name)
+			return f
+		}
+		ids := field("spanID")
+		if ids == nil {
+			continue
+		}
+		traceIDField, parents, services, operations := field("traceID"), field("parentSpanID"), field("serviceName"), field("operationName")
+		starts, durations, statusCodes, statusMessages, tags := field("startTime"), field("duration"), field("statusCode"), field("statusMessage"), field("tags")
+		for i := range ids.Len() {
+			traceID := traceString(traceIDField, i)
+			if len(spans[traceID]) >= maxTraceSpans {
+				continue
+			}
+			if _, ok := spans[traceID]; !ok {
+				traceIDs = append(traceIDs, traceID)
+			}
+			n := &spanNode{
+				traceSpan: traceSpan{Service: traceString(services, i), Operation: traceString(operations, i), Duration: traceNumber(durations, i)},
+				id:        traceString(ids, i),
+				parentID:  traceString(parents, i),
+				start:     traceNumber(starts, i),
+			}
+			n.failed = traceNumber(statusCodes, i) == traceStatusError || errorTagged(traceString(tags, i))
+			if n.failed {
+				n.Status = truncate(traceString(statusMessages, i), maxContextTitle)
+			}
+			spans[traceID] = append(spans[traceID], n)
+		}
+	}
+	return traceIDs, spans
+}
+
+// summarizeTraces summarizes the traces of the trace frames, the longest
+// first.
+func summarizeTraces(frames data.Frames, source string) []traceSummary {
+	traceIDs, spans := traceSpans(frames)
+	summaries := make([]traceSummary, 0, len(traceIDs))
+	for _, id := range traceIDs {
+		summaries = append(summaries, summarizeTrace(id, source, spans[id]))
+	}
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].Duration > summaries[j].Duration })
+	return summaries
+}
+
+// summarizeTrace links the spans of a trace into a tree and computes its
+// critical path, its slowest spans by self time and its failed spans.
+func summarizeTrace(traceID, source string, spans []*spanNode) traceSummary {
+	byID := make(map[string]*spanNode, len(spans))
+	for _, n := range spans {
+		byID[n.id] = n
+	}
+	var roots []*spanNode
+	for _, n := range spans {
+		if parent, ok := byID[n.parentID]; ok && parent != n {
+			parent.children = append(parent.children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	byStart := func(nodes []*spanNode) {
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].start < nodes[j].start })
+	}
+	byStart(roots)
+
+	s := traceSummary{TraceID: traceID, Source: source, SpanCount: len(spans)}
+	services := make(map[string]bool)
+	first, last := spans[0].start, spans[0].end()
+	for _, n := range spans {
+		byStart(n.children)
+		n.SelfTime = selfTime(n)
+		services[n.Service] = true
+		first, last = min(first, n.start), max(last, n.end())
+		if n.failed {
+			s.ErrorCount++
+			if len(s.Errors) < maxContextTraceSpans {
+				s.Errors = append(s.Errors, n.traceSpan)
+			}
+		}
+	}
+	s.Services = len(services)
+	s.Start = time.UnixMicro(int64(first * 1000)).UTC()
+	s.Duration = last - first
+
+	if len(roots) > 0 {
+		root := roots[0]
+		for _, r := range roots[1:] {
+			if r.Duration > root.Duration {
+				root = r
+			}
+		}
+		s.Service, s.Operation = root.Service, root.Operation
+		path := criticalPath(root, root.end())
+		s.CriticalPathLength = len(path)
+		for _, n := range path {
+			n.critical = true
+			if len(s.CriticalPath) < maxTraceCriticalPath {
+				s.CriticalPath = append(s.CriticalPath, n.traceSpan)
+			}
+		}
+	}
+
+	slowest := slices.Clone(spans)
+	sort.SliceStable(slowest, func(i, j int) bool { return slowest[i].SelfTime > slowest[j].SelfTime })
+	for _, n := range slowest[:min(len(slowest), maxContextTraceSpans)] {
+		s.Slowest = append(s.Slowest, n.traceSpan)
+	}
+
+	tree := traceTree{}
+	tree.write(roots, 0)
+	s.Tree, s.TreeOmitted = tree.lines, len(spans)-tree.shown
+	return s
+}
+
+// selfTime is the time of a span not covered by its children.
+func selfTime(n *spanNode) float64 {
+	covered, start, end := 0.0, n.start, n.start
+	for _, c := range n.children {
+		cStart, cEnd := max(c.start, n.start), min(c.end(), n.end())
+		if cEnd <= cStart {
+			continue
+		}
+		if cStart > end {
+			covered += end - start
+			start, end = cStart, cEnd
+		} else {
+			end = max(end, cEnd)
+		}
+	}
+	covered += end - start
+	return max(n.Duration-covered, 0)
+}
+
+// criticalPath returns the spans a span waits on until end: walking back
+// from end, the child that finishes last, then the child that finishes last
+// before that one starts, and so on, each with its own critical path.
+func criticalPath(n *spanNode, end float64) []*spanNode {
+	path := []*spanNode{n}
+	children := slices.Clone(n.children)
+	sort.SliceStable(children, func(i, j int) bool { return children[i].end() > children[j].end() })
+	cursor := min(n.end(), end)
+	var segments [][]*spanNode
+	for _, c := range children {
+		if c.start >= cursor {
+			continue
+		}
+		segments = append(segments, criticalPath(c, cursor))
+		cursor = c.start
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		path = append(path, segments[i]...)
+	}
+	return path
+}
+
+// traceTree renders spans as indented lines. Siblings with the same service
+// and operation are collapsed into one line, under which the children of
+// the critical or else slowest of them are shown.
+type traceTree struct {
+	lines []string
+	shown int
+}
+
+func (t *traceTree) write(nodes []*spanNode, depth int) {
+	if depth >= maxTraceTreeDepth {
+		return
+	}
+	var groups [][]*spanNode
+	index := make(map[string]int)
+	for _, n := range nodes {
+		key := n.Service + "\x00" + n.Operation
+		if i, ok := index[key]; ok {
+			groups[i] = append(groups[i], n)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []*spanNode{n})
+	}
+
+	for _, group := range groups {
+		if len(t.lines) >= maxTraceTreeLines {
+			return
+		}
+		shown, total, failed := group[0], 0.0, 0
+		for _, n := range group {
+			total += n.Duration
+			if n.failed {
+				failed++
+			}
+			if (n.critical && !shown.critical) || (n.critical == shown.critical && n.Duration > shown.Duration) {
+				shown = n
+			}
+		}
+
+		line := strings.Repeat("  ", depth)
+		if shown.critical {
+			line += "* "
+		}
+		line += shown.name()
+		if len(group) == 1 {
+			line += " " + formatSpanDuration(shown.Duration)
+		} else {
+			line += fmt.Sprintf(" x%d, total %s, max %s", len(group), formatSpanDuration(total), formatSpanDuration(shown.Duration))
+		}
+		switch {
+		case failed == 1 && len(group) == 1:
+			line += " [error"
+			if shown.Status != "" {
+				line += ": " + shown.Status
+			}
+			line += "]"
+		case failed > 0:
+			line += fmt.Sprintf(" [%d errors]", failed)
+		}
+		t.lines = append(t.lines, line)
+		t.shown += len(group)
+		t.write(shown.children, depth+1)
+	}
+}
+
+// formatSpanDuration formats a duration in milliseconds.
+func formatSpanDuration(ms float64) string {
+	if ms >= 1000 {
+		return formatNumber(ms/1000) + "s"
+	}
+	return formatNumber(ms) + "ms"
+}
+
+// traceRef is a trace referenced by an exemplar or search result, to be
+// fetched from the data source of Datasource.
+type traceRef struct {
+	ID         string
+	Source     string
+	Datasource dataSourceRef
+}
+
+// dataSourceSettings is the subset of /api/datasources/uid/:uid the trace
+// references are resolved with.
+type dataSourceSettings struct {
+	UID      string `json:"uid"`
+	Type     string `json:"type"`
+	JSONData struct {
+		ExemplarTraceIDDestinations []struct {
+			Name          string `json:"name"`
+			DatasourceUID string `json:"datasourceUid"`
+		} `json:"exemplarTraceIdDestinations"`
+	} `json:"jsonData"`
+}
+
+// traceLookup resolves the data sources of trace references, caching their
+// settings for the dashboard.
+type traceLookup struct {
+	client   *grafanaClient
+	resolver *dataSourceResolver
+	settings map[string]*dataSourceSettings
+}
+
+func (l *traceLookup) dataSource(ctx context.Context, uid string) (*dataSourceSettings, error) {
+	if s, ok := l.settings[uid]; ok {
+		return s, nil
+	}
+	var s dataSourceSettings
+	if err := l.client.get(ctx, "/api/datasources/uid/"+url.PathEscape(uid), &s); err != nil {
+		return nil, err
+	}
+	l.settings[uid] = &s
+	return &s, nil
+}
+
+// frameDataSource returns the data source of the panel's query the frame
+// was returned for.
+func (l *traceLookup) frameDataSource(ctx context.Context, dc *dashboardContext, panel *panelContext, frame *data.Frame) (*dataSourceSettings, error) {
+	if len(panel.targets) == 0 {
+		return nil, fmt.Errorf("panel %d has no queries", panel.ID)
+	}
+	target := panel.targets[0]
+	if i := slices.IndexFunc(panel.targets, func(t panelTarget) bool { return t.RefID == frame.RefID }); i >= 0 {
+		target = panel.targets[i]
+	}
+	ref := panel.targetDataSource(target)
+	if ref == nil {
+		return nil, fmt.Errorf("panel %d has no data source", panel.ID)
+	}
+	resolved, err := l.resolver.resolve(ctx, interpolateRef(*ref, dc.variables))
+	if err != nil {
+		return nil, err
+	}
+	return l.dataSource(ctx, resolved.UID)
+}
+
+// panelTraceRefs returns the traces referenced by the exemplars and search
+// results of a panel, the slowest first.
+func (l *traceLookup) panelTraceRefs(ctx context.Context, dc *dashboardContext, panel *panelContext) []traceRef {
+	var refs []traceRef
+	for _, frame := range panel.Frames {
+		switch {
+		case isExemplarFrame(frame):
+			source, err := l.frameDataSource(ctx, dc, panel, frame)
+			if err != nil {
+				log.DefaultLogger.Warn("Cannot resolve exemplar data source", "dashboard", dc.UID, "panel", panel.ID, "error", err)
+				continue
+			}
+			for _, dest := range source.JSONData.ExemplarTraceIDDestinations {
+				idField, _ := frame.FieldByName(dest.Name)
+				if idField == nil || dest.DatasourceUID == "" {
+					continue
+				}
+				target, err := l.dataSource(ctx, dest.DatasourceUID)
+				if err != nil {
+					log.DefaultLogger.Warn("Cannot resolve trace data source", "uid", dest.DatasourceUID, "error", err)
+					continue
+				}
+				valueField, _ := frame.FieldByName("Value")
+				for _, id := range rankedTraceIDs(idField, valueField) {
+					refs = append(refs, traceRef{ID: id, Source: traceSourceExemplar, Datasource: dataSourceRef{Type: target.Type, UID: target.UID}})
+				}
+			}
+		case isTraceSearchFrame(frame):
+			source, err := l.frameDataSource(ctx, dc, panel, frame)
+			if err != nil {
+				log.DefaultLogger.Warn("Cannot resolve trace data source", "dashboard", dc.UID, "panel", panel.ID, "error", err)
+				continue
+			}
+			idField, _ := frame.FieldByName("traceID")
+			durationField, _ := frame.FieldByName("traceDuration")
+			if durationField == nil {
+				durationField, _ = frame.FieldByName("duration")
+			}
+			for _, id := range rankedTraceIDs(idField, durationField) {
+				refs = append(refs, traceRef{ID: id, Source: traceSourceSearch, Datasource: dataSourceRef{Type: source.Type, UID: source.UID}})
+			}
+		}
+	}
+	return refs
+}
+
+// rankedTraceIDs returns the distinct trace IDs of a field by the largest
+// value of the other field for them, such as the latency of an exemplar.
+func rankedTraceIDs(idField, valueField *data.Field) []string {
+	values := make(map[string]float64)
+	var ids []string
+	for i := range idField.Len() {
+		id := strings.TrimSpace(traceString(idField, i))
+		if id == "" {
+			continue
+		}
+		v := traceNumber(valueField, i)
+		if old, ok := values[id]; !ok {
+			ids = append(ids, id)
+			values[id] = v
+		} else if v > old {
+			values[id] = v
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool { return values[ids[i]] > values[ids[j]] })
+	return ids
+}
+
+// fetchTraces queries traces by ID from a trace data source over the
+// dashboard's time range.
+func fetchTraces(ctx context.Context, client *grafanaClient, dc *dashboardContext, source dataSourceRef, ids []string) (data.Frames, error) {
+	req := dsQueryRequest{
+		From: strconv.FormatInt(dc.From.UnixMilli(), 10),
+		To:   strconv.FormatInt(dc.To.UnixMilli(), 10),
+	}
+	for i, id := range ids {
+		query := map[string]any{"refId": fmt.Sprintf("trace%d", i), "datasource": source, "query": id}
+		if source.Type == tempoDataSourceType {
+			query["queryType"] = "traceId"
+		}
+		req.Queries = append(req.Queries, query)
+	}
+	resp, err := queryData(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	var frames data.Frames
+	for _, query := range req.Queries {
+		result, ok := resp.Responses[query["refId"].(string)]
+		if !ok || result.Error != nil {
+			continue
+		}
+		frames = append(frames, result.Frames...)
+	}
+	return frames, nil
+}
+
+// summarizeTracePanels summarizes the traces of trace panels, and fetches
+// and summarizes the traces the exemplars and trace search results of the
+// panels reference, up to maxDashboardTraces of them.
+func (ds *Datasource) summarizeTracePanels(ctx context.Context, client *grafanaClient, dc *dashboardContext) {
+	var tracePanels []*panelContext
+	for i := range dc.Panels {
+		if dc.Panels[i].Error == "" && hasTraceData(&dc.Panels[i]) {
+			tracePanels = append(tracePanels, &dc.Panels[i])
+		}
+	}
+	if len(tracePanels) == 0 {
+		return
+	}
+	ctx, span := startSpan(ctx, "context.summarize_traces")
+	defer span.End()
+
+	lookup := &traceLookup{
+		client:   client,
+		resolver: &dataSourceResolver{client: client, refs: make(map[string]dataSourceRef)},
+		settings: make(map[string]*dataSourceSettings),
+	}
+	seen := make(map[string]bool)
+	fetched := 0
+	for _, panel := range tracePanels {
+		traces := summarizeTraces(panel.Frames, traceSourcePanel)
+		panel.Traces = traces[:min(len(traces), maxContextTraces)]
+		for _, s := range panel.Traces {
+			seen[s.TraceID] = true
+		}
+
+		var refs []traceRef
+		for _, ref := range lookup.panelTraceRefs(ctx, dc, panel) {
+			if seen[ref.ID] || fetched+len(refs) >= maxDashboardTraces || len(panel.Traces)+len(refs) >= maxContextTraces {
+				continue
+			}
+			seen[ref.ID] = true
+			refs = append(refs, ref)
+		}
+		for len(refs) > 0 {
+			source := refs[0].Datasource
+			var ids []string
+			sources := make(map[string]string)
+			refs = slices.DeleteFunc(refs, func(ref traceRef) bool {
+				if ref.Datasource != source {
+					return false
+				}
+				ids = append(ids, ref.ID)
+				sources[ref.ID] = ref.Source
+				return true
+			})
+			fetched += len(ids)
+			frames, err := fetchTraces(ctx, client, dc, source, ids)
+			if err != nil {
+				log.DefaultLogger.Warn("Failed to fetch traces", "dashboard", dc.UID, "panel", panel.ID, "error", err)
+				continue
+			}
+			for _, s := range summarizeTraces(frames, "") {
+				s.Source = sources[s.TraceID]
+				if s.Source != "" {
+					panel.Traces = append(panel.Traces, s)
+				}
+			}
+		}
+	}
+	span.SetAttributes(attribute.Int("context.trace_panels", len(tracePanels)), attribute.Int("context.traces", fetched))
+}
+
+// writeTraceSummary renders the trace summaries of a panel.
+func writeTraceSummary(b *strings.Builder, traces []traceSummary) {
+	sources := map[string]string{traceSourceExemplar: " (from an exemplar)", traceSourceSearch: " (from the search results)"}
+	for _, s := range traces {
+		fmt.Fprintf(b, "  Trace %s%s: %s at %s, %s, %d spans in %d services",
+			s.TraceID, sources[s.Source], traceSpan{Service: s.Service, Operation: s.Operation}.name(), s.Start.Format(time.RFC3339), formatSpanDuration(s.Duration), s.SpanCount, s.Services)
+		if s.ErrorCount > 0 {
+			fmt.Fprintf(b, ", %d failed spans", s.ErrorCount)
+		}
+		b.WriteString("\n")
+
+		path := make([]string, len(s.CriticalPath))
+		for i, span := range s.CriticalPath {
+			path[i] = fmt.Sprintf("%s %s (self %s)", span.name(), formatSpanDuration(span.Duration), formatSpanDuration(span.SelfTime))
+		}
+		fmt.Fprintf(b, "    Critical path: %s", strings.Join(path, " > "))
+		if omitted := s.CriticalPathLength - len(s.CriticalPath); omitted > 0 {
+			fmt.Fprintf(b, " > (%d more)", omitted)
+		}
+		b.WriteString("\n")
+
+		slowest := make([]string, len(s.Slowest))
+		for i, span := range s.Slowest {
+			slowest[i] = fmt.Sprintf("%s self %s of %s", span.name(), formatSpanDuration(span.SelfTime), formatSpanDuration(span.Duration))
+		}
+		fmt.Fprintf(b, "    Slowest by self time: %s\n", strings.Join(slowest, "; "))
+
+		if len(s.Errors) > 0 {
+			failed := make([]string, len(s.Errors))
+			for i, span := range s.Errors {
+				failed[i] = span.name()
+				if span.Status != "" {
+					failed[i] += ": " + span.Status
+				}
+			}
+			fmt.Fprintf(b, "    Failed spans: %s\n", strings.Join(failed, "; "))
+		}
+
+		b.WriteString("    Span tree (* marks the critical path, xN repeated calls):\n")
+		for _, line := range s.Tree {
+			fmt.Fprintf(b, "      %s\n", line)
+		}
+		if s.TreeOmitted > 0 {
+			fmt.Fprintf(b, "      (%d more spans)\n", s.TreeOmitted)
+		}
+	}
+}
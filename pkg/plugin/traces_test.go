@@ -0,0 +1,194 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+type testSpan struct {
+	id, parent, service, operation string
+	start, end                     float64
+	status                         string
+	tags                           string
+}
+
+// testTraceSpans is a checkout whose payment fails after three sequential
+// database calls.
+var testTraceSpans = []testSpan{
+	{id: "1", service: "frontend", operation: "GET /checkout", start: 0, end: 800},
+	{id: "2", parent: "1", service: "checkout", operation: "PlaceOrder", start: 10, end: 790},
+	{id: "3", parent: "2", service: "cart", operation: "GetCart", start: 20, end: 120},
+	{id: "4", parent: "2", service: "db", operation: "SELECT", start: 130, end: 180},
+	{id: "5", parent: "2", service: "db", operation: "SELECT", start: 180, end: 230},
+	{id: "6", parent: "2", service: "db", operation: "SELECT", start: 230, end: 400},
+	{id: "7", parent: "2", service: "payment", operation: "Charge", start: 400, end: 780, status: "card declined"},
+	{id: "8", parent: "7", service: "fraud", operation: "Check", start: 410, end: 450, tags: `[{"key":"error","value":true}]`},
+	{id: "9", parent: "1", service: "frontend", operation: "render", start: 790, end: 795},
+}
+
+// newTestTraceFrame builds a frame like Tempo's for a trace of spans, which
+// start at offsets in milliseconds from 1700000000000.
+func newTestTraceFrame(traceID string, spans []testSpan) *data.Frame {
+	frame := data.NewFrame("Trace",
+		data.NewField("traceID", nil, []string{}),
+		data.NewField("spanID", nil, []string{}),
+		data.NewField("parentSpanID", nil, []string{}),
+		data.NewField("serviceName", nil, []string{}),
+		data.NewField("operationName", nil, []string{}),
+		data.NewField("startTime", nil, []float64{}),
+		data.NewField("duration", nil, []float64{}),
+		data.NewField("statusCode", nil, []*int64{}),
+		data.NewField("statusMessage", nil, []*string{}),
+		data.NewField("tags", nil, []json.RawMessage{}),
+	)
+	for _, s := range spans {
+		var code *int64
+		var message *string
+		if s.status != "" {
+			code, message = new(int64), &s.status
+			*code = traceStatusError
+		}
+		frame.AppendRow(traceID, s.id, s.parent, s.service, s.operation, 1700000000000+s.start, s.end-s.start, code, message, json.RawMessage(orDefaultString(s.tags, "[]")))
+	}
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTrace}
+	return frame
+}
+
+func TestSummarizeTrace(t *testing.T) {
+	traces := summarizeTraces(data.Frames{newTestTraceFrame("abc", testTraceSpans)}, traceSourcePanel)
+	if len(traces) != 1 {
+		t.Fatalf("Expected one trace, got %+v", traces)
+	}
+	s := traces[0]
+	if s.TraceID != "abc" || s.Service != "frontend" || s.Operation != "GET /checkout" || s.Duration != 800 ||
+		s.SpanCount != 9 || s.Services != 6 || s.ErrorCount != 2 || s.Start.UnixMilli() != 1700000000000 {
+		t.Errorf("Unexpected trace summary %+v", s)
+	}
+
+	names := func(spans []traceSpan, withSelf bool) string {
+		var out []string
+		for _, span := range spans {
+			name := span.name()
+			if withSelf {
+				name += fmt.Sprintf("=%g", span.SelfTime)
+			}
+			out = append(out, name)
+		}
+		return strings.Join(out, ", ")
+	}
+	if got, expected := names(s.CriticalPath, true), "frontend GET /checkout=15, checkout PlaceOrder=30, cart GetCart=100, db SELECT=50, db SELECT=50, db SELECT=170, payment Charge=340, fraud Check=40, frontend render=5"; got != expected {
+		t.Errorf("Expected critical path %q, got %q", expected, got)
+	}
+	if got, expected := names(s.Slowest, true), "payment Charge=340, db SELECT=170, cart GetCart=100, db SELECT=50, db SELECT=50"; got != expected {
+		t.Errorf("Expected slowest spans %q, got %q", expected, got)
+	}
+	if len(s.Errors) != 2 || s.Errors[0].Status != "card declined" || s.Errors[1].name() != "fraud Check" {
+		t.Errorf("Unexpected failed spans %+v", s.Errors)
+	}
+
+	expected := []string{
+		"* frontend GET /checkout 800ms",
+		"  * checkout PlaceOrder 780ms",
+		"    * cart GetCart 100ms",
+		"    * db SELECT x3, total 270ms, max 170ms",
+		"    * payment Charge 380ms [error: card declined]",
+		"      * fraud Check 40ms [error]",
+		"  * frontend render 5ms",
+	}
+	if !slices.Equal(s.Tree, expected) || s.TreeOmitted != 0 {
+		t.Errorf("Expected tree\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(s.Tree, "\n"))
+	}
+
+	var b strings.Builder
+	writePanelSummary(&b, panelContext{Traces: traces}, detailStandard, s.Start)
+	for _, want := range []string{"Trace abc: frontend GET /checkout at 2023-11-14T22:13:20Z, 800ms, 9 spans in 6 services, 2 failed spans",
+		"Critical path: frontend GET /checkout 800ms (self 15ms) > checkout PlaceOrder 780ms (self 30ms)", "Failed spans: payment Charge: card declined; fraud Check"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected %q in the summary:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestContextTraces(t *testing.T) {
+	const dashboard = `{"dashboard": {"uid": "traces", "title": "Checkout", "panels": [
+		{"id": 1, "type": "traces", "title": "Slow checkout", "datasource": {"type": "tempo", "uid": "tempo"}, "targets": [{"refId": "A", "queryType": "traceql", "query": "trace-1"}]},
+		{"id": 2, "type": "timeseries", "title": "Latency", "datasource": {"type": "prometheus", "uid": "prom"}, "targets": [{"refId": "A", "expr": "histogram_quantile(0.99, rate(checkout_seconds_bucket[5m]))", "exemplar": true}]}
+	]}}`
+
+	var mu sync.Mutex
+	var fetched []string
+	grafana := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/dashboards/uid/traces":
+			w.Write([]byte(dashboard))
+		case "/api/datasources/uid/prom":
+			w.Write([]byte(`{"uid":"prom","type":"prometheus","jsonData":{"exemplarTraceIdDestinations":[{"name":"trace_id","datasourceUid":"tempo"}]}}`))
+		case "/api/datasources/uid/tempo":
+			w.Write([]byte(`{"uid":"tempo","type":"tempo","jsonData":{}}`))
+		case "/api/ds/query":
+			var req dsQueryRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			resp := backend.NewQueryDataResponse()
+			for _, q := range req.Queries {
+				refID, _ := q["refId"].(string)
+				ds, _ := q["datasource"].(map[string]any)
+				if ds["uid"] == "prom" {
+					exemplars := data.NewFrame("exemplar",
+						data.NewField("Time", nil, []time.Time{time.UnixMilli(1700000000000), time.UnixMilli(1700000060000), time.UnixMilli(1700000120000)}),
+						data.NewField("Value", nil, []float64{0.9, 0.1, 0.5}),
+						data.NewField("trace_id", nil, []string{"trace-2", "trace-1", "trace-3"}),
+					).SetRefID(refID)
+					resp.Responses[refID] = backend.DataResponse{Frames: data.Frames{exemplars}}
+					continue
+				}
+				id, _ := q["query"].(string)
+				if strings.HasPrefix(refID, "trace") && q["queryType"] != "traceId" {
+					t.Errorf("Expected Tempo to be queried by trace ID, got %v", q)
+				}
+				mu.Lock()
+				fetched = append(fetched, id)
+				mu.Unlock()
+				resp.Responses[refID] = backend.DataResponse{Frames: data.Frames{newTestTraceFrame(id, testTraceSpans)}}
+			}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer grafana.Close()
+
+	ds := &Datasource{config: pluginConfig{GrafanaURL: grafana.URL}}
+	req := httptest.NewRequest("GET", "/context?dashboardUid=traces&from=1699999000000&to=1700001000000", nil)
+	rr := httptest.NewRecorder()
+	ds.handleContext(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	slices.Sort(fetched)
+	if !slices.Equal(fetched, []string{"trace-1", "trace-2", "trace-3"}) {
+		t.Errorf("Expected the panel's trace and the exemplars' other traces to be fetched once, got %v", fetched)
+	}
+	var resp struct {
+		Prompt string `json:"prompt"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	for _, want := range []string{"Trace trace-1: frontend GET /checkout", "Trace trace-2 (from an exemplar)", "Trace trace-3 (from an exemplar)", "      * db SELECT x3"} {
+		if !strings.Contains(resp.Prompt, want) {
+			t.Errorf("Expected %q in the prompt, got %s", want, resp.Prompt)
+		}
+	}
+	if strings.Contains(resp.Prompt, "Series duration") || strings.Index(resp.Prompt, "Trace trace-2") > strings.Index(resp.Prompt, "Trace trace-3") {
+		t.Errorf("Expected trace frames to be summarized as traces only, the slowest exemplar first, got %s", resp.Prompt)
+	}
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attribute keys. Model and token attributes follow the OpenTelemetry
+// GenAI semantic conventions so they line up with other LLM instrumentation.
+const (
+	attrModel            = "gen_ai.request.model"
+	attrInputTokens      = "gen_ai.usage.input_tokens"
+	attrOutputTokens     = "gen_ai.usage.output_tokens"
+	attrTotalTokens      = "chat.usage.total_tokens"
+	attrMessagesCount    = "chat.messages_count"
+	attrPayloadBytes     = "chat.payload_bytes"
+	attrStatusCode       = "http.response.status_code"
+	attrRateLimitAllowed = "chat.rate_limit.allowed"
+	attrRetryAttempt     = "chat.retry.attempt"
+	attrRetryWillRetry   = "chat.retry.will_retry"
+	attrEstimatedTokens  = "chat.budget.estimated_tokens"
+	attrContextWindow    = "chat.budget.context_window"
+	attrDroppedMessages  = "chat.budget.dropped_messages"
+	attrDroppedPanels    = "chat.budget.dropped_panels"
+	attrHistoryMessages  = "chat.history.summarized_messages"
+	attrPanelID          = "grafana.panel.id"
+	attrToolName         = "gen_ai.tool.name"
+	attrAgentIterations  = "agent.iterations"
+	attrAgentStop        = "agent.stop_reason"
+)
+
+// startSpan starts a span with the plugin's default tracer. The tracer is looked
+// up on every call so that tests can install their own with
+// tracing.InitDefaultTracer.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, name)
+}
+
+// spanError records err on span and returns it.
+func spanError(span trace.Span, err *requestError) *requestError {
+	tracing.Error(span, err)
+	return err
+}
+
+// writeRequestError records err and the response status on span and sends it
+// to the client.
+func writeRequestError(w http.ResponseWriter, span trace.Span, err *requestError) {
+	span.SetAttributes(attribute.Int(attrStatusCode, err.status))
+	spanError(span, err)
+	http.Error(w, err.message, err.status)
+}
+
+// usageAttributes converts token counts to span attributes.
+func usageAttributes(usage chatUsage) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int(attrInputTokens, usage.PromptTokens),
+		attribute.Int(attrOutputTokens, usage.CompletionTokens),
+		attribute.Int(attrTotalTokens, usage.TotalTokens),
+	}
+}
@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// setupTestTracer installs a tracer that records into an in-memory exporter.
+func setupTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracing.InitDefaultTracer(provider.Tracer("test"))
+	t.Cleanup(func() {
+		_ = provider.Shutdown(t.Context())
+	})
+	return exporter
+}
+
+func findSpans(spans tracetest.SpanStubs, name string) tracetest.SpanStubs {
+	var found tracetest.SpanStubs
+	for _, span := range spans {
+		if span.Name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+func spanAttribute(span tracetest.SpanStub, key string) (attribute.Value, bool) {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func newTestChatRequest() *http.Request {
+	body := `{"model":"llama-3.3-70b-versatile","messages":[{"role":"user","content":"hello"}]}`
+	req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestChatSpans(t *testing.T) {
+	exporter := setupTestTracer(t)
+	globalRateLimiter.reset()
+
+	groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`))
+	}))
+	defer groq.Close()
+
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		groqURL:  groq.URL,
+	}
+
+	rr := httptest.NewRecorder()
+	ds.handleGroqChat(rr, newTestChatRequest())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	spans := exporter.GetSpans()
+	for _, name := range []string{"chat.handle", "chat.rate_limit", "chat.validate", "chat.build_context", "chat.upstream_attempt", "chat.process_response"} {
+		if len(findSpans(spans, name)) != 1 {
+			t.Errorf("Expected exactly one %s span, got %d", name, len(findSpans(spans, name)))
+		}
+	}
+
+	root := findSpans(spans, "chat.handle")[0]
+	for _, span := range spans {
+		if span.Name != "chat.handle" && span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("Span %s is not a child of chat.handle", span.Name)
+		}
+	}
+
+	expected := map[string]attribute.Value{
+		attrModel:        attribute.StringValue("llama-3.3-70b-versatile"),
+		attrInputTokens:  attribute.IntValue(12),
+		attrOutputTokens: attribute.IntValue(3),
+		attrTotalTokens:  attribute.IntValue(15),
+		attrStatusCode:   attribute.IntValue(http.StatusOK),
+	}
+	for key, want := range expected {
+		got, ok := spanAttribute(root, key)
+		if !ok || got != want {
+			t.Errorf("Expected root attribute %s=%v, got %v", key, want.Emit(), got.Emit())
+		}
+	}
+}
+
+func TestChatSpansRecordUpstreamErrors(t *testing.T) {
+	exporter := setupTestTracer(t)
+	globalRateLimiter.reset()
+
+	calls := 0
+	groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer groq.Close()
+
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		groqURL:  groq.URL,
+	}
+
+	rr := httptest.NewRecorder()
+	ds.handleGroqChat(rr, newTestChatRequest())
+	if rr.Code != http.StatusBadGateway || calls != 1 {
+		t.Fatalf("Expected status %d after a single call, got %d after %d calls", http.StatusBadGateway, rr.Code, calls)
+	}
+
+	attempts := findSpans(exporter.GetSpans(), "chat.upstream_attempt")
+	if len(attempts) != 1 {
+		t.Fatalf("Expected 1 upstream attempt span, got %d", len(attempts))
+	}
+	if v, _ := spanAttribute(attempts[0], attrStatusCode); v.AsInt64() != http.StatusServiceUnavailable {
+		t.Errorf("Expected attempt status 503, got %d", v.AsInt64())
+	}
+	if v, _ := spanAttribute(attempts[0], attrRetryAttempt); v.AsInt64() != 1 {
+		t.Errorf("Expected attempt number 1, got %d", v.AsInt64())
+	}
+	if v, ok := spanAttribute(attempts[0], attrRetryWillRetry); !ok || v.AsBool() {
+		t.Errorf("Expected the attempt not to be retried, got %v", v.AsInterface())
+	}
+	if attempts[0].Status.Description != "External API error occurred" {
+		t.Errorf("Expected upstream span error status, got %q", attempts[0].Status.Description)
+	}
+}
+
+func TestChatSpansRecordValidationErrors(t *testing.T) {
+	exporter := setupTestTracer(t)
+	globalRateLimiter.reset()
+
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+	}
+
+	req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(`{"model":"bad model","messages":[]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	ds.handleGroqChat(rr, req)
+
+	validate := findSpans(exporter.GetSpans(), "chat.validate")
+	if len(validate) != 1 {
+		t.Fatalf("Expected one validation span, got %d", len(validate))
+	}
+	if validate[0].Status.Description != "Invalid model name" {
+		t.Errorf("Expected validation span error status, got %q", validate[0].Status.Description)
+	}
+	if len(findSpans(exporter.GetSpans(), "chat.upstream_attempt")) != 0 {
+		t.Error("Expected no upstream attempt for an invalid request")
+	}
+}
@@ -0,0 +1,416 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// usageRetention is how long usage records are kept.
+	usageRetention = 90 * 24 * time.Hour
+
+	// maxUsageRecords bounds the memory used by the ledger.
+	maxUsageRecords = 100000
+
+	// usageTrimBatch is how far the ledger may grow past maxUsageRecords
+	// before the oldest records are dropped, so a full ledger is not copied
+	// on every request.
+	usageTrimBatch = maxUsageRecords / 10
+
+	// usageDir is the usage directory below the plugin data directory.
+	usageDir = "usage"
+
+	// usageFileDay is the layout of the day in the name of a usage file.
+	usageFileDay = "20060102"
+)
+
+// modelPrice is the price in USD per million tokens.
+type modelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// defaultPricing holds Groq's list prices for the models offered by default.
+// Prices change, so deployments should configure their own table.
+var defaultPricing = map[string]modelPrice{
+	"llama-3.3-70b-versatile": {Input: 0.59, Output: 0.79},
+	"llama-3.1-8b-instant":    {Input: 0.05, Output: 0.08},
+}
+
+// usageRecord describes a single completed chat request.
+type usageRecord struct {
+	Time             time.Time     `json:"time"`
+	User             string        `json:"user"`
+	OrgID            int64         `json:"orgId"`
+	DashboardUID     string        `json:"dashboardUid"`
+	Model            string        `json:"model"`
+	PromptTokens     int           `json:"promptTokens"`
+	CompletionTokens int           `json:"completionTokens"`
+	Latency          time.Duration `json:"latency"`
+}
+
+// usageAggregate sums the usage of one group.
+type usageAggregate struct {
+	Key              string  `json:"key"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	TotalTokens      int     `json:"totalTokens"`
+	EstimatedCost    float64 `json:"estimatedCost"`
+	AvgLatencyMs     float64 `json:"avgLatencyMs"`
+}
+
+// usageGroupings maps the supported groupBy values to the record key.
+var usageGroupings = map[string]func(usageRecord) string{
+	"user":      func(r usageRecord) string { return r.User },
+	"dashboard": func(r usageRecord) string { return r.DashboardUID },
+	"model":     func(r usageRecord) string { return r.Model },
+	"day":       func(r usageRecord) string { return r.Time.UTC().Format(time.DateOnly) },
+}
+
+// usageTotalKey puts all records into a single group.
+func usageTotalKey(usageRecord) string {
+	return "total"
+}
+
+// usageLedger keeps usage records in memory. Records older than
+// usageRetention are dropped, so the ledger covers recent usage only. A
+// ledger opened with openUsageLedger also appends its records as JSON lines
+// to one file per day, and reads them back when the plugin starts;
+// otherwise it starts empty.
+type usageLedger struct {
+	mu      sync.Mutex
+	records []usageRecord
+	pricing map[string]modelPrice
+
+	// dir is where the ledger's files are, or "" if it isn't persisted.
+	// file is open for appending records of day.
+	dir  string
+	file *os.File
+	day  string
+}
+
+func newUsageLedger(pricing map[string]modelPrice) *usageLedger {
+	merged := make(map[string]modelPrice, len(defaultPricing)+len(pricing))
+	for model, price := range defaultPricing {
+		merged[model] = price
+	}
+	for model, price := range pricing {
+		merged[model] = price
+	}
+	return &usageLedger{pricing: merged}
+}
+
+// openUsageLedger creates a ledger that is persisted in dir and loads the
+// records of the retention period from it. Expired files are deleted, and
+// lines that can't be decoded, e.g. one cut short by a crash, are skipped.
+func openUsageLedger(dir string, pricing map[string]modelPrice) (*usageLedger, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create usage directory: %w", err)
+	}
+	l := newUsageLedger(pricing)
+	l.dir = dir
+
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-usageRetention)
+	for _, name := range files {
+		if l.expired(name, cutoff) {
+			if err := os.Remove(name); err != nil {
+				log.DefaultLogger.Warn("Failed to delete expired usage file", "file", name, "error", err)
+			}
+			continue
+		}
+		records, err := readUsageFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			if !rec.Time.Before(cutoff) {
+				l.records = append(l.records, rec)
+			}
+		}
+	}
+	if excess := len(l.records) - maxUsageRecords; excess > 0 {
+		l.records = l.records[excess:]
+	}
+	return l, nil
+}
+
+// files returns the usage files, oldest first.
+func (l *usageLedger) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, "usage-*.jsonl"))
+	sort.Strings(files)
+	return files, err
+}
+
+// expired reports whether a usage file only holds records from before
+// cutoff. Files whose name has no day are left alone.
+func (l *usageLedger) expired(name string, cutoff time.Time) bool {
+	day, err := time.Parse(usageFileDay, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "usage-"), ".jsonl"))
+	return err == nil && day.Add(24*time.Hour).Before(cutoff)
+}
+
+// readUsageFile reads all records of a file, skipping lines that can't be
+// decoded.
+func readUsageFile(name string) ([]usageRecord, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []usageRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec usageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// record adds a record to the ledger. A nil ledger discards it.
+func (l *usageLedger) record(rec usageRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, rec)
+
+	// Drop expired records. Reslicing leaves the copy to append, which only
+	// moves the remaining records once the backing array is full.
+	cutoff := time.Now().Add(-usageRetention)
+	drop := 0
+	for drop < len(l.records) && l.records[drop].Time.Before(cutoff) {
+		drop++
+	}
+	l.records = l.records[drop:]
+
+	// Drop the oldest records in batches once the ledger is full
+	if excess := len(l.records) - maxUsageRecords; excess > usageTrimBatch {
+		l.records = append([]usageRecord(nil), l.records[excess:]...)
+	}
+
+	if l.dir != "" && !rec.Time.Before(cutoff) {
+		if err := l.write(rec, cutoff); err != nil {
+			log.DefaultLogger.Error("Failed to write usage record", "error", err)
+		}
+	}
+}
+
+// write appends a record to the file of its day, which is synced after
+// every record like the audit log. Switching to a new file deletes the
+// expired ones. Must be called with l.mu held.
+func (l *usageLedger) write(rec usageRecord, cutoff time.Time) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if day := rec.Time.UTC().Format(usageFileDay); l.file == nil || day != l.day {
+		if l.file != nil {
+			if err := l.file.Close(); err != nil {
+				log.DefaultLogger.Warn("Failed to close usage file", "error", err)
+			}
+			l.file = nil
+		}
+		file, err := os.OpenFile(filepath.Join(l.dir, "usage-"+day+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		l.file, l.day = file, day
+		l.deleteExpired(cutoff)
+	}
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// deleteExpired removes the files of days before cutoff. Must be called
+// with l.mu held.
+func (l *usageLedger) deleteExpired(cutoff time.Time) {
+	files, err := l.files()
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to list usage files", "error", err)
+		return
+	}
+	for _, name := range files {
+		if l.expired(name, cutoff) {
+			if err := os.Remove(name); err != nil {
+				log.DefaultLogger.Warn("Failed to delete expired usage file", "file", name, "error", err)
+			}
+		}
+	}
+}
+
+// close closes the current file.
+func (l *usageLedger) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// cost estimates the cost of a record. Models without a price cost nothing.
+func (l *usageLedger) cost(rec usageRecord) float64 {
+	price := l.pricing[rec.Model]
+	return (float64(rec.PromptTokens)*price.Input + float64(rec.CompletionTokens)*price.Output) / 1e6
+}
+
+// query returns the records of an organization within [from, to).
+func (l *usageLedger) query(orgID int64, from, to time.Time) []usageRecord {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var result []usageRecord
+	for _, rec := range l.records {
+		if rec.OrgID == orgID && !rec.Time.Before(from) && rec.Time.Before(to) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// aggregate groups records by key and sums them, sorted by key.
+func (l *usageLedger) aggregate(records []usageRecord, key func(usageRecord) string) []usageAggregate {
+	groups := make(map[string]*usageAggregate)
+	latency := make(map[string]time.Duration)
+	for _, rec := range records {
+		k := key(rec)
+		agg, ok := groups[k]
+		if !ok {
+			agg = &usageAggregate{Key: k}
+			groups[k] = agg
+		}
+		agg.Requests++
+		agg.PromptTokens += rec.PromptTokens
+		agg.CompletionTokens += rec.CompletionTokens
+		agg.TotalTokens += rec.PromptTokens + rec.CompletionTokens
+		agg.EstimatedCost += l.cost(rec)
+		latency[k] += rec.Latency
+	}
+
+	result := make([]usageAggregate, 0, len(groups))
+	for k, agg := range groups {
+		agg.AvgLatencyMs = float64(latency[k].Milliseconds()) / float64(agg.Requests)
+		result = append(result, *agg)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// handleUsage returns aggregated usage of the caller's organization. Only
+// organization admins may see it, since it breaks usage down per user.
+//
+// Query parameters: groupBy (user, dashboard, model or day; default model),
+// from and to (RFC 3339; default the last 30 days).
+func (ds *Datasource) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isOrgAdmin(backend.UserFromContext(r.Context())) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	groupBy := query.Get("groupBy")
+	if groupBy == "" {
+		groupBy = "model"
+	}
+	key, ok := usageGroupings[groupBy]
+	if !ok {
+		http.Error(w, "Invalid groupBy", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-30 * 24 * time.Hour)
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	orgID := backend.PluginConfigFromContext(r.Context()).OrgID
+	records := ds.usage.query(orgID, from, to)
+
+	resp := struct {
+		GroupBy string           `json:"groupBy"`
+		From    time.Time        `json:"from"`
+		To      time.Time        `json:"to"`
+		Groups  []usageAggregate `json:"groups"`
+		Total   usageAggregate   `json:"total"`
+	}{
+		GroupBy: groupBy,
+		From:    from,
+		To:      to,
+		Groups:  ds.usage.aggregate(records, key),
+		Total:   usageAggregate{Key: "total"},
+	}
+	if total := ds.usage.aggregate(records, usageTotalKey); len(total) == 1 {
+		resp.Total = total[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.DefaultLogger.Error("Failed to encode usage response", "error", err)
+	}
+}
+
+// isOrgAdmin reports whether user is an admin of the current organization.
+func isOrgAdmin(user *backend.User) bool {
+	return user != nil && user.Role == "Admin"
+}
+
+// newUsageRecord describes a completed chat request of the calling user.
+func newUsageRecord(ctx context.Context, req *chatRequest, usage chatUsage, latency time.Duration) usageRecord {
+	rec := usageRecord{
+		Time:             time.Now(),
+		OrgID:            backend.PluginConfigFromContext(ctx).OrgID,
+		DashboardUID:     req.DashboardUID,
+		Model:            req.Model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Latency:          latency,
+	}
+	if user := backend.UserFromContext(ctx); user != nil {
+		rec.User = user.Login
+	}
+	return rec
+}
@@ -0,0 +1,204 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestUsageLedgerAggregate(t *testing.T) {
+	ledger := newUsageLedger(map[string]modelPrice{"custom": {Input: 1, Output: 2}})
+	now := time.Now()
+	ledger.record(usageRecord{Time: now, User: "alice", OrgID: 1, Model: "custom", PromptTokens: 1000000, CompletionTokens: 500000, Latency: time.Second})
+	ledger.record(usageRecord{Time: now, User: "bob", OrgID: 1, Model: "llama-3.3-70b-versatile", PromptTokens: 1000000, Latency: 3 * time.Second})
+	ledger.record(usageRecord{Time: now, User: "alice", OrgID: 1, Model: "unpriced", PromptTokens: 10})
+	ledger.record(usageRecord{Time: now, User: "carol", OrgID: 2, Model: "custom", PromptTokens: 10})
+
+	records := ledger.query(1, now.Add(-time.Minute), now.Add(time.Minute))
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records for org 1, got %d", len(records))
+	}
+
+	byUser := ledger.aggregate(records, usageGroupings["user"])
+	if len(byUser) != 2 || byUser[0].Key != "alice" || byUser[1].Key != "bob" {
+		t.Fatalf("Unexpected user groups: %+v", byUser)
+	}
+	if byUser[0].Requests != 2 || byUser[0].TotalTokens != 1500010 {
+		t.Errorf("Unexpected totals for alice: %+v", byUser[0])
+	}
+	if math.Abs(byUser[0].EstimatedCost-2) > 1e-9 {
+		t.Errorf("Expected alice to cost 2, got %v", byUser[0].EstimatedCost)
+	}
+	if math.Abs(byUser[1].EstimatedCost-0.59) > 1e-9 {
+		t.Errorf("Expected default pricing for bob, got %v", byUser[1].EstimatedCost)
+	}
+	if byUser[1].AvgLatencyMs != 3000 {
+		t.Errorf("Expected 3000ms average latency for bob, got %v", byUser[1].AvgLatencyMs)
+	}
+}
+
+func TestUsageLedgerRetention(t *testing.T) {
+	ledger := newUsageLedger(nil)
+	ledger.record(usageRecord{Time: time.Now().Add(-usageRetention - time.Hour)})
+	ledger.record(usageRecord{Time: time.Now()})
+
+	if len(ledger.records) != 1 {
+		t.Errorf("Expected expired record to be dropped, got %d records", len(ledger.records))
+	}
+}
+
+func TestUsageLedgerPersistence(t *testing.T) {
+	dir := t.TempDir()
+	expired := filepath.Join(dir, "usage-20000101.jsonl")
+	if err := os.WriteFile(expired, []byte(`{"time":"2000-01-01T00:00:00Z","user":"old"}`+"\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := openUsageLedger(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open usage ledger: %v", err)
+	}
+	if len(ledger.records) != 0 {
+		t.Errorf("Expected expired records not to be loaded, got %+v", ledger.records)
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired file to be deleted, got %v", err)
+	}
+
+	now := time.Now()
+	ledger.record(usageRecord{Time: now.Add(-48 * time.Hour), User: "alice", OrgID: 1, Model: "custom", PromptTokens: 10})
+	ledger.record(usageRecord{Time: now, User: "bob", OrgID: 1, Model: "custom", PromptTokens: 20})
+	ledger.record(usageRecord{Time: now.Add(-usageRetention - time.Hour), User: "carol", OrgID: 1})
+	ledger.close()
+
+	// A line cut short by a crash is skipped
+	today := filepath.Join(dir, "usage-"+now.UTC().Format(usageFileDay)+".jsonl")
+	f, err := os.OpenFile(today, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Expected a file for today: %v", err)
+	}
+	f.WriteString(`{"time":`)
+	f.Close()
+
+	reopened, err := openUsageLedger(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen usage ledger: %v", err)
+	}
+	defer reopened.close()
+	records := reopened.query(1, now.Add(-72*time.Hour), now.Add(time.Minute))
+	if len(records) != 2 || records[0].User != "alice" || records[1].User != "bob" || records[1].PromptTokens != 20 {
+		t.Errorf("Expected the records to survive a restart, got %+v", records)
+	}
+}
+
+func TestUsageLedgerTrim(t *testing.T) {
+	ledger := newUsageLedger(nil)
+	now := time.Now()
+	for i := 0; i < maxUsageRecords+usageTrimBatch; i++ {
+		ledger.record(usageRecord{Time: now, PromptTokens: i})
+	}
+	if len(ledger.records) != maxUsageRecords+usageTrimBatch {
+		t.Fatalf("Expected the ledger to grow by up to a batch, got %d records", len(ledger.records))
+	}
+
+	ledger.record(usageRecord{Time: now, PromptTokens: maxUsageRecords + usageTrimBatch})
+	if len(ledger.records) != maxUsageRecords {
+		t.Fatalf("Expected the ledger to be trimmed to %d records, got %d", maxUsageRecords, len(ledger.records))
+	}
+	if first := ledger.records[0].PromptTokens; first != usageTrimBatch+1 {
+		t.Errorf("Expected the oldest records to be dropped, first record is %d", first)
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	ds := &Datasource{usage: newUsageLedger(nil)}
+	ds.usage.record(usageRecord{Time: time.Now(), OrgID: 1, Model: "llama-3.3-70b-versatile", DashboardUID: "abc", PromptTokens: 10, CompletionTokens: 5})
+
+	testCases := []struct {
+		name           string
+		role           string
+		query          string
+		expectedStatus int
+	}{
+		{name: "viewer is forbidden", role: "Viewer", query: "", expectedStatus: http.StatusForbidden},
+		{name: "invalid groupBy", role: "Admin", query: "?groupBy=color", expectedStatus: http.StatusBadRequest},
+		{name: "invalid from", role: "Admin", query: "?from=yesterday", expectedStatus: http.StatusBadRequest},
+		{name: "group by dashboard", role: "Admin", query: "?groupBy=dashboard", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/usage"+tc.query, nil)
+			ctx := backend.WithUser(req.Context(), &backend.User{Login: "admin", Role: tc.role})
+			ctx = backend.WithPluginContext(ctx, backend.PluginContext{OrgID: 1})
+			rr := httptest.NewRecorder()
+			ds.handleUsage(rr, req.WithContext(ctx))
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Groups []usageAggregate `json:"groups"`
+				Total  usageAggregate   `json:"total"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(resp.Groups) != 1 || resp.Groups[0].Key != "abc" || resp.Total.TotalTokens != 15 {
+				t.Errorf("Unexpected usage response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestChatRecordsUsage(t *testing.T) {
+	globalRateLimiter.reset()
+
+	groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if _, ok := body["dashboardUid"]; ok {
+			t.Error("Dashboard UID must not be forwarded to Groq")
+		}
+		w.Write([]byte(`{"choices":[],"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`))
+	}))
+	defer groq.Close()
+
+	ds := &Datasource{
+		settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key"}},
+		groqURL:  groq.URL,
+		usage:    newUsageLedger(nil),
+	}
+
+	body := `{"model":"llama-3.3-70b-versatile","dashboardUid":"dash-1","messages":[{"role":"user","content":"hello"}]}`
+	req := httptest.NewRequest("POST", "/groq-chat", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	ctx := backend.WithUser(req.Context(), &backend.User{Login: "alice"})
+	ctx = backend.WithPluginContext(ctx, backend.PluginContext{OrgID: 3})
+
+	rr := httptest.NewRecorder()
+	ds.handleGroqChat(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	if len(ds.usage.records) != 1 {
+		t.Fatalf("Expected 1 usage record, got %d", len(ds.usage.records))
+	}
+	rec := ds.usage.records[0]
+	if rec.User != "alice" || rec.OrgID != 3 || rec.DashboardUID != "dash-1" || rec.PromptTokens != 7 || rec.CompletionTokens != 3 {
+		t.Errorf("Unexpected usage record: %+v", rec)
+	}
+}
@@ -0,0 +1,366 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// defaultWebhookTimeoutSeconds is the time budget of the analysis of a
+	// notification. Grafana's webhook contact point gives up after
+	// grafanaWebhookTimeout, so the notification must be forwarded well
+	// before.
+	defaultWebhookTimeoutSeconds = 15
+	grafanaWebhookTimeout        = 30 * time.Second
+
+	// webhookForwardTimeout bounds the call of the downstream webhook.
+	webhookForwardTimeout = 10 * time.Second
+
+	// maxWebhookRules bounds the rules of a notification whose queries are
+	// run, and maxWebhookAlerts the alerts listed in a Slack message.
+	maxWebhookRules  = 3
+	maxWebhookAlerts = 10
+)
+
+// Formats of the forwarded notification.
+const (
+	webhookFormatJSON  = "json"
+	webhookFormatSlack = "slack"
+)
+
+const webhookInstructions = `You analyze a Grafana alert notification for the on-call engineer who receives it in a chat channel. Below are the alerts of the notification and, where available, their rules with the data of their queries.
+Answer with a JSON object with these keys:
+- "summary": what is happening, in one or two sentences
+- "probableCauses": an array of up to three objects with "cause", "likelihood" ("high", "medium" or "low") and "evidence", most likely first
+- "nextSteps": an array of up to three short checks or actions, most useful first
+Be brief. Base the analysis only on the data below.`
+
+// generatorURLRegex extracts the rule UID from the generator URL of a
+// Grafana-managed alert.
+var generatorURLRegex = regexp.MustCompile(`/alerting/grafana/([a-zA-Z0-9_-]+)/view`)
+
+// webhookConfig configures /alert-webhook. Zero values select the
+// defaults.
+type webhookConfig struct {
+	// URL is the downstream webhook notifications are forwarded to. The
+	// secure setting webhookUrl takes precedence, since the URL of e.g. a
+	// Slack webhook is a secret.
+	URL string `json:"url"`
+
+	// Format is one of the webhookFormat* formats.
+	Format string `json:"format"`
+
+	// Model analyzes the notifications.
+	Model string `json:"model"`
+
+	// TimeoutSeconds is the time budget of the analysis. When it runs out,
+	// the notification is forwarded without it.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// alertNotification is the payload of Grafana's webhook contact point.
+type alertNotification struct {
+	Receiver          string              `json:"receiver"`
+	Status            string              `json:"status"`
+	Alerts            []notificationAlert `json:"alerts"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Title             string              `json:"title"`
+}
+
+type notificationAlert struct {
+	Status       string             `json:"status"`
+	Labels       map[string]string  `json:"labels"`
+	Annotations  map[string]string  `json:"annotations"`
+	StartsAt     time.Time          `json:"startsAt"`
+	GeneratorURL string             `json:"generatorURL"`
+	Fingerprint  string             `json:"fingerprint"`
+	Values       map[string]float64 `json:"values"`
+}
+
+// validWebhookTimeout reports whether the analysis and the forwarding of a
+// notification fit into the time Grafana waits for the webhook.
+func validWebhookTimeout(seconds int) bool {
+	return time.Duration(seconds)*time.Second+webhookForwardTimeout < grafanaWebhookTimeout
+}
+
+func validWebhookFormat(format string) bool {
+	return format == "" || format == webhookFormatJSON || format == webhookFormatSlack
+}
+
+// webhookURL returns the downstream webhook from the secure plugin
+// configuration, or from the plugin settings.
+func (ds *Datasource) webhookURL() string {
+	if webhookURL := ds.settings.DecryptedSecureJSONData["webhookUrl"]; webhookURL != "" {
+		return webhookURL
+	}
+	return ds.config.Webhook.URL
+}
+
+// ruleUID returns the UID of the Grafana-managed rule that fired the alert,
+// or "" for alerts of other sources.
+func (a notificationAlert) ruleUID() string {
+	u, err := url.Parse(a.GeneratorURL)
+	if err != nil {
+		return ""
+	}
+	if m := generatorURLRegex.FindStringSubmatch(u.Path); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// analyzeNotification asks the model about the firing alerts of a
+// notification, with the data of their rules' queries. Rules that can't be
+// read are left out; the alerts' labels and values are still analyzed.
+func (ds *Datasource) analyzeNotification(ctx context.Context, r *http.Request, apiKey string, n *alertNotification) (*alertAnalysis, *requestError) {
+	ctx, span := startSpan(ctx, "webhook.analyze")
+	defer span.End()
+
+	rules := make(map[string][]firingAlert)
+	var order []string
+	for _, a := range n.Alerts {
+		if a.Status != "firing" {
+			continue
+		}
+		alert := firingAlert{Fingerprint: a.Fingerprint, Labels: a.Labels, Annotations: a.Annotations, StartsAt: a.StartsAt, Values: a.Values}
+		alert.Status.State = a.Status
+		uid := a.ruleUID()
+		if _, ok := rules[uid]; !ok {
+			order = append(order, uid)
+		}
+		rules[uid] = append(rules[uid], alert)
+	}
+
+	var b strings.Builder
+	b.WriteString(webhookInstructions)
+	fmt.Fprintf(&b, "\n\nNotification %q, receiver %q\n", truncate(n.Title, maxContextTitle), truncate(n.Receiver, maxContextTitle))
+	writeStringMap(&b, "Common labels", userLabels(n.CommonLabels))
+	writeStringMap(&b, "Common annotations", n.CommonAnnotations)
+
+	client, err := ds.newGrafanaClient(r)
+	if err != nil {
+		log.DefaultLogger.Warn("Cannot call Grafana API, analyzing without query data", "error", err)
+	}
+	now := time.Now().UTC()
+	for i, uid := range order {
+		alerts := rules[uid]
+		slices.SortFunc(alerts, func(a, b firingAlert) int { return a.StartsAt.Compare(b.StartsAt) })
+		var rule alertRule
+		if uid == "" || i >= maxWebhookRules || client == nil || ctx.Err() != nil {
+			writeNotificationAlerts(&b, alerts)
+			continue
+		}
+		if err := client.get(ctx, "/api/ruler/grafana/api/v1/rule/"+url.PathEscape(uid), &rule); err != nil {
+			log.DefaultLogger.Info("Failed to load alert rule of notification", "rule", uid, "error", err)
+			writeNotificationAlerts(&b, alerts)
+			continue
+		}
+		inv := &alertInvestigation{Rule: &rule, Alerts: alerts}
+		inv.From, inv.To = alertWindow(&rule, alerts, now)
+		inv.Queries = queryAlertData(ctx, client, &rule, inv.From, inv.To)
+		b.WriteString("\n")
+		inv.writeTo(&b)
+	}
+	span.SetAttributes(attribute.Int("webhook.rules", len(order)))
+
+	model := orDefaultString(ds.config.Webhook.Model, defaultChatModel)
+	chatReq := &chatRequest{Model: model, Messages: []chatMessage{
+		{Role: "system", Content: b.String()},
+		{Role: "user", Content: "Analyze this notification."},
+	}}
+	var analysis alertAnalysis
+	if _, reqErr := ds.completeJSON(ctx, apiKey, "alert-webhook", chatReq, &analysis); reqErr != nil {
+		return nil, reqErr
+	}
+	for i := range analysis.ProbableCauses {
+		if !slices.Contains(concernSeverities, analysis.ProbableCauses[i].Likelihood) {
+			analysis.ProbableCauses[i].Likelihood = "medium"
+		}
+	}
+	return &analysis, nil
+}
+
+// writeNotificationAlerts writes alerts whose rule isn't known.
+func writeNotificationAlerts(b *strings.Builder, alerts []firingAlert) {
+	fmt.Fprintf(b, "\nAlerts (%d):\n", len(alerts))
+	for _, a := range alerts[:min(len(alerts), maxAlertInstances)] {
+		fmt.Fprintf(b, "- since %s, labels %s", a.StartsAt.UTC().Format(time.RFC3339), formatStringMap(userLabels(a.Labels)))
+		writeAlertValues(b, a.Values)
+		if len(a.Annotations) > 0 {
+			fmt.Fprintf(b, ", annotations %s", formatStringMap(userLabels(a.Annotations)))
+		}
+		b.WriteString("\n")
+	}
+}
+
+// slackEscaper escapes the characters Slack's mrkdwn reserves.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackMessage renders a notification as a message of a Slack incoming
+// webhook, with the analysis if there is one.
+func slackMessage(n *alertNotification, analysis *alertAnalysis) map[string]any {
+	var b strings.Builder
+	title := n.Title
+	if title == "" {
+		title = fmt.Sprintf("[%s:%d] %s", strings.ToUpper(n.Status), len(n.Alerts), n.CommonLabels["alertname"])
+	}
+	fmt.Fprintf(&b, "*%s*\n", slackEscaper.Replace(title))
+	for _, a := range n.Alerts[:min(len(n.Alerts), maxWebhookAlerts)] {
+		line := fmt.Sprintf("%s %s", a.Status, formatStringMap(userLabels(a.Labels)))
+		if summary := a.Annotations["summary"]; summary != "" {
+			line += ": " + truncate(summary, maxContextDescription)
+		}
+		if strings.HasPrefix(a.GeneratorURL, "http") {
+			fmt.Fprintf(&b, "• <%s|%s>\n", a.GeneratorURL, slackEscaper.Replace(line))
+		} else {
+			fmt.Fprintf(&b, "• %s\n", slackEscaper.Replace(line))
+		}
+	}
+	if omitted := len(n.Alerts) - maxWebhookAlerts; omitted > 0 {
+		fmt.Fprintf(&b, "• and %d more\n", omitted)
+	}
+
+	if analysis != nil {
+		fmt.Fprintf(&b, "\n*Analysis:* %s\n", slackEscaper.Replace(analysis.Summary))
+		if len(analysis.ProbableCauses) > 0 {
+			b.WriteString("*Probable causes:*\n")
+			for _, c := range analysis.ProbableCauses {
+				fmt.Fprintf(&b, "• %s (%s): %s\n", slackEscaper.Replace(c.Cause), c.Likelihood, slackEscaper.Replace(c.Evidence))
+			}
+		}
+		if len(analysis.NextSteps) > 0 {
+			b.WriteString("*Next steps:*\n")
+			for _, step := range analysis.NextSteps {
+				fmt.Fprintf(&b, "• %s\n", slackEscaper.Replace(step))
+			}
+		}
+	}
+	return map[string]any{"text": b.String()}
+}
+
+// notificationPayload renders the forwarded notification. The JSON format
+// is Grafana's payload, unchanged but for an analysis field.
+func notificationPayload(format string, raw []byte, n *alertNotification, analysis *alertAnalysis) ([]byte, error) {
+	if format == webhookFormatSlack {
+		return json.Marshal(slackMessage(n, analysis))
+	}
+	if analysis == nil {
+		return raw, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(analysis)
+	if err != nil {
+		return nil, err
+	}
+	fields["analysis"] = encoded
+	return json.Marshal(fields)
+}
+
+// forwardNotification posts the payload to the downstream webhook.
+func forwardNotification(ctx context.Context, webhookURL string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookForwardTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleAlertWebhook receives notifications of Grafana's webhook contact
+// point, adds an analysis of the firing alerts and forwards them to the
+// configured webhook. The analysis has a time budget and is skipped when
+// the model is unavailable or the budget runs out, so that notifications
+// are always forwarded. A failed forward is answered with 502, which makes
+// Grafana retry the notification.
+func (ds *Datasource) handleAlertWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r.Context(), "webhook.handle")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		writeRequestError(w, span, &requestError{status: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed, message: "Method not allowed"})
+		return
+	}
+	webhookURL := ds.webhookURL()
+	if webhookURL == "" {
+		log.DefaultLogger.Error("Alert webhook received a notification, but no downstream webhook is configured")
+		writeRequestError(w, span, &requestError{status: http.StatusInternalServerError, code: errCodeNotConfigured, message: "Service configuration error"})
+		return
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	var n alertNotification
+	if err == nil {
+		err = json.Unmarshal(raw, &n)
+	}
+	if err != nil {
+		writeRequestError(w, span, &requestError{status: http.StatusBadRequest, code: errCodeInvalidBody, message: "Invalid request body"})
+		return
+	}
+	span.SetAttributes(attribute.String("webhook.status", n.Status), attribute.Int("webhook.alerts", len(n.Alerts)))
+
+	var analysis *alertAnalysis
+	firing := slices.ContainsFunc(n.Alerts, func(a notificationAlert) bool { return a.Status == "firing" })
+	apiKey := ds.groqAPIKey()
+	switch {
+	case !firing:
+	case apiKey == "":
+		log.DefaultLogger.Warn("Forwarding notification without analysis: GROQ API key not configured")
+	case !checkRateLimit(ctx, requestClientID(r)):
+		log.DefaultLogger.Warn("Forwarding notification without analysis: rate limit exceeded")
+	default:
+		timeout := time.Duration(orDefault(ds.config.Webhook.TimeoutSeconds, defaultWebhookTimeoutSeconds)) * time.Second
+		analyzeCtx, cancel := context.WithTimeout(ctx, timeout)
+		var reqErr *requestError
+		analysis, reqErr = ds.analyzeNotification(analyzeCtx, r, apiKey, &n)
+		cancel()
+		if reqErr != nil {
+			log.DefaultLogger.Warn("Forwarding notification without analysis", "error", reqErr.message, "deadlineExceeded", analyzeCtx.Err() != nil)
+		}
+	}
+	span.SetAttributes(attribute.Bool("webhook.analyzed", analysis != nil))
+
+	format := orDefaultString(ds.config.Webhook.Format, webhookFormatJSON)
+	payload, err := notificationPayload(format, raw, &n, analysis)
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to render notification, forwarding it unchanged", "error", err)
+		payload = raw
+	}
+	if err := forwardNotification(ctx, webhookURL, payload); err != nil {
+		log.DefaultLogger.Error("Failed to forward notification", "error", err)
+		writeRequestError(w, span, &requestError{status: http.StatusBadGateway, code: errCodeUpstreamUnavailable, message: "Failed to forward notification"})
+		return
+	}
+	span.SetAttributes(attribute.Int(attrStatusCode, http.StatusOK))
+	log.DefaultLogger.Info("Forwarded notification", "status", n.Status, "alerts", len(n.Alerts), "analyzed", analysis != nil)
+
+	writeJSON(w, map[string]any{"forwarded": true, "analyzed": analysis != nil, "alerts": len(n.Alerts)})
+}
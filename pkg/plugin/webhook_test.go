@@ -0,0 +1,196 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func newTestNotification(status string) string {
+	notification := map[string]any{
+		"receiver": "ai", "status": status, "title": "[FIRING:2] CPU high", "groupKey": "{}:{alertname=\"CPU high\"}",
+		"commonLabels": map[string]string{"alertname": "CPU high"},
+		"alerts": []map[string]any{
+			{"status": status, "labels": map[string]string{"alertname": "CPU high", "instance": "web-1"}, "annotations": map[string]string{"summary": "CPU > 90% & rising"},
+				"startsAt": time.Now().Add(-10 * time.Minute), "generatorURL": "http://grafana.example.com/alerting/grafana/cpu-high/view?orgId=1",
+				"fingerprint": "abc123", "values": map[string]float64{"A": 0.97, "C": 1}},
+			{"status": status, "labels": map[string]string{"alertname": "CPU high", "instance": "db-1"},
+				"startsAt": time.Now().Add(-5 * time.Minute), "generatorURL": "http://prometheus.example.com/graph", "fingerprint": "def456"},
+		},
+	}
+	payload, _ := json.Marshal(notification)
+	return string(payload)
+}
+
+func TestHandleAlertWebhook(t *testing.T) {
+	const answer = `{"summary":"CPU of web-1 rose.","probableCauses":[{"cause":"Traffic <spike>","likelihood":"high","evidence":"A=0.97"}],"nextSteps":["Check the load balancer"]}`
+
+	testCases := []struct {
+		name             string
+		body             string
+		format           string
+		groqStatus       int
+		groqDelay        time.Duration
+		downstreamStatus int
+		noWebhookURL     bool
+		expectedStatus   int
+		expectedAnalyzed bool
+		expectedGroq     bool
+	}{
+		{name: "json", body: newTestNotification("firing"), expectedStatus: http.StatusOK, expectedAnalyzed: true, expectedGroq: true},
+		{name: "slack", body: newTestNotification("firing"), format: webhookFormatSlack, expectedStatus: http.StatusOK, expectedAnalyzed: true, expectedGroq: true},
+		{name: "resolved", body: newTestNotification("resolved"), expectedStatus: http.StatusOK},
+		{name: "model down", body: newTestNotification("firing"), groqStatus: http.StatusServiceUnavailable, expectedStatus: http.StatusOK, expectedGroq: true},
+		{name: "model too slow", body: newTestNotification("firing"), format: webhookFormatSlack, groqDelay: 5 * time.Second, expectedStatus: http.StatusOK, expectedGroq: true},
+		{name: "downstream fails", body: newTestNotification("firing"), downstreamStatus: http.StatusInternalServerError, expectedStatus: http.StatusBadGateway, expectedAnalyzed: true, expectedGroq: true},
+		{name: "not configured", body: newTestNotification("firing"), noWebhookURL: true, expectedStatus: http.StatusInternalServerError},
+		{name: "invalid body", body: `{"alerts":`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			globalRateLimiter.reset()
+			var queries []dsQueryRequest
+			grafana := newTestAlertGrafana(t, &queries)
+
+			var sent *groqChatRequest
+			groq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sent = &groqChatRequest{}
+				json.NewDecoder(r.Body).Decode(sent)
+				if tc.groqDelay > 0 {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(tc.groqDelay):
+					}
+				}
+				if tc.groqStatus != 0 {
+					w.WriteHeader(tc.groqStatus)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"message": chatMessage{Role: "assistant", Content: answer}}}})
+			}))
+			defer groq.Close()
+
+			var forwarded []byte
+			downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded, _ = io.ReadAll(r.Body)
+				if tc.downstreamStatus != 0 {
+					w.WriteHeader(tc.downstreamStatus)
+				}
+			}))
+			defer downstream.Close()
+
+			ds := &Datasource{
+				settings: backend.DataSourceInstanceSettings{DecryptedSecureJSONData: map[string]string{"groqApiKey": "test-api-key", "webhookUrl": downstream.URL}},
+				config:   pluginConfig{GrafanaURL: grafana.URL, Webhook: webhookConfig{Format: tc.format, TimeoutSeconds: 1}},
+				groqURL:  groq.URL,
+			}
+			if tc.noWebhookURL {
+				delete(ds.settings.DecryptedSecureJSONData, "webhookUrl")
+			}
+			req := httptest.NewRequest("POST", "/alert-webhook", bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			ds.handleAlertWebhook(rr, req)
+
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("Expected the notification to be forwarded within the time budget, took %s", elapsed)
+			}
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if (sent != nil) != tc.expectedGroq {
+				t.Errorf("Expected a call of the model: %v", tc.expectedGroq)
+			}
+			if sent != nil {
+				system := sent.Messages[0].Content
+				for _, expected := range []string{`Alert rule "CPU high"`, "A=0.97", "rate(cpu_seconds_total[5m])", "Series", `instance="db-1"`} {
+					if !strings.Contains(system, expected) {
+						t.Errorf("Expected %q in the prompt, got %q", expected, system)
+					}
+				}
+			}
+			if tc.expectedStatus != http.StatusOK && tc.downstreamStatus == 0 {
+				if forwarded != nil {
+					t.Errorf("Expected no forwarded notification, got %s", forwarded)
+				}
+				return
+			}
+
+			if tc.format == webhookFormatSlack {
+				var message struct {
+					Text string `json:"text"`
+				}
+				if err := json.Unmarshal(forwarded, &message); err != nil {
+					t.Fatalf("Failed to decode Slack message: %v", err)
+				}
+				if !strings.Contains(message.Text, "*[FIRING:2] CPU high*") || !strings.Contains(message.Text, "CPU &gt; 90% &amp; rising") ||
+					!strings.Contains(message.Text, "<http://grafana.example.com/alerting/grafana/cpu-high/view?orgId=1|") {
+					t.Errorf("Unexpected Slack message %q", message.Text)
+				}
+				if strings.Contains(message.Text, "Traffic &lt;spike&gt; (high)") != tc.expectedAnalyzed {
+					t.Errorf("Expected analysis in the Slack message: %v, got %q", tc.expectedAnalyzed, message.Text)
+				}
+			} else {
+				var payload struct {
+					GroupKey string         `json:"groupKey"`
+					Alerts   []any          `json:"alerts"`
+					Analysis *alertAnalysis `json:"analysis"`
+				}
+				if err := json.Unmarshal(forwarded, &payload); err != nil {
+					t.Fatalf("Failed to decode forwarded notification: %v", err)
+				}
+				if payload.GroupKey == "" || len(payload.Alerts) != 2 {
+					t.Errorf("Expected Grafana's payload to be forwarded, got %s", forwarded)
+				}
+				if (payload.Analysis != nil) != tc.expectedAnalyzed {
+					t.Errorf("Expected analysis: %v, got %s", tc.expectedAnalyzed, forwarded)
+				}
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Forwarded bool `json:"forwarded"`
+				Analyzed  bool `json:"analyzed"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if !resp.Forwarded || resp.Analyzed != tc.expectedAnalyzed {
+				t.Errorf("Unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestWebhookTimeoutConfig(t *testing.T) {
+	testCases := []struct {
+		timeout string
+		valid   bool
+	}{
+		{timeout: "", valid: true},
+		{timeout: "15", valid: true},
+		{timeout: "19", valid: true},
+		{timeout: "20", valid: false},
+		{timeout: "60", valid: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.timeout, func(t *testing.T) {
+			t.Setenv(envWebhookTimeout, tc.timeout)
+			_, err := loadPluginConfig(backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+			if (err == nil) != tc.valid {
+				t.Errorf("Expected valid: %v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
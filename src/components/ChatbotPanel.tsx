@@ -1,6 +1,6 @@
 import React, { useState, useEffect, useRef } from 'react';
-import { getBackendSrv } from '@grafana/runtime';
-import { PanelData, PanelProps } from '@grafana/data';
+import { getBackendSrv, getTemplateSrv } from '@grafana/runtime';
+import { PanelProps } from '@grafana/data';
 import { useTheme2 } from '@grafana/ui';
 import { firstValueFrom } from 'rxjs';
 import { css } from '@emotion/css';
@@ -9,14 +9,6 @@ import DOMPurify from 'dompurify';
 // Constants for validation limits
 const VALIDATION_LIMITS = {
   MESSAGE_LENGTH: 10000,
-  STRING_LENGTH: 1000,
-  DESCRIPTION_LENGTH: 500,
-  TITLE_LENGTH: 100,
-  TYPE_LENGTH: 50,
-  ARRAY_SIZE: 100,
-  SERIES_LIMIT: 10,
-  FIELDS_LIMIT: 20,
-  VALUES_LIMIT: 100,
 } as const;
 
 // Proper TypeScript interfaces
@@ -24,16 +16,10 @@ interface ChatbotPanelProps extends PanelProps {
   options: {
     initialChatMessage?: string;
     llmUsed?: string;
+    enableTools?: boolean;
   };
 }
 
-interface PanelMetadata {
-  id: number;
-  title: string;
-  description: string;
-  type: string;
-}
-
 interface Message {
   content: string;
   role: 'user' | 'assistant' | 'system';
@@ -50,29 +36,6 @@ interface GroqApiResponse {
   }>;
 }
 
-interface EnrichedPanelData {
-  id: number;
-  title: string;
-  description: string;
-  type: string;
-  data: Array<{
-    name: string;
-    type: string;
-    values: unknown[];
-  }>;
-}
-
-interface DashboardData {
-  dashboard?: {
-    panels?: Array<{
-      id: number;
-      title?: string;
-      description?: string;
-      type?: string;
-    }>;
-  };
-}
-
 // Error boundary component with theme support
 const ErrorBoundaryContent: React.FC<{ onRetry: () => void }> = ({ onRetry }) => {
   const theme = useTheme2();
@@ -249,96 +212,6 @@ const getStyles = (theme: any) => ({
   `,
 });
 
-// Data sanitization function
-function sanitizeDashboardData(data: unknown): unknown {
-  if (typeof data === 'string') {
-    // More comprehensive HTML/script sanitization
-    return data
-      .replace(/<script[\s\S]*?<\/script>/gi, '') // Remove script tags with any content
-      .replace(/<[^>]*script[^>]*>/gi, '') // Remove malformed script tags
-      .replace(/javascript:/gi, '') // Remove javascript: URLs
-      .replace(/on\w+\s*=/gi, '') // Remove event handlers (onclick, etc.)
-      .replace(/<\s*\/?[^>]*>/g, '') // Remove all HTML tags
-      .slice(0, VALIDATION_LIMITS.STRING_LENGTH);
-  }
-
-  if (Array.isArray(data)) {
-    return data.slice(0, VALIDATION_LIMITS.ARRAY_SIZE).map((item) => sanitizeDashboardData(item));
-  }
-
-  if (data && typeof data === 'object') {
-    const sanitized: Record<string, unknown> = {};
-    const safeProps = ['title', 'description', 'type', 'id', 'name', 'values'] as const;
-
-    for (const key of safeProps) {
-      if (key in data) {
-        sanitized[key] = sanitizeDashboardData((data as Record<string, unknown>)[key]);
-      }
-    }
-    return sanitized;
-  }
-
-  return data;
-}
-
-// Extract panel metadata from dashboard
-function extractPanelMetadata(dashboardData: DashboardData, currentPanelId: number): PanelMetadata[] {
-  if (!dashboardData?.dashboard?.panels) {
-    return [];
-  }
-
-  return dashboardData.dashboard.panels
-    .filter((panel) => panel && panel.id !== currentPanelId)
-    .map((panel) => ({
-      id: panel.id,
-      description: (panel.description ?? '').slice(0, VALIDATION_LIMITS.DESCRIPTION_LENGTH),
-      title: (panel.title ?? '').slice(0, VALIDATION_LIMITS.TITLE_LENGTH),
-      type: (panel.type ?? '').slice(0, VALIDATION_LIMITS.TYPE_LENGTH),
-    }));
-}
-
-// Enrich panel data with metadata
-function enrichPanelData(panelData: PanelData, panelMetadata: PanelMetadata[]): EnrichedPanelData[] {
-  return panelData.series
-    .slice(0, VALIDATION_LIMITS.SERIES_LIMIT)
-    .map((panel) => {
-      if (!panel.meta || !Array.isArray(panel.fields)) {
-        return null;
-      }
-
-      const metadata = panelMetadata.find((item) => item.id === panel.meta?.custom?.panelId) ||
-        panelMetadata[0] || { id: 0, title: 'Unknown', description: '', type: 'unknown' };
-
-      return {
-        ...metadata,
-        data: panel.fields.slice(0, VALIDATION_LIMITS.FIELDS_LIMIT).map((field) => ({
-          name: (field.name ?? '').slice(0, VALIDATION_LIMITS.TITLE_LENGTH),
-          type: (field.type ?? '').slice(0, VALIDATION_LIMITS.TYPE_LENGTH),
-          values: Array.isArray(field.values) ? field.values.slice(0, VALIDATION_LIMITS.VALUES_LIMIT) : [],
-        })),
-      };
-    })
-    .filter((item): item is EnrichedPanelData => item !== null);
-}
-
-// Main data extraction function
-async function extractAndEnrichData(
-  dashboardId: string,
-  currentPanelId: number,
-  data: PanelData
-): Promise<EnrichedPanelData[]> {
-  try {
-    const dashboardData = (await getBackendSrv().get(`/api/dashboards/uid/${dashboardId}`)) as DashboardData;
-    const sanitizedDashboard = sanitizeDashboardData(dashboardData) as DashboardData;
-
-    const panelMetadata = extractPanelMetadata(sanitizedDashboard, currentPanelId);
-    return enrichPanelData(data, panelMetadata);
-  } catch (error) {
-    console.error('Failed to extract dashboard data:', error);
-    throw new Error('Failed to extract dashboard data');
-  }
-}
-
 // Sanitize message content to prevent XSS attacks
 function sanitizeMessageContent(content: string): string {
   // Configure DOMPurify to only allow safe HTML elements and attributes
@@ -360,8 +233,21 @@ function validateMessages(messages: Message[]): Message[] {
   }));
 }
 
+// Current values of the dashboard's template variables, as selected in the
+// browser. The backend would otherwise use the values saved with the dashboard.
+function dashboardVariables(): Record<string, string[]> {
+  const variables: Record<string, string[]> = {};
+  for (const variable of getTemplateSrv().getVariables()) {
+    const value = 'current' in variable ? variable.current?.value : undefined;
+    if (value !== undefined && value !== null) {
+      variables[variable.name] = Array.isArray(value) ? value.map(String) : [String(value)];
+    }
+  }
+  return variables;
+}
+
 // Main ChatbotPanel component
-const ChatbotPanelInner: React.FC<ChatbotPanelProps> = ({ data, options, id }) => {
+const ChatbotPanelInner: React.FC<ChatbotPanelProps> = ({ data, options, id, timeRange }) => {
   const theme = useTheme2();
   const styles = getStyles(theme);
   const [inputValue, setInputValue] = useState('');
@@ -408,6 +294,16 @@ const ChatbotPanelInner: React.FC<ChatbotPanelProps> = ({ data, options, id }) =
           data: {
             model: options.llmUsed || 'llama-3.3-70b-versatile',
             messages: sanitizedMessages,
+            dashboardUid: data.request?.dashboardUID,
+            // The backend builds the dashboard context for this time range
+            context: {
+              from: timeRange.from.valueOf(),
+              to: timeRange.to.valueOf(),
+              panelId: id,
+              variables: dashboardVariables(),
+            },
+            // The backend runs the Grafana tools the model calls
+            tools: options.enableTools ?? false,
           },
         })
       );
@@ -463,35 +359,16 @@ const ChatbotPanelInner: React.FC<ChatbotPanelProps> = ({ data, options, id }) =
         content: trimmedInput,
       };
 
-      if (chat.length === 0) {
-        const dashboardUID = data.request?.dashboardUID ?? '';
-
-        // Validate dashboard UID format (basic alphanumeric check)
-        if (!dashboardUID || !/^[a-zA-Z0-9_-]+$/.test(dashboardUID)) {
-          throw new Error('Invalid dashboard identifier');
-        }
-
-        const dashboardData = await extractAndEnrichData(dashboardUID, id, data);
+      const dashboardUID = data.request?.dashboardUID ?? '';
 
-        const initialMessages: Message[] = [
-          {
-            role: 'system' as const,
-            content: `${options.initialChatMessage || ''} This is the data on the dashboard: ${JSON.stringify(
-              dashboardData,
-              null,
-              2
-            )}.`,
-          },
-          userMessage,
-        ];
-
-        setChat(initialMessages);
-        await fetchGroqData(initialMessages);
-      } else {
-        const newMessages = [...chat, userMessage];
-        setChat(newMessages);
-        await fetchGroqData(newMessages);
+      // Validate dashboard UID format (basic alphanumeric check)
+      if (!dashboardUID || !/^[a-zA-Z0-9_-]+$/.test(dashboardUID)) {
+        throw new Error('Invalid dashboard identifier');
       }
+
+      const newMessages = [...chat, userMessage];
+      setChat(newMessages);
+      await fetchGroqData(newMessages);
     } catch (error) {
       console.error('Error submitting question:', error);
       setChat((prevChat) => [
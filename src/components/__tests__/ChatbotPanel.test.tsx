@@ -2,12 +2,13 @@ import React from 'react';
 import { render, screen, fireEvent, waitFor } from '@testing-library/react';
 import '@testing-library/jest-dom';
 import { ChatbotPanel } from '../ChatbotPanel';
-import { getBackendSrv } from '@grafana/runtime';
+import { getBackendSrv, getTemplateSrv } from '@grafana/runtime';
 import { useTheme2 } from '@grafana/ui';
 
 // Mock Grafana dependencies
 jest.mock('@grafana/runtime', () => ({
   getBackendSrv: jest.fn(),
+  getTemplateSrv: jest.fn(),
 }));
 
 jest.mock('@grafana/ui', () => ({
@@ -20,6 +21,7 @@ jest.mock('rxjs', () => ({
 }));
 
 const mockGetBackendSrv = getBackendSrv as jest.MockedFunction<typeof getBackendSrv>;
+const mockGetTemplateSrv = getTemplateSrv as jest.MockedFunction<typeof getTemplateSrv>;
 const mockUseTheme2 = useTheme2 as jest.MockedFunction<typeof useTheme2>;
 
 const mockTheme = {
@@ -92,6 +94,12 @@ describe('ChatbotPanel Integration Tests', () => {
   beforeEach(() => {
     jest.clearAllMocks();
     mockUseTheme2.mockReturnValue(mockTheme as any);
+    mockGetTemplateSrv.mockReturnValue({
+      getVariables: () => [
+        { name: 'env', current: { value: 'staging' } },
+        { name: 'pod', current: { value: ['a', 'b'] } },
+      ],
+    } as any);
   });
 
   describe('Component Rendering', () => {
@@ -212,15 +220,9 @@ describe('ChatbotPanel Integration Tests', () => {
       });
     });
 
-    it('should call dashboard API to enrich data', async () => {
+    it('should ask the backend to build the dashboard context', async () => {
       const mockBackendSrv = {
-        get: jest.fn().mockResolvedValue({ 
-          dashboard: { 
-            panels: [
-              { id: 2, title: 'Other Panel', type: 'graph' }
-            ] 
-          } 
-        }),
+        get: jest.fn(),
         fetch: jest.fn().mockResolvedValue({
           data: {
             choices: [{ message: { role: 'assistant', content: 'AI response' } }],
@@ -238,8 +240,17 @@ describe('ChatbotPanel Integration Tests', () => {
       fireEvent.click(sendButton);
       
       await waitFor(() => {
-        expect(mockBackendSrv.get).toHaveBeenCalledWith('/api/dashboards/uid/test-dashboard-uid');
+        expect(mockBackendSrv.fetch).toHaveBeenCalledWith(
+          expect.objectContaining({
+            data: expect.objectContaining({
+              dashboardUid: 'test-dashboard-uid',
+              context: expect.objectContaining({ panelId: 1, variables: { env: ['staging'], pod: ['a', 'b'] } }),
+              messages: [expect.objectContaining({ role: 'user', content: 'Analyze the data' })],
+            }),
+          })
+        );
       });
+      expect(mockBackendSrv.get).not.toHaveBeenCalled();
     });
 
     it('should send correct API payload to backend', async () => {
@@ -15,5 +15,12 @@ export const plugin = new PanelPlugin(ChatbotPanel).setPanelOptions((builder) =>
       name: 'LLM model name',
       description: 'Define the LLM model that should be used when making the API call to groq.',
       defaultValue: 'llama-3.3-70b-versatile',
+    })
+    .addBooleanSwitch({
+      path: 'enableTools',
+      name: 'Let the model query Grafana',
+      description:
+        'Allow the model to search dashboards, fetch panel data, list firing alerts and search annotations with your permissions before it answers.',
+      defaultValue: false,
     });
 });